@@ -0,0 +1,91 @@
+package dkeyczar
+
+/*
+Signatures over a canonical form of a value, so that producers who encode the
+same JSON with different whitespace or key order still agree on what was signed.
+
+The signature is an ordinary one from Sign over the canonical bytes; nothing
+about the canonicalization is recorded in it, so both sides must use the same
+Canonicalizer.
+
+SignMulti does the same for a list of byte strings, packing them with their
+lengths so that the boundaries between parts are signed too.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// A Canonicalizer turns a value into the bytes that are signed for it
+type Canonicalizer func(obj interface{}) ([]byte, error)
+
+// CanonicalJSON is the default Canonicalizer.  It encodes obj as JSON with object keys sorted,
+// no insignificant whitespace and no HTML escaping.  Numbers are kept as written, so 1 and 1.0 differ.
+func CanonicalJSON(obj interface{}) ([]byte, error) {
+
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	// struct fields come out in declaration order, so round-trip through maps to sort them
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// SignCanonical signs the canonical form of obj.  A nil canon uses CanonicalJSON.
+func SignCanonical(s Signer, obj interface{}, canon Canonicalizer) (string, error) {
+
+	if canon == nil {
+		canon = CanonicalJSON
+	}
+
+	msg, err := canon(obj)
+	if err != nil {
+		return "", err
+	}
+
+	return s.Sign(msg)
+}
+
+// VerifyCanonical checks a signature from SignCanonical against the canonical form of obj.
+// obj may be a json.RawMessage holding the JSON as received.  A nil canon uses CanonicalJSON.
+func VerifyCanonical(v Verifier, obj interface{}, signature string, canon Canonicalizer) (bool, error) {
+
+	if canon == nil {
+		canon = CanonicalJSON
+	}
+
+	msg, err := canon(obj)
+	if err != nil {
+		return false, err
+	}
+
+	return v.Verify(msg, signature)
+}
+
+// SignMulti signs several parts as one message.  The parts are length-prefixed and packed together first,
+// so ["ab", "c"] and ["a", "bc"] get different signatures.
+func SignMulti(s Signer, parts ...[]byte) (string, error) {
+	return s.Sign(lenPrefixPack(parts...))
+}
+
+// VerifyMulti checks a signature from SignMulti against the same parts, in the same order
+func VerifyMulti(v Verifier, signature string, parts ...[]byte) (bool, error) {
+	return v.Verify(lenPrefixPack(parts...), signature)
+}
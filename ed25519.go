@@ -0,0 +1,218 @@
+package dkeyczar
+
+/*
+Ed25519 signing keys.
+
+Ed25519 keys aren't part of the Keyczar spec, so other implementations won't
+load them.  The key JSON holds the 32-byte public key, and for private keys
+the 32-byte seed the private key is derived from:
+
+	{"publicKeyString": <web64>, "size": 256}
+	{"publicKey": {"publicKeyString": <web64>, "size": 256}, "seed": <web64>, "size": 256}
+
+Signatures are the plain 64-byte Ed25519 signature over the same bytes the
+other key types sign, with no ASN.1 wrapping.
+*/
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"hash"
+)
+
+type ed25519PublicKeyJSON struct {
+	PublicKeyString string `json:"publicKeyString"`
+	Size            uint   `json:"size"`
+}
+
+type ed25519PublicKey struct {
+	key ed25519.PublicKey
+	id  []byte
+}
+
+type ed25519KeyJSON struct {
+	PublicKey ed25519PublicKeyJSON `json:"publicKey"`
+	Seed      string               `json:"seed"`
+	Size      uint                 `json:"size"`
+}
+
+type ed25519Key struct {
+	key       ed25519.PrivateKey
+	publicKey ed25519PublicKey
+}
+
+func generateEd25519Key(size uint) (*ed25519Key, error) {
+
+	if size == 0 {
+		size = T_ED25519_PRIV.defaultSize()
+	}
+
+	if !T_ED25519_PRIV.isAcceptableSize(size) {
+		return nil, ErrInvalidKeySize
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ed25519Key{key: priv, publicKey: ed25519PublicKey{key: pub}}, nil
+}
+
+func newEd25519PublicKeyFromJSON(s []byte) (*ed25519PublicKey, error) {
+	edjson := new(ed25519PublicKeyJSON)
+	err := json.Unmarshal(s, &edjson)
+	if err != nil {
+		return nil, err
+	}
+
+	if !T_ED25519_PUB.isAcceptableSize(edjson.Size) {
+		return nil, newFieldError(ErrInvalidKeySize, "size")
+	}
+
+	b, err := decodeWeb64String(edjson.PublicKeyString)
+	if err != nil {
+		return nil, newFieldError(ErrBase64Decoding, "publicKeyString")
+	}
+
+	if len(b) != ed25519.PublicKeySize {
+		return nil, newFieldError(ErrKeySizeMismatch, "publicKeyString")
+	}
+
+	return &ed25519PublicKey{key: ed25519.PublicKey(b)}, nil
+}
+
+func newEd25519KeyFromJSON(s []byte) (*ed25519Key, error) {
+	edjson := new(ed25519KeyJSON)
+	err := json.Unmarshal(s, &edjson)
+	if err != nil {
+		return nil, err
+	}
+
+	if !T_ED25519_PRIV.isAcceptableSize(edjson.Size) {
+		return nil, newFieldError(ErrInvalidKeySize, "size")
+	}
+
+	if !T_ED25519_PUB.isAcceptableSize(edjson.PublicKey.Size) {
+		return nil, newFieldError(ErrInvalidKeySize, "publicKey.size")
+	}
+
+	seed, err := decodeWeb64String(edjson.Seed)
+	if err != nil {
+		return nil, newFieldError(ErrBase64Decoding, "seed")
+	}
+
+	if len(seed) != ed25519.SeedSize {
+		return nil, newFieldError(ErrKeySizeMismatch, "seed")
+	}
+
+	b, err := decodeWeb64String(edjson.PublicKey.PublicKeyString)
+	if err != nil {
+		return nil, newFieldError(ErrBase64Decoding, "publicKey.publicKeyString")
+	}
+
+	edkey := new(ed25519Key)
+	edkey.key = ed25519.NewKeyFromSeed(seed)
+	edkey.publicKey.key = edkey.key.Public().(ed25519.PublicKey)
+
+	// the public key is derived from the seed, so a different one means the JSON has been tampered with
+	if !bytes.Equal(b, edkey.publicKey.key) {
+		return nil, newFieldError(ErrKeyCheckFailed, "publicKey.publicKeyString")
+	}
+
+	return edkey, nil
+}
+
+func newEd25519PublicJSONFromKey(key ed25519.PublicKey) *ed25519PublicKeyJSON {
+	return &ed25519PublicKeyJSON{
+		PublicKeyString: encodeWeb64String(key),
+		Size:            uint(len(key)) * 8,
+	}
+}
+
+func (ek *ed25519PublicKey) ToKeyJSON() []byte {
+	j := newEd25519PublicJSONFromKey(ek.key)
+	s, _ := json.Marshal(j)
+	return s
+}
+
+func (ek *ed25519Key) ToKeyJSON() []byte {
+	j := &ed25519KeyJSON{
+		PublicKey: *newEd25519PublicJSONFromKey(ek.publicKey.key),
+		Seed:      encodeWeb64String(ek.key.Seed()),
+		Size:      ed25519.SeedSize * 8,
+	}
+	s, _ := json.Marshal(j)
+	return s
+}
+
+// the id is the length-prefixed public key, hashed the same way as the DSA and RSA key components
+func (ek *ed25519PublicKey) KeyID() []byte {
+
+	if len(ek.id) != 0 {
+		return ek.id
+	}
+
+	h := sha1.New()
+	binary.Write(h, binary.BigEndian, uint32(len(ek.key)))
+	h.Write(ek.key)
+
+	ek.id = h.Sum(nil)[:4]
+
+	return ek.id
+}
+
+func (ek *ed25519Key) KeyID() []byte {
+	return ek.publicKey.KeyID()
+}
+
+func (ek *ed25519Key) Sign(msg []byte) ([]byte, error) {
+	return ed25519.Sign(ek.key, msg), nil
+}
+
+// the digest is the whole message; see newHash
+func (ek *ed25519Key) signDigest(digest []byte) ([]byte, error) {
+	return ek.Sign(digest)
+}
+
+func (ek *ed25519Key) Verify(msg []byte, signature []byte) (bool, error) {
+	return ek.publicKey.Verify(msg, signature)
+}
+
+func (ek *ed25519Key) newHash() hash.Hash {
+	return ek.publicKey.newHash()
+}
+
+func (ek *ed25519Key) verifyDigest(digest []byte, signature []byte) (bool, error) {
+	return ek.publicKey.verifyDigest(digest, signature)
+}
+
+func (ek *ed25519PublicKey) Verify(msg []byte, signature []byte) (bool, error) {
+	if len(signature) != ed25519.SignatureSize {
+		return false, ErrShortSignature
+	}
+	return ed25519.Verify(ek.key, msg, signature), nil
+}
+
+// Ed25519 hashes the message twice, so it can't be fed in a piece at a time: the "hash" just collects the message
+func (ek *ed25519PublicKey) newHash() hash.Hash {
+	return new(messageBuffer)
+}
+
+// for Ed25519 the digest is the whole message
+func (ek *ed25519PublicKey) verifyDigest(digest []byte, signature []byte) (bool, error) {
+	return ek.Verify(digest, signature)
+}
+
+// a hash.Hash whose sum is everything written to it
+type messageBuffer struct {
+	bytes.Buffer
+}
+
+func (m *messageBuffer) Sum(b []byte) []byte { return append(b, m.Bytes()...) }
+func (m *messageBuffer) Size() int           { return m.Len() }
+func (m *messageBuffer) BlockSize() int      { return 1 }
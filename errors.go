@@ -1,6 +1,10 @@
 package dkeyczar
 
-import "errors"
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
 
 var (
 	ErrBadVersion          = errors.New("keyczar: bad version number in header")
@@ -14,4 +18,121 @@ var (
 	ErrUnacceptablePurpose = errors.New("keyczar: unacceptable key purpose")
 	ErrInvalidKeySize      = errors.New("keyczar: bad key size")
 	ErrNoSuchKeyVersion    = errors.New("keyczar: no such key version")
+
+	ErrUnauthenticatedCiphertext = errors.New("keyczar: ciphertext format does not provide integrity")
+	ErrKeysetEncrypted           = errors.New("keyczar: keyset is encrypted; use NewEncryptedReader")
+	ErrBadPadding                = errors.New("keyczar: bad padding in plaintext")
+	ErrCiphertextTooLarge        = errors.New("keyczar: ciphertext exceeds maximum size")
+	ErrKeySizeMismatch           = errors.New("keyczar: key material doesn't match declared size")
+	ErrKeyCheckFailed            = errors.New("keyczar: key failed round-trip check")
+	ErrRandomSource              = errors.New("keyczar: failed to read from random source")
+	ErrKeyTypeMismatch           = errors.New("keyczar: key material doesn't match the keyset's key type")
+	ErrNoPrivateKey              = errors.New("keyczar: keyset has no private key")
+	ErrUnknownIssuer             = errors.New("keyczar: no issuer has a key matching the signature")
+	ErrBadPacking                = errors.New("keyczar: malformed length-prefixed data")
+	ErrInvalidNonce              = errors.New("keyczar: nonce length out of range")
+	ErrShortHeader               = errors.New("keyczar: input too short to hold a header")
+	ErrDecompression             = errors.New("keyczar: failed to decompress key data")
+	ErrEmptyPlaintext            = errors.New("keyczar: empty plaintext")
+	ErrMalformedSignature        = errors.New("keyczar: malformed signature")
+	ErrInvalidDSAParameters      = errors.New("keyczar: invalid DSA group parameters")
+	ErrUnexpectedKey             = errors.New("keyczar: key is not in the pinned set")
+	ErrUnsupportedCipherMode     = errors.New("keyczar: unsupported cipher mode")
+	ErrIssuerTooLong             = errors.New("keyczar: issuer longer than 255 bytes")
+	ErrMalformedKeyset           = errors.New("keyczar: malformed keyset")
+	ErrKeyTooWeak                = errors.New("keyczar: key smaller than policy allows")
+	ErrBadLayout                 = errors.New("keyczar: key file template must contain a single %d")
+	ErrUnsupportedHash           = errors.New("keyczar: unsupported hash function")
+	ErrIVReused                  = errors.New("keyczar: key would reuse an iv")
+	ErrFooterTooLong             = errors.New("keyczar: footer longer than 4096 bytes")
+	ErrBadFooter                 = errors.New("keyczar: malformed footer")
+	ErrDeprecatedAlgorithm       = errors.New("keyczar: algorithm is deprecated for new keys")
+	ErrBadMagic                  = errors.New("keyczar: input doesn't start with the expected magic")
+	ErrIncompleteRead            = errors.New("keyczar: signature requested before the end of the input")
+	ErrMalformedCiphertext       = errors.New("keyczar: ciphertext is not a whole number of blocks")
+	ErrTooManyCandidates         = errors.New("keyczar: too many keys match the signature")
+	ErrSignerOnlyOption          = errors.New("keyczar: option only applies to signers")
+	ErrSignatureExpired          = errors.New("keyczar: signature has expired")
+	ErrUnexpectedSigner          = errors.New("keyczar: signature is not from the expected key")
 )
+
+// A KeyczarError wraps one of the errors above with details about where it happened.
+// Use errors.Is to compare it against the wrapped error.
+//
+// Errors from a Crypter, Signer or Verifier are only wrapped when there are details to add, and then carry
+// the keyset's metadata "name" if it has one.  With CrypterNamedErrors or SignerNamedErrors every error
+// from a named keyset is wrapped, and must be compared with errors.Is rather than ==.
+type KeyczarError struct {
+	Err     error  // the underlying error
+	Keyset  string // the name of the keyset, if known
+	Version int    // the key version being processed, if non-zero
+	Field   string // the key field that failed to parse, if any
+	Msg     string // any additional detail
+}
+
+func (e *KeyczarError) Error() string {
+
+	var context []string
+
+	if e.Keyset != "" {
+		context = append(context, "keyset "+strconv.Quote(e.Keyset))
+	}
+
+	if e.Version != 0 {
+		context = append(context, "version "+strconv.Itoa(e.Version))
+	}
+
+	if e.Field != "" {
+		context = append(context, "field "+e.Field)
+	}
+
+	if e.Msg != "" {
+		context = append(context, e.Msg)
+	}
+
+	if len(context) == 0 {
+		return e.Err.Error()
+	}
+
+	return e.Err.Error() + " (" + strings.Join(context, ", ") + ")"
+}
+
+// Unwrap returns the underlying error
+func (e *KeyczarError) Unwrap() error {
+	return e.Err
+}
+
+// wrap 'err' with the name of the key field that caused it
+func newFieldError(err error, field string) error {
+	return &KeyczarError{Err: err, Field: field}
+}
+
+// add the key version to 'err', wrapping it if it isn't already a KeyczarError
+func withVersion(err error, version int) error {
+
+	var kerr *KeyczarError
+	if errors.As(err, &kerr) {
+		e := *kerr
+		e.Version = version
+		return &e
+	}
+
+	return &KeyczarError{Err: err, Version: version}
+}
+
+// add the keyset name to 'err', wrapping it if it isn't already a KeyczarError
+func withKeyset(err error, name string) error {
+
+	if err == nil || name == "" {
+		return err
+	}
+
+	var kerr *KeyczarError
+	if errors.As(err, &kerr) {
+		e := *kerr
+		e.Keyset = name
+		return &e
+	}
+
+	return &KeyczarError{Err: err, Keyset: name}
+}
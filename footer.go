@@ -0,0 +1,198 @@
+package dkeyczar
+
+/*
+Ciphertexts with an authenticated footer.
+
+Some formats carry a small piece of cleartext, such as a timestamp, after the
+ciphertext, covered by the same HMAC.  These look like ordinary AES ciphertexts
+with version kzFooterVersion in the header rather than kzVersion, and the
+footer and its length between the ciphertext and the signature:
+
+|header|iv|ciphertext|footer|footerLength|signature|
+
+with lengths
+
+|kzHeaderLength|blockSize|<unknown>|footerLength|4|macLength|
+
+footerLength is a big-endian uint32 of at most maxFooterLength.  The signature
+covers everything before it, so the footer can be read but not changed.  Only
+keys in CBC or CTR mode have an HMAC to cover the footer.
+
+The version byte keeps the two formats apart: Decrypt refuses these
+ciphertexts with ErrBadVersion, and DecryptWithFooter refuses ordinary ones, so
+neither can be misread as the other.  Changing the version byte breaks the
+signature.  Other Keyczar implementations can't read these ciphertexts.
+*/
+
+import (
+	"encoding/binary"
+)
+
+// the longest footer EncryptWithFooter accepts
+const maxFooterLength = 4096
+
+// the header version byte of ciphertexts with a footer
+const kzFooterVersion = uint8(0x81)
+
+// A FooterCrypter is a Crypter that can add an authenticated footer to its ciphertexts.
+// The Crypters from NewCrypter implement it.
+type FooterCrypter interface {
+	Crypter
+	// EncryptWithFooter encrypts the plaintext and appends footer in the clear, covered by the HMAC
+	EncryptWithFooter(plaintext []uint8, footer []byte) (string, error)
+	// DecryptWithFooter decrypts a ciphertext made by EncryptWithFooter and returns the plaintext and footer
+	DecryptWithFooter(ciphertext string) ([]uint8, []byte, error)
+}
+
+// EncryptWithFooter encrypts 'plaintext' with the primary key and appends 'footer' in the clear after the
+// ciphertext, covered by its HMAC.  It returns ErrFooterTooLong for footers over 4096 bytes, and
+// ErrUnsupportedCipherMode unless the primary key is an AES key in CBC or CTR mode.
+func (kc *keyCrypter) EncryptWithFooter(plaintext []uint8, footer []byte) (string, error) {
+
+	if len(footer) > maxFooterLength {
+		return "", ErrFooterTooLong
+	}
+
+	if err := kc.checkPlaintext(plaintext); err != nil {
+		return "", err
+	}
+
+	kz := kc.keys()
+
+	s, err := footerSession(kz.getPrimaryKey())
+	if err != nil {
+		return "", kz.named(err)
+	}
+
+	trailer := make([]byte, len(footer)+4)
+	copy(trailer, footer)
+	binary.BigEndian.PutUint32(trailer[len(footer):], uint32(len(footer)))
+
+	h := makeHeader(s.key)
+	h[0] = kzFooterVersion
+
+	ciphertext, err := s.encryptHMAC(h, kc.compress(plaintext), trailer)
+	if err != nil {
+		return "", err
+	}
+
+	return kc.encode(ciphertext), nil
+}
+
+// DecryptWithFooter decrypts a ciphertext made by EncryptWithFooter and returns the plaintext and footer
+func (kc *keyCrypter) DecryptWithFooter(ciphertext string) ([]uint8, []byte, error) {
+	plaintext, footer, _, err := kc.decryptWithFooter(kc.keys(), ciphertext)
+	return plaintext, footer, err
+}
+
+// decrypt a ciphertext with a footer using the keys in 'kz', and return the key that decrypted it too
+func (kc *keyCrypter) decryptWithFooter(kz *keyczar, ciphertext string) ([]uint8, []byte, keydata, error) {
+
+	if err := kc.checkSize(kc.encodingController, ciphertext); err != nil {
+		return nil, nil, nil, kz.named(err)
+	}
+
+	b, err := decodeCryptotext(kc.encodingController, ciphertext)
+	if err != nil {
+		return nil, nil, nil, kz.named(err)
+	}
+
+	return kc.decryptFooterBytes(kz, b)
+}
+
+// decrypt the decoded ciphertext 'b' like decryptWithFooter
+func (kc *keyCrypter) decryptFooterBytes(kz *keyczar, b []byte) ([]uint8, []byte, keydata, error) {
+
+	kl, err := footerKeys(kz, b)
+	if err != nil {
+		return nil, nil, nil, kz.named(err)
+	}
+
+	for _, k := range kl {
+		s, err := footerSession(k)
+		if err != nil {
+			return nil, nil, nil, kz.named(err)
+		}
+
+		compressedPlaintext, footer, err := s.decryptFooter(b)
+		if err == nil {
+			plaintext, err := kc.decompress(compressedPlaintext)
+			return plaintext, footer, k, err
+		}
+		if err != ErrInvalidSignature {
+			return nil, nil, nil, kz.named(err)
+		}
+	}
+
+	return nil, nil, nil, kz.named(ErrInvalidSignature)
+}
+
+// check the header of 'b' has the footer version and return the keys that might have produced it
+func footerKeys(lookup lookupKeyIDer, b []byte) ([]keydata, error) {
+
+	version, keyID, _, err := ParseHeader(b)
+	if err != nil {
+		return nil, ErrShortCiphertext
+	}
+
+	if version != kzFooterVersion {
+		return nil, ErrBadVersion
+	}
+
+	return lookup.getKeyForID(keyID)
+}
+
+// return a session for 'k' if it can carry a footer
+func footerSession(k keydata) (*aesSession, error) {
+
+	ak, ok := k.(*aesKey)
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+
+	if ak.mode != cmCBC && ak.mode != cmCTR {
+		return nil, ErrUnsupportedCipherMode
+	}
+
+	return ak.newSession()
+}
+
+// check the signature on 'data', then split off the footer and decrypt the rest
+func (s *aesSession) decryptFooter(data []byte) ([]byte, []byte, error) {
+
+	macLength := s.mac.Size()
+	blockSize := s.block.BlockSize()
+
+	if len(data) < kzHeaderLength+blockSize+4+macLength {
+		return nil, nil, ErrShortCiphertext
+	}
+
+	msg := data[:len(data)-macLength]
+	sig := data[len(data)-macLength:]
+
+	if ok, err := s.mac.Verify(msg, sig); !ok || err != nil {
+		if err == nil {
+			err = ErrInvalidSignature
+		}
+		return nil, nil, err
+	}
+
+	// the length is authenticated now, but it still has to fit
+	n := binary.BigEndian.Uint32(msg[len(msg)-4:])
+	body := msg[kzHeaderLength+blockSize : len(msg)-4]
+
+	if n > maxFooterLength || int(n) > len(body) {
+		return nil, nil, ErrBadFooter
+	}
+
+	iv := msg[kzHeaderLength : kzHeaderLength+blockSize]
+	cipherBytes := body[:len(body)-int(n)]
+	footer := append([]byte(nil), body[len(body)-int(n):]...)
+
+	plaintext, err := s.decryptBody(iv, cipherBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return plaintext, footer, nil
+}
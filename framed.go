@@ -0,0 +1,80 @@
+package dkeyczar
+
+/*
+Length-prefixed framing for storing several ciphertexts in one file or stream.
+
+Each ciphertext, in the crypter's current encoding, is written as
+
+|length|ciphertext|
+
+where length is the big-endian uint32 length of the ciphertext.  The framing
+adds no integrity of its own: each ciphertext is still authenticated by Decrypt.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+const framedLengthSize = 4
+
+// EncryptFramed encrypts plaintext and writes it to w, prefixed with its length
+func EncryptFramed(e Encrypter, w io.Writer, plaintext []byte) error {
+
+	c, err := e.Encrypt(plaintext)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, framedLengthSize+len(c))
+	binary.BigEndian.PutUint32(frame, uint32(len(c)))
+	copy(frame[framedLengthSize:], c)
+
+	_, err = w.Write(frame)
+	return err
+}
+
+// DecryptFramed reads a single length-prefixed ciphertext from r and decrypts it.
+// It returns io.EOF if r has no more ciphertexts.
+func DecryptFramed(c Crypter, r io.Reader) ([]byte, error) {
+
+	h := make([]byte, framedLengthSize)
+	if _, err := io.ReadFull(r, h); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, ErrShortCiphertext
+	}
+
+	length := int64(binary.BigEndian.Uint32(h))
+
+	ec := encodingController{encoding: c.Encoding()}
+	if max := c.MaxCiphertextBytes(); max > 0 && ec.decodedLen(int(length)) > max {
+		return nil, ErrCiphertextTooLarge
+	}
+
+	// grow the buffer as data arrives rather than trusting the length up front
+	var buf bytes.Buffer
+	if n, _ := io.CopyN(&buf, r, length); n != length {
+		return nil, ErrShortCiphertext
+	}
+
+	return c.Decrypt(buf.String())
+}
+
+// A FramedReader decrypts the ciphertexts written by EncryptFramed one at a time
+type FramedReader struct {
+	c Crypter
+	r io.Reader
+}
+
+// NewFramedReader returns a FramedReader that reads ciphertexts from r and decrypts them with c
+func NewFramedReader(c Crypter, r io.Reader) *FramedReader {
+	return &FramedReader{c: c, r: r}
+}
+
+// Next returns the plaintext of the next ciphertext, or io.EOF when there are no more
+func (fr *FramedReader) Next() ([]byte, error) {
+	return DecryptFramed(fr.c, fr.r)
+}
@@ -2,6 +2,13 @@ package dkeyczar
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
 	"testing"
 )
 
@@ -443,3 +450,63 @@ func TestRSAInteropVerifyTimeoutSucess(t *testing.T) {
 func TestRSAInteropVerifyTimeoutExpired(t *testing.T) {
 	testInteropVerifyTimeout(t, "rsa-sign", false)
 }
+
+// TestAESKnownAnswer builds Keyczar AES ciphertexts from the format description with the standard library
+// and checks Encrypt produces exactly the same bytes, with the iv pinned.  Unlike the tests above it needs
+// no reference data, so it catches format changes even when the interop data isn't checked out.
+func TestAESKnownAnswer(t *testing.T) {
+
+	k := &aesKey{key: bytes.Repeat([]byte{0x01}, 16)}
+	k.hmacKey.key = bytes.Repeat([]byte{0x02}, 32)
+
+	defer func(r io.Reader) { rand.Reader = r }(rand.Reader)
+	rand.Reader = constReader(0x42)
+
+	kz, err := NewCrypter(newImportedAESKeyReader(k))
+	if err != nil {
+		t.Fatal("failed to create crypter: " + err.Error())
+	}
+	kz.SetEncoding(NO_ENCODING)
+
+	// the KeyID is the first 4 bytes of sha1(len(aesKey)|aesKey|hmacKey)
+	h := sha1.New()
+	binary.Write(h, binary.BigEndian, uint32(len(k.key)))
+	h.Write(k.key)
+	h.Write(k.hmacKey.key)
+	header := append([]byte{kzVersion}, h.Sum(nil)[:4]...)
+
+	block, _ := aes.NewCipher(k.key)
+	iv := bytes.Repeat([]byte{0x42}, aes.BlockSize)
+
+	for _, tt := range []struct {
+		name      string
+		plaintext string
+	}{
+		{"empty", ""},
+		{"short", "abc"},
+		{"block", "0123456789abcdef"},
+		{"interop", INTEROP_INPUT},
+	} {
+		pad := aes.BlockSize - len(tt.plaintext)%aes.BlockSize
+		padded := append([]byte(tt.plaintext), bytes.Repeat([]byte{byte(pad)}, pad)...)
+
+		ct := make([]byte, len(padded))
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(ct, padded)
+
+		want := append(append(append([]byte(nil), header...), iv...), ct...)
+
+		m := hmac.New(sha1.New, k.hmacKey.key)
+		m.Write(want)
+		want = m.Sum(want)
+
+		got, err := kz.Encrypt([]byte(tt.plaintext))
+		if err != nil {
+			t.Error(tt.name, ": failed to encrypt: ", err)
+			continue
+		}
+
+		if !bytes.Equal([]byte(got), want) {
+			t.Errorf("%s: got %x want %x", tt.name, got, want)
+		}
+	}
+}
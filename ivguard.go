@@ -0,0 +1,97 @@
+package dkeyczar
+
+/*
+An optional check that a Crypter never encrypts twice with the same key and iv.
+
+Every iv and GCM nonce is drawn from the random source, so a repeat only
+happens if that source is broken, for instance when a virtual machine is
+restored from a snapshot.  A repeated CBC iv reveals which plaintexts share a
+prefix, and a repeated CTR iv or GCM nonce is far worse, so a Crypter made
+with StrictIVs fails the encryption instead.
+
+The check remembers a SHA-256 hash of each key and iv pair, not the pairs
+themselves, and only the most recent maxTrackedIVs of them.  SIV ciphertexts
+are deterministic by design and aren't tracked.
+*/
+
+import (
+	"crypto/sha256"
+	"sync"
+)
+
+// the most (key, iv) pairs a Crypter made with StrictIVs remembers; past that, the oldest are forgotten
+const maxTrackedIVs = 1 << 16
+
+// StrictIVs makes Encrypt and the other encrypting methods fail with ErrIVReused if an AES key would use an iv
+// or GCM nonce that it has already used in this Crypter, which catches a broken random source.  It is meant for
+// debugging and testing: it costs a lock and a hash per encryption, and about 8MB once it is full.
+func StrictIVs() CrypterOption {
+	return func(kc *keyCrypter) error {
+		kc.ivs = new(ivSet)
+		return nil
+	}
+}
+
+// the (key, iv) pairs used by one Crypter
+type ivSet struct {
+	mu   sync.Mutex
+	seen map[[sha256.Size]byte]bool
+	ring [][sha256.Size]byte // the entries in 'seen', oldest at 'next' once it is full
+	next int
+}
+
+// make every AES key in 'kz' record its ivs in 's'.  A nil set leaves them unchecked.
+func (s *ivSet) watch(kz *keyczar) {
+
+	if s == nil {
+		return
+	}
+
+	for _, k := range kz.keys {
+		if ak, ok := k.(*aesKey); ok {
+			ak.ivs = s
+		}
+	}
+}
+
+// record that 'ak' is about to use 'iv', returning ErrIVReused if it already has
+func (s *ivSet) add(ak *aesKey, iv []byte) error {
+
+	sum := sha256.Sum256(lenPrefixPack(ak.key, iv))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.seen[sum] {
+		return ErrIVReused
+	}
+
+	if s.seen == nil {
+		s.seen = make(map[[sha256.Size]byte]bool)
+	}
+
+	if len(s.ring) < maxTrackedIVs {
+		s.ring = append(s.ring, sum)
+	} else {
+		delete(s.seen, s.ring[s.next])
+		s.ring[s.next] = sum
+		s.next = (s.next + 1) % maxTrackedIVs
+	}
+	s.seen[sum] = true
+
+	return nil
+}
+
+// fill 'iv' from the random source for encrypting with 'ak', refusing an iv it has already used if it is being watched
+func (ak *aesKey) randIV(iv []byte) error {
+
+	if err := randBytes(iv); err != nil {
+		return err
+	}
+
+	if ak.ivs == nil {
+		return nil
+	}
+
+	return ak.ivs.add(ak, iv)
+}
@@ -1,7 +1,29 @@
 package dkeyczar
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/dsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -513,25 +535,4172 @@ func TestPKCS5Pad(t *testing.T) {
 			t.Error("pkcs5pad: got: ", r, "expected: ", pkcs.r)
 		}
 
-		u := pkcs5unpad(r)
-		if bytes.Compare(unpad, u) != 0 {
+		u, err := pkcs5unpad(r, pkcs.pad)
+		if err != nil || bytes.Compare(unpad, u) != 0 {
 			t.Error("pkcs5unpad: got: ", u, "expected: ", unpad)
 		}
 
 	}
 }
 
+func TestPKCS5UnpadInvalid(t *testing.T) {
+
+	for _, b := range [][]byte{
+		{},
+		{0, 0, 0, 0, 0, 0, 0, 0},
+		{0, 0, 0, 0, 0, 0, 0, 9},
+		{0, 0, 0, 0, 0, 3, 2, 3},
+		{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		{0, 0, 0, 0, 0, 0, 0},
+	} {
+		if _, err := pkcs5unpad(b, 8); err != ErrBadPadding {
+			t.Error("pkcs5unpad: expected ErrBadPadding for ", b)
+		}
+	}
+}
+
+func TestAESCiphertextSize(t *testing.T) {
+	k, _ := generateAESKey(0)
+
+	// block-aligned plaintext always gets a full block of padding
+	for _, size := range []int{0, 1, 15, 16, 17, 32} {
+		c, err := k.Encrypt(make([]byte, size))
+		if err != nil {
+			t.Fatal("failed to encrypt: " + err.Error())
+		}
+
+		want := kzHeaderLength + aes.BlockSize + (size/aes.BlockSize+1)*aes.BlockSize + hmacSigLength
+		if len(c) != want {
+			t.Error("ciphertext for", size, "bytes: got length", len(c), "expected", want)
+		}
+	}
+}
+
 func TestLenPrefixPack(t *testing.T) {
 
 	b := lenPrefixPack([]byte{4, 5, 6, 2, 1}, []byte{1, 4, 2, 8, 5, 7}, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9}, []byte{1})
-	arrays := lenPrefixUnpack(b)
+	arrays, err := lenPrefixUnpack(b)
+
+	if err != nil || len(arrays) != 4 || len(arrays[3]) != 1 || arrays[3][0] != 1 {
+		t.Error("unpack error: ", err)
+	}
 
-	// FIXME: make this test more complete
+	bad := [][]byte{
+		nil,
+		{0, 0, 0},
+		b[:len(b)-1],
+		append(b, 0),
+		{0xff, 0xff, 0xff, 0xff}, // more arrays than could fit
+		{0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff, 1, 2}, // length past the end
+	}
 
-	if len(arrays[3]) != 1 || arrays[3][0] != 1 {
-		t.Error("unpack error")
+	for _, p := range bad {
+		if _, err := lenPrefixUnpack(p); err != ErrBadPacking {
+			t.Errorf("unpacking %v: expected ErrBadPacking, got %v", p, err)
+		}
 	}
 
+	if _, err := newAESFromPackedKeys(b[:len(b)-1]); err != ErrBadPacking {
+		t.Error("unpacking truncated session keys: expected ErrBadPacking, got ", err)
+	}
 }
 
 // FIXME: DecodeWeb64String / EncodeWeb64String
+
+func TestRequireAuthentication(t *testing.T) {
+	k, _ := generateAESKey(0)
+	r := newImportedAESKeyReader(k)
+
+	kz, err := NewCrypter(r)
+	if err != nil {
+		t.Fatal("failed to create crypter: " + err.Error())
+	}
+
+	kz.SetRequireAuthentication(true)
+
+	c, err := kz.Encrypt([]byte(INPUT))
+	if err != nil {
+		t.Fatal("failed to encrypt: " + err.Error())
+	}
+
+	p, err := kz.Decrypt(c)
+	if err != nil {
+		t.Fatal("failed to decrypt authenticated ciphertext: " + err.Error())
+	}
+
+	if string(p) != INPUT {
+		t.Error("decrypt(encrypt(p)) != p with authentication required")
+	}
+
+	// RSA-OAEP ciphertexts can be made by anyone with the public key
+	rk, _ := generateRSAKey(1024)
+	rc, _ := NewCrypter(newImportedRSAPrivateKeyReader(&rk.key, P_DECRYPT_AND_ENCRYPT))
+
+	c, _ = rc.Encrypt([]byte(INPUT))
+	if _, err := rc.Decrypt(c); err != nil {
+		t.Error("failed to decrypt without authentication required: ", err)
+	}
+
+	rc.SetRequireAuthentication(true)
+	if _, err := rc.Decrypt(c); !errors.Is(err, ErrUnauthenticatedCiphertext) {
+		t.Error("expected ErrUnauthenticatedCiphertext, got ", err)
+	}
+	if _, err := rc.DecryptWithVersion(c, 0); !errors.Is(err, ErrUnauthenticatedCiphertext) {
+		t.Error("DecryptWithVersion: expected ErrUnauthenticatedCiphertext, got ", err)
+	}
+}
+
+func TestRSAPSSSignVerify(t *testing.T) {
+	k, err := generateRSAKey(1024)
+	if err != nil {
+		t.Fatal("failed to generate rsa key: " + err.Error())
+	}
+
+	k.publicKey.scheme = SS_PSS
+
+	// round-trip through JSON to make sure the scheme is persisted
+	k, err = newRSAKeyFromJSON(k.ToKeyJSON())
+	if err != nil {
+		t.Fatal("failed to load rsa key from json: " + err.Error())
+	}
+
+	if k.publicKey.scheme != SS_PSS {
+		t.Fatal("signing scheme lost in json round-trip")
+	}
+
+	sig, err := k.Sign([]byte(INPUT))
+	if err != nil {
+		t.Fatal("failed to pss sign: " + err.Error())
+	}
+
+	if ok, _ := k.Verify([]byte(INPUT), sig); !ok {
+		t.Error("pss verify failed")
+	}
+
+	k.publicKey.scheme = SS_PKCS1_V15
+	if ok, _ := k.Verify([]byte(INPUT), sig); ok {
+		t.Error("pss signature verified as pkcs1v15")
+	}
+}
+
+func TestEncryptDecryptBatch(t *testing.T) {
+	k, _ := generateAESKey(0)
+	r := newImportedAESKeyReader(k)
+
+	kz, err := NewCrypter(r)
+	if err != nil {
+		t.Fatal("failed to create crypter: " + err.Error())
+	}
+
+	plaintexts := [][]byte{[]byte(INPUT), []byte(""), []byte(INPUT + INPUT)}
+
+	c, err := kz.(BatchEncrypter).EncryptBatch(plaintexts)
+	if err != nil {
+		t.Fatal("failed to batch encrypt: " + err.Error())
+	}
+
+	if c[0] == c[2] || len(c) != len(plaintexts) {
+		t.Error("unexpected batch encrypt output")
+	}
+
+	// batches must be readable one at a time, and vice versa
+	p, err := kz.Decrypt(c[2])
+	if err != nil || string(p) != INPUT+INPUT {
+		t.Error("decrypt of batch encrypted message failed")
+	}
+
+	single, _ := kz.Encrypt([]byte(INPUT))
+	c = append(c, single)
+
+	ps, err := kz.(BatchDecrypter).DecryptBatch(c)
+	if err != nil {
+		t.Fatal("failed to batch decrypt: " + err.Error())
+	}
+
+	for i, want := range append(plaintexts, []byte(INPUT)) {
+		if !bytes.Equal(ps[i], want) {
+			t.Error("batch decrypt(encrypt(p)) != p for message", i)
+		}
+	}
+}
+
+// a KeyReader over the output of KeyManager.ToJSONs
+type jsonsReader []string
+
+func (r jsonsReader) GetMetadata() (string, error) {
+	return r[0], nil
+}
+
+func (r jsonsReader) GetKey(version int) (string, error) {
+	if version <= 0 || version >= len(r) {
+		return "", ErrNoSuchKeyVersion
+	}
+	return r[version], nil
+}
+
+// a KeyWriter storing the keyset in the same form
+func (r *jsonsReader) PutMetadata(meta string) error {
+	if len(*r) == 0 {
+		*r = append(*r, "")
+	}
+	(*r)[0] = meta
+	return nil
+}
+
+func (r *jsonsReader) PutKey(version int, key string) error {
+	for len(*r) <= version {
+		*r = append(*r, "")
+	}
+	(*r)[version] = key
+	return nil
+}
+
+func TestRotateHMACKey(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("rotate", P_DECRYPT_AND_ENCRYPT, T_AES)
+
+	if err := km.AddKey(0, S_PRIMARY); err != nil {
+		t.Fatal("failed to add key: " + err.Error())
+	}
+
+	old, err := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+	if err != nil {
+		t.Fatal("failed to create crypter: " + err.Error())
+	}
+
+	c, _ := old.Encrypt([]byte(INPUT))
+
+	if err := km.RotateHMACKey(1, S_PRIMARY); err != nil {
+		t.Fatal("failed to rotate hmac key: " + err.Error())
+	}
+
+	if err := km.RotateAESKey(2, S_PRIMARY); err != nil {
+		t.Fatal("failed to rotate aes key: " + err.Error())
+	}
+
+	kz, err := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+	if err != nil {
+		t.Fatal("failed to create crypter after rotation: " + err.Error())
+	}
+
+	p, err := kz.Decrypt(c)
+	if err != nil || string(p) != INPUT {
+		t.Error("failed to decrypt message from before rotation")
+	}
+
+	k1 := km.(*keyManager).kz.keys[1].(*aesKey)
+	k2 := km.(*keyManager).kz.keys[2].(*aesKey)
+	k3 := km.(*keyManager).kz.keys[3].(*aesKey)
+
+	if !bytes.Equal(k1.key, k2.key) || bytes.Equal(k1.hmacKey.key, k2.hmacKey.key) {
+		t.Error("RotateHMACKey didn't keep the aes key and replace the hmac key")
+	}
+
+	if bytes.Equal(k2.key, k3.key) || !bytes.Equal(k2.hmacKey.key, k3.hmacKey.key) {
+		t.Error("RotateAESKey didn't keep the hmac key and replace the aes key")
+	}
+
+	if km.(*keyManager).kz.primary != 3 {
+		t.Error("newest rotated key isn't primary")
+	}
+}
+
+func TestKeyczarErrorVersionAndField(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("broken", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	km.AddKey(0, S_ACTIVE)
+
+	jsons := km.ToJSONs(nil)
+	jsons[2] = `{"aesKeyString":"!!!","size":128,"hmacKey":{"hmacKeyString":"","size":256},"mode":"CBC"}`
+
+	_, err := NewCrypter(jsonsReader(jsons))
+	if !errors.Is(err, ErrBase64Decoding) {
+		t.Fatal("expected base64 error, got ", err)
+	}
+
+	var kerr *KeyczarError
+	if !errors.As(err, &kerr) || kerr.Version != 2 || kerr.Field != "aesKeyString" {
+		t.Error("error missing version or field: ", err)
+	}
+}
+
+func TestVerifierFromPublicKey(t *testing.T) {
+	k, _ := generateDSAKey(0)
+
+	kz, err := NewSigner(newImportedDSAPrivateKeyReader(&k.key))
+	if err != nil {
+		t.Fatal("failed to create signer: " + err.Error())
+	}
+
+	s, err := kz.Sign([]byte(INPUT))
+	if err != nil {
+		t.Fatal("failed to sign: " + err.Error())
+	}
+
+	kv, err := NewVerifierFromDSAPublicKey(&k.key.PublicKey)
+	if err != nil {
+		t.Fatal("failed to create verifier from dsa public key: " + err.Error())
+	}
+
+	if ok, _ := kv.Verify([]byte(INPUT), s); !ok {
+		t.Error("dsa public key verify failed")
+	}
+}
+
+func TestVerifierFromPEM(t *testing.T) {
+	k, _ := generateRSAKey(1024)
+
+	ks, err := NewSigner(newImportedRSAPrivateKeyReader(&k.key, P_SIGN_AND_VERIFY))
+	if err != nil {
+		t.Fatal("failed to create signer: " + err.Error())
+	}
+
+	s, _ := ks.Sign([]byte(INPUT))
+
+	pkix, _ := x509.MarshalPKIXPublicKey(&k.key.PublicKey)
+
+	for _, block := range []*pem.Block{
+		{Type: "PUBLIC KEY", Bytes: pkix},
+		{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&k.key.PublicKey)},
+	} {
+		kv, err := NewVerifierFromPEM(pem.EncodeToMemory(block))
+		if err != nil {
+			t.Error(block.Type, ": failed to create verifier: ", err)
+			continue
+		}
+
+		if ok, _ := kv.Verify([]byte(INPUT), s); !ok {
+			t.Error(block.Type, ": verify failed")
+		}
+	}
+
+	// a private key, or a public key under the wrong label, is refused
+	for _, block := range []*pem.Block{
+		{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(&k.key)},
+		{Type: "CERTIFICATE", Bytes: pkix},
+	} {
+		if _, err := NewVerifierFromPEM(pem.EncodeToMemory(block)); err != ErrUnsupportedType {
+			t.Error(block.Type, ": expected ErrUnsupportedType, got ", err)
+		}
+	}
+
+	if _, err := NewVerifierFromPEM([]byte("not pem")); err != ErrUnsupportedType {
+		t.Error("expected ErrUnsupportedType for data without a PEM block, got ", err)
+	}
+
+	// so is a key smaller than keyczar allows for RSA
+	n, _ := rand.Prime(rand.Reader, 512)
+	small := &rsa.PublicKey{N: n, E: 65537}
+
+	if _, err := NewVerifierFromRSAPublicKey(small); !errors.Is(err, ErrInvalidKeySize) {
+		t.Error("512-bit key: expected ErrInvalidKeySize, got ", err)
+	}
+
+	block := &pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(small)}
+	if _, err := NewVerifierFromPEM(pem.EncodeToMemory(block)); !errors.Is(err, ErrInvalidKeySize) {
+		t.Error("512-bit PEM key: expected ErrInvalidKeySize, got ", err)
+	}
+}
+
+func TestEncryptedKeysetNeedsCrypter(t *testing.T) {
+	k, _ := generateAESKey(0)
+	cr, _ := NewCrypter(newImportedAESKeyReader(k))
+
+	km := NewKeyManager()
+	km.Create("encrypted", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+
+	jsons := jsonsReader(km.ToJSONs(cr))
+
+	if _, err := NewCrypter(jsons); err != ErrKeysetEncrypted {
+		t.Error("expected ErrKeysetEncrypted loading encrypted keyset, got ", err)
+	}
+
+	if _, err := NewCrypter(NewEncryptedReader(jsons, cr)); err != nil {
+		t.Error("failed to load encrypted keyset with crypter: " + err.Error())
+	}
+
+	// a reader of the caller's own that wraps the decrypting one can load it too
+	if _, err := NewCrypter(passthroughReader{reader: NewEncryptedReader(jsons, cr)}); err != nil {
+		t.Error("failed to load encrypted keyset through a wrapping reader: " + err.Error())
+	}
+}
+
+// a KeyReader that only passes reads through, as a caching or logging wrapper would
+type passthroughReader struct {
+	reader KeyReader
+}
+
+func (r passthroughReader) GetMetadata() (string, error) { return r.reader.GetMetadata() }
+
+func (r passthroughReader) GetKey(version int) (string, error) { return r.reader.GetKey(version) }
+
+func TestStreamEncryptDecrypt(t *testing.T) {
+	k, _ := generateAESKey(0)
+
+	sc, err := NewStreamCrypter(newImportedAESKeyReader(k))
+	if err != nil {
+		t.Fatal("failed to create stream crypter: " + err.Error())
+	}
+
+	for _, size := range []int{0, 100, streamFrameSize, 2*streamFrameSize + 17} {
+		input := bytes.Repeat([]byte{'x'}, size)
+
+		var c bytes.Buffer
+		if err := sc.EncryptStream(&c, bytes.NewReader(input)); err != nil {
+			t.Fatal("failed to encrypt stream: " + err.Error())
+		}
+
+		var p bytes.Buffer
+		if err := sc.DecryptStream(&p, bytes.NewReader(c.Bytes())); err != nil {
+			t.Fatal("failed to decrypt stream: " + err.Error())
+		}
+
+		if !bytes.Equal(p.Bytes(), input) {
+			t.Error("stream decrypt(encrypt(p)) != p for size", size)
+		}
+	}
+
+	input := bytes.Repeat([]byte{'x'}, 2*streamFrameSize+17)
+
+	var c bytes.Buffer
+	sc.EncryptStream(&c, bytes.NewReader(input))
+
+	frameLen := streamFrameHeaderSize + aes.BlockSize + streamFrameSize + aes.BlockSize + hmacSigLength
+
+	// tampering with the second frame must stop output after the first
+	tampered := append([]byte(nil), c.Bytes()...)
+	tampered[kzHeaderLength+frameLen+streamFrameHeaderSize+aes.BlockSize] ^= 1
+
+	var p bytes.Buffer
+	if err := sc.DecryptStream(&p, bytes.NewReader(tampered)); err != ErrInvalidSignature {
+		t.Error("tampered stream: expected ErrInvalidSignature, got ", err)
+	}
+
+	if p.Len() != streamFrameSize {
+		t.Error("tampered stream released", p.Len(), "bytes, expected only the first frame")
+	}
+
+	// dropping the final frame must be detected
+	p.Reset()
+	if err := sc.DecryptStream(&p, bytes.NewReader(c.Bytes()[:kzHeaderLength+2*frameLen])); err != ErrShortCiphertext {
+		t.Error("truncated stream: expected ErrShortCiphertext, got ", err)
+	}
+
+	// so must anything appended after it, before the last frame's plaintext is released
+	p.Reset()
+	if err := sc.DecryptStream(&p, bytes.NewReader(append(c.Bytes(), 0))); err != ErrInvalidSignature {
+		t.Error("stream with trailing data: expected ErrInvalidSignature, got ", err)
+	}
+
+	if p.Len() != 2*streamFrameSize {
+		t.Error("stream with trailing data released", p.Len(), "bytes, expected only the full frames")
+	}
+}
+
+var normalizeBase64Tests = []struct {
+	in  string
+	out string
+}{
+	{"+/8=", "-_8"},
+	{"-_8", "-_8"},
+	{"AAEC", "AAEC"},
+	{"AA==", "AA"},
+}
+
+func TestWeb64(t *testing.T) {
+
+	for _, tt := range normalizeBase64Tests {
+		if s := NormalizeBase64(tt.in); s != tt.out {
+			t.Error("NormalizeBase64(", tt.in, "): got: ", s, "expected: ", tt.out)
+		}
+	}
+
+	b := []byte{0xfb, 0xff, 0x00, 0x01}
+	s := EncodeWeb64(b)
+
+	d, err := DecodeWeb64(s)
+	if err != nil || !bytes.Equal(b, d) {
+		t.Error("DecodeWeb64(EncodeWeb64(b)) != b")
+	}
+
+	if _, err := DecodeWeb64("!!"); err != ErrBase64Decoding {
+		t.Error("expected ErrBase64Decoding for bad input, got ", err)
+	}
+}
+
+func TestInspectSignature(t *testing.T) {
+	k, _ := generateDSAKey(0)
+
+	kz, _ := NewSigner(newImportedDSAPrivateKeyReader(&k.key))
+	kz.SetEncoding(NO_ENCODING)
+
+	s, err := kz.Sign([]byte(INPUT))
+	if err != nil {
+		t.Fatal("failed to sign: " + err.Error())
+	}
+
+	info, err := InspectSignature([]byte(s))
+	if err != nil {
+		t.Fatal("failed to inspect signature: " + err.Error())
+	}
+
+	if info.Algorithm != "DSA" || info.R == nil || info.S == nil {
+		t.Error("dsa signature not recognized: ", info)
+	}
+
+	if !bytes.Equal(info.KeyID, k.KeyID()) || info.Version != kzVersion {
+		t.Error("bad header fields in signature info")
+	}
+
+	if _, err := InspectSignature([]byte{0, 1}); err != ErrShortSignature {
+		t.Error("expected ErrShortSignature, got ", err)
+	}
+}
+
+func TestMaxCiphertextBytes(t *testing.T) {
+	k, _ := generateAESKey(0)
+
+	kz, err := NewCrypter(newImportedAESKeyReader(k))
+	if err != nil {
+		t.Fatal("failed to create crypter: " + err.Error())
+	}
+
+	c, _ := kz.Encrypt([]byte(INPUT))
+
+	kz.SetMaxCiphertextBytes(len(c) * 3 / 4)
+	if _, err := kz.Decrypt(c); err != nil {
+		t.Error("ciphertext within limit rejected: ", err)
+	}
+
+	kz.SetMaxCiphertextBytes(kzHeaderLength + aes.BlockSize)
+	if _, err := kz.Decrypt(c); !errors.Is(err, ErrCiphertextTooLarge) {
+		t.Error("expected ErrCiphertextTooLarge, got ", err)
+	}
+}
+
+func TestVerifierDropsPrivateKey(t *testing.T) {
+	k, _ := generateDSAKey(0)
+	r := newImportedDSAPrivateKeyReader(&k.key)
+
+	kz, _ := NewSigner(r)
+	s, _ := kz.Sign([]byte(INPUT))
+
+	kv, err := NewVerifier(r)
+	if err != nil {
+		t.Fatal("failed to create verifier from private keyset: " + err.Error())
+	}
+
+	if ok, _ := kv.Verify([]byte(INPUT), s); !ok {
+		t.Error("verify with public half of private keyset failed")
+	}
+
+	for _, key := range kv.(*keySigner).keys().keys {
+		if _, ok := key.(*dsaPublicKey); !ok {
+			t.Error("verifier kept private key material")
+		}
+	}
+
+	if _, err := kv.(Signer).Sign([]byte(INPUT)); err != ErrUnacceptablePurpose {
+		t.Error("verifier was able to sign")
+	}
+}
+
+func TestComputeKeyID(t *testing.T) {
+	ak, _ := generateAESKey(0)
+	if !bytes.Equal(ComputeAESKeyID(ak.key, ak.hmacKey.key), ak.KeyID()) {
+		t.Error("ComputeAESKeyID doesn't match aesKey.KeyID")
+	}
+
+	hk, _ := generateHMACKey()
+	if !bytes.Equal(ComputeHMACKeyID(hk.key), hk.KeyID()) {
+		t.Error("ComputeHMACKeyID doesn't match hmacKey.KeyID")
+	}
+
+	dk, _ := generateDSAKey(0)
+	if !bytes.Equal(ComputeDSAKeyID(&dk.key.PublicKey), dk.KeyID()) {
+		t.Error("ComputeDSAKeyID doesn't match dsaKey.KeyID")
+	}
+}
+
+func TestKeySizeMismatch(t *testing.T) {
+	k, _ := generateDSAKey(0)
+
+	j := newDSAPublicJSONFromKey(&k.key.PublicKey)
+	j.P = encodeWeb64String(bigIntBytes(big.NewInt(0).Rsh(k.key.P, 512)))
+
+	b, _ := json.Marshal(j)
+	if _, err := newDSAPublicKeyFromJSON(b); !errors.Is(err, ErrKeySizeMismatch) {
+		t.Error("expected ErrKeySizeMismatch for short dsa p, got ", err)
+	}
+
+	if _, err := newDSAKeyFromJSON(k.ToKeyJSON()); err != nil {
+		t.Error("failed to load correctly sized dsa key: ", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("reload", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+
+	r := jsonsReader(km.ToJSONs(nil))
+
+	kz, err := NewCrypter(&r)
+	if err != nil {
+		t.Fatal("failed to create crypter: " + err.Error())
+	}
+
+	c1, _ := kz.Encrypt([]byte(INPUT))
+
+	km.AddKey(0, S_PRIMARY)
+	r = jsonsReader(km.ToJSONs(nil))
+
+	if err := kz.Reload(); err != nil {
+		t.Fatal("failed to reload: " + err.Error())
+	}
+
+	c2, _ := kz.Encrypt([]byte(INPUT))
+
+	b1, _ := decodeWeb64String(c1)
+	b2, _ := decodeWeb64String(c2)
+	if bytes.Equal(b1[1:kzHeaderLength], b2[1:kzHeaderLength]) {
+		t.Error("reload didn't pick up new primary key")
+	}
+
+	for _, c := range []string{c1, c2} {
+		if p, err := kz.Decrypt(c); err != nil || string(p) != INPUT {
+			t.Error("failed to decrypt after reload")
+		}
+	}
+
+	// a failed reload keeps the old keys
+	r = jsonsReader{"{"}
+	if err := kz.Reload(); err == nil {
+		t.Error("reload of bad keyset didn't fail")
+	}
+
+	if p, err := kz.Decrypt(c2); err != nil || string(p) != INPUT {
+		t.Error("failed reload lost existing keys")
+	}
+}
+
+func TestKeysetNameInErrors(t *testing.T) {
+	k, _ := generateAESKey(0)
+
+	kz, _ := NewCrypter(newImportedAESKeyReader(k))
+
+	if kz.KeyInfo().Name != "Imported AES Key" || kz.KeyInfo().Primary != 0 {
+		t.Error("unexpected KeyInfo: ", kz.KeyInfo())
+	}
+
+	other, _ := generateAESKey(0)
+	oc, _ := NewCrypter(newImportedAESKeyReader(other))
+	c, _ := oc.Encrypt([]byte(INPUT))
+
+	// by default the error is the bare sentinel
+	if _, err := kz.Decrypt(c); err != ErrKeyNotFound {
+		t.Error("expected ErrKeyNotFound, got ", err)
+	}
+
+	named, _ := NewCrypter(newImportedAESKeyReader(k), CrypterNamedErrors())
+
+	_, err := named.Decrypt(c)
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatal("expected ErrKeyNotFound, got ", err)
+	}
+
+	var kerr *KeyczarError
+	if !errors.As(err, &kerr) || kerr.Keyset != "Imported AES Key" {
+		t.Error("error doesn't name the keyset: ", err)
+	}
+
+	// an expired timeout signature is still reported as simply invalid
+	km := NewKeyManager()
+	km.Create("timeouts", P_SIGN_AND_VERIFY, T_HMAC_SHA1, S_PRIMARY)
+	ks, _ := NewSigner(jsonsReader(km.ToJSONs(nil)), SignerNamedErrors())
+	sig, _ := ks.TimeoutSign([]byte(INPUT), 1)
+	if ok, err := ks.TimeoutVerify([]byte(INPUT), sig); ok || err != nil {
+		t.Error("expired signature: expected false and no error, got ", ok, err)
+	}
+	if _, _, err := ks.VerifyTimeoutDetailed([]byte(INPUT), sig); !errors.As(err, &kerr) || kerr.Err != ErrSignatureExpired || kerr.Keyset != "timeouts" {
+		t.Error("expected a named ErrSignatureExpired, got ", err)
+	}
+}
+
+type sha256MAC struct {
+	key []byte
+}
+
+func (m sha256MAC) Sign(msg []byte) ([]byte, error) {
+	h := hmac.New(sha256.New, m.key)
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+func (m sha256MAC) Verify(msg []byte, tag []byte) (bool, error) {
+	sig, _ := m.Sign(msg)
+	return hmac.Equal(sig, tag), nil
+}
+
+func (m sha256MAC) Size() int {
+	return sha256.Size
+}
+
+func TestCustomMAC(t *testing.T) {
+	k, _ := generateAESKey(0)
+
+	kz, err := NewCrypterWithMAC(newImportedAESKeyReader(k), func(key []byte) MAC { return sha256MAC{key} })
+	if err != nil {
+		t.Fatal("failed to create crypter: ", err)
+	}
+
+	kz.SetEncoding(NO_ENCODING)
+
+	c, _ := kz.Encrypt([]byte(INPUT))
+	if len(c) != kzHeaderLength+aes.BlockSize+aes.BlockSize*(len(INPUT)/aes.BlockSize+1)+sha256.Size {
+		t.Error("unexpected ciphertext length: ", len(c))
+	}
+
+	if p, err := kz.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Error("failed to decrypt with custom MAC: ", err)
+	}
+
+	std, _ := NewCrypter(newImportedAESKeyReader(k))
+	std.SetEncoding(NO_ENCODING)
+	if _, err := std.Decrypt(c); err == nil {
+		t.Error("HMAC-SHA1 crypter accepted a ciphertext with a custom MAC")
+	}
+}
+
+func TestTrailingWhitespace(t *testing.T) {
+	k, _ := generateDSAKey(0)
+
+	ks, _ := NewSigner(newImportedDSAPrivateKeyReader(&k.key))
+
+	sig, _ := ks.Sign([]byte(INPUT))
+
+	if ok, err := ks.Verify([]byte(INPUT), " "+sig+"\r\n"); !ok || err != nil {
+		t.Error("failed to verify signature with surrounding whitespace: ", err)
+	}
+
+	ks.SetStrictDecoding(true)
+	if _, err := ks.Verify([]byte(INPUT), sig+"\n"); !errors.Is(err, ErrBase64Decoding) {
+		t.Error("strict decoding accepted trailing newline: ", err)
+	}
+
+	ak, _ := generateAESKey(0)
+	kc, _ := NewCrypter(newImportedAESKeyReader(ak))
+	c, _ := kc.Encrypt([]byte(INPUT))
+
+	if p, err := kc.Decrypt(c + "\n"); err != nil || string(p) != INPUT {
+		t.Error("failed to decrypt ciphertext with trailing newline: ", err)
+	}
+}
+
+func TestRSAOAEPOptions(t *testing.T) {
+	k, err := generateRSAKey(1024)
+	if err != nil {
+		t.Fatal("failed to generate rsa key: " + err.Error())
+	}
+
+	k.publicKey.oaepHash = OH_SHA256
+	k.publicKey.oaepLabel = []byte("label")
+
+	// round-trip through JSON to make sure the options are persisted
+	k, err = newRSAKeyFromJSON(k.ToKeyJSON())
+	if err != nil {
+		t.Fatal("failed to load rsa key from json: " + err.Error())
+	}
+
+	if k.publicKey.oaepHash != OH_SHA256 || string(k.publicKey.oaepLabel) != "label" {
+		t.Fatal("oaep options lost in json round-trip")
+	}
+
+	c, err := k.Encrypt([]byte(INPUT))
+	if err != nil {
+		t.Fatal("failed to encrypt: " + err.Error())
+	}
+
+	if p, err := k.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Error("oaep sha256 decrypt failed: ", err)
+	}
+
+	k.publicKey.oaepLabel = []byte("other")
+	if _, err := k.Decrypt(c); err == nil {
+		t.Error("decrypted with the wrong label")
+	}
+
+	k.publicKey.oaepHash = OH_SHA1
+	k.publicKey.oaepLabel = []byte("label")
+	if _, err := k.Decrypt(c); err == nil {
+		t.Error("sha256 ciphertext decrypted with sha1")
+	}
+}
+
+func TestValidateKeyset(t *testing.T) {
+	k, _ := generateAESKey(0)
+
+	if err := ValidateKeyset(newImportedAESKeyReader(k)); err != nil {
+		t.Error("valid aes keyset failed validation: ", err)
+	}
+
+	rk, _ := generateRSAKey(1024)
+	if err := ValidateKeyset(newImportedRSAPrivateKeyReader(&rk.key, P_SIGN_AND_VERIFY)); err != nil {
+		t.Error("valid rsa keyset failed validation: ", err)
+	}
+
+	// a private exponent that doesn't match the public key
+	rk.key.D = new(big.Int).Add(rk.key.D, big.NewInt(2))
+	rk.key.Precomputed.Dp = new(big.Int).Add(rk.key.Precomputed.Dp, big.NewInt(2))
+	err := ValidateKeyset(newImportedRSAPrivateKeyReader(&rk.key, P_DECRYPT_AND_ENCRYPT))
+
+	// imported keys are version 0
+	var kerr *KeyczarError
+	if !errors.As(err, &kerr) || kerr.Keyset != "Imported RSA Private Key" || kerr.Version != 0 {
+		t.Error("expected an error naming the broken key, got ", err)
+	}
+
+	// an RSA signing keyset is checked by signing, with its own scheme
+	km := NewKeyManager()
+	km.Create("rsa-sign", P_SIGN_AND_VERIFY, T_RSA_PRIV)
+	km.AddKey(1024, S_PRIMARY)
+	km.SetSignatureScheme(1, SS_PSS, 0)
+	if err := ValidateKeyset(jsonsReader(km.ToJSONs(nil))); err != nil {
+		t.Error("valid rsa signing keyset failed validation: ", err)
+	}
+	if err := ValidateKeyset(newImportedRSAPrivateKeyReader(&rk.key, P_SIGN_AND_VERIFY)); err == nil {
+		t.Error("broken rsa signing keyset passed validation")
+	}
+
+	// public keysets have their parameters checked
+	pub := km.PubKeys().ToJSONs(nil)
+	if err := ValidateKeyset(jsonsReader(pub)); err != nil {
+		t.Error("valid rsa public keyset failed validation: ", err)
+	}
+	pub[1] = strings.Replace(pub[1], `"publicExponent":"AQAB"`, `"publicExponent":"BA"`, 1)
+	if err := ValidateKeyset(jsonsReader(pub)); !errors.As(err, &kerr) || kerr.Err != ErrKeyCheckFailed || kerr.Version != 1 {
+		t.Error("expected ErrKeyCheckFailed for an even exponent, got ", err)
+	}
+
+	enc := NewKeyManager()
+	enc.Create("rsa-encrypt", P_DECRYPT_AND_ENCRYPT, T_RSA_PRIV)
+	enc.AddKey(1024, S_PRIMARY)
+	if err := ValidateKeyset(jsonsReader(enc.PubKeys().ToJSONs(nil))); err != nil {
+		t.Error("valid rsa encrypting public keyset failed validation: ", err)
+	}
+
+	dsaKM := NewKeyManager()
+	dsaKM.Create("dsa", P_SIGN_AND_VERIFY, T_DSA_PRIV)
+	dsaKM.AddKey(0, S_PRIMARY)
+	if err := ValidateKeyset(jsonsReader(dsaKM.PubKeys().ToJSONs(nil))); err != nil {
+		t.Error("valid dsa public keyset failed validation: ", err)
+	}
+}
+
+func TestDSAVerifyByKeyID(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("dsa", P_SIGN_AND_VERIFY, T_DSA_PRIV)
+
+	if err := km.AddKey(0, S_PRIMARY); err != nil {
+		t.Fatal("failed to add key: " + err.Error())
+	}
+
+	s1, _ := NewSigner(jsonsReader(km.ToJSONs(nil)))
+	sig1, _ := s1.Sign([]byte(INPUT))
+
+	if err := km.AddKey(0, S_PRIMARY); err != nil {
+		t.Fatal("failed to add key: " + err.Error())
+	}
+
+	s2, _ := NewSigner(jsonsReader(km.ToJSONs(nil)))
+	sig2, _ := s2.Sign([]byte(INPUT))
+
+	kv, err := NewVerifier(jsonsReader(km.PubKeys().ToJSONs(nil)))
+	if err != nil {
+		t.Fatal("failed to create verifier: " + err.Error())
+	}
+
+	for i, sig := range []string{sig1, sig2} {
+		if ok, err := kv.Verify([]byte(INPUT), sig); !ok || err != nil {
+			t.Errorf("failed to verify signature from version %d: %v", i+1, err)
+		}
+	}
+
+	other, _ := generateDSAKey(0)
+	so, _ := NewSigner(newImportedDSAPrivateKeyReader(&other.key))
+	sig3, _ := so.Sign([]byte(INPUT))
+
+	if ok, err := kv.Verify([]byte(INPUT), sig3); ok || !errors.Is(err, ErrKeyNotFound) {
+		t.Error("expected ErrKeyNotFound for unknown key, got ", err)
+	}
+}
+
+func TestFramed(t *testing.T) {
+	k, _ := generateAESKey(0)
+	kz, _ := NewCrypter(newImportedAESKeyReader(k))
+
+	var buf bytes.Buffer
+	inputs := []string{INPUT, "", "another message"}
+
+	for _, in := range inputs {
+		if err := EncryptFramed(kz, &buf, []byte(in)); err != nil {
+			t.Fatal("failed to encrypt framed: " + err.Error())
+		}
+	}
+
+	fr := NewFramedReader(kz, bytes.NewReader(buf.Bytes()))
+
+	for _, in := range inputs {
+		p, err := fr.Next()
+		if err != nil || string(p) != in {
+			t.Errorf("framed decrypt failed: %q %v", p, err)
+		}
+	}
+
+	if _, err := fr.Next(); err != io.EOF {
+		t.Error("expected io.EOF after last frame, got ", err)
+	}
+
+	if _, err := DecryptFramed(kz, bytes.NewReader(buf.Bytes()[:buf.Len()-1])); err != nil {
+		t.Error("first frame should decrypt from a truncated stream: ", err)
+	}
+
+	truncated := bytes.NewReader(buf.Bytes()[:10])
+	if _, err := DecryptFramed(kz, truncated); err != ErrShortCiphertext {
+		t.Error("expected ErrShortCiphertext for truncated frame, got ", err)
+	}
+}
+
+func TestHMACTagLength(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("truncated", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+
+	if err := km.SetHMACTagLength(1, 4); err != ErrInvalidKeySize {
+		t.Error("accepted a 4 byte tag")
+	}
+
+	if err := km.SetHMACTagLength(1, 16); err != nil {
+		t.Fatal("failed to set tag length: " + err.Error())
+	}
+
+	for _, newMAC := range []MACFactory{nil, func(key []byte) MAC { return sha256MAC{key} }} {
+		kz, err := NewCrypterWithMAC(jsonsReader(km.ToJSONs(nil)), newMAC)
+		if err != nil {
+			t.Fatal("failed to create crypter: " + err.Error())
+		}
+		kz.SetEncoding(NO_ENCODING)
+
+		c, _ := kz.Encrypt([]byte(INPUT))
+		if len(c) != kzHeaderLength+aes.BlockSize+aes.BlockSize*(len(INPUT)/aes.BlockSize+1)+16 {
+			t.Error("unexpected ciphertext length: ", len(c))
+		}
+
+		if p, err := kz.Decrypt(c); err != nil || string(p) != INPUT {
+			t.Error("failed to decrypt with truncated tag: ", err)
+		}
+
+		// flip a bit in the tag
+		b := []byte(c)
+		b[len(b)-1] ^= 1
+		if _, err := kz.Decrypt(string(b)); err == nil {
+			t.Error("decrypted with a corrupted truncated tag")
+		}
+	}
+}
+
+func TestSignEncryptBoth(t *testing.T) {
+	k, _ := generateDSAKey(0)
+	ks, _ := NewSigner(newImportedDSAPrivateKeyReader(&k.key))
+
+	raw, web64, err := ks.(RawSigner).SignBoth([]byte(INPUT))
+	if err != nil {
+		t.Fatal("failed to sign: " + err.Error())
+	}
+
+	if EncodeWeb64(raw) != web64 {
+		t.Error("raw and web64 signatures differ")
+	}
+
+	if ok, _ := ks.Verify([]byte(INPUT), web64); !ok {
+		t.Error("failed to verify web64 signature")
+	}
+
+	ks.SetEncoding(NO_ENCODING)
+	if ok, _ := ks.Verify([]byte(INPUT), string(raw)); !ok {
+		t.Error("failed to verify raw signature")
+	}
+
+	ak, _ := generateAESKey(0)
+	kc, _ := NewCrypter(newImportedAESKeyReader(ak))
+
+	rawc, web64c, err := kc.(RawEncrypter).EncryptBoth([]byte(INPUT))
+	if err != nil {
+		t.Fatal("failed to encrypt: " + err.Error())
+	}
+
+	if p, err := kc.Decrypt(web64c); err != nil || string(p) != INPUT {
+		t.Error("failed to decrypt web64 ciphertext: ", err)
+	}
+
+	kc.SetEncoding(NO_ENCODING)
+	if p, err := kc.Decrypt(string(rawc)); err != nil || string(p) != INPUT {
+		t.Error("failed to decrypt raw ciphertext: ", err)
+	}
+}
+
+func TestImportAESKey(t *testing.T) {
+	if _, err := ImportAESKey(make([]byte, 20)); err != ErrInvalidKeySize {
+		t.Error("accepted a 20 byte aes key")
+	}
+
+	raw := make([]byte, 32)
+	for i := range raw {
+		raw[i] = byte(i)
+	}
+
+	r, err := ImportAESKey(raw)
+	if err != nil {
+		t.Fatal("failed to import aes key: " + err.Error())
+	}
+
+	s, _ := r.GetKey(0)
+	ak, err := newAESKeyFromJSON([]byte(s))
+	if err != nil || !bytes.Equal(ak.key, raw) || len(ak.hmacKey.key) == 0 {
+		t.Error("imported key didn't round-trip through json: ", err)
+	}
+
+	kz, err := NewCrypter(r)
+	if err != nil {
+		t.Fatal("failed to create crypter: " + err.Error())
+	}
+
+	c, _ := kz.Encrypt([]byte(INPUT))
+	if p, err := kz.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Error("failed to round-trip with imported key: ", err)
+	}
+}
+
+func TestKeyIDs(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("ids", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	km.AddKey(0, S_PRIMARY)
+
+	kz, _ := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+	kz.SetEncoding(NO_ENCODING)
+
+	ids := kz.(KeyIDLister).KeyIDs()
+	if len(ids) != 2 {
+		t.Fatal("expected 2 key ids, got ", len(ids))
+	}
+
+	c, _ := kz.Encrypt([]byte(INPUT))
+	if !bytes.Equal([]byte(c)[1:kzHeaderLength], ids[1]) {
+		t.Error("ciphertext header doesn't match the primary key's id")
+	}
+
+	kmk := km.(*keyManager).kz.keys
+	for i, id := range ids {
+		if !bytes.Equal(id, kmk[i+1].KeyID()) {
+			t.Errorf("KeyIDs()[%d] doesn't match version %d", i, i+1)
+		}
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(b []byte) (int, error) {
+	return 0, errors.New("no entropy")
+}
+
+func TestRandomSourceFailure(t *testing.T) {
+	k, _ := generateAESKey(0)
+	kz, _ := NewCrypter(newImportedAESKeyReader(k))
+
+	defer func(r io.Reader) { rand.Reader = r }(rand.Reader)
+	rand.Reader = failingReader{}
+
+	if _, err := kz.Encrypt([]byte(INPUT)); err != ErrRandomSource {
+		t.Error("expected ErrRandomSource from Encrypt, got ", err)
+	}
+
+	if _, err := generateAESKey(0); err != ErrRandomSource {
+		t.Error("expected ErrRandomSource from generateAESKey, got ", err)
+	}
+}
+
+func TestVerifyReader(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("hmac", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	km.AddKey(0, S_PRIMARY)
+
+	dk, _ := generateDSAKey(0)
+	rk, _ := generateRSAKey(1024)
+
+	readers := map[string]KeyReader{
+		"hmac": jsonsReader(km.ToJSONs(nil)),
+		"dsa":  newImportedDSAPrivateKeyReader(&dk.key),
+		"rsa":  newImportedRSAPrivateKeyReader(&rk.key, P_SIGN_AND_VERIFY),
+	}
+
+	msg := bytes.Repeat([]byte(INPUT), 10000)
+
+	for name, r := range readers {
+		ks, err := NewSigner(r)
+		if err != nil {
+			t.Fatal(name, ": failed to create signer: ", err)
+		}
+
+		sig, _ := ks.Sign(msg)
+
+		if ok, err := ks.VerifyReader(bytes.NewReader(msg), sig); !ok || err != nil {
+			t.Error(name, ": failed to verify streamed message: ", err)
+		}
+
+		if ok, _ := ks.VerifyReader(bytes.NewReader(msg[1:]), sig); ok {
+			t.Error(name, ": verified the wrong message")
+		}
+	}
+}
+
+func TestKeyTypeMismatch(t *testing.T) {
+	rk, _ := generateRSAKey(1024)
+
+	meta := `{"name":"mislabeled","purpose":"DECRYPT_AND_ENCRYPT","type":"AES","encrypted":false,"versions":[{"exportable":false,"status":"PRIMARY","versionNumber":1}]}`
+
+	_, err := NewCrypter(jsonsReader{meta, string(rk.ToKeyJSON())})
+	if !errors.Is(err, ErrKeyTypeMismatch) {
+		t.Fatal("expected ErrKeyTypeMismatch, got ", err)
+	}
+
+	var kerr *KeyczarError
+	if !errors.As(err, &kerr) || kerr.Version != 1 || kerr.Field != "aesKeyString" {
+		t.Error("error doesn't name the version and field: ", err)
+	}
+
+	// key material that isn't a JSON object is reported as such
+	for _, s := range []string{"not json", `["aesKeyString"]`} {
+		var serr *json.SyntaxError
+		var terr *json.UnmarshalTypeError
+		if err := T_AES.checkKeyJSON([]byte(s)); !errors.As(err, &serr) && !errors.As(err, &terr) {
+			t.Errorf("checkKeyJSON(%q): expected the JSON error, got %v", s, err)
+		}
+	}
+}
+
+func TestNoPrivateKey(t *testing.T) {
+	rk, _ := generateRSAKey(1024)
+
+	// an encrypt-only keyset can't make a Crypter
+	if _, err := NewCrypter(newImportedRSAPublicKeyReader(&rk.key.PublicKey, P_ENCRYPT)); err != ErrNoPrivateKey {
+		t.Error("expected ErrNoPrivateKey, got ", err)
+	}
+
+	// but the wrong kind of keyset is still the wrong purpose
+	if _, err := NewCrypter(newImportedRSAPublicKeyReader(&rk.key.PublicKey, P_VERIFY)); err != ErrUnacceptablePurpose {
+		t.Error("expected ErrUnacceptablePurpose, got ", err)
+	}
+
+	// public keys mislabeled as a full keyset
+	if _, err := NewCrypter(newImportedRSAPublicKeyReader(&rk.key.PublicKey, P_DECRYPT_AND_ENCRYPT)); err != ErrNoPrivateKey {
+		t.Error("expected ErrNoPrivateKey, got ", err)
+	}
+
+	if _, err := NewSigner(newImportedRSAPublicKeyReader(&rk.key.PublicKey, P_SIGN_AND_VERIFY)); err != ErrNoPrivateKey {
+		t.Error("expected ErrNoPrivateKey, got ", err)
+	}
+}
+
+func TestEncryptSessions(t *testing.T) {
+	rk, _ := generateRSAKey(1024)
+	kz, err := NewCrypter(newImportedRSAPrivateKeyReader(&rk.key, P_DECRYPT_AND_ENCRYPT))
+	if err != nil {
+		t.Fatal("failed to create crypter with rsa: " + err.Error())
+	}
+
+	payloads := [][]byte{[]byte(INPUT), []byte("second file"), []byte(INPUT)}
+
+	keys, ciphertexts, err := EncryptSessions(kz, payloads)
+	if err != nil {
+		t.Fatal("failed to encrypt sessions: " + err.Error())
+	}
+
+	if ciphertexts[0] == ciphertexts[2] {
+		t.Error("identical payloads produced identical ciphertexts")
+	}
+
+	sess, err := NewSessionDecrypter(kz, keys)
+	if err != nil {
+		t.Fatal("failed to create session decrypter: " + err.Error())
+	}
+
+	plaintexts, err := sess.(BatchDecrypter).DecryptBatch(ciphertexts)
+	if err != nil {
+		t.Fatal("failed to decrypt sessions: " + err.Error())
+	}
+
+	for i := range payloads {
+		if !bytes.Equal(plaintexts[i], payloads[i]) {
+			t.Errorf("payload %d didn't round-trip", i)
+		}
+	}
+}
+
+// an insecure 8-byte block "cipher" for checking the block size isn't assumed to be aes.BlockSize
+type xorBlock8 struct{}
+
+func (xorBlock8) BlockSize() int { return 8 }
+
+func (xorBlock8) Encrypt(dst, src []byte) {
+	for i := 0; i < 8; i++ {
+		dst[i] = src[i] ^ 0x5a
+	}
+}
+
+func (xorBlock8) Decrypt(dst, src []byte) {
+	xorBlock8{}.Encrypt(dst, src)
+}
+
+func TestSessionBlockSize(t *testing.T) {
+	k, _ := generateAESKey(0)
+
+	s := &aesSession{key: k, block: xorBlock8{}, mac: newHMACSHA1MAC(k.hmacKey.key)}
+
+	for _, in := range []string{"", "1234567", "12345678", INPUT} {
+		c, err := s.Encrypt([]byte(in))
+		if err != nil {
+			t.Fatal("failed to encrypt: " + err.Error())
+		}
+
+		if len(c) != kzHeaderLength+8+8*(len(in)/8+1)+hmacSigLength {
+			t.Errorf("unexpected ciphertext length %d for %q", len(c), in)
+		}
+
+		if p, err := s.Decrypt(c); err != nil || string(p) != in {
+			t.Errorf("failed to round-trip %q with 8-byte blocks: %v", in, err)
+		}
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("reencrypt", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+
+	old, _ := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+	c, _ := old.Encrypt([]byte(INPUT))
+
+	km.AddKey(0, S_PRIMARY)
+
+	kz, _ := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+
+	nc, err := kz.Reencrypt(c)
+	if err != nil {
+		t.Fatal("failed to reencrypt: " + err.Error())
+	}
+
+	b, _ := DecodeWeb64(nc)
+	if !bytes.Equal(b[1:kzHeaderLength], kz.(KeyIDLister).KeyIDs()[1]) {
+		t.Error("reencrypted ciphertext isn't under the new primary key")
+	}
+
+	if p, err := kz.Decrypt(nc); err != nil || string(p) != INPUT {
+		t.Error("failed to decrypt reencrypted ciphertext: ", err)
+	}
+}
+
+func TestMultiVerifier(t *testing.T) {
+	dk, _ := generateDSAKey(0)
+	rk, _ := generateRSAKey(1024)
+	ek, _ := generateDSAKey(0)
+
+	alice, _ := NewSigner(newImportedDSAPrivateKeyReader(&dk.key))
+	bob, _ := NewSigner(newImportedRSAPrivateKeyReader(&rk.key, P_SIGN_AND_VERIFY))
+	eve, _ := NewSigner(newImportedDSAPrivateKeyReader(&ek.key))
+
+	av, _ := NewVerifier(newImportedDSAPublicKeyReader(&dk.key.PublicKey))
+	bv, _ := NewVerifier(newImportedRSAPublicKeyReader(&rk.key.PublicKey, P_VERIFY))
+
+	mv := NewMultiVerifier(map[string]Verifier{"alice": av, "bob": bv})
+
+	for name, s := range map[string]Signer{"alice": alice, "bob": bob} {
+		sig, _ := s.Sign([]byte(INPUT))
+
+		issuer, valid, err := mv.Verify([]byte(INPUT), sig)
+		if err != nil || !valid || issuer != name {
+			t.Errorf("expected %s to verify, got %q %v %v", name, issuer, valid, err)
+		}
+
+		if _, valid, _ := mv.Verify([]byte(INPUT+"x"), sig); valid {
+			t.Error("verified the wrong message for ", name)
+		}
+	}
+
+	sig, _ := eve.Sign([]byte(INPUT))
+	if _, valid, err := mv.Verify([]byte(INPUT), sig); valid || err != ErrUnknownIssuer {
+		t.Error("expected ErrUnknownIssuer, got ", err)
+	}
+
+	// a Verifier that can't list its KeyIDs is tried for every signature
+	mv = NewMultiVerifier(map[string]Verifier{"alice": av, "bob": struct{ Verifier }{bv}})
+
+	sig, _ = bob.Sign([]byte(INPUT))
+	if issuer, valid, err := mv.Verify([]byte(INPUT), sig); err != nil || !valid || issuer != "bob" {
+		t.Errorf("expected unlisted bob to verify, got %q %v %v", issuer, valid, err)
+	}
+
+	sig, _ = eve.Sign([]byte(INPUT))
+	if _, valid, err := mv.Verify([]byte(INPUT), sig); valid || err != ErrUnknownIssuer {
+		t.Error("expected ErrUnknownIssuer with bob unlisted, got ", err)
+	}
+}
+
+func TestEncryptWithNonce(t *testing.T) {
+	k, _ := generateAESKey(0)
+	kz, _ := NewCrypter(newImportedAESKeyReader(k))
+
+	nonce := []byte("audit-0001")
+
+	c, err := kz.EncryptWithNonce([]byte(INPUT), nonce)
+	if err != nil {
+		t.Fatal("failed to encrypt with nonce: " + err.Error())
+	}
+
+	p, n, err := kz.DecryptWithNonce(c)
+	if err != nil || string(p) != INPUT || !bytes.Equal(n, nonce) {
+		t.Error("failed to round-trip with nonce: ", err)
+	}
+
+	for _, bad := range [][]byte{nil, make([]byte, 7), make([]byte, 65)} {
+		if _, err := kz.EncryptWithNonce([]byte(INPUT), bad); err != ErrInvalidNonce {
+			t.Error("expected ErrInvalidNonce for nonce of length ", len(bad))
+		}
+	}
+
+	// a plain ciphertext has no nonce packed in it
+	c, _ = kz.Encrypt([]byte(INPUT))
+	if _, _, err := kz.DecryptWithNonce(c); err != ErrBadPacking {
+		t.Error("expected ErrBadPacking, got ", err)
+	}
+}
+
+func TestKeyMetaString(t *testing.T) {
+	km := keyMeta{"test", T_AES, P_DECRYPT_AND_ENCRYPT, false, []keyVersion{{1, S_ACTIVE, false}, {2, S_PRIMARY, false}}}
+
+	if s := km.String(); s != `"test" AES DECRYPT_AND_ENCRYPT [1:ACTIVE 2:PRIMARY]` {
+		t.Error("unexpected keyMeta string: ", s)
+	}
+
+	b, _ := json.Marshal(km)
+	expected := `{"name":"test","type":"AES","purpose":"DECRYPT_AND_ENCRYPT","encrypted":false,"versions":[{"versionNumber":1,"status":"ACTIVE","exportable":false},{"versionNumber":2,"status":"PRIMARY","exportable":false}]}`
+	if string(b) != expected {
+		t.Error("unexpected keyMeta json: ", string(b))
+	}
+
+	var km2 keyMeta
+	if err := json.Unmarshal(b, &km2); err != nil || km2.String() != km.String() {
+		t.Error("keyMeta didn't round-trip through json: ", err)
+	}
+}
+
+func TestTarReader(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("tar", P_SIGN_AND_VERIFY, T_DSA_PRIV)
+	km.AddKey(0, S_PRIMARY)
+
+	ks, _ := NewSigner(jsonsReader(km.ToJSONs(nil)))
+	sig, _ := ks.Sign([]byte(INPUT))
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	tw.WriteHeader(&tar.Header{Name: "keyset/", Typeflag: tar.TypeDir, Mode: 0755})
+	for i, s := range km.PubKeys().ToJSONs(nil) {
+		name := "keyset/meta"
+		if i > 0 {
+			name = "keyset/" + strconv.Itoa(i)
+		}
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(s))})
+		tw.Write([]byte(s))
+	}
+	tw.Close()
+
+	r, err := NewTarReader(&buf)
+	if err != nil {
+		t.Fatal("failed to read tar: " + err.Error())
+	}
+
+	kv, err := NewVerifier(r)
+	if err != nil {
+		t.Fatal("failed to create verifier from tar: " + err.Error())
+	}
+
+	if ok, err := kv.Verify([]byte(INPUT), sig); !ok || err != nil {
+		t.Error("failed to verify with keyset from tar: ", err)
+	}
+
+	if _, err := r.GetKey(2); !os.IsNotExist(err) {
+		t.Error("expected a not-exist error for a missing version, got ", err)
+	}
+}
+
+func TestFileReaderWithLayout(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("layout", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_ACTIVE)
+	km.AddKey(0, S_PRIMARY)
+
+	dir := t.TempDir()
+	for i, s := range km.ToJSONs(nil) {
+		name := "keyset.json"
+		if i > 0 {
+			name = "key_" + strconv.Itoa(i) + ".json"
+		}
+		if err := os.WriteFile(dir+"/"+name, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := NewFileReaderWithLayout(dir, "keyset.json", "key_%d.json")
+	if err != nil {
+		t.Fatal("failed to create reader: " + err.Error())
+	}
+
+	kz, err := NewCrypter(r)
+	if err != nil {
+		t.Fatal("failed to load keyset with custom layout: " + err.Error())
+	}
+
+	if c, err := kz.Encrypt([]byte(INPUT)); err != nil {
+		t.Error("failed to encrypt: ", err)
+	} else if p, err := kz.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Error("failed to decrypt: ", err)
+	}
+
+	if _, err := NewCrypter(NewFileReader(dir)); !os.IsNotExist(err) {
+		t.Error("standard layout found the files: ", err)
+	}
+
+	for _, template := range []string{"key.json", "key_%s.json", "%d_%d", "%d%%"} {
+		if _, err := NewFileReaderWithLayout(dir, "keyset.json", template); err != ErrBadLayout {
+			t.Error("accepted template ", template, ": ", err)
+		}
+	}
+}
+
+func TestGetKeyForID(t *testing.T) {
+	k1, _ := generateAESKey(0)
+	k2, _ := generateAESKey(0)
+	k3, _ := generateAESKey(0)
+
+	// force a collision between the first and last keys
+	k3.id = k1.KeyID()
+
+	kz := &keyczar{idkeys: []keydata{k1, k2, k3}}
+
+	kl, err := kz.getKeyForID(k1.KeyID())
+	if err != nil || len(kl) != 2 || kl[0] != k1 || kl[1] != k3 {
+		t.Error("expected both colliding keys in order, got ", kl, err)
+	}
+
+	if _, err := kz.getKeyForID([]byte{0, 0, 0, 0}); err != ErrKeyNotFound {
+		t.Error("expected ErrKeyNotFound, got ", err)
+	}
+}
+
+func TestLargeRSAKeys(t *testing.T) {
+	for _, size := range []uint{3072, 4096} {
+		if size > 3072 && testing.Short() {
+			continue
+		}
+
+		k, err := generateRSAKey(size)
+		if err != nil {
+			t.Fatalf("failed to generate %d bit rsa key: %v", size, err)
+		}
+
+		// load it back from json to make sure the size is accepted
+		k2, err := newRSAKeyFromJSON(k.ToKeyJSON())
+		if err != nil {
+			t.Fatalf("failed to load %d bit rsa key: %v", size, err)
+		}
+
+		if !bytes.Equal(k.KeyID(), k2.KeyID()) {
+			t.Errorf("%d bit key id changed in json round-trip", size)
+		}
+
+		pub, err := newRSAPublicKeyFromJSON(k2.publicKey.ToKeyJSON())
+		if err != nil {
+			t.Fatalf("failed to load %d bit rsa public key: %v", size, err)
+		}
+
+		r := newImportedRSAPrivateKeyReader(&k2.key, P_SIGN_AND_VERIFY)
+		testSignVerify(t, "rsa "+strconv.Itoa(int(size)), r)
+
+		sig, _ := k2.Sign([]byte(INPUT))
+		if ok, _ := pub.Verify([]byte(INPUT), sig); !ok {
+			t.Errorf("%d bit public key failed to verify", size)
+		}
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	for n := 0; n < kzHeaderLength; n++ {
+		if _, _, _, err := ParseHeader(make([]byte, n)); err != ErrShortHeader {
+			t.Errorf("expected ErrShortHeader for %d bytes, got %v", n, err)
+		}
+	}
+
+	version, keyID, rest, err := ParseHeader([]byte{0, 1, 2, 3, 4, 5, 6})
+	if err != nil || version != 0 || !bytes.Equal(keyID, []byte{1, 2, 3, 4}) || !bytes.Equal(rest, []byte{5, 6}) {
+		t.Error("bad header parse: ", version, keyID, rest, err)
+	}
+
+	_, _, rest, _ = ParseHeader([]byte{1, 1, 2, 3, 4})
+	if len(rest) != 0 {
+		t.Error("expected empty rest for header-only input")
+	}
+}
+
+func TestHeaderInfo(t *testing.T) {
+	k, _ := generateAESKey(0)
+	kz, _ := NewCrypter(newImportedAESKeyReader(k))
+	kz.SetEncoding(NO_ENCODING)
+
+	c, _ := kz.Encrypt([]byte(INPUT))
+
+	version, keyID, err := HeaderInfo([]byte(c))
+	if err != nil || version != kzVersion || !bytes.Equal(keyID[:], k.KeyID()) {
+		t.Error("bad header info: ", version, keyID, err)
+	}
+
+	if _, _, err := HeaderInfo([]byte(c)[:kzHeaderLength-1]); err != ErrShortHeader {
+		t.Error("expected ErrShortHeader, got ", err)
+	}
+
+	if version, _, err := HeaderInfo([]byte{7, 1, 2, 3, 4}); err != ErrBadVersion || version != 7 {
+		t.Error("expected ErrBadVersion, got ", version, err)
+	}
+}
+
+func TestGCMMode(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("gcm", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+
+	if err := km.SetCipherMode(1, cmECB); err != ErrUnsupportedCipherMode {
+		t.Error("accepted ECB mode")
+	}
+
+	cbc, _ := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+	cbc.SetEncoding(NO_ENCODING)
+	cbcCiphertext, _ := cbc.Encrypt([]byte(INPUT))
+
+	if err := km.SetCipherMode(1, cmGCM); err != nil {
+		t.Fatal("failed to set GCM mode: " + err.Error())
+	}
+
+	jsons := km.ToJSONs(nil)
+
+	kz, err := NewCrypter(jsonsReader(jsons))
+	if err != nil {
+		t.Fatal("failed to create GCM crypter: " + err.Error())
+	}
+	kz.SetEncoding(NO_ENCODING)
+
+	c, err := kz.Encrypt([]byte(INPUT))
+	if err != nil {
+		t.Fatal("failed to encrypt: " + err.Error())
+	}
+
+	if len(c) != kzHeaderLength+gcmNonceSize+len(INPUT)+gcmTagSize {
+		t.Error("unexpected ciphertext length: ", len(c))
+	}
+
+	if p, err := kz.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Error("failed to decrypt GCM ciphertext: ", err)
+	}
+
+	b := []byte(c)
+	b[kzHeaderLength+gcmNonceSize] ^= 1
+	if _, err := kz.Decrypt(string(b)); !errors.Is(err, ErrInvalidSignature) {
+		t.Error("decrypted a corrupted GCM ciphertext: ", err)
+	}
+
+	// same key material, different mode: neither reads the other's ciphertexts
+	if _, err := kz.Decrypt(cbcCiphertext); err == nil {
+		t.Error("GCM key decrypted a CBC ciphertext")
+	}
+	if _, err := cbc.Decrypt(c); err == nil {
+		t.Error("CBC key decrypted a GCM ciphertext")
+	}
+
+	sc, _ := NewStreamCrypter(jsonsReader(jsons))
+	if err := sc.EncryptStream(new(bytes.Buffer), bytes.NewReader([]byte(INPUT))); err != ErrUnsupportedType {
+		t.Error("streamed with a GCM key: ", err)
+	}
+
+	for _, mode := range []string{"ECB", "DET_CBC", "XTS"} {
+		jsons[1] = strings.Replace(km.ToJSONs(nil)[1], `"mode":"GCM"`, `"mode":"`+mode+`"`, 1)
+		if _, err := NewCrypter(jsonsReader(jsons)); !errors.Is(err, ErrUnsupportedCipherMode) {
+			t.Error("unexpected error loading a key in mode ", mode, ": ", err)
+		}
+	}
+}
+
+func TestEncryptString(t *testing.T) {
+	k, _ := generateAESKey(0)
+	kz, _ := NewCrypter(newImportedAESKeyReader(k))
+
+	c, err := EncryptString(kz, INPUT)
+	if err != nil {
+		t.Fatal("failed to encrypt: " + err.Error())
+	}
+
+	if p, err := DecryptString(kz, c); err != nil || p != INPUT {
+		t.Error("failed to decrypt string: ", err)
+	}
+
+	if p, err := kz.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Error("Decrypt disagrees with EncryptString: ", err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("checksum", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	km.AddKey(0, S_PRIMARY)
+
+	jsons := km.ToJSONs(nil)
+
+	sum, err := GenerateChecksum(jsonsReader(jsons))
+	if err != nil {
+		t.Fatal("failed to generate checksum: " + err.Error())
+	}
+
+	if again, _ := GenerateChecksum(jsonsReader(jsons)); again != sum {
+		t.Error("checksum isn't stable")
+	}
+
+	if ok, err := VerifyChecksum(jsonsReader(jsons), sum); !ok || err != nil {
+		t.Error("failed to verify checksum: ", err)
+	}
+
+	// swap in a different key for version 1
+	other := NewKeyManager()
+	other.Create("other", P_DECRYPT_AND_ENCRYPT, T_AES)
+	other.AddKey(0, S_PRIMARY)
+
+	swapped := append([]string(nil), jsons...)
+	swapped[1] = other.ToJSONs(nil)[1]
+	if ok, _ := VerifyChecksum(jsonsReader(swapped), sum); ok {
+		t.Error("verified checksum with a swapped key")
+	}
+
+	// demote the primary in the metadata
+	edited := append([]string(nil), jsons...)
+	edited[0] = strings.Replace(edited[0], `"PRIMARY"`, `"ACTIVE"`, 1)
+	if ok, _ := VerifyChecksum(jsonsReader(edited), sum); ok {
+		t.Error("verified checksum with edited metadata")
+	}
+
+	if _, err := VerifyChecksum(jsonsReader(jsons), "!!!"); err != ErrBase64Decoding {
+		t.Error("accepted a malformed checksum")
+	}
+}
+
+func TestDecryptSinglePass(t *testing.T) {
+	k, _ := generateAESKey(0)
+	s, _ := k.newSession()
+
+	for _, n := range []int{singlePassMinLength - 100, singlePassMinLength, 3*singlePassMinLength + 7} {
+		plaintext := make([]byte, n)
+		rand.Read(plaintext)
+
+		c, err := s.Encrypt(plaintext)
+		if err != nil {
+			t.Fatal("failed to encrypt: " + err.Error())
+		}
+
+		if p, err := s.Decrypt(c); err != nil || !bytes.Equal(p, plaintext) {
+			t.Error("failed to decrypt ", n, " bytes: ", err)
+		}
+
+		c[len(c)/2] ^= 1
+		if _, err := s.Decrypt(c); err != ErrInvalidSignature {
+			t.Error("decrypted a corrupted ciphertext of ", n, " bytes: ", err)
+		}
+	}
+}
+
+func benchmarkDecrypt(b *testing.B, singlePass bool) {
+	k, _ := generateAESKey(0)
+	s, _ := k.newSession()
+
+	c, _ := s.Encrypt(make([]byte, 1<<20))
+
+	b.SetBytes(int64(len(c)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var err error
+		if singlePass {
+			_, err = s.decryptSinglePass(s.mac.(*hmacSHA1MAC), c)
+		} else {
+			_, err = s.decryptTwoPass(c)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecryptSinglePass(b *testing.B) { benchmarkDecrypt(b, true) }
+func BenchmarkDecryptTwoPass(b *testing.B)    { benchmarkDecrypt(b, false) }
+
+func TestRSAFixedLengthCiphertext(t *testing.T) {
+	k, _ := generateRSAKey(1024)
+	kz, _ := NewCrypter(newImportedRSAPrivateKeyReader(&k.key, P_DECRYPT_AND_ENCRYPT))
+	kz.SetEncoding(NO_ENCODING)
+
+	// keep going until we see a ciphertext with a leading zero, which we then strip
+	stripped := false
+	for i := 0; i < 5000 && !stripped; i++ {
+		c, err := kz.Encrypt([]byte(INPUT))
+		if err != nil {
+			t.Fatal("failed to encrypt: " + err.Error())
+		}
+
+		if len(c) != kzHeaderLength+128 {
+			t.Fatal("ciphertext isn't the modulus size: ", len(c)-kzHeaderLength)
+		}
+
+		if c[kzHeaderLength] != 0 {
+			continue
+		}
+
+		stripped = true
+		c = c[:kzHeaderLength] + c[kzHeaderLength+1:]
+		if p, err := kz.Decrypt(c); err != nil || string(p) != INPUT {
+			t.Error("failed to decrypt a stripped ciphertext: ", err)
+		}
+	}
+
+	if !stripped {
+		t.Error("never saw a ciphertext with a leading zero")
+	}
+}
+
+func TestSignedKeysSession(t *testing.T) {
+	rk, _ := generateRSAKey(1024)
+	kz, _ := NewCrypter(newImportedRSAPrivateKeyReader(&rk.key, P_DECRYPT_AND_ENCRYPT))
+
+	dk, _ := generateDSAKey(0)
+	ks, _ := NewSigner(newImportedDSAPrivateKeyReader(&dk.key))
+
+	other, _ := generateDSAKey(0)
+	ko, _ := NewSigner(newImportedDSAPrivateKeyReader(&other.key))
+
+	sess1, keys, err := NewSignedKeysSessionEncrypter(kz, ks)
+	if err != nil {
+		t.Fatal("failed to create session encrypter: " + err.Error())
+	}
+
+	c, _ := sess1.Encrypt([]byte(INPUT))
+
+	sess2, err := NewSignedKeysSessionDecrypter(kz, ks, keys)
+	if err != nil {
+		t.Fatal("failed to create session decrypter: " + err.Error())
+	}
+
+	if p, err := sess2.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Error("failed to session decrypt: ", err)
+	}
+
+	if _, err := NewSignedKeysSessionDecrypter(kz, ko, keys); err == nil {
+		t.Error("accepted session keys signed by someone else")
+	}
+
+	// the session keys re-signed by another sender
+	raw, _ := ks.AttachedVerify(keys, nil)
+	forged, _ := ko.AttachedSign(raw, nil)
+	if _, err := NewSignedKeysSessionDecrypter(kz, ks, forged); err == nil {
+		t.Error("accepted session keys re-signed by someone else")
+	}
+
+	// an Encrypter without EncryptBoth has its ciphertext decoded instead
+	sess3, keys, err := NewSignedKeysSessionEncrypter(struct{ Encrypter }{kz}, ks)
+	if err != nil {
+		t.Fatal("failed to create session encrypter from a plain Encrypter: " + err.Error())
+	}
+
+	c, _ = sess3.Encrypt([]byte(INPUT))
+
+	if sess4, err := NewSignedKeysSessionDecrypter(kz, ks, keys); err != nil {
+		t.Error("failed to create session decrypter: ", err)
+	} else if p, err := sess4.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Error("failed to session decrypt: ", err)
+	}
+}
+
+func gzipJSONs(jsons []string, metadata bool) []string {
+	gz := append([]string(nil), jsons...)
+	for i := range gz {
+		if i == 0 && !metadata {
+			continue
+		}
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		w.Write([]byte(gz[i]))
+		w.Close()
+		gz[i] = b.String()
+	}
+	return gz
+}
+
+func TestGzipReader(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("gzipped", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+
+	jsons := km.ToJSONs(nil)
+
+	plain, _ := NewCrypter(jsonsReader(jsons))
+	c, _ := plain.Encrypt([]byte(INPUT))
+
+	for _, metadata := range []bool{false, true} {
+		gz := gzipJSONs(jsons, metadata)
+
+		newReader := NewGzipReader
+		if metadata {
+			newReader = NewGzipMetadataReader
+		}
+
+		kz, err := NewCrypter(newReader(jsonsReader(gz)))
+		if err != nil {
+			t.Fatal("failed to load gzipped keyset: " + err.Error())
+		}
+
+		if p, err := kz.Decrypt(c); err != nil || string(p) != INPUT {
+			t.Error("failed to decrypt with gzipped keyset: ", err)
+		}
+
+		gz[1] = gz[1][:len(gz[1])/2]
+		if _, err := NewCrypter(newReader(jsonsReader(gz))); !errors.Is(err, ErrDecompression) {
+			t.Error("unexpected error for truncated gzip: ", err)
+		}
+	}
+}
+
+func TestRejectEmptyPlaintext(t *testing.T) {
+	k, _ := generateAESKey(0)
+	kz, _ := NewCrypter(newImportedAESKeyReader(k))
+
+	// allowed by default
+	c, err := kz.Encrypt(nil)
+	if err != nil {
+		t.Fatal("failed to encrypt empty plaintext: " + err.Error())
+	}
+
+	kz.SetRejectEmptyPlaintext(true)
+
+	if _, err := kz.Encrypt([]byte{}); err != ErrEmptyPlaintext {
+		t.Error("Encrypt accepted an empty plaintext: ", err)
+	}
+	if _, err := kz.(BatchEncrypter).EncryptBatch([][]byte{[]byte(INPUT), nil}); err != ErrEmptyPlaintext {
+		t.Error("EncryptBatch accepted an empty plaintext: ", err)
+	}
+	if _, err := kz.EncryptWithNonce(nil, []byte("01234567")); err != ErrEmptyPlaintext {
+		t.Error("EncryptWithNonce accepted an empty plaintext: ", err)
+	}
+
+	// decrypting is unaffected
+	if p, err := kz.Decrypt(c); err != nil || len(p) != 0 {
+		t.Error("failed to decrypt empty plaintext: ", err)
+	}
+
+	if _, err := kz.Encrypt([]byte(INPUT)); err != nil {
+		t.Error("failed to encrypt: ", err)
+	}
+}
+
+func TestPBECrypterControllers(t *testing.T) {
+	for _, e := range []Encrypter{NewPBECrypter([]byte("pass")), NewPBEEncrypter([]byte("pass"))} {
+		e.SetRejectEmptyPlaintext(true)
+		if _, err := e.Encrypt(nil); err != ErrEmptyPlaintext {
+			t.Error("expected ErrEmptyPlaintext, got ", err)
+		}
+	}
+
+	c := NewPBECrypter([]byte("pass"))
+	ciphertext, _ := c.Encrypt([]byte(INPUT))
+
+	if _, err := c.EncryptWithNonce(nil, []byte("nonce-nonce")); err != nil {
+		t.Error("empty plaintext refused without RejectEmptyPlaintext: ", err)
+	}
+
+	c.SetMaxCiphertextBytes(len(ciphertext) - 1)
+	if _, err := c.Decrypt(ciphertext); err != ErrCiphertextTooLarge {
+		t.Error("expected ErrCiphertextTooLarge, got ", err)
+	}
+	c.SetMaxCiphertextBytes(0)
+
+	// the PBE format has no MAC
+	c.SetRequireAuthentication(true)
+	if _, err := c.Decrypt(ciphertext); err != ErrUnauthenticatedCiphertext {
+		t.Error("expected ErrUnauthenticatedCiphertext, got ", err)
+	}
+}
+
+func TestDSAP1363(t *testing.T) {
+	k, _ := generateDSAKey(0)
+	ks, _ := NewSigner(newImportedDSAPrivateKeyReader(&k.key))
+	ks.SetEncoding(NO_ENCODING)
+
+	kv, err := NewVerifier(newImportedDSAPublicKeyReader(&k.key.PublicKey), P1363Signatures())
+	if err != nil {
+		t.Fatal("failed to create verifier: " + err.Error())
+	}
+	kv.SetEncoding(NO_ENCODING)
+
+	sig, _ := ks.Sign([]byte(INPUT))
+	h, der := sig[:kzHeaderLength], []byte(sig[kzHeaderLength:])
+
+	p1363, err := DSASignatureToP1363(&k.key.PublicKey, der)
+	if err != nil {
+		t.Fatal("failed to convert signature: " + err.Error())
+	}
+
+	if len(p1363) != 2*(k.key.Q.BitLen()/8) {
+		t.Error("unexpected P1363 signature length: ", len(p1363))
+	}
+
+	if back, _ := DSASignatureFromP1363(&k.key.PublicKey, p1363); !bytes.Equal(back, der) {
+		t.Error("signature changed converting to P1363 and back")
+	}
+
+	if ok, err := kv.Verify([]byte(INPUT), h+string(p1363)); !ok || err != nil {
+		t.Error("failed to verify P1363 signature: ", err)
+	}
+
+	if ok, err := kv.Verify([]byte(INPUT), sig); !ok || err != nil {
+		t.Error("failed to verify DER signature: ", err)
+	}
+
+	if ok, _ := kv.Verify([]byte("wrong message"), h+string(p1363)); ok {
+		t.Error("verified P1363 signature for the wrong message")
+	}
+
+	// a plain Verifier only takes DER
+	if ok, _ := ks.Verify([]byte(INPUT), h+string(p1363)); ok {
+		t.Error("plain verifier accepted a P1363 signature")
+	}
+
+	// r and s must fit in the group order's length
+	r := new(big.Int).Lsh(big.NewInt(1), uint(k.key.Q.BitLen()))
+	oversized, _ := asn1.Marshal(dsaSignature{r, k.key.Q})
+	if _, err := DSASignatureToP1363(&k.key.PublicKey, oversized); err != ErrMalformedSignature {
+		t.Error("oversized r: expected ErrMalformedSignature, got ", err)
+	}
+}
+
+// a ContextKeyReader whose key server hangs until the context is done
+type hungReader struct {
+	jsonsReader
+}
+
+func (r hungReader) GetMetadataContext(ctx context.Context) (string, error) {
+	return r.GetMetadata()
+}
+
+func (r hungReader) GetKeyContext(ctx context.Context, version int) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func TestReloadContext(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("remote", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+
+	jsons := jsonsReader(km.ToJSONs(nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// local readers just check the context before reading
+	if _, err := NewCrypterContext(ctx, jsons); err != context.Canceled {
+		t.Error("loaded keys with a cancelled context: ", err)
+	}
+
+	kz, err := NewCrypterContext(context.Background(), jsons)
+	if err != nil {
+		t.Fatal("failed to create crypter: " + err.Error())
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// the deadline reaches through decorating readers
+	if _, err := NewVerifierContext(ctx, NewGzipReader(hungReader{jsons})); err != context.DeadlineExceeded {
+		t.Error("unexpected error from a hung key server: ", err)
+	}
+
+	if err := kz.ReloadContext(ctx); err != context.Canceled && err != context.DeadlineExceeded {
+		t.Error("reloaded with a done context: ", err)
+	}
+
+	if _, err := kz.Encrypt([]byte(INPUT)); err != nil {
+		t.Error("lost the keys after a failed reload: ", err)
+	}
+}
+
+func TestDSAParameterChecks(t *testing.T) {
+	k, _ := generateDSAKey(0)
+
+	load := func(key *dsa.PrivateKey) error {
+		_, err := NewVerifier(newImportedDSAPrivateKeyReader(key))
+		return err
+	}
+
+	if err := load(&k.key); err != nil {
+		t.Fatal("failed to load good DSA key: " + err.Error())
+	}
+
+	one := big.NewInt(1)
+
+	bad := map[string]func(key *dsa.PrivateKey){
+		"g of 1":             func(key *dsa.PrivateKey) { key.G = one },
+		"g outside group":    func(key *dsa.PrivateKey) { key.G = new(big.Int).Add(key.G, one) },
+		"q not dividing p-1": func(key *dsa.PrivateKey) { key.Q = new(big.Int).Add(key.Q, big.NewInt(2)) },
+		"short q":            func(key *dsa.PrivateKey) { key.Q = big.NewInt(65537) },
+		"y outside group":    func(key *dsa.PrivateKey) { key.Y = new(big.Int).Add(key.Y, one) },
+		"x out of range":     func(key *dsa.PrivateKey) { key.X = new(big.Int).Set(key.Q) },
+	}
+
+	for name, corrupt := range bad {
+		key := k.key
+		corrupt(&key)
+		if err := load(&key); !errors.Is(err, ErrInvalidDSAParameters) {
+			t.Error(name+": unexpected error: ", err)
+		}
+	}
+}
+
+func TestHeaderless(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("headerless", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	km.AddKey(0, S_PRIMARY)
+
+	kz, _ := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+	kz.SetEncoding(NO_ENCODING)
+
+	full, _ := kz.Encrypt([]byte(INPUT))
+
+	c, version, err := kz.(HeaderlessEncrypter).EncryptHeaderless([]byte(INPUT))
+	if err != nil {
+		t.Fatal("failed to encrypt: " + err.Error())
+	}
+
+	if version != 2 {
+		t.Error("expected the primary key version, got ", version)
+	}
+
+	if len(c) != len(full)-kzHeaderLength {
+		t.Error("unexpected headerless ciphertext length: ", len(c))
+	}
+
+	if p, err := kz.(HeaderlessDecrypter).DecryptHeaderless(c, version); err != nil || string(p) != INPUT {
+		t.Error("failed to decrypt headerless ciphertext: ", err)
+	}
+
+	if _, err := kz.(HeaderlessDecrypter).DecryptHeaderless(c, 1); !errors.Is(err, ErrInvalidSignature) {
+		t.Error("decrypted with the wrong key version: ", err)
+	}
+
+	if _, err := kz.(HeaderlessDecrypter).DecryptHeaderless(c, 3); !errors.Is(err, ErrNoSuchKeyVersion) {
+		t.Error("unexpected error for missing key version: ", err)
+	}
+
+	if _, err := kz.Decrypt(c); err == nil {
+		t.Error("Decrypt accepted a headerless ciphertext")
+	}
+}
+
+func TestSignCanonical(t *testing.T) {
+	k, _ := generateDSAKey(0)
+	ks, _ := NewSigner(newImportedDSAPrivateKeyReader(&k.key))
+
+	type claims struct {
+		Subject string `json:"sub"`
+		Admin   bool   `json:"admin"`
+		Note    string `json:"note"`
+	}
+
+	sig, err := SignCanonical(ks, claims{"alice", true, "<b>&</b>"}, nil)
+	if err != nil {
+		t.Fatal("failed to sign: " + err.Error())
+	}
+
+	// the same object from another producer, reordered and spaced out
+	received := json.RawMessage("{ \"note\": \"<b>&</b>\",\n  \"admin\": true, \"sub\": \"alice\" }")
+
+	if ok, err := VerifyCanonical(ks, received, sig, nil); !ok || err != nil {
+		t.Error("failed to verify canonical signature: ", err)
+	}
+
+	if b, _ := CanonicalJSON(received); string(b) != `{"admin":true,"note":"<b>&</b>","sub":"alice"}` {
+		t.Error("unexpected canonical form: ", string(b))
+	}
+
+	changed := json.RawMessage(`{"note":"<b>&</b>","admin":false,"sub":"alice"}`)
+	if ok, _ := VerifyCanonical(ks, changed, sig, nil); ok {
+		t.Error("verified a changed object")
+	}
+
+	// a custom canonicalizer must be used on both sides
+	upper := func(obj interface{}) ([]byte, error) {
+		b, err := CanonicalJSON(obj)
+		return bytes.ToUpper(b), err
+	}
+	if ok, _ := VerifyCanonical(ks, received, sig, upper); ok {
+		t.Error("verified with a different canonicalizer")
+	}
+}
+
+func TestPinnedReader(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("pinned", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	km.AddKey(0, S_PRIMARY)
+
+	jsons := km.ToJSONs(nil)
+
+	kz, _ := NewCrypter(jsonsReader(jsons))
+	ids := kz.(KeyIDLister).KeyIDs()
+
+	if _, err := NewCrypter(NewPinnedReader(jsonsReader(jsons), ids)); err != nil {
+		t.Error("failed to load pinned keyset: ", err)
+	}
+
+	if _, err := NewCrypter(NewPinnedReader(NewGzipReader(jsonsReader(gzipJSONs(jsons, false))), ids)); err != nil {
+		t.Error("failed to load pinned gzipped keyset: ", err)
+	}
+
+	_, err := NewCrypter(NewPinnedReader(jsonsReader(jsons), ids[1:]))
+	var kerr *KeyczarError
+	if !errors.As(err, &kerr) || kerr.Err != ErrUnexpectedKey || kerr.Version != 1 {
+		t.Error("unexpected error for unpinned key version 1: ", err)
+	}
+
+	other := NewKeyManager()
+	other.Create("other", P_DECRYPT_AND_ENCRYPT, T_AES)
+	other.AddKey(0, S_PRIMARY)
+
+	swapped := append([]string(nil), jsons...)
+	swapped[2] = other.ToJSONs(nil)[1]
+	if _, err := NewCrypter(NewPinnedReader(jsonsReader(swapped), ids)); !errors.Is(err, ErrUnexpectedKey) {
+		t.Error("loaded a swapped key: ", err)
+	}
+
+	// the newest pinned key has been removed
+	var meta keyMeta
+	json.Unmarshal([]byte(jsons[0]), &meta)
+	meta.Versions = meta.Versions[:1]
+	meta.Versions[0].Status = S_PRIMARY
+	b, _ := json.Marshal(meta)
+	removed := []string{string(b), jsons[1]}
+	if _, err := NewCrypter(jsonsReader(removed)); err != nil {
+		t.Fatal("failed to load keyset with a version removed: ", err)
+	}
+	if _, err := NewCrypter(NewPinnedReader(jsonsReader(removed), ids)); !errors.Is(err, ErrUnexpectedKey) {
+		t.Error("loaded a keyset missing a pinned key: ", err)
+	}
+
+	// the check starts again with each load, and loads sharing the reader don't disturb each other
+	pr := NewPinnedReader(jsonsReader(jsons), ids)
+	c, err := NewCrypter(pr)
+	if err != nil {
+		t.Fatal("failed to load pinned keyset: ", err)
+	}
+	if err := c.Reload(); err != nil {
+		t.Error("failed to reload pinned keyset: ", err)
+	}
+
+	errs := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func() { errs <- c.Reload() }()
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Error("failed to reload pinned keyset concurrently: ", err)
+		}
+	}
+}
+
+// an endless stream of the same byte, to make IVs repeatable
+type constReader byte
+
+func (r constReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = byte(r)
+	}
+	return len(b), nil
+}
+
+func TestWriteEncrypted(t *testing.T) {
+	realRand := rand.Reader
+	defer func() { rand.Reader = realRand }()
+
+	ak, _ := generateAESKey(0)
+	rk, _ := generateRSAKey(1024)
+
+	readers := map[string]KeyReader{
+		"aes": newImportedAESKeyReader(ak),
+		"rsa": newImportedRSAPrivateKeyReader(&rk.key, P_DECRYPT_AND_ENCRYPT),
+	}
+
+	for name, r := range readers {
+		kz, _ := NewCrypter(r)
+
+		for _, encoding := range []KeyczarEncoding{BASE64W, NO_ENCODING} {
+			kz.SetEncoding(encoding)
+
+			for _, n := range []int{0, 15, 16, writeChunkSize, 3*writeChunkSize + 5} {
+				if name == "rsa" && n > 64 {
+					continue
+				}
+
+				plaintext := bytes.Repeat([]byte{'x'}, n)
+
+				rand.Reader = constReader(7)
+				want, err := kz.Encrypt(plaintext)
+				if err != nil {
+					t.Fatal("failed to encrypt: " + err.Error())
+				}
+
+				rand.Reader = constReader(7)
+				var buf bytes.Buffer
+				if err := kz.WriteEncrypted(&buf, plaintext); err != nil {
+					t.Fatal("failed to write encrypted: " + err.Error())
+				}
+
+				// RSA encryption isn't guaranteed to be repeatable from the reader, so just check it decrypts
+				if name == "aes" && buf.String() != want {
+					t.Error(name, " ", n, " bytes: WriteEncrypted differs from Encrypt")
+				}
+
+				rand.Reader = realRand
+				if p, err := kz.Decrypt(buf.String()); err != nil || !bytes.Equal(p, plaintext) {
+					t.Error(name, " ", n, " bytes: failed to decrypt: ", err)
+				}
+			}
+		}
+	}
+}
+
+func TestCTRMode(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("ctr", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+
+	cbc, _ := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+	cbc.SetEncoding(NO_ENCODING)
+
+	if err := km.SetCipherMode(1, cmCTR); err != nil {
+		t.Fatal("failed to set CTR mode: " + err.Error())
+	}
+
+	kz, err := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+	if err != nil {
+		t.Fatal("failed to create CTR crypter: " + err.Error())
+	}
+	kz.SetEncoding(NO_ENCODING)
+
+	for _, n := range []int{0, 1, aes.BlockSize, singlePassMinLength + 3} {
+		plaintext := bytes.Repeat([]byte{'x'}, n)
+
+		c, err := kz.Encrypt(plaintext)
+		if err != nil {
+			t.Fatal("failed to encrypt: " + err.Error())
+		}
+
+		// no padding
+		if len(c) != kzHeaderLength+aes.BlockSize+n+hmacSigLength {
+			t.Error("unexpected CTR ciphertext length: ", len(c))
+		}
+
+		if p, err := kz.Decrypt(c); err != nil || !bytes.Equal(p, plaintext) {
+			t.Error("failed to decrypt ", n, " bytes: ", err)
+		}
+
+		b := []byte(c)
+		b[kzHeaderLength+aes.BlockSize/2] ^= 1
+		if _, err := kz.Decrypt(string(b)); !errors.Is(err, ErrInvalidSignature) {
+			t.Error("decrypted a corrupted CTR ciphertext: ", err)
+		}
+
+		if p, err := cbc.Decrypt(c); err == nil && bytes.Equal(p, plaintext) {
+			t.Error("CBC key decrypted a CTR ciphertext")
+		}
+	}
+}
+
+func TestCiphertextLen(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("sizes", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+
+	rk, _ := generateRSAKey(1024)
+	rsaCrypter, _ := NewCrypter(newImportedRSAPrivateKeyReader(&rk.key, P_DECRYPT_AND_ENCRYPT))
+
+	crypters := map[string]Crypter{"rsa": rsaCrypter}
+	for _, mode := range []cipherMode{cmCBC, cmCTR, cmGCM} {
+		km.SetCipherMode(1, mode)
+		crypters[mode.String()], _ = NewCrypter(jsonsReader(km.ToJSONs(nil)))
+	}
+	km.SetCipherMode(1, cmCBC)
+	km.SetHMACTagLength(1, 12)
+	crypters["truncated"], _ = NewCrypter(jsonsReader(km.ToJSONs(nil)))
+
+	for name, kz := range crypters {
+		for _, encoding := range []KeyczarEncoding{BASE64W, NO_ENCODING} {
+			kz.SetEncoding(encoding)
+			for _, n := range []int{0, 1, 15, 16, 17, 80} {
+				c, _ := kz.Encrypt(make([]byte, n))
+				if l := kz.CiphertextLen(n); l != len(c) {
+					t.Error(name, ": CiphertextLen(", n, ") = ", l, ", want ", len(c))
+				}
+			}
+		}
+	}
+
+	if l := crypters["CBC"].CiphertextLen(16); l != kzHeaderLength+16+32+hmacSigLength {
+		t.Error("aligned CBC plaintext didn't get a full block of padding: ", l)
+	}
+}
+
+func TestSignerIssuer(t *testing.T) {
+	k, _ := generateDSAKey(0)
+	r := newImportedDSAPrivateKeyReader(&k.key)
+
+	if _, err := NewSigner(r, WithIssuer(strings.Repeat("x", 256))); err != ErrIssuerTooLong {
+		t.Error("accepted an over-long issuer: ", err)
+	}
+
+	ks, err := NewSigner(r, WithIssuer("auth.example.com"))
+	if err != nil {
+		t.Fatal("failed to create signer: " + err.Error())
+	}
+
+	plain, _ := NewSigner(r)
+	kv, _ := NewVerifierFromDSAPublicKey(&k.key.PublicKey)
+
+	sig, err := ks.Sign([]byte(INPUT))
+	if err != nil {
+		t.Fatal("failed to sign: " + err.Error())
+	}
+
+	issuer, ok, err := kv.VerifyIssuer([]byte(INPUT), sig)
+	if !ok || err != nil || issuer != "auth.example.com" {
+		t.Error("failed to verify issuer signature: ", issuer, ok, err)
+	}
+
+	if ok, _ := kv.Verify([]byte(INPUT), sig); !ok {
+		t.Error("Verify rejected an issuer signature")
+	}
+
+	if _, ok, _ := kv.VerifyIssuer([]byte("wrong message"), sig); ok {
+		t.Error("verified issuer signature for the wrong message")
+	}
+
+	// the issuer is covered by the signature
+	b, _ := DecodeWeb64(sig)
+	b[kzHeaderLength+1] ^= 1
+	if _, ok, _ := kv.VerifyIssuer([]byte(INPUT), EncodeWeb64(b)); ok {
+		t.Error("verified a signature with a changed issuer")
+	}
+
+	// verifiers that only know the standard format see a bad version
+	if _, _, err := splitHeader(encodingController{}, kv.(*keySigner).keys(), sig, ErrShortSignature); err != ErrBadVersion {
+		t.Error("standard header parsing accepted an issuer signature: ", err)
+	}
+
+	sig, _ = plain.Sign([]byte(INPUT))
+	if issuer, ok, err := kv.VerifyIssuer([]byte(INPUT), sig); !ok || err != nil || issuer != "" {
+		t.Error("failed to verify standard signature: ", issuer, ok, err)
+	}
+}
+
+func TestNDJSONReader(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("ndjson", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	km.AddKey(0, S_PRIMARY)
+
+	jsons := km.ToJSONs(nil)
+
+	kz, _ := NewCrypter(jsonsReader(jsons))
+	c, _ := kz.Encrypt([]byte(INPUT))
+
+	keyString, _ := json.Marshal(jsons[2])
+	stream := jsons[0] + "\n" +
+		`{"version":1,"key":` + jsons[1] + "}\n\n" +
+		`{"version":2,"key":` + string(keyString) + "}\n"
+
+	r, err := NewNDJSONReader(strings.NewReader(stream))
+	if err != nil {
+		t.Fatal("failed to read NDJSON keyset: " + err.Error())
+	}
+
+	kn, err := NewCrypter(r)
+	if err != nil {
+		t.Fatal("failed to load NDJSON keyset: " + err.Error())
+	}
+
+	if p, err := kn.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Error("failed to decrypt with NDJSON keyset: ", err)
+	}
+
+	bad := map[string]string{
+		"empty":             "\n\n",
+		"bad metadata":      "[1,2]\n",
+		"missing version":   jsons[0] + "\n" + `{"key":` + jsons[1] + "}\n",
+		"duplicate version": jsons[0] + "\n" + `{"version":1,"key":` + jsons[1] + "}\n" + `{"version":1,"key":` + jsons[2] + "}\n",
+	}
+
+	for name, s := range bad {
+		if _, err := NewNDJSONReader(strings.NewReader(s)); !errors.Is(err, ErrMalformedKeyset) {
+			t.Error(name, ": unexpected error: ", err)
+		}
+	}
+}
+
+func TestKeysetContains(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("contains", P_SIGN_AND_VERIFY, T_DSA_PRIV)
+	km.AddKey(0, S_PRIMARY)
+
+	old := km.ToJSONs(nil)
+	oldPub := km.PubKeys().ToJSONs(nil)
+
+	km.AddKey(0, S_PRIMARY)
+	cur := km.PubKeys().ToJSONs(nil)
+
+	tests := []struct {
+		name             string
+		superset, subset []string
+		want             bool
+	}{
+		{"rotated", cur, oldPub, true},
+		{"private", old, oldPub, true},
+		{"self", cur, cur, true},
+		{"rollback", oldPub, cur, false},
+	}
+
+	for _, tt := range tests {
+		got, err := KeysetContains(jsonsReader(tt.superset), jsonsReader(tt.subset))
+		if err != nil {
+			t.Error(tt.name, ": ", err)
+		} else if got != tt.want {
+			t.Error(tt.name, ": got ", got, " want ", tt.want)
+		}
+	}
+
+	other := NewKeyManager()
+	other.Create("other", P_SIGN_AND_VERIFY, T_DSA_PRIV)
+	other.AddKey(0, S_PRIMARY)
+
+	if got, err := KeysetContains(jsonsReader(cur), jsonsReader(other.PubKeys().ToJSONs(nil))); err != nil || got {
+		t.Error("unrelated keyset reported as contained: ", got, err)
+	}
+}
+
+func TestDecryptWithVersion(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("withversion", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	km.AddKey(0, S_PRIMARY)
+
+	kz, _ := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+	kz.SetEncoding(NO_ENCODING)
+
+	c, _ := kz.Encrypt([]byte(INPUT))
+
+	// wreck the header: bad version byte and KeyID
+	b := []byte(c)
+	for i := 0; i < kzHeaderLength; i++ {
+		b[i] ^= 0xff
+	}
+	damaged := string(b)
+
+	if _, err := kz.Decrypt(damaged); err == nil {
+		t.Error("decrypted ciphertext with damaged header")
+	}
+
+	p, err := kz.DecryptWithVersion(damaged, 2)
+	if err != nil || string(p) != INPUT {
+		t.Error("failed to recover ciphertext with damaged header: ", err)
+	}
+
+	if _, err := kz.DecryptWithVersion(damaged, 1); !errors.Is(err, ErrInvalidSignature) {
+		t.Error("wrong key version: unexpected error: ", err)
+	}
+
+	if _, err := kz.DecryptWithVersion(damaged, 3); !errors.Is(err, ErrNoSuchKeyVersion) {
+		t.Error("missing key version: unexpected error: ", err)
+	}
+
+	if _, err := kz.DecryptWithVersion("abc", 2); !errors.Is(err, ErrShortCiphertext) {
+		t.Error("short ciphertext: unexpected error: ", err)
+	}
+}
+
+func TestGuessSignatureScheme(t *testing.T) {
+	for _, tt := range []struct {
+		ktype   keyType
+		purpose keyPurpose
+		want    string
+	}{
+		{T_DSA_PRIV, P_SIGN_AND_VERIFY, "DSA"},
+		{T_RSA_PRIV, P_SIGN_AND_VERIFY, "RSA"},
+		{T_HMAC_SHA1, P_SIGN_AND_VERIFY, "HMAC_SHA1"},
+		{T_ED25519_PRIV, P_SIGN_AND_VERIFY, "ED25519"},
+	} {
+		km := NewKeyManager()
+		km.Create("guess", tt.purpose, tt.ktype)
+		km.AddKey(0, S_PRIMARY)
+
+		s, _ := NewSigner(jsonsReader(km.ToJSONs(nil)))
+		s.SetEncoding(NO_ENCODING)
+
+		sig, err := s.Sign([]byte(INPUT))
+		if err != nil {
+			t.Fatal("failed to sign: " + err.Error())
+		}
+
+		if got := GuessSignatureScheme([]byte(sig)); got != tt.want {
+			t.Error(tt.ktype, ": got ", got, " want ", tt.want)
+		}
+
+		// without the header too
+		if got := GuessSignatureScheme([]byte(sig)[kzHeaderLength:]); got != tt.want {
+			t.Error(tt.ktype, " headerless: got ", got, " want ", tt.want)
+		}
+	}
+
+	if got := GuessSignatureScheme(nil); got != "unknown" {
+		t.Error("empty signature: got ", got)
+	}
+
+	// a headerless RSA signature that happens to start with the version byte
+	if got := GuessSignatureScheme(make([]byte, 128)); got != "RSA" {
+		t.Error("headerless RSA signature starting with 0: got ", got)
+	}
+}
+
+func TestMinKeySize(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("minsize", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(128, S_ACTIVE)
+	km.AddKey(256, S_PRIMARY)
+
+	r := jsonsReader(km.ToJSONs(nil))
+
+	if _, err := NewCrypter(r, CrypterMinKeySize(KeySizePolicy{T_AES: 128})); err != nil {
+		t.Error("AES-128 rejected by 128-bit policy: ", err)
+	}
+
+	_, err := NewCrypter(r, CrypterMinKeySize(KeySizePolicy{T_AES: 256}))
+	var kerr *KeyczarError
+	if !errors.As(err, &kerr) || kerr.Err != ErrKeyTooWeak || kerr.Version != 1 {
+		t.Error("AES-128 accepted by 256-bit policy: ", err)
+	}
+
+	if _, err := NewCrypter(r, CrypterMinKeySize(KeySizePolicy{T_RSA_PRIV: 4096})); err != nil {
+		t.Error("AES keyset checked against RSA policy: ", err)
+	}
+
+	sm := NewKeyManager()
+	sm.Create("minsize", P_SIGN_AND_VERIFY, T_RSA_PRIV)
+	sm.AddKey(1024, S_PRIMARY)
+
+	if _, err := NewSigner(jsonsReader(sm.ToJSONs(nil)), SignerMinKeySize(KeySizePolicy{T_RSA_PRIV: 2048})); !errors.Is(err, ErrKeyTooWeak) {
+		t.Error("RSA-1024 signer: unexpected error: ", err)
+	}
+
+	// a policy on the private type covers the public keys too
+	if err := (KeySizePolicy{T_RSA_PRIV: 2048}).check(mustKeyczar(t, sm.PubKeys().ToJSONs(nil))); !errors.Is(err, ErrKeyTooWeak) {
+		t.Error("RSA-1024 public key: unexpected error: ", err)
+	}
+}
+
+func mustKeyczar(t *testing.T, jsons []string) *keyczar {
+	kz, err := newKeyczar(jsonsReader(jsons))
+	if err != nil {
+		t.Fatal("failed to load keyset: " + err.Error())
+	}
+	return kz
+}
+
+func TestRewrapKeyset(t *testing.T) {
+	oldKey, _ := generateAESKey(0)
+	newKey, _ := generateAESKey(0)
+
+	oldCrypter, _ := NewCrypter(newImportedAESKeyReader(oldKey))
+	newCrypter, _ := NewCrypter(newImportedAESKeyReader(newKey))
+
+	km := NewKeyManager()
+	km.Create("rewrap", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_ACTIVE)
+	km.AddKey(0, S_PRIMARY)
+
+	base := jsonsReader(km.ToJSONs(oldCrypter))
+
+	kz, _ := NewCrypter(NewEncryptedReader(base, oldCrypter))
+	c, _ := kz.Encrypt([]byte(INPUT))
+
+	var rewrapped jsonsReader
+	if err := RewrapKeyset(base, oldCrypter, newCrypter, &rewrapped); err != nil {
+		t.Fatal("failed to rewrap keyset: " + err.Error())
+	}
+
+	if len(rewrapped) != len(base) || rewrapped[0] != base[0] {
+		t.Error("rewrapped keyset has different metadata or versions")
+	}
+
+	if _, err := NewCrypter(NewEncryptedReader(rewrapped, oldCrypter)); err == nil {
+		t.Error("rewrapped keyset still loads with the old crypter")
+	}
+
+	kn, err := NewCrypter(NewEncryptedReader(rewrapped, newCrypter))
+	if err != nil {
+		t.Fatal("failed to load rewrapped keyset: " + err.Error())
+	}
+
+	if p, err := kn.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Error("rewrapped keyset failed to decrypt: ", err)
+	}
+
+	// the wrong crypter writes nothing
+	var untouched jsonsReader
+	if err := RewrapKeyset(rewrapped, oldCrypter, newCrypter, &untouched); err == nil {
+		t.Error("rewrapped with the wrong old crypter")
+	}
+	if len(untouched) != 0 {
+		t.Error("failed rewrap wrote to the writer")
+	}
+
+	if err := RewrapKeyset(jsonsReader(km.ToJSONs(nil)), oldCrypter, newCrypter, &untouched); err == nil {
+		t.Error("rewrapped an unencrypted keyset")
+	}
+}
+
+func TestSignMulti(t *testing.T) {
+	k, _ := generateDSAKey(0)
+	ks, _ := NewSigner(newImportedDSAPrivateKeyReader(&k.key))
+
+	sig, err := SignMulti(ks, []byte("ab"), []byte("c"))
+	if err != nil {
+		t.Fatal("failed to sign: " + err.Error())
+	}
+
+	if ok, err := VerifyMulti(ks, sig, []byte("ab"), []byte("c")); !ok || err != nil {
+		t.Error("failed to verify multi-part signature: ", err)
+	}
+
+	for _, parts := range [][][]byte{
+		{[]byte("a"), []byte("bc")},
+		{[]byte("abc")},
+		{[]byte("c"), []byte("ab")},
+		{[]byte("ab"), []byte("c"), nil},
+	} {
+		if ok, _ := VerifyMulti(ks, sig, parts...); ok {
+			t.Errorf("verified with different parts %q", parts)
+		}
+	}
+
+	// and it's not the same as signing the concatenation
+	if ok, _ := ks.Verify([]byte("abc"), sig); ok {
+		t.Error("multi-part signature verified as a plain one")
+	}
+}
+
+func TestPrimaryVersion(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("versions", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	km.AddKey(0, S_ACTIVE)
+	km.AddKey(0, S_PRIMARY)
+	km.AddKey(0, S_INACTIVE)
+	km.AddKey(0, S_ACTIVE)
+
+	ks, err := NewSigner(jsonsReader(km.ToJSONs(nil)))
+	if err != nil {
+		t.Fatal("failed to load signer: " + err.Error())
+	}
+
+	if v, err := ks.PrimaryVersion(); v != 2 || err != nil {
+		t.Error("unexpected primary version: ", v, err)
+	}
+
+	if got := ks.ActiveVersions(); len(got) != 3 || got[0] != 2 || got[1] != 1 || got[2] != 4 {
+		t.Error("unexpected active versions: ", got)
+	}
+
+	km.Demote(2)
+
+	kv, err := NewVerifier(jsonsReader(km.ToJSONs(nil)))
+	if err != nil {
+		t.Fatal("failed to load verifier: " + err.Error())
+	}
+
+	if _, err := kv.PrimaryVersion(); !errors.Is(err, ErrNoPrimaryKey) {
+		t.Error("keyset without a primary: unexpected error: ", err)
+	}
+}
+
+func TestSIVMode(t *testing.T) {
+	// RFC 5297, appendix A.1
+	key, _ := hex.DecodeString("fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff")
+	ad, _ := hex.DecodeString("101112131415161718191a1b1c1d1e1f2021222324252627")
+	plaintext, _ := hex.DecodeString("112233445566778899aabbccddee")
+
+	s, err := (&aesKey{key: key, mode: cmSIV}).newSession()
+	if err != nil {
+		t.Fatal("failed to create SIV session: " + err.Error())
+	}
+
+	v := sivS2V(s.s2v, ad, plaintext)
+	if hex.EncodeToString(v) != "85632d07c6e8f37f950acd320a2ecc93" {
+		t.Error("unexpected synthetic iv: ", hex.EncodeToString(v))
+	}
+
+	c := make([]byte, len(plaintext))
+	sivCTR(s.block, v).XORKeyStream(c, plaintext)
+	if hex.EncodeToString(c) != "40c02b9690c4dc04daef7f6afe5c" {
+		t.Error("unexpected ciphertext: ", hex.EncodeToString(c))
+	}
+
+	km := NewKeyManager()
+	km.Create("siv", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(128, S_PRIMARY)
+	km.AddKey(256, S_PRIMARY)
+
+	if err := km.SetCipherMode(1, cmSIV); err != ErrInvalidKeySize {
+		t.Error("accepted SIV mode for a 128-bit key: ", err)
+	}
+
+	if err := km.SetCipherMode(2, cmSIV); err != nil {
+		t.Fatal("failed to set SIV mode: " + err.Error())
+	}
+
+	kz, err := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+	if err != nil {
+		t.Fatal("failed to create SIV crypter: " + err.Error())
+	}
+	kz.SetEncoding(NO_ENCODING)
+
+	for _, input := range []string{"", "short", INPUT, strings.Repeat("sixteen bytes!!!", 4)} {
+		c1, err := kz.Encrypt([]byte(input))
+		if err != nil {
+			t.Fatal("failed to encrypt: " + err.Error())
+		}
+
+		if c2, _ := kz.Encrypt([]byte(input)); c1 != c2 {
+			t.Error("SIV encryption isn't deterministic")
+		}
+
+		if len(c1) != kz.CiphertextLen(len(input)) {
+			t.Error("unexpected ciphertext length: ", len(c1))
+		}
+
+		if p, err := kz.Decrypt(c1); err != nil || string(p) != input {
+			t.Error("failed to decrypt SIV ciphertext: ", err)
+		}
+
+		b := []byte(c1)
+		b[len(b)-1] ^= 1
+		if _, err := kz.Decrypt(string(b)); !errors.Is(err, ErrInvalidSignature) {
+			t.Error("decrypted a corrupted SIV ciphertext: ", err)
+		}
+	}
+
+	// a 128-bit key can't be loaded in SIV mode
+	jsons := km.ToJSONs(nil)
+	jsons[1] = strings.Replace(jsons[1], `"mode":"CBC"`, `"mode":"SIV"`, 1)
+	if _, err := NewCrypter(jsonsReader(jsons)); !errors.Is(err, ErrInvalidKeySize) {
+		t.Error("loaded a 128-bit SIV key: ", err)
+	}
+}
+
+func TestVerifyCache(t *testing.T) {
+	k, _ := generateDSAKey(0)
+	ks, _ := NewSigner(newImportedDSAPrivateKeyReader(&k.key))
+
+	sigs := make([]string, 3)
+	for i := range sigs {
+		sigs[i], _ = ks.Sign([]byte(INPUT + strconv.Itoa(i)))
+	}
+
+	kv, err := NewVerifier(newImportedDSAPublicKeyReader(&k.key.PublicKey), WithVerifyCache(2))
+	if err != nil {
+		t.Fatal("failed to create verifier: " + err.Error())
+	}
+
+	verify := func(i int, sig string, want bool) {
+		t.Helper()
+		if ok, err := kv.Verify([]byte(INPUT+strconv.Itoa(i)), sig); ok != want || err != nil {
+			t.Error("message ", i, ": got ", ok, err, " want ", want)
+		}
+	}
+
+	cached := func(i int, sig string) bool {
+		vc := kv.(*keySigner).keys().verified
+		_, ok := vc.entries[verifyCacheKey(kv.Encoding(), []byte(INPUT+strconv.Itoa(i)), sig)]
+		return ok
+	}
+
+	verify(0, sigs[0], true)
+	if !cached(0, sigs[0]) {
+		t.Error("valid signature wasn't cached")
+	}
+	verify(0, sigs[0], true)
+
+	// invalid signatures are never cached
+	verify(1, sigs[0], false)
+	if cached(1, sigs[0]) {
+		t.Error("invalid signature was cached")
+	}
+
+	// 0 was used last, so 1 is evicted when 2 comes in
+	verify(1, sigs[1], true)
+	verify(0, sigs[0], true)
+	verify(2, sigs[2], true)
+	if !cached(0, sigs[0]) || cached(1, sigs[1]) || !cached(2, sigs[2]) {
+		t.Error("unexpected eviction")
+	}
+
+	kv.Reload()
+	if cached(0, sigs[0]) || cached(2, sigs[2]) {
+		t.Error("cache survived reload")
+	}
+	verify(2, sigs[2], true)
+
+	// without the option nothing is cached
+	plain, _ := NewVerifier(newImportedDSAPublicKeyReader(&k.key.PublicKey))
+	if plain.(*keySigner).keys().verified != nil {
+		t.Error("cache without WithVerifyCache")
+	}
+}
+
+func TestExport(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("export", P_SIGN_AND_VERIFY, T_RSA_PRIV)
+	km.AddKey(1024, S_ACTIVE)
+	km.AddKey(1024, S_PRIMARY)
+
+	ks, _ := NewSigner(jsonsReader(km.ToJSONs(nil)))
+	sig, _ := ks.Sign([]byte(INPUT))
+
+	dir := t.TempDir()
+	if err := km.Export(NewFileWriter(dir)); err != nil {
+		t.Fatal("failed to export keyset: " + err.Error())
+	}
+
+	kv, err := NewVerifier(NewFileReader(dir))
+	if err != nil {
+		t.Fatal("failed to load exported keyset: " + err.Error())
+	}
+
+	if ok, err := kv.Verify([]byte(INPUT), sig); !ok || err != nil {
+		t.Error("failed to verify with exported keyset: ", err)
+	}
+
+	// the exported files are exactly what ToJSONs produces
+	var exported jsonsReader
+	km.Export(&exported)
+	for i, s := range km.ToJSONs(nil) {
+		if exported[i] != s {
+			t.Error("exported file ", i, " differs from ToJSONs")
+		}
+	}
+
+	// exporting a keyset that was loaded encrypted leaves the manager's metadata alone
+	k, _ := generateAESKey(0)
+	cr, _ := NewCrypter(newImportedAESKeyReader(k))
+	enc := NewKeyManager()
+	if err := enc.Load(NewEncryptedReader(jsonsReader(km.ToJSONs(cr)), cr)); err != nil {
+		t.Fatal("failed to load encrypted keyset: " + err.Error())
+	}
+	var plain jsonsReader
+	if err := enc.Export(&plain); err != nil {
+		t.Fatal("failed to export encrypted keyset: " + err.Error())
+	}
+	if !enc.(*keyManager).kz.keymeta.Encrypted {
+		t.Error("Export cleared the manager's encrypted flag")
+	}
+	if _, err := NewVerifier(plain); err != nil {
+		t.Error("failed to load keyset exported from an encrypted one: " + err.Error())
+	}
+}
+
+func TestDeriveCrypter(t *testing.T) {
+	// RFC 5869, test case 1
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	if okm, err := hkdfSHA256(ikm, salt, info, 42); err != nil {
+		t.Error("HKDF failed: ", err)
+	} else if hex.EncodeToString(okm) != "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865" {
+		t.Error("unexpected HKDF output: ", hex.EncodeToString(okm))
+	}
+	if _, err := hkdfSHA256(ikm, salt, info, 255*32+1); err == nil {
+		t.Error("HKDF output past 255 hash lengths should fail")
+	}
+
+	km := NewKeyManager()
+	km.Create("derive", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_ACTIVE)
+	km.AddKey(0, S_PRIMARY)
+
+	master, _ := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+
+	alice, err := master.(CrypterDeriver).DeriveCrypter([]byte("alice"))
+	if err != nil {
+		t.Fatal("failed to derive crypter: " + err.Error())
+	}
+	bob, _ := master.(CrypterDeriver).DeriveCrypter([]byte("bob"))
+	alice2, _ := master.(CrypterDeriver).DeriveCrypter([]byte("alice"))
+
+	c, _ := alice.Encrypt([]byte(INPUT))
+
+	if p, err := alice2.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Error("same label failed to decrypt: ", err)
+	}
+
+	if !reflect.DeepEqual(alice.(KeyIDLister).KeyIDs(), alice2.(KeyIDLister).KeyIDs()) {
+		t.Error("derived KeyIDs aren't stable")
+	}
+
+	if _, err := bob.Decrypt(c); err == nil {
+		t.Error("decrypted under another label")
+	}
+	if _, err := master.Decrypt(c); err == nil {
+		t.Error("decrypted with the master keys")
+	}
+
+	if v, _ := alice.PrimaryVersion(); v != 2 {
+		t.Error("derived crypter has the wrong primary: ", v)
+	}
+
+	sm := NewKeyManager()
+	sm.Create("rsa", P_DECRYPT_AND_ENCRYPT, T_RSA_PRIV)
+	sm.AddKey(1024, S_PRIMARY)
+	rc, _ := NewCrypter(jsonsReader(sm.ToJSONs(nil)))
+	if _, err := rc.(CrypterDeriver).DeriveCrypter([]byte("alice")); !errors.Is(err, ErrUnsupportedType) {
+		t.Error("derived from an RSA keyset: ", err)
+	}
+}
+
+func TestAcceptRSAHashes(t *testing.T) {
+	rk, _ := generateRSAKey(1024)
+	pub := rk.publicKey.key
+
+	digest := sha256.Sum256([]byte(INPUT))
+	raw, err := rsa.SignPKCS1v15(rand.Reader, &rk.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal("failed to sign: " + err.Error())
+	}
+	sig := EncodeWeb64(raw)
+
+	plain, _ := NewVerifierFromRSAPublicKey(&pub)
+	if ok, _ := plain.UnversionedVerify([]byte(INPUT), sig); ok {
+		t.Error("default verifier accepted a SHA-256 signature")
+	}
+
+	kv, err := NewVerifier(newImportedRSAPublicKeyReader(&pub, P_VERIFY), AcceptRSAHashes(crypto.SHA256, crypto.SHA512))
+	if err != nil {
+		t.Fatal("failed to create verifier: " + err.Error())
+	}
+
+	if ok, err := kv.UnversionedVerify([]byte(INPUT), sig); !ok || err != nil {
+		t.Error("failed to verify SHA-256 signature: ", err)
+	}
+
+	if ok, _ := kv.UnversionedVerify([]byte(INPUT+"x"), sig); ok {
+		t.Error("verified SHA-256 signature over the wrong message")
+	}
+
+	// the usual SHA-1 signatures still verify
+	ks, _ := NewSigner(newImportedRSAPrivateKeyReader(&rk.key, P_SIGN_AND_VERIFY))
+	s1, _ := ks.Sign([]byte(INPUT))
+	if ok, err := kv.Verify([]byte(INPUT), s1); !ok || err != nil {
+		t.Error("failed to verify SHA-1 signature: ", err)
+	}
+
+	if _, err := NewVerifier(newImportedRSAPublicKeyReader(&pub, P_VERIFY), AcceptRSAHashes(crypto.MD5)); err != ErrUnsupportedHash {
+		t.Error("accepted MD5: ", err)
+	}
+}
+
+func TestStrictIVs(t *testing.T) {
+	crypters := make(map[cipherMode]Crypter)
+	for _, mode := range []cipherMode{cmCBC, cmCTR, cmGCM} {
+		km := NewKeyManager()
+		km.Create("ivs", P_DECRYPT_AND_ENCRYPT, T_AES)
+		km.AddKey(0, S_PRIMARY)
+		km.SetCipherMode(1, mode)
+		crypters[mode], _ = NewCrypter(jsonsReader(km.ToJSONs(nil)), StrictIVs())
+	}
+
+	km := NewKeyManager()
+	km.Create("ivs", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	r := jsonsReader(km.ToJSONs(nil))
+	lax, _ := NewCrypter(r)
+	strict, _ := NewCrypter(r, StrictIVs())
+
+	realRand := rand.Reader
+	defer func() { rand.Reader = realRand }()
+
+	// a stuck random source hands out the same iv every time
+	rand.Reader = constReader(7)
+
+	for i := 0; i < 2; i++ {
+		if _, err := lax.Encrypt([]byte(INPUT)); err != nil {
+			t.Error("repeated iv refused without StrictIVs: ", err)
+		}
+	}
+
+	for mode, kz := range crypters {
+		if _, err := kz.Encrypt([]byte(INPUT)); err != nil {
+			t.Error(mode, ": first encrypt failed: ", err)
+		}
+		if _, err := kz.Encrypt([]byte("other")); err != ErrIVReused {
+			t.Error(mode, ": expected ErrIVReused, got ", err)
+		}
+	}
+
+	// the ivs used so far are kept across a reload, and are separate from other Crypters'
+	if _, err := strict.Encrypt([]byte(INPUT)); err != nil {
+		t.Error("iv used by another Crypter refused: ", err)
+	}
+	strict.Reload()
+	if _, err := strict.Encrypt([]byte(INPUT)); err != ErrIVReused {
+		t.Error("after reload: expected ErrIVReused, got ", err)
+	}
+}
+
+func TestSupportedKeyTypes(t *testing.T) {
+	types := SupportedKeyTypes()
+	if len(types) != len(keyTypeInfo) {
+		t.Fatal("unexpected number of key types: ", len(types))
+	}
+
+	for _, kt := range types {
+		if kt.Name != kt.Type.String() {
+			t.Error(kt.Type, ": unexpected name ", kt.Name)
+		}
+		for _, size := range kt.Sizes {
+			if !kt.Type.isAcceptableSize(size) {
+				t.Error(kt.Type, ": size ", size, " isn't acceptable")
+			}
+		}
+		if !kt.Type.isAcceptableSize(kt.DefaultSize) || len(kt.Purposes) == 0 {
+			t.Error(kt.Type, ": bad default size or purposes")
+		}
+	}
+
+	// every private type can make a keyset for each of its purposes
+	for _, kt := range types {
+		if !kt.Type.isPrivate() {
+			continue
+		}
+		for _, purpose := range kt.Purposes {
+			km := NewKeyManager()
+			km.Create("supported", purpose, kt.Type)
+			if err := km.AddKey(kt.Sizes[len(kt.Sizes)-1], S_PRIMARY); err != nil {
+				t.Error(kt.Type, " ", purpose, ": ", err)
+				continue
+			}
+			if _, err := newKeyczar(jsonsReader(km.ToJSONs(nil))); err != nil {
+				t.Error(kt.Type, " ", purpose, ": failed to load: ", err)
+			}
+		}
+	}
+
+	types[0].Sizes[0] = 1
+	if SupportedKeyTypes()[0].Sizes[0] == 1 {
+		t.Error("SupportedKeyTypes shares the size table")
+	}
+}
+
+func TestFooter(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("footer", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+
+	kz, _ := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+	kz.SetEncoding(NO_ENCODING)
+
+	footer := []byte("2026-10-15T00:00:00Z")
+
+	c, err := kz.(FooterCrypter).EncryptWithFooter([]byte(INPUT), footer)
+	if err != nil {
+		t.Fatal("failed to encrypt: " + err.Error())
+	}
+
+	// the footer is readable in place
+	if !strings.Contains(c, string(footer)) {
+		t.Error("footer isn't in the clear")
+	}
+
+	p, f, err := kz.(FooterCrypter).DecryptWithFooter(c)
+	if err != nil || string(p) != INPUT || !bytes.Equal(f, footer) {
+		t.Error("failed to decrypt with footer: ", err)
+	}
+
+	if _, err := kz.Decrypt(c); !errors.Is(err, ErrBadVersion) {
+		t.Error("Decrypt accepted a ciphertext with a footer: ", err)
+	}
+
+	plain, _ := kz.Encrypt([]byte(INPUT))
+	if _, _, err := kz.(FooterCrypter).DecryptWithFooter(plain); !errors.Is(err, ErrBadVersion) {
+		t.Error("DecryptWithFooter accepted a ciphertext without a footer: ", err)
+	}
+
+	// the version byte is signed, so putting back the standard one doesn't help
+	b := []byte(c)
+	b[0] = kzVersion
+	if _, err := kz.Decrypt(string(b)); err == nil {
+		t.Error("Decrypt accepted a footer ciphertext with its version changed: ", err)
+	}
+
+	b = []byte(c)
+	b[strings.Index(c, string(footer))] ^= 1
+	if _, _, err := kz.(FooterCrypter).DecryptWithFooter(string(b)); !errors.Is(err, ErrInvalidSignature) {
+		t.Error("decrypted with a changed footer: ", err)
+	}
+
+	if p, f, err := kz.(FooterCrypter).DecryptWithFooter(mustEncryptWithFooter(t, kz, nil)); err != nil || string(p) != INPUT || len(f) != 0 {
+		t.Error("failed with an empty footer: ", err)
+	}
+
+	if _, err := kz.(FooterCrypter).EncryptWithFooter([]byte(INPUT), make([]byte, maxFooterLength+1)); err != ErrFooterTooLong {
+		t.Error("expected ErrFooterTooLong, got ", err)
+	}
+
+	// CTR has no padding to fail, so only the version byte stops Decrypt returning garbage
+	km.SetCipherMode(1, cmCTR)
+	ctr, _ := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+	ctr.SetEncoding(NO_ENCODING)
+	c = mustEncryptWithFooter(t, ctr, footer)
+	if p, f, err := ctr.(FooterCrypter).DecryptWithFooter(c); err != nil || string(p) != INPUT || !bytes.Equal(f, footer) {
+		t.Error("failed to decrypt with footer in CTR mode: ", err)
+	}
+	if _, err := ctr.Decrypt(c); !errors.Is(err, ErrBadVersion) {
+		t.Error("Decrypt accepted a ciphertext with a footer in CTR mode: ", err)
+	}
+	b = []byte(c)
+	b[0] = kzVersion
+	if _, err := ctr.Decrypt(string(b)); !errors.Is(err, ErrInvalidSignature) {
+		t.Error("Decrypt accepted a footer ciphertext with its version changed in CTR mode: ", err)
+	}
+	plain, _ = ctr.Encrypt([]byte(INPUT))
+	if _, _, err := ctr.(FooterCrypter).DecryptWithFooter(plain); !errors.Is(err, ErrBadVersion) {
+		t.Error("DecryptWithFooter accepted a ciphertext without a footer in CTR mode: ", err)
+	}
+
+	km.SetCipherMode(1, cmGCM)
+	gcm, _ := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+	if _, err := gcm.(FooterCrypter).EncryptWithFooter([]byte(INPUT), footer); !errors.Is(err, ErrUnsupportedCipherMode) {
+		t.Error("added a footer in GCM mode: ", err)
+	}
+}
+
+func mustEncryptWithFooter(t *testing.T, kz Crypter, footer []byte) string {
+	c, err := kz.(FooterCrypter).EncryptWithFooter([]byte(INPUT), footer)
+	if err != nil {
+		t.Fatal("failed to encrypt: " + err.Error())
+	}
+	return c
+}
+
+func TestEd25519(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("ed25519", P_SIGN_AND_VERIFY, T_ED25519_PRIV)
+	if err := km.AddKey(0, S_PRIMARY); err != nil {
+		t.Fatal("failed to generate key: ", err)
+	}
+
+	r := jsonsReader(km.ToJSONs(nil))
+
+	signer, err := NewSigner(r)
+	if err != nil {
+		t.Fatal("failed to create signer: ", err)
+	}
+	signer.SetEncoding(NO_ENCODING)
+
+	sig, err := signer.Sign([]byte(INPUT))
+	if err != nil {
+		t.Fatal("failed to sign: ", err)
+	}
+
+	if len(sig) != kzHeaderLength+64 {
+		t.Error("unexpected signature length: ", len(sig))
+	}
+
+	if info, err := InspectSignature([]byte(sig)); err != nil || info.Algorithm != "ED25519" || info.ExpectedLength != 64 {
+		t.Error("ed25519 signature not recognized: ", info, err)
+	}
+
+	// the public keys verify, whether exported or taken from the private keyset
+	pub := km.PubKeys()
+	for _, r := range []KeyReader{jsonsReader(pub.ToJSONs(nil)), r} {
+		verifier, err := NewVerifier(r)
+		if err != nil {
+			t.Fatal("failed to create verifier: ", err)
+		}
+		verifier.SetEncoding(NO_ENCODING)
+
+		if ok, err := verifier.Verify([]byte(INPUT), sig); !ok || err != nil {
+			t.Error("failed to verify: ", err)
+		}
+
+		if ok, _ := verifier.Verify([]byte(INPUT+"x"), sig); ok {
+			t.Error("verified a changed message")
+		}
+
+		if ok, err := verifier.VerifyReader(strings.NewReader(INPUT), sig); !ok || err != nil {
+			t.Error("failed to verify from a reader: ", err)
+		}
+	}
+
+	// private and public keys agree on the id, and it covers the public key
+	k := signer.(*keySigner).keys().getPrimaryKey().(*ed25519Key)
+	if !bytes.Equal(k.KeyID(), pub.(*keyManager).kz.keys[1].KeyID()) {
+		t.Error("private and public key ids differ")
+	}
+
+	if err := ValidateKeyset(r); err != nil {
+		t.Error("keyset failed validation: ", err)
+	}
+
+	// a public key that doesn't match the seed is rejected
+	var kj ed25519KeyJSON
+	json.Unmarshal([]byte(r[1]), &kj)
+	other, _ := generateEd25519Key(0)
+	kj.PublicKey.PublicKeyString = encodeWeb64String(other.publicKey.key)
+	b, _ := json.Marshal(kj)
+	if _, err := newEd25519KeyFromJSON(b); !errors.Is(err, ErrKeyCheckFailed) {
+		t.Error("loaded a key with the wrong public key: ", err)
+	}
+
+	if _, err := generateEd25519Key(512); err != ErrInvalidKeySize {
+		t.Error("expected ErrInvalidKeySize, got ", err)
+	}
+}
+
+func TestDeprecationPolicy(t *testing.T) {
+
+	legacy := NewKeyManager()
+	legacy.Create("legacy", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	legacy.AddKey(0, S_PRIMARY)
+	signer, _ := NewSigner(jsonsReader(legacy.ToJSONs(nil)))
+	sig, _ := signer.Sign([]byte(INPUT))
+
+	for _, kt := range []keyType{T_HMAC_SHA1, T_DSA_PRIV} {
+		km := NewKeyManager()
+		km.Create("deprecated", P_SIGN_AND_VERIFY, kt)
+		km.SetDeprecationPolicy(DeprecationPolicy{SHA1Signatures: true})
+		if err := km.AddKey(0, S_PRIMARY); err != ErrDeprecatedAlgorithm {
+			t.Error(kt, ": expected ErrDeprecatedAlgorithm, got ", err)
+		}
+	}
+
+	// existing SHA-1 keys still load and verify
+	km := NewKeyManager()
+	km.SetDeprecationPolicy(DeprecationPolicy{SHA1Signatures: true})
+	if err := km.Load(jsonsReader(legacy.ToJSONs(nil))); err != nil {
+		t.Fatal("failed to load legacy keyset: ", err)
+	}
+	verifier, _ := NewVerifier(jsonsReader(km.ToJSONs(nil)))
+	if ok, err := verifier.Verify([]byte(INPUT), sig); !ok || err != nil {
+		t.Error("failed to verify with legacy key: ", err)
+	}
+
+	// new RSA signing keys use PSS, and can't be switched back
+	km = NewKeyManager()
+	km.Create("rsa", P_SIGN_AND_VERIFY, T_RSA_PRIV)
+	km.SetDeprecationPolicy(DeprecationPolicy{SHA1Signatures: true})
+	if err := km.AddKey(1024, S_PRIMARY); err != nil {
+		t.Fatal("failed to add RSA key: ", err)
+	}
+	if km.(*keyManager).kz.keys[1].(*rsaKey).publicKey.scheme != SS_PSS {
+		t.Error("new RSA signing key doesn't use PSS")
+	}
+	if err := km.SetSignatureScheme(1, SS_PKCS1_V15, 0); err != ErrDeprecatedAlgorithm {
+		t.Error("expected ErrDeprecatedAlgorithm, got ", err)
+	}
+
+	// RSA encryption keys are unaffected
+	km = NewKeyManager()
+	km.Create("rsa", P_DECRYPT_AND_ENCRYPT, T_RSA_PRIV)
+	km.SetDeprecationPolicy(DeprecationPolicy{SHA1Signatures: true})
+	if err := km.AddKey(1024, S_PRIMARY); err != nil {
+		t.Error("failed to add RSA encryption key: ", err)
+	}
+}
+
+func TestTranslateSigned(t *testing.T) {
+
+	newSigner := func(name string) (Signer, Verifier) {
+		km := NewKeyManager()
+		km.Create(name, P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+		km.AddKey(0, S_PRIMARY)
+		r := jsonsReader(km.ToJSONs(nil))
+		s, _ := NewSigner(r)
+		v, _ := NewVerifier(r)
+		return s, v
+	}
+
+	inSigner, inVerifier := newSigner("inbound")
+	outSigner, outVerifier := newSigner("outbound")
+
+	blob, _ := inSigner.AttachedSign([]byte(INPUT), nil)
+
+	out, err := TranslateSigned(blob, inVerifier, outSigner)
+	if err != nil {
+		t.Fatal("failed to translate: ", err)
+	}
+
+	if msg, err := outVerifier.AttachedVerify(out, nil); err != nil || string(msg) != INPUT {
+		t.Error("translated signature doesn't verify: ", err)
+	}
+
+	if _, err := inVerifier.AttachedVerify(out, nil); err == nil {
+		t.Error("translated signature verifies in the inbound domain")
+	}
+
+	// a blob signed by the wrong domain isn't passed on
+	if _, err := TranslateSigned(out, inVerifier, outSigner); !errors.Is(err, ErrKeyNotFound) && !errors.Is(err, ErrInvalidSignature) {
+		t.Error("translated a blob from the wrong domain: ", err)
+	}
+}
+
+func TestWrappedJSONReader(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("wrapped", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_ACTIVE)
+	km.AddKey(0, S_PRIMARY)
+	js := km.ToJSONs(nil)
+
+	c, _ := NewCrypter(jsonsReader(js))
+	ciphertext, _ := c.Encrypt([]byte(INPUT))
+
+	// keys inline as objects, and as strings
+	docs := []string{
+		`{"meta":` + js[0] + `,"data":{"1":` + js[1] + `,"2":` + js[2] + `}}`,
+		`{"meta":` + strconv.Quote(js[0]) + `,"data":{"1":` + strconv.Quote(js[1]) + `,"2":` + strconv.Quote(js[2]) + `}}`,
+	}
+
+	for i, doc := range docs {
+		r, err := NewWrappedJSONReader(doc)
+		if err != nil {
+			t.Fatal(i, ": failed to read: ", err)
+		}
+		c, err := NewCrypter(r)
+		if err != nil {
+			t.Fatal(i, ": failed to create crypter: ", err)
+		}
+		if p, err := c.Decrypt(ciphertext); err != nil || string(p) != INPUT {
+			t.Error(i, ": failed to decrypt: ", err)
+		}
+	}
+
+	for _, doc := range []string{
+		`{"data":{"1":` + js[1] + `}}`,
+		`{"meta":` + js[0] + `,"data":{"one":` + js[1] + `}}`,
+		`{"meta":` + js[0] + `,"data":{"01":` + js[1] + `}}`,
+		`{"meta":` + js[0] + `,"data":{"1":1}}`,
+		`[` + js[0] + `]`,
+	} {
+		if _, err := NewWrappedJSONReader(doc); !errors.Is(err, ErrMalformedKeyset) {
+			t.Error("expected ErrMalformedKeyset for ", doc[:20], ", got ", err)
+		}
+	}
+}
+
+func TestCrypterMagic(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("magic", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	r := jsonsReader(km.ToJSONs(nil))
+
+	plain, _ := NewCrypter(r)
+
+	for _, encoding := range []KeyczarEncoding{BASE64W, NO_ENCODING} {
+		kz, err := NewCrypter(r, CrypterMagic("DKZ1:"))
+		if err != nil {
+			t.Fatal("failed to create crypter: ", err)
+		}
+		kz.SetEncoding(encoding)
+		plain.SetEncoding(encoding)
+
+		c, _ := kz.Encrypt([]byte(INPUT))
+		if !strings.HasPrefix(c, "DKZ1:") {
+			t.Error(encoding, ": ciphertext doesn't start with the magic")
+		}
+
+		if len(c) != kz.CiphertextLen(len(INPUT)) {
+			t.Error(encoding, ": CiphertextLen doesn't count the magic")
+		}
+
+		if p, err := kz.Decrypt(c); err != nil || string(p) != INPUT {
+			t.Error(encoding, ": failed to decrypt: ", err)
+		}
+
+		var buf bytes.Buffer
+		kz.WriteEncrypted(&buf, []byte(INPUT))
+		if p, err := kz.Decrypt(buf.String()); err != nil || string(p) != INPUT {
+			t.Error(encoding, ": failed to decrypt from WriteEncrypted: ", err)
+		}
+
+		// the magic is outside the Keyczar format
+		if p, err := plain.Decrypt(strings.TrimPrefix(c, "DKZ1:")); err != nil || string(p) != INPUT {
+			t.Error(encoding, ": stripped ciphertext didn't decrypt: ", err)
+		}
+
+		c2, _ := plain.Encrypt([]byte(INPUT))
+		if _, err := kz.Decrypt(c2); !errors.Is(err, ErrBadMagic) {
+			t.Error(encoding, ": expected ErrBadMagic, got ", err)
+		}
+	}
+}
+
+func TestVerifyInactiveKey(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("rotated", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	km.AddKey(0, S_PRIMARY)
+
+	signer, _ := NewSigner(jsonsReader(km.ToJSONs(nil)))
+	sig, _ := signer.Sign([]byte(INPUT))
+
+	// rotate: a new primary, and the old key demoted all the way to inactive
+	km.AddKey(0, S_PRIMARY)
+	km.Demote(1)
+
+	if s := km.(*keyManager).kz.keymeta.Versions[0].Status; s != S_INACTIVE {
+		t.Fatal("old key wasn't demoted to inactive: ", s)
+	}
+
+	verifier, err := NewVerifier(jsonsReader(km.ToJSONs(nil)))
+	if err != nil {
+		t.Fatal("failed to load verifier: ", err)
+	}
+
+	if ok, err := verifier.Verify([]byte(INPUT), sig); !ok || err != nil {
+		t.Error("signature from an inactive key didn't verify: ", err)
+	}
+}
+
+func TestCiphertextEqual(t *testing.T) {
+
+	newCrypter := func(mode cipherMode) Crypter {
+		km := NewKeyManager()
+		km.Create("equal", P_DECRYPT_AND_ENCRYPT, T_AES)
+		km.AddKey(256, S_PRIMARY)
+		km.SetCipherMode(1, mode)
+		kz, _ := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+		kz.SetEncoding(NO_ENCODING)
+		return kz
+	}
+
+	siv := newCrypter(cmSIV)
+	a, _ := siv.Encrypt([]byte(INPUT))
+	b, _ := siv.Encrypt([]byte(INPUT))
+	c, _ := siv.Encrypt([]byte(INPUT + "!"))
+
+	if !CiphertextEqual([]byte(a), []byte(b)) {
+		t.Error("SIV ciphertexts of the same plaintext aren't equal")
+	}
+
+	if CiphertextEqual([]byte(a), []byte(c)) {
+		t.Error("SIV ciphertexts of different plaintexts are equal")
+	}
+
+	other, _ := newCrypter(cmSIV).Encrypt([]byte(INPUT))
+	if CiphertextEqual([]byte(a), []byte(other)) {
+		t.Error("ciphertexts from different keys are equal")
+	}
+
+	cbc := newCrypter(cmCBC)
+	d, _ := cbc.Encrypt([]byte(INPUT))
+	e, _ := cbc.Encrypt([]byte(INPUT))
+	if CiphertextEqual([]byte(d), []byte(e)) {
+		t.Error("CBC ciphertexts with random ivs are equal")
+	}
+
+	if CiphertextEqual([]byte(a)[:3], []byte(a)[:3]) {
+		t.Error("truncated headers are equal")
+	}
+}
+
+func TestSignReader(t *testing.T) {
+
+	msg := bytes.Repeat([]byte(INPUT), 5000)
+
+	for _, kt := range []keyType{T_HMAC_SHA1, T_DSA_PRIV, T_RSA_PRIV, T_ED25519_PRIV} {
+		km := NewKeyManager()
+		km.Create("reader", P_SIGN_AND_VERIFY, kt)
+		size := uint(0)
+		if kt == T_RSA_PRIV {
+			size = 1024
+		}
+		km.AddKey(size, S_PRIMARY)
+		r := jsonsReader(km.ToJSONs(nil))
+
+		for _, opts := range [][]SignerOption{nil, {WithIssuer("proxy")}} {
+			signer, _ := NewSigner(r, opts...)
+
+			sr, err := signer.(ReaderSigner).SignReader(bytes.NewReader(msg))
+			if err != nil {
+				t.Fatal(kt, ": failed to create signing reader: ", err)
+			}
+
+			if _, err := sr.Signature(); err != ErrIncompleteRead {
+				t.Error(kt, ": expected ErrIncompleteRead, got ", err)
+			}
+
+			var out bytes.Buffer
+			if _, err := io.Copy(&out, sr); err != nil || !bytes.Equal(out.Bytes(), msg) {
+				t.Fatal(kt, ": data changed in passing: ", err)
+			}
+
+			sig, err := sr.Signature()
+			if err != nil {
+				t.Fatal(kt, ": failed to sign: ", err)
+			}
+
+			if again, _ := sr.Signature(); again != sig {
+				t.Error(kt, ": signature changed on a second call")
+			}
+
+			issuer, ok, err := signer.VerifyIssuer(msg, sig)
+			if !ok || err != nil {
+				t.Error(kt, ": signature from reader didn't verify: ", err)
+			}
+			if opts != nil && issuer != "proxy" {
+				t.Error(kt, ": unexpected issuer ", issuer)
+			}
+
+			// HMAC signatures are deterministic, so they match Sign exactly
+			if kt == T_HMAC_SHA1 {
+				if direct, _ := signer.Sign(msg); direct != sig {
+					t.Error("signature from reader differs from Sign")
+				}
+			}
+		}
+	}
+}
+
+func TestFileReaderBOM(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("bom", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	js := km.ToJSONs(nil)
+
+	dir := t.TempDir()
+	os.WriteFile(dir+"/meta", []byte("\ufeff"+js[0]+"\r\n"), 0600)
+	os.WriteFile(dir+"/1", []byte("\ufeff  "+js[1]+"\r\n\r\n"), 0600)
+
+	kz, err := NewCrypter(NewFileReader(dir))
+	if err != nil {
+		t.Fatal("failed to load keyset with byte order marks: ", err)
+	}
+
+	c, _ := NewCrypter(jsonsReader(js))
+	ciphertext, _ := c.Encrypt([]byte(INPUT))
+	if p, err := kz.Decrypt(ciphertext); err != nil || string(p) != INPUT {
+		t.Error("failed to decrypt: ", err)
+	}
+}
+
+func TestCreateWithPrimary(t *testing.T) {
+	km := NewKeyManager()
+	if err := km.Create("bootstrap", P_DECRYPT_AND_ENCRYPT, T_AES, S_PRIMARY); err != nil {
+		t.Fatal("failed to create keyset: ", err)
+	}
+
+	kz, err := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+	if err != nil {
+		t.Fatal("failed to load keyset: ", err)
+	}
+
+	c, err := kz.Encrypt([]byte(INPUT))
+	if err != nil {
+		t.Fatal("failed to encrypt: ", err)
+	}
+	if p, err := kz.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Error("failed to decrypt: ", err)
+	}
+
+	km.Create("two", P_SIGN_AND_VERIFY, T_HMAC_SHA1, S_ACTIVE, S_PRIMARY)
+	ks, _ := NewSigner(jsonsReader(km.ToJSONs(nil)))
+	if v, err := ks.PrimaryVersion(); v != 2 || err != nil || len(ks.ActiveVersions()) != 2 {
+		t.Error("unexpected versions: ", v, err, ks.ActiveVersions())
+	}
+
+	if err := km.Create("public", P_VERIFY, T_RSA_PUB, S_PRIMARY); err != ErrUnsupportedType {
+		t.Error("expected ErrUnsupportedType, got ", err)
+	}
+}
+
+func TestDecryptDetailed(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("detailed", P_DECRYPT_AND_ENCRYPT, T_AES, S_PRIMARY)
+
+	old, _ := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+	c, _ := old.Encrypt([]byte(INPUT))
+
+	km.AddKey(0, S_PRIMARY)
+	kz, _ := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+
+	r, err := kz.(DetailedDecrypter).DecryptDetailed(c)
+	if err != nil {
+		t.Fatal("failed to decrypt: ", err)
+	}
+
+	if string(r.Plaintext) != INPUT || r.Version != kzVersion || r.KeyVersion != 1 || !r.Authenticated || r.Footer != nil {
+		t.Error("unexpected result: ", r)
+	}
+
+	if !bytes.Equal(r.KeyID, kz.(KeyIDLister).KeyIDs()[0]) {
+		t.Error("unexpected key id: ", r.KeyID)
+	}
+
+	if _, err := kz.(DetailedDecrypter).DecryptDetailed(c[:len(c)-2]); err == nil {
+		t.Error("decrypted a truncated ciphertext")
+	}
+
+	kz.SetMaxCiphertextBytes(10)
+	if _, err := kz.(DetailedDecrypter).DecryptDetailed(c); !errors.Is(err, ErrCiphertextTooLarge) {
+		t.Error("expected ErrCiphertextTooLarge, got ", err)
+	}
+	kz.SetMaxCiphertextBytes(0)
+
+	c, _ = kz.(FooterCrypter).EncryptWithFooter([]byte(INPUT), []byte("footer"))
+	r, err = kz.(DetailedDecrypter).DecryptDetailed(c)
+	if err != nil || string(r.Plaintext) != INPUT || string(r.Footer) != "footer" || r.Version != kzFooterVersion || r.KeyVersion != 2 {
+		t.Error("unexpected result with a footer: ", r, err)
+	}
+
+	km = NewKeyManager()
+	km.Create("detailed", P_DECRYPT_AND_ENCRYPT, T_RSA_PRIV, S_PRIMARY)
+	rk, _ := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+	c, _ = rk.Encrypt([]byte(INPUT))
+
+	r, err = rk.(DetailedDecrypter).DecryptDetailed(c)
+	if err != nil || string(r.Plaintext) != INPUT || r.Authenticated {
+		t.Error("unexpected result for RSA: ", r, err)
+	}
+}
+
+func TestMalformedCiphertext(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("malformed", P_DECRYPT_AND_ENCRYPT, T_AES, S_PRIMARY)
+
+	kz, _ := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+	kz.SetEncoding(NO_ENCODING)
+
+	c, _ := kz.Encrypt([]byte(INPUT))
+
+	if _, err := kz.Decrypt(c[:len(c)-3]); !errors.Is(err, ErrMalformedCiphertext) {
+		t.Error("truncated ciphertext: expected ErrMalformedCiphertext, got ", err)
+	}
+
+	// header, iv and tag with no ciphertext blocks at all
+	if _, err := kz.Decrypt(c[:kzHeaderLength+16] + c[len(c)-hmacSigLength:]); !errors.Is(err, ErrMalformedCiphertext) {
+		t.Error("empty ciphertext: expected ErrMalformedCiphertext, got ", err)
+	}
+
+	b := []byte(c)
+	b[len(b)-1] ^= 1
+	if _, err := kz.Decrypt(string(b)); !errors.Is(err, ErrInvalidSignature) {
+		t.Error("bad tag: expected ErrInvalidSignature, got ", err)
+	}
+
+	// in CTR mode any length is possible, so only the MAC can tell
+	km.SetCipherMode(1, cmCTR)
+	ctr, _ := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+	ctr.SetEncoding(NO_ENCODING)
+	c, _ = ctr.Encrypt([]byte(INPUT))
+	if _, err := ctr.Decrypt(c[:len(c)-3]); !errors.Is(err, ErrInvalidSignature) {
+		t.Error("truncated CTR ciphertext: expected ErrInvalidSignature, got ", err)
+	}
+}
+
+func TestHMACDigestMigration(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("migrate", P_SIGN_AND_VERIFY, T_HMAC_SHA1, S_PRIMARY)
+
+	oldSigner, _ := NewSigner(jsonsReader(km.ToJSONs(nil)))
+	oldSig, _ := oldSigner.Sign([]byte(INPUT))
+
+	// the same key material under SHA-256 must get a different id
+	hk := km.(*keyManager).kz.keys[1].(*hmacKey)
+	sha256Key := &hmacKey{key: hk.key, digest: HD_SHA256}
+	if bytes.Equal(hk.KeyID(), sha256Key.KeyID()) {
+		t.Error("KeyID doesn't depend on the digest")
+	}
+
+	// step 1: an active SHA-256 key, which verifiers learn about first
+	km.AddKey(0, S_ACTIVE)
+	if err := km.SetHMACDigest(2, HD_SHA256); err != nil {
+		t.Fatal("failed to set digest: ", err)
+	}
+
+	// step 2: promote it, so signers switch over
+	km.Promote(2)
+
+	r := jsonsReader(km.ToJSONs(nil))
+	signer, err := NewSigner(r)
+	if err != nil {
+		t.Fatal("failed to load migrated keyset: ", err)
+	}
+	signer.SetEncoding(NO_ENCODING)
+	newSig, _ := signer.Sign([]byte(INPUT))
+	if len(newSig) != kzHeaderLength+sha256.Size {
+		t.Error("new signature isn't HMAC-SHA256: ", len(newSig))
+	}
+	if info, err := InspectSignature([]byte(newSig)); err != nil || info.Algorithm != "HMAC_SHA256" {
+		t.Error("HMAC-SHA256 signature not recognized: ", info, err)
+	}
+	if got := GuessSignatureScheme([]byte(newSig)); got != "HMAC_SHA256" {
+		t.Error("HMAC-SHA256 signature guessed as ", got)
+	}
+	signer.SetEncoding(BASE64W)
+	newSig, _ = signer.Sign([]byte(INPUT))
+
+	verifier, _ := NewVerifier(r)
+	for _, sig := range []string{oldSig, newSig} {
+		if ok, err := verifier.Verify([]byte(INPUT), sig); !ok || err != nil {
+			t.Error("failed to verify during migration: ", err)
+		}
+	}
+
+	if err := km.SetHMACDigest(2, hmacDigest(7)); err != ErrUnsupportedHash {
+		t.Error("expected ErrUnsupportedHash, got ", err)
+	}
+
+	// once SHA-1 is deprecated, keys can't be switched back
+	km.SetDeprecationPolicy(DeprecationPolicy{SHA1Signatures: true})
+	if err := km.SetHMACDigest(2, HD_SHA1); err != ErrDeprecatedAlgorithm {
+		t.Error("expected ErrDeprecatedAlgorithm, got ", err)
+	}
+	if err := km.SetHMACDigest(2, HD_SHA256); err != nil {
+		t.Error("failed to keep SHA-256 under the policy: ", err)
+	}
+
+	// an unknown digest isn't mistaken for SHA-1
+	js := km.ToJSONs(nil)
+	js[2] = strings.Replace(js[2], `"digest":"SHA256"`, `"digest":"SHA512"`, 1)
+	if _, err := NewVerifier(jsonsReader(js)); !errors.Is(err, ErrUnsupportedHash) {
+		t.Error("loaded an HMAC key with an unknown digest: ", err)
+	}
+
+	// AES keys always use HMAC-SHA1
+	aes := NewKeyManager()
+	aes.Create("aes", P_DECRYPT_AND_ENCRYPT, T_AES, S_PRIMARY)
+	if err := aes.SetHMACDigest(1, HD_SHA256); err != ErrUnsupportedType {
+		t.Error("expected ErrUnsupportedType, got ", err)
+	}
+	js = aes.ToJSONs(nil)
+	js[1] = strings.Replace(js[1], `"hmacKeyString"`, `"digest":"SHA256","hmacKeyString"`, 1)
+	if _, err := NewCrypter(jsonsReader(js)); !errors.Is(err, ErrUnsupportedHash) {
+		t.Error("loaded an AES key with a SHA-256 HMAC: ", err)
+	}
+}
+
+func TestMaxVerifyAttempts(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("candidates", P_SIGN_AND_VERIFY, T_HMAC_SHA1, S_PRIMARY, S_ACTIVE, S_ACTIVE)
+
+	// give every version the same key, so they all match any signature's KeyID
+	js := km.ToJSONs(nil)
+	js[2], js[3] = js[1], js[1]
+	r := jsonsReader(js)
+
+	signer, _ := NewSigner(r)
+	sig, _ := signer.Sign([]byte(INPUT))
+	tsig, _ := signer.TimeoutSign([]byte(INPUT), currentMillis()+60000)
+	asig, _ := signer.AttachedSign([]byte(INPUT), nil)
+
+	v, err := NewVerifier(r, MaxVerifyAttempts(2))
+	if err != nil {
+		t.Fatal("failed to load verifier: ", err)
+	}
+
+	// a good signature verifies with the first candidate
+	if ok, err := v.Verify([]byte(INPUT), sig); !ok || err != nil {
+		t.Error("failed to verify: ", err)
+	}
+
+	if ok, err := v.Verify([]byte("forged"), sig); ok || !errors.Is(err, ErrTooManyCandidates) {
+		t.Error("expected ErrTooManyCandidates, got ", ok, err)
+	}
+	if ok, err := v.TimeoutVerify([]byte("forged"), tsig); ok || !errors.Is(err, ErrTooManyCandidates) {
+		t.Error("TimeoutVerify: expected ErrTooManyCandidates, got ", ok, err)
+	}
+	if _, err := v.AttachedVerify(asig, []byte("nonce")); !errors.Is(err, ErrTooManyCandidates) {
+		t.Error("AttachedVerify: expected ErrTooManyCandidates, got ", err)
+	}
+	if ok, err := v.VerifyReader(strings.NewReader("forged"), sig); ok || !errors.Is(err, ErrTooManyCandidates) {
+		t.Error("VerifyReader: expected ErrTooManyCandidates, got ", ok, err)
+	}
+
+	if _, err := NewVerifier(r, WithIssuer("signer")); err != ErrSignerOnlyOption {
+		t.Error("expected ErrSignerOnlyOption, got ", err)
+	}
+
+	// without a limit, a bad signature is just invalid
+	unlimited, _ := NewVerifier(r)
+	if ok, err := unlimited.Verify([]byte("forged"), sig); ok || err != nil {
+		t.Error("expected an invalid signature, got ", ok, err)
+	}
+
+	// a limit of one doesn't affect an ordinary keyset
+	plain := NewKeyManager()
+	plain.Create("plain", P_SIGN_AND_VERIFY, T_HMAC_SHA1, S_PRIMARY, S_ACTIVE)
+	pr := jsonsReader(plain.ToJSONs(nil))
+	ps, _ := NewSigner(pr)
+	psig, _ := ps.Sign([]byte(INPUT))
+	pv, _ := NewVerifier(pr, MaxVerifyAttempts(1))
+	if ok, err := pv.Verify([]byte(INPUT), psig); !ok || err != nil {
+		t.Error("failed to verify: ", err)
+	}
+	if ok, err := pv.Verify([]byte("forged"), psig); ok || err != nil {
+		t.Error("expected an invalid signature, got ", ok, err)
+	}
+
+	// without a KeyID every key is a candidate, and the primary must always be among those tried
+	many := NewKeyManager()
+	many.Create("unversioned", P_SIGN_AND_VERIFY, T_HMAC_SHA1, S_INACTIVE, S_ACTIVE, S_PRIMARY, S_ACTIVE)
+	mr := jsonsReader(many.ToJSONs(nil))
+	ms, _ := NewSigner(mr)
+	usig, _ := ms.UnversionedSign([]byte(INPUT))
+	mv, _ := NewVerifier(mr, MaxVerifyAttempts(1))
+	for i := 0; i < 50; i++ {
+		if ok, err := mv.UnversionedVerify([]byte(INPUT), usig); !ok || err != nil {
+			t.Fatal("failed to verify an unversioned signature from the primary key: ", ok, err)
+		}
+	}
+
+	kz := mv.(*keySigner).keys()
+	var order []int
+	for _, k := range kz.verifyOrder() {
+		for version, vk := range kz.keys {
+			if vk == k {
+				order = append(order, version)
+			}
+		}
+	}
+	if !reflect.DeepEqual(order, []int{3, 4, 2, 1}) {
+		t.Error("unexpected unversioned verify order: ", order)
+	}
+}
+
+func TestEncryptJSON(t *testing.T) {
+	type record struct {
+		Name  string
+		Cards []string
+	}
+	in := record{Name: "alice", Cards: []string{strings.Repeat("4111", 64)}}
+
+	km := NewKeyManager()
+	km.Create("json", P_DECRYPT_AND_ENCRYPT, T_AES, S_PRIMARY)
+	c, _ := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+
+	for _, comp := range []KeyczarCompression{NO_COMPRESSION, GZIP} {
+		c.SetCompression(comp)
+
+		blob, err := EncryptJSON(c, in)
+		if err != nil {
+			t.Fatal("failed to encrypt: ", err)
+		}
+		if bytes.Contains(blob, []byte("alice")) {
+			t.Error("plaintext in the ciphertext")
+		}
+
+		var out record
+		if err := DecryptJSON(c, blob, &out); err != nil {
+			t.Fatal("failed to decrypt: ", err)
+		}
+		if out.Name != in.Name || len(out.Cards) != 1 || out.Cards[0] != in.Cards[0] {
+			t.Error("round trip failed: ", out)
+		}
+
+		// the same as marshalling and decrypting by hand
+		plaintext, err := c.Decrypt(string(blob))
+		if err != nil {
+			t.Fatal("failed to decrypt: ", err)
+		}
+		js, _ := json.Marshal(in)
+		if !bytes.Equal(plaintext, js) {
+			t.Error("plaintext isn't the marshalled value: ", string(plaintext))
+		}
+	}
+
+	c.SetCompression(NO_COMPRESSION)
+	raw, _ := EncryptJSON(c, in)
+	c.SetCompression(GZIP)
+	gz, _ := EncryptJSON(c, in)
+	if len(gz) >= len(raw) {
+		t.Error("compression not applied: ", len(gz), len(raw))
+	}
+
+	if _, err := EncryptJSON(c, make(chan int)); err == nil {
+		t.Error("encrypted a value that can't be marshalled")
+	}
+
+	notJSON, _ := c.Encrypt([]byte("not json"))
+	var out record
+	if err := DecryptJSON(c, []byte(notJSON), &out); err == nil {
+		t.Error("unmarshalled a plaintext that isn't JSON")
+	}
+}
+
+func TestSharedHMACKey(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("shared", P_DECRYPT_AND_ENCRYPT, T_AES, S_ACTIVE)
+	km.RotateAESKey(1, S_PRIMARY)
+
+	embedded := km.ToJSONs(nil)
+	c, _ := NewCrypter(jsonsReader(embedded))
+	ciphertext, _ := c.Encrypt([]byte(INPUT))
+
+	// version 2 shares version 1's HMAC key: write it as a legacy reference instead
+	var aj aesKeyJSON
+	json.Unmarshal([]byte(embedded[2]), &aj)
+	legacy := append([]string(nil), embedded...)
+	legacy[2] = `{"aesKeyString":"` + aj.AESKeyString + `","size":128,"hmacKeyVersion":1,"mode":"CBC"}`
+
+	lc, err := NewCrypter(jsonsReader(legacy))
+	if err != nil {
+		t.Fatal("failed to load keyset with a shared HMAC key: ", err)
+	}
+	if p, err := lc.Decrypt(ciphertext); err != nil || string(p) != INPUT {
+		t.Error("failed to decrypt: ", err)
+	}
+	if !bytes.Equal(lc.(KeyIDLister).KeyIDs()[1], c.(KeyIDLister).KeyIDs()[1]) {
+		t.Error("KeyID depends on how the HMAC key is stored")
+	}
+
+	pinned, err := NewCrypter(NewPinnedReader(jsonsReader(legacy), c.(KeyIDLister).KeyIDs()))
+	if err != nil {
+		t.Error("pinned reader rejected a shared HMAC key: ", err)
+	} else if p, err := pinned.Decrypt(ciphertext); err != nil || string(p) != INPUT {
+		t.Error("failed to decrypt: ", err)
+	}
+
+	// a KeyManager writes the HMAC key back into each version
+	lkm := NewKeyManager()
+	if err := lkm.Load(jsonsReader(legacy)); err != nil {
+		t.Fatal("failed to load: ", err)
+	}
+	if js := lkm.ToJSONs(nil); js[2] != embedded[2] {
+		t.Error("shared HMAC key not written out embedded: ", js[2])
+	}
+
+	for _, ref := range []string{`"hmacKeyVersion":3`, `"hmacKeyVersion":2`, `"hmacKeyVersion":-1`} {
+		bad := append([]string(nil), legacy...)
+		bad[2] = strings.Replace(bad[2], `"hmacKeyVersion":1`, ref, 1)
+		_, err := NewCrypter(jsonsReader(bad))
+		var kerr *KeyczarError
+		if !errors.As(err, &kerr) || kerr.Version != 2 || kerr.Field != "hmacKeyVersion" {
+			t.Error(ref, ": expected an error for version 2, got ", err)
+		}
+	}
+}
+
+func TestVerifyTimeoutDetailed(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("timeout", P_SIGN_AND_VERIFY, T_HMAC_SHA1, S_PRIMARY)
+	r := jsonsReader(km.ToJSONs(nil))
+
+	signer, _ := NewSigner(r)
+	expiration := int64(1500000000000)
+	sig, _ := signer.TimeoutSign([]byte(INPUT), expiration)
+
+	now := expiration - 1
+	v, _ := NewVerifierTimeProvider(r, func() int64 { return now })
+
+	exp, valid, err := v.VerifyTimeoutDetailed([]byte(INPUT), sig)
+	if !valid || err != nil || exp != expiration {
+		t.Error("unexpired: got ", exp, valid, err)
+	}
+
+	now = expiration + 3600000
+	exp, valid, err = v.VerifyTimeoutDetailed([]byte(INPUT), sig)
+	if valid || err != ErrSignatureExpired || exp != expiration {
+		t.Error("expired: got ", exp, valid, err)
+	}
+	if valid, err := v.TimeoutVerify([]byte(INPUT), sig); valid || err != nil {
+		t.Error("TimeoutVerify of an expired signature: got ", valid, err)
+	}
+
+	// a forged signature doesn't give up its timestamp
+	exp, valid, err = v.VerifyTimeoutDetailed([]byte("forged"), sig)
+	if valid || err != nil || exp != 0 {
+		t.Error("forged: got ", exp, valid, err)
+	}
+}
+
+func TestMixedSizeAESKeyset(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("strengthened", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(128, S_PRIMARY)
+
+	old, _ := NewCrypter(jsonsReader(km.ToJSONs(nil)))
+	oldCiphertext, _ := old.Encrypt([]byte(INPUT))
+	oldStream, _ := NewStreamCrypter(jsonsReader(km.ToJSONs(nil)))
+	var oldStreamed bytes.Buffer
+	oldStream.EncryptStream(&oldStreamed, strings.NewReader(INPUT))
+
+	// upgrade in place: the 256-bit key becomes primary, and the 128-bit one stays to decrypt
+	km.AddKey(192, S_ACTIVE)
+	km.AddKey(256, S_PRIMARY)
+
+	r := jsonsReader(km.ToJSONs(nil))
+	c, err := NewCrypter(r)
+	if err != nil {
+		t.Fatal("failed to load mixed-size keyset: ", err)
+	}
+
+	ciphertext, _ := c.Encrypt([]byte(INPUT))
+	if len(ciphertext) != c.CiphertextLen(len(INPUT)) {
+		t.Error("CiphertextLen disagrees with Encrypt")
+	}
+
+	for _, ct := range []string{oldCiphertext, ciphertext} {
+		res, err := c.(DetailedDecrypter).DecryptDetailed(ct)
+		if err != nil || string(res.Plaintext) != INPUT {
+			t.Fatal("failed to decrypt: ", err)
+		}
+		if ct == ciphertext && res.KeyVersion != 3 {
+			t.Error("didn't encrypt with the 256-bit primary: ", res.KeyVersion)
+		}
+		if ct == oldCiphertext && res.KeyVersion != 1 {
+			t.Error("old ciphertext decrypted with version ", res.KeyVersion)
+		}
+	}
+
+	ids := c.(KeyIDLister).KeyIDs()
+	if bytes.Equal(ids[0], ids[1]) || bytes.Equal(ids[1], ids[2]) || bytes.Equal(ids[0], ids[2]) {
+		t.Error("key ids collide across sizes")
+	}
+
+	sc, _ := NewStreamCrypter(r)
+	var out bytes.Buffer
+	if err := sc.DecryptStream(&out, &oldStreamed); err != nil || out.String() != INPUT {
+		t.Error("failed to decrypt an old stream: ", err)
+	}
+
+	if err := ValidateKeyset(r); err != nil {
+		t.Error("mixed-size keyset failed validation: ", err)
+	}
+
+	// a size policy applies to each key, not just the primary
+	if _, err := NewCrypter(r, CrypterMinKeySize(KeySizePolicy{T_AES: 256})); !errors.Is(err, ErrKeyTooWeak) {
+		t.Error("expected ErrKeyTooWeak, got ", err)
+	}
+
+	// a key whose material isn't the size it declares is rejected
+	js := km.ToJSONs(nil)
+	js[1] = strings.Replace(js[1], `"size":128`, `"size":256`, 1)
+	var kerr *KeyczarError
+	if _, err := NewCrypter(jsonsReader(js)); !errors.As(err, &kerr) || kerr.Err != ErrKeySizeMismatch || kerr.Version != 1 {
+		t.Error("expected ErrKeySizeMismatch for version 1, got ", err)
+	}
+}
+
+func TestEncryptOnlyKeyset(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("encrypt-only", P_DECRYPT_AND_ENCRYPT, T_RSA_PRIV, S_PRIMARY)
+	private := jsonsReader(km.ToJSONs(nil))
+	public := jsonsReader(km.PubKeys().ToJSONs(nil))
+
+	crypter, _ := NewCrypter(private)
+
+	for _, r := range []KeyReader{public, private} {
+		e, err := NewEncrypter(r)
+		if err != nil {
+			t.Fatal("failed to load encrypter: ", err)
+		}
+
+		if _, ok := e.(Crypter); ok {
+			t.Error("an Encrypter can be used as a Crypter")
+		}
+		if e.KeyInfo().Type != "RSA_PUB" {
+			t.Error("encrypter kept the private keys: ", e.KeyInfo().Type)
+		}
+
+		ciphertext, err := e.Encrypt([]byte(INPUT))
+		if err != nil {
+			t.Fatal("failed to encrypt: ", err)
+		}
+		if p, err := crypter.Decrypt(ciphertext); err != nil || string(p) != INPUT {
+			t.Error("failed to decrypt: ", err)
+		}
+
+		// even reaching past the interface, there's nothing to decrypt with
+		kc := e.(*keyEncrypter).Encrypter.(*keyCrypter)
+		if _, err := kc.Decrypt(ciphertext); !errors.Is(err, ErrNoPrivateKey) {
+			t.Error("expected ErrNoPrivateKey, got ", err)
+		}
+	}
+
+	if _, err := NewCrypter(public); err != ErrNoPrivateKey {
+		t.Error("expected ErrNoPrivateKey, got ", err)
+	}
+}
+
+func TestVerifyFromKeyID(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("pinned", P_SIGN_AND_VERIFY, T_RSA_PRIV, S_ACTIVE, S_PRIMARY)
+	r := jsonsReader(km.ToJSONs(nil))
+
+	signer, _ := NewSigner(r)
+	issuerSigner, _ := NewSigner(r, WithIssuer("svc"))
+	verifier, _ := NewVerifier(r)
+
+	ids := verifier.(KeyIDLister).KeyIDs()
+	oldID, newID := ids[0], ids[1]
+
+	sig, _, _ := signer.(RawSigner).SignBoth([]byte(INPUT))
+	isig, _, _ := issuerSigner.(RawSigner).SignBoth([]byte(INPUT))
+
+	for _, s := range [][]byte{sig, isig} {
+		if ok, err := verifier.(KeyIDVerifier).VerifyFromKeyID([]byte(INPUT), s, newID); !ok || err != nil {
+			t.Error("failed to verify from the expected key: ", err)
+		}
+
+		// a valid signature from the wrong key
+		if ok, err := verifier.(KeyIDVerifier).VerifyFromKeyID([]byte(INPUT), s, oldID); ok || !errors.Is(err, ErrUnexpectedSigner) {
+			t.Error("expected ErrUnexpectedSigner, got ", ok, err)
+		}
+
+		if ok, err := verifier.(KeyIDVerifier).VerifyFromKeyID([]byte("forged"), s, newID); ok || err != nil {
+			t.Error("verified a forged message: ", ok, err)
+		}
+	}
+
+	if ok, err := verifier.(KeyIDVerifier).VerifyFromKeyID([]byte(INPUT), sig[:3], newID); ok || !errors.Is(err, ErrShortSignature) {
+		t.Error("expected ErrShortSignature, got ", ok, err)
+	}
+}
@@ -19,10 +19,26 @@ import (
 	"bytes"
 	"compress/gzip"
 	"compress/zlib"
-	"crypto/rand"
+	"context"
+	"crypto"
+	"crypto/dsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"hash"
 	"io"
+	"math/big"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -33,6 +49,9 @@ const (
 	NO_ENCODING                        // Do not encode the output
 )
 
+// the whitespace trimmed from base64 input unless strict decoding is set
+const asciiSpace = " \t\r\n\v\f"
+
 type KeyczarCompression int
 
 const (
@@ -43,10 +62,12 @@ const (
 
 // Our main base type.  We only expose this through one of the interfaces.
 type keyczar struct {
-	keymeta keyMeta              // metadata for this key
-	keys    map[int]keydata      // maps versions to keys
-	idkeys  map[uint32][]keydata // maps keyids to keys
-	primary int                  // integer version of the primary key
+	keymeta    keyMeta         // metadata for this key
+	keys       map[int]keydata // maps versions to keys
+	idkeys     []keydata       // every key, in the order its KeyID is checked
+	primary    int             // integer version of the primary key
+	nameErrors bool            // wrap every error in a KeyczarError naming the keyset, not just detailed ones
+	verified   *verifyCache    // if set, signatures Verify has found valid with these keys, for WithVerifyCache
 }
 
 type KeyczarCompressionController interface {
@@ -56,26 +77,77 @@ type KeyczarCompressionController interface {
 	Compression() KeyczarCompression
 }
 
+type KeyczarAuthenticationController interface {
+	// Set whether Decrypt rejects ciphertexts from keys whose mode carries no integrity check, such as RSA-OAEP
+	SetRequireAuthentication(require bool)
+	// Return whether Decrypt rejects unauthenticated ciphertexts
+	RequireAuthentication() bool
+}
+
+type KeyczarPlaintextController interface {
+	// Set whether Encrypt rejects empty plaintexts, to catch data that was never filled in
+	SetRejectEmptyPlaintext(reject bool)
+	// Return whether Encrypt rejects empty plaintexts
+	RejectEmptyPlaintext() bool
+}
+
+type KeyczarLimitController interface {
+	// Set the largest decoded ciphertext Decrypt will accept, or 0 for no limit
+	SetMaxCiphertextBytes(max int)
+	// Return the largest decoded ciphertext Decrypt will accept
+	MaxCiphertextBytes() int
+}
+
 type KeyczarEncodingController interface {
 	// Set the current output encoding
 	SetEncoding(encoding KeyczarEncoding)
 	// Return the current output encoding
 	Encoding() KeyczarEncoding
+	// Set whether surrounding whitespace on encoded input is rejected rather than ignored
+	SetStrictDecoding(strict bool)
+	// Return whether surrounding whitespace on encoded input is rejected
+	StrictDecoding() bool
 }
 
 // An Encrypter can be used for encrypting
 type Encrypter interface {
 	KeyczarEncodingController
 	KeyczarCompressionController
+	KeyczarPlaintextController
 	// Encrypt returns an encrypted string representing the plaintext bytes passed.
 	Encrypt(plaintext []uint8) (string, error)
+	// CiphertextLen returns the length of the string Encrypt returns for a plaintext of plaintextLen bytes, or -1 if it varies
+	CiphertextLen(plaintextLen int) int
+	// WriteEncrypted writes the ciphertext for plaintext to w as it is produced, exactly as Encrypt would return it
+	WriteEncrypted(w io.Writer, plaintext []uint8) error
+	// Reload re-reads the keys from the KeyReader, picking up new versions and primary key changes
+	Reload() error
+	// ReloadContext is Reload, giving up when ctx is done if the KeyReader is a ContextKeyReader
+	ReloadContext(ctx context.Context) error
+	// KeyInfo describes the keyset in use
+	KeyInfo() KeyInfo
+	// PrimaryVersion returns the version number of the primary key
+	PrimaryVersion() (int, error)
+	// ActiveVersions returns the versions that aren't inactive, primary first
+	ActiveVersions() []int
 }
 
 // A Crypter can used for encrypting or decrypting
 type Crypter interface {
 	Encrypter
+	KeyczarAuthenticationController
+	KeyczarLimitController
 	// Decrypt returns the plaintext bytes of an encrypted string
 	Decrypt(ciphertext string) ([]uint8, error)
+	// DecryptWithVersion decrypts a ciphertext with the given key version, ignoring the KeyID in its header.
+	// Advanced: for recovering data whose header is damaged.
+	DecryptWithVersion(ciphertext string, version int) ([]uint8, error)
+	// Reencrypt decrypts a ciphertext with whichever key made it and encrypts the plaintext again with the primary key
+	Reencrypt(ciphertext string) (string, error)
+	// EncryptWithNonce encrypts the plaintext together with an application nonce, which is covered by the HMAC
+	EncryptWithNonce(plaintext []uint8, nonce []byte) (string, error)
+	// DecryptWithNonce decrypts a ciphertext made by EncryptWithNonce and returns the plaintext and nonce
+	DecryptWithNonce(ciphertext string) ([]uint8, []byte, error)
 }
 
 // A SignedEncrypter can be used for encrypting and signing
@@ -114,17 +186,37 @@ type Verifier interface {
 	KeyczarEncodingController
 	// Verify checks the cryptographic signature for a message
 	Verify(message []byte, signature string) (bool, error)
+	// VerifyIssuer is Verify, also returning the issuer embedded by a Signer using WithIssuer, or "" if there isn't one
+	VerifyIssuer(message []byte, signature string) (issuer string, valid bool, err error)
 	AttachedVerify(signedMessage string, nonce []byte) ([]byte, error)
 
 	// TimeoutVerify checks the cryptographic signature for a message and ensure it hasn't expired.
 	TimeoutVerify(message []byte, signature string) (bool, error)
+	// VerifyTimeoutDetailed is TimeoutVerify, also returning the expiration from a valid signature, even an expired one
+	VerifyTimeoutDetailed(message []byte, signature string) (expiration int64, valid bool, err error)
 
 	// UnversionedVerify checks the plained, non-Keyczar-tagged cryptographic signature for a message
 	UnversionedVerify(message []byte, signature string) (bool, error)
+
+	// VerifyReader checks the cryptographic signature for the message read from src, without holding it all in memory
+	VerifyReader(src io.Reader, signature string) (bool, error)
+
+	// Reload re-reads the keys from the KeyReader, picking up new versions and primary key changes
+	Reload() error
+	// ReloadContext is Reload, giving up when ctx is done if the KeyReader is a ContextKeyReader
+	ReloadContext(ctx context.Context) error
+	// KeyInfo describes the keyset in use
+	KeyInfo() KeyInfo
+	// PrimaryVersion returns the version number of the primary key
+	PrimaryVersion() (int, error)
+	// ActiveVersions returns the versions that aren't inactive, primary first
+	ActiveVersions() []int
 }
 
 type encodingController struct {
 	encoding KeyczarEncoding
+	strict   bool
+	magic    string // written before the encoded output, and required on input; see CrypterMagic
 }
 
 // Encoding returns the current output encoding for the keyczar object
@@ -137,14 +229,74 @@ func (ec *encodingController) SetEncoding(encoding KeyczarEncoding) {
 	ec.encoding = encoding
 }
 
+// StrictDecoding returns whether surrounding whitespace on base64 input is rejected
+func (ec *encodingController) StrictDecoding() bool {
+	return ec.strict
+}
+
+// SetStrictDecoding sets whether surrounding whitespace on base64 input is rejected.
+// By default leading and trailing spaces, tabs and newlines are ignored, as they often
+// creep in when signatures and ciphertexts are copied through logs or text files.
+func (ec *encodingController) SetStrictDecoding(strict bool) {
+	ec.strict = strict
+}
+
 // return 'data' encoded based on the value of the 'encoding' field
 func (ec *encodingController) encode(data []byte) string {
 
 	switch ec.encoding {
 	case NO_ENCODING:
-		return string(data)
+		return ec.magic + string(data)
+	case BASE64W:
+		return ec.magic + encodeWeb64String(data)
+	}
+
+	panic("not reached")
+}
+
+// return the number of characters 'n' bytes encode to, based on the value of the 'encoding' field
+func (ec *encodingController) encodedLen(n int) int {
+
+	switch ec.encoding {
+	case NO_ENCODING:
+		return len(ec.magic) + n
+	case BASE64W:
+		return len(ec.magic) + base64.RawURLEncoding.EncodedLen(n)
+	}
+
+	panic("not reached")
+}
+
+// return a writer that encodes what is written to it onto 'w', based on the value of the 'encoding' field.
+// The output is only complete once the writer is closed.
+func (ec *encodingController) encoder(w io.Writer) io.WriteCloser {
+
+	switch ec.encoding {
+	case NO_ENCODING:
+		return nopWriteCloser{w}
+	case BASE64W:
+		return base64.NewEncoder(base64.RawURLEncoding, w)
+	}
+
+	panic("not reached")
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// return the number of bytes 'n' characters of input will decode to, based on the value of the 'encoding' field
+func (ec *encodingController) decodedLen(n int) int {
+
+	switch ec.encoding {
+	case NO_ENCODING:
+		return n
 	case BASE64W:
-		return encodeWeb64String(data)
+		return n * 3 / 4
 	}
 
 	panic("not reached")
@@ -153,10 +305,23 @@ func (ec *encodingController) encode(data []byte) string {
 // return 'data' decoded based on the value of the 'encoding' field
 func (ec *encodingController) decode(data string) ([]byte, error) {
 
+	if ec.magic != "" {
+		if ec.encoding == BASE64W && !ec.strict {
+			data = strings.TrimLeft(data, asciiSpace)
+		}
+		if !strings.HasPrefix(data, ec.magic) {
+			return nil, ErrBadMagic
+		}
+		data = data[len(ec.magic):]
+	}
+
 	switch ec.encoding {
 	case NO_ENCODING:
 		return []byte(data), nil
 	case BASE64W:
+		if !ec.strict {
+			data = strings.Trim(data, asciiSpace)
+		}
 		return decodeWeb64String(data)
 	}
 
@@ -232,703 +397,2557 @@ func (cc *compressionController) decompress(data []byte) ([]byte, error) {
 	panic("not reached")
 }
 
-type keyCrypter struct {
-	kz *keyczar
-	encodingController
-	compressionController
+type authenticationController struct {
+	requireAuthentication bool
 }
 
-type keySignedEncypter struct {
-	kz *keyczar
-	encodingController
-	compressionController
-	nonce  []byte
-	signer Signer
+// RequireAuthentication returns whether unauthenticated ciphertexts are rejected
+func (ac *authenticationController) RequireAuthentication() bool {
+	return ac.requireAuthentication
 }
 
-type keySignedDecrypter struct {
-	kz *keyczar
-	encodingController
-	compressionController
-	nonce    []byte
-	verifier Verifier
+// SetRequireAuthentication sets whether unauthenticated ciphertexts are rejected
+func (ac *authenticationController) SetRequireAuthentication(require bool) {
+	ac.requireAuthentication = require
 }
 
-// Encrypt plaintext and return encoded encrypted text as a string
-// All the heavy lifting is done by the key
-func (kc *keyCrypter) Encrypt(plaintext []uint8) (string, error) {
+// return an error if ciphertexts from 'k' have no integrity protection and we've been asked to refuse those
+func (ac *authenticationController) checkAuthenticated(k keydata) error {
+	if ac.requireAuthentication && !isAuthenticatedKey(k) {
+		return ErrUnauthenticatedCiphertext
+	}
+	return nil
+}
 
-	key := kc.kz.getPrimaryKey()
+type plaintextController struct {
+	rejectEmptyPlaintext bool
+}
 
-	encryptKey := key.(encryptKey)
+// RejectEmptyPlaintext returns whether empty plaintexts are refused
+func (pc *plaintextController) RejectEmptyPlaintext() bool {
+	return pc.rejectEmptyPlaintext
+}
 
-	compressedPlaintext := kc.compress(plaintext)
+// SetRejectEmptyPlaintext sets whether empty plaintexts are refused.  Empty plaintexts are allowed by default.
+func (pc *plaintextController) SetRejectEmptyPlaintext(reject bool) {
+	pc.rejectEmptyPlaintext = reject
+}
 
-	ciphertext, err := encryptKey.Encrypt(compressedPlaintext)
-	if err != nil {
-		return "", err
+// return an error if 'plaintext' is empty and we've been asked to refuse those
+func (pc *plaintextController) checkPlaintext(plaintext []byte) error {
+	if pc.rejectEmptyPlaintext && len(plaintext) == 0 {
+		return ErrEmptyPlaintext
 	}
+	return nil
+}
 
-	s := kc.encode(ciphertext)
+type limitController struct {
+	maxCiphertextBytes int
+}
 
-	return s, nil
+// MaxCiphertextBytes returns the largest ciphertext that will be decrypted
+func (lc *limitController) MaxCiphertextBytes() int {
+	return lc.maxCiphertextBytes
+}
 
+// SetMaxCiphertextBytes sets the largest ciphertext that will be decrypted.  0 means no limit.
+func (lc *limitController) SetMaxCiphertextBytes(max int) {
+	lc.maxCiphertextBytes = max
 }
 
-func (kc *keySignedEncypter) Encrypt(plaintext []uint8) (string, error) {
+// return an error if 'ciphertext' would decode to more than the allowed number of bytes
+func (lc *limitController) checkSize(ec encodingController, ciphertext string) error {
+	if lc.maxCiphertextBytes > 0 && ec.decodedLen(len(ciphertext)) > lc.maxCiphertextBytes {
+		return ErrCiphertextTooLarge
+	}
+	return nil
+}
 
-	key := kc.kz.getPrimaryKey()
+// KeyInfo describes a loaded keyset
+type KeyInfo struct {
+	Name    string // the name from the keyset metadata
+	Type    string // the key type, e.g. "AES" or "RSA_PUB"
+	Purpose string // the key purpose, e.g. "DECRYPT_AND_ENCRYPT"
+	Primary int    // the primary key version, or -1 if there isn't one
+}
 
-	encryptKey := key.(encryptKey)
+// keyset holds the keys currently in use by an object, and knows how to load them again
+type keyset struct {
+	current    atomic.Value                                // *keyczar
+	load       func(ctx context.Context) (*keyczar, error) // re-read the keys from the reader
+	minSize    KeySizePolicy                               // if set, the smallest keys that may be loaded
+	nameErrors bool                                        // if set, errors from these keys always carry the keyset's name
+}
 
-	compressedPlaintext := kc.compress(plaintext)
+// A KeySizePolicy gives the smallest size in bits allowed for each key type, as in {T_AES: 256, T_RSA_PRIV: 2048}.
+// Sizes are those in the key JSON: the AES key (not its HMAC key) for AES, and the modulus for DSA and RSA.
+// An entry for T_DSA_PRIV, T_RSA_PRIV or T_ED25519_PRIV also covers the public type unless it has its own entry.
+// Types without an entry are not checked.
+type KeySizePolicy map[keyType]uint
 
-	ciphertext, err := encryptKey.Encrypt(compressedPlaintext)
-	if err != nil {
-		return "", err
+// return the smallest size allowed for keys of type 't', or 0 if there's no limit
+func (p KeySizePolicy) min(t keyType) uint {
+
+	if n, ok := p[t]; ok {
+		return n
 	}
 
-	attachedMessage, err := kc.signer.AttachedSign(ciphertext, kc.nonce)
+	switch t {
+	case T_DSA_PUB:
+		return p[T_DSA_PRIV]
+	case T_RSA_PUB:
+		return p[T_RSA_PRIV]
+	case T_ED25519_PUB:
+		return p[T_ED25519_PRIV]
+	}
 
-	if err != nil {
-		return "", err
+	return 0
+}
+
+// return ErrKeyTooWeak if any version of 'kz' is smaller than the policy allows.
+// Every version is checked, not just the primary, since any of them can still decrypt or verify.
+func (p KeySizePolicy) check(kz *keyczar) error {
+
+	min := p.min(kz.keymeta.Type)
+	if min == 0 {
+		return nil
 	}
 
-	return attachedMessage, nil
+	for _, version := range kz.versions() {
+		if keyBits(kz.keys[version]) < min {
+			return kz.named(withVersion(ErrKeyTooWeak, version))
+		}
+	}
+
+	return nil
 }
 
-// Decode and decrypt ciphertext and return plaintext as []byte
-// All the heavy lifting is done by the key
-func (kc *keyCrypter) Decrypt(ciphertext string) ([]uint8, error) {
+// KeyInfo describes the keyset in use
+func (ks *keyset) KeyInfo() KeyInfo {
+	kz := ks.keys()
+	return KeyInfo{
+		Name:    kz.keymeta.Name,
+		Type:    kz.keymeta.Type.String(),
+		Purpose: kz.keymeta.Purpose.String(),
+		Primary: kz.primary,
+	}
+}
+
+// A KeyIDLister can list the KeyIDs of its keys.  The Encrypters, Crypters, Signers and Verifiers made by
+// this package implement it.
+type KeyIDLister interface {
+	// KeyIDs returns the 4-byte KeyID of every key version, in version order
+	KeyIDs() [][]byte
+}
 
-	b, kl, err := splitHeader(kc.encodingController, kc.kz, ciphertext, ErrShortCiphertext)
+// KeyIDs returns the KeyID found in the header of ciphertexts and signatures from each key version.
+// A message whose header carries none of these can't have come from this keyset.
+func (ks *keyset) KeyIDs() [][]byte {
+	kz := ks.keys()
 
-	if err != nil {
-		return nil, err
+	var ids [][]byte
+	for _, version := range kz.versions() {
+		ids = append(ids, append([]byte(nil), kz.keys[version].KeyID()...))
 	}
 
-	for _, k := range kl {
-		decryptKey := k.(decryptEncryptKey)
-		compressedPlaintext, err := decryptKey.Decrypt(b)
-		if err == nil {
-			return kc.decompress(compressedPlaintext)
+	return ids
+}
+
+// PrimaryVersion returns the version number of the key marked primary in the keyset metadata.
+// It returns ErrNoPrimaryKey if there isn't one, as in a verify-only keyset with only active keys.
+func (ks *keyset) PrimaryVersion() (int, error) {
+	kz := ks.keys()
+
+	for _, v := range kz.keymeta.Versions {
+		if v.Status == S_PRIMARY {
+			return v.VersionNumber, nil
 		}
 	}
 
-	return nil, ErrInvalidSignature
+	return -1, kz.named(ErrNoPrimaryKey)
 }
 
-// Decode and decrypt ciphertext and return plaintext as []byte
-// All the heavy lifting is done by the key
-func (kc *keySignedDecrypter) Decrypt(signedCiphertext string) ([]uint8, error) {
-
-	ciphertext, err := kc.verifier.AttachedVerify(signedCiphertext, kc.nonce)
+// ActiveVersions returns the version numbers of the primary and active keys: the primary first,
+// then the active keys in ascending order.  Inactive keys are left out.
+func (ks *keyset) ActiveVersions() []int {
+	kz := ks.keys()
 
-	if err != nil {
-		return nil, err
+	var primary, active []int
+	for _, v := range kz.keymeta.Versions {
+		switch v.Status {
+		case S_PRIMARY:
+			primary = append(primary, v.VersionNumber)
+		case S_ACTIVE:
+			active = append(active, v.VersionNumber)
+		}
 	}
 
-	b, kl, err := splitHeaderBytes(kc.encodingController, kc.kz, ciphertext, ErrShortCiphertext)
+	sort.Ints(active)
+
+	return append(primary, active...)
+}
+
+// return the keys currently in use.  Callers should fetch this once per operation to get a consistent snapshot.
+func (ks *keyset) keys() *keyczar {
+	return ks.current.Load().(*keyczar)
+}
+
+// Reload re-reads the keys from the reader and atomically replaces the ones in use,
+// picking up any new versions and changes to the primary key.
+// Operations already in progress finish with the keys they started with.
+// If loading fails, the existing keys are kept.
+func (ks *keyset) Reload() error {
+	return ks.ReloadContext(context.Background())
+}
 
+// ReloadContext is Reload, with 'ctx' passed on to the KeyReader if it is a ContextKeyReader
+func (ks *keyset) ReloadContext(ctx context.Context) error {
+	kz, err := ks.load(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	for _, k := range kl {
-		decryptKey := k.(decryptEncryptKey)
-		compressedPlaintext, err := decryptKey.Decrypt(b)
-		if err == nil {
-			return kc.decompress(compressedPlaintext)
-		}
+
+	if err := ks.minSize.check(kz); err != nil {
+		return err
 	}
 
-	return nil, ErrInvalidSignature
+	kz.nameErrors = ks.nameErrors
+
+	ks.current.Store(kz)
 
+	return nil
 }
 
-type currentTime func() int64
+type keyCrypter struct {
+	keyset
+	encodingController
+	compressionController
+	authenticationController
+	limitController
+	plaintextController
 
-type keySigner struct {
+	ivs *ivSet // if set, every AES key records its ivs here, for StrictIVs
+}
+
+type keySignedEncypter struct {
 	kz *keyczar
-	currentTime
 	encodingController
+	compressionController
+	nonce  []byte
+	signer Signer
 }
 
-func (ks *keySigner) UnversionedSign(message []byte) (string, error) {
-
-	key := ks.kz.getPrimaryKey()
-
-	signingKey := key.(signVerifyKey)
+type keySignedDecrypter struct {
+	kz *keyczar
+	encodingController
+	compressionController
+	nonce    []byte
+	verifier Verifier
+}
 
-	signature, err := signingKey.Sign(message)
+// Encrypt plaintext and return encoded encrypted text as a string
+// All the heavy lifting is done by the key
+func (kc *keyCrypter) Encrypt(plaintext []uint8) (string, error) {
 
+	ciphertext, err := kc.encrypt(plaintext)
 	if err != nil {
 		return "", err
 	}
 
-	s := ks.encode(signature)
+	s := kc.encode(ciphertext)
 
 	return s, nil
+
 }
 
-func (ks *keySigner) UnversionedVerify(message []byte, signature string) (bool, error) {
+// A RawEncrypter is an Encrypter that can return its ciphertext unencoded as well, without encrypting twice.
+// The Encrypters and Crypters from NewEncrypter and NewCrypter implement it.
+type RawEncrypter interface {
+	Encrypter
+	// EncryptBoth encrypts once and returns the ciphertext both as raw bytes and encoded with web-safe base64
+	EncryptBoth(plaintext []uint8) ([]byte, string, error)
+}
 
-	b, err := ks.decode(signature)
+// EncryptBoth returns the ciphertext for 'plaintext' unencoded and as web-safe base64, regardless of the encoding setting
+func (kc *keyCrypter) EncryptBoth(plaintext []uint8) ([]byte, string, error) {
 
+	ciphertext, err := kc.encrypt(plaintext)
 	if err != nil {
-		return false, err
+		return nil, "", err
 	}
 
-	// without a key id, we have to check all the keys
-	for _, k := range ks.kz.keys {
-		verifyKey := k.(verifyKey)
-		// errors ignored here
-		valid, _ := verifyKey.Verify(message, b)
-		if valid {
-			return true, nil
-		}
-	}
+	return ciphertext, encodeWeb64String(ciphertext), nil
+}
 
-	return false, nil
+// CiphertextLen returns the length of the ciphertext, in the current encoding, that Encrypt produces for
+// 'plaintextLen' bytes with the primary key, for sizing buffers and columns ahead of time.
+// If compression is on, plaintextLen must be the length after compression.
+func (kc *keyCrypter) CiphertextLen(plaintextLen int) int {
+	key := kc.keys().getPrimaryKey()
+	return kc.encodedLen(key.(encryptKey).ciphertextLen(plaintextLen))
 }
 
-// Verify the signature on 'msg'
-// All the heavy lifting is done by the key
-func (ks *keySigner) Verify(msg []byte, signature string) (bool, error) {
+// WriteEncrypted encrypts 'plaintext' with the primary key and writes the encoded ciphertext to 'w'.
+// With the default HMAC the ciphertext is written a chunk at a time rather than assembled in memory first.
+func (kc *keyCrypter) WriteEncrypted(w io.Writer, plaintext []uint8) error {
+
+	if err := kc.checkPlaintext(plaintext); err != nil {
+		return err
+	}
 
-	b, kl, err := splitHeader(ks.encodingController, ks.kz, signature, ErrShortSignature)
+	key := kc.keys().getPrimaryKey()
 
-	if err != nil {
-		return false, err
+	data := kc.compress(plaintext)
+
+	if _, err := io.WriteString(w, kc.magic); err != nil {
+		return err
 	}
 
-	signedbytes := make([]byte, len(msg)+1)
-	copy(signedbytes, msg)
-	signedbytes[len(msg)] = kzVersion
+	enc := kc.encoder(w)
 
-	for _, k := range kl {
-		sig := b[kzHeaderLength:]
-		verifyKey := k.(verifyKey)
-		valid, _ := verifyKey.Verify(signedbytes, sig)
-		if valid {
-			return true, nil
+	if ak, ok := key.(*aesKey); ok {
+		session, err := ak.newSession()
+		if err != nil {
+			return err
+		}
+		if m, ok := session.mac.(*hmacSHA1MAC); ok && ak.mode == cmCBC {
+			if err := session.writeEncrypted(enc, m, data); err != nil {
+				return err
+			}
+			return enc.Close()
 		}
 	}
 
-	return false, nil
+	ciphertext, err := key.(encryptKey).Encrypt(data)
+	if err != nil {
+		return err
+	}
+
+	if _, err := enc.Write(ciphertext); err != nil {
+		return err
+	}
+
+	return enc.Close()
 }
 
-// Return a signature for 'msg'
-// All the heavy lifting is done by the key
-func (ks *keySigner) Sign(msg []byte) (string, error) {
+// EncryptString encrypts a string plaintext with 'e', as the Java and Python Keyczar encrypt does
+func EncryptString(e Encrypter, plaintext string) (string, error) {
+	return e.Encrypt([]byte(plaintext))
+}
 
-	key := ks.kz.getPrimaryKey()
+// compress and encrypt 'plaintext' with the primary key, returning the raw ciphertext
+func (kc *keyCrypter) encrypt(plaintext []uint8) ([]byte, error) {
 
-	signingKey := key.(signVerifyKey)
+	if err := kc.checkPlaintext(plaintext); err != nil {
+		return nil, err
+	}
 
-	signedbytes := make([]byte, len(msg)+1)
-	copy(signedbytes, msg)
-	signedbytes[len(msg)] = kzVersion
+	key := kc.keys().getPrimaryKey()
 
-	signature, err := signingKey.Sign(signedbytes)
+	encryptKey := key.(encryptKey)
 
-	if err != nil {
-		return "", err
+	compressedPlaintext := kc.compress(plaintext)
+	if kc.compression != NO_COMPRESSION {
+		// the compressed copy is ours, so it needn't outlive the encryption
+		defer zeroBytes(compressedPlaintext)
 	}
 
-	h := makeHeader(key)
-	signature = append(h, signature...)
+	return encryptKey.Encrypt(compressedPlaintext)
+}
 
-	s := ks.encode(signature)
+func (kc *keySignedEncypter) Encrypt(plaintext []uint8) (string, error) {
 
-	return s, nil
-}
+	key := kc.kz.getPrimaryKey()
 
-func buildAttachedSignedBytes(msg []byte, nonce []byte) []byte {
+	encryptKey := key.(encryptKey)
 
-	signedBytesLen := len(msg) + 1
-	if nonce != nil {
-		signedBytesLen += 4 + len(nonce)
-	} else {
-		signedBytesLen += 4
+	compressedPlaintext := kc.compress(plaintext)
+	if kc.compression != NO_COMPRESSION {
+		defer zeroBytes(compressedPlaintext)
 	}
 
-	signedbytes := make([]byte, signedBytesLen)
-	offs := 0
-	copy(signedbytes[offs:], msg)
-	offs += len(msg)
-	if nonce != nil {
-		binary.BigEndian.PutUint32(signedbytes[offs:], uint32(len(nonce)))
-		offs += 4
-		copy(signedbytes[offs:], nonce)
-		offs += len(nonce)
-	} else {
-		binary.BigEndian.PutUint32(signedbytes[offs:], uint32(0))
-		offs += 4
+	ciphertext, err := encryptKey.Encrypt(compressedPlaintext)
+	if err != nil {
+		return "", err
 	}
-	signedbytes[offs] = kzVersion
 
-	return signedbytes
+	attachedMessage, err := kc.signer.AttachedSign(ciphertext, kc.nonce)
+
+	if err != nil {
+		return "", err
+	}
+
+	return attachedMessage, nil
 }
 
-// Verify the attached signature on 'msg', and return the signed data if valid
-// All the heavy lifting is done by the key
-func (ks *keySigner) AttachedVerify(signedMsg string, nonce []byte) ([]byte, error) {
+// A BatchEncrypter is an Encrypter that can encrypt many plaintexts at once more cheaply than one at a time.
+// The Encrypters and Crypters from NewEncrypter and NewCrypter implement it.
+type BatchEncrypter interface {
+	Encrypter
+	// EncryptBatch encrypts each plaintext in turn, setting up the cipher only once
+	EncryptBatch(plaintexts [][]uint8) ([]string, error)
+}
 
-	b, kl, err := splitHeader(ks.encodingController, ks.kz, signedMsg, ErrShortSignature)
+// A BatchDecrypter is a Crypter that can decrypt many ciphertexts at once more cheaply than one at a time.
+// The Crypters from NewCrypter implement it.
+type BatchDecrypter interface {
+	Crypter
+	// DecryptBatch decrypts each ciphertext in turn, reusing the cipher for each key
+	DecryptBatch(ciphertexts []string) ([][]uint8, error)
+}
 
-	if err != nil {
-		return nil, err
+// Encrypt each of the plaintexts with the primary key
+// Each message gets its own IV, but the cipher and hmac are only set up once
+func (kc *keyCrypter) EncryptBatch(plaintexts [][]uint8) ([]string, error) {
+
+	key := kc.keys().getPrimaryKey()
+
+	encrypt := key.(encryptKey).Encrypt
+
+	if ak, ok := key.(*aesKey); ok {
+		session, err := ak.newSession()
+		if err != nil {
+			return nil, err
+		}
+		encrypt = session.Encrypt
 	}
 
-	offs := kzHeaderLength
+	ciphertexts := make([]string, len(plaintexts))
 
-	if len(b[offs:]) < 4 {
-		return nil, ErrShortSignature
+	for i, plaintext := range plaintexts {
+		if err := kc.checkPlaintext(plaintext); err != nil {
+			return nil, err
+		}
+		ciphertext, err := encrypt(kc.compress(plaintext))
+		if err != nil {
+			return nil, err
+		}
+		ciphertexts[i] = kc.encode(ciphertext)
 	}
 
-	msglen := int(binary.BigEndian.Uint32(b[offs:]))
+	return ciphertexts, nil
+}
 
-	offs += 4
+// bounds on the length of nonces passed to EncryptWithNonce
+const (
+	minNonceLength = 8
+	maxNonceLength = 64
+)
 
-	if msglen > len(b[offs:]) {
-		return nil, ErrShortSignature
+// EncryptWithNonce packs 'nonce' in with the plaintext before encrypting, so it travels inside the ciphertext
+func (kc *keyCrypter) EncryptWithNonce(plaintext []uint8, nonce []byte) (string, error) {
+
+	if len(nonce) < minNonceLength || len(nonce) > maxNonceLength {
+		return "", ErrInvalidNonce
 	}
 
-	msg := b[offs : offs+msglen]
-	offs += msglen
-	sig := b[offs:]
+	// the packed nonce is never empty, so check the plaintext on its own
+	if err := kc.checkPlaintext(plaintext); err != nil {
+		return "", err
+	}
 
-	signedbytes := buildAttachedSignedBytes(msg, nonce)
-	for _, k := range kl {
-		verifyKey := k.(verifyKey)
-		valid, _ := verifyKey.Verify(signedbytes, sig)
+	return kc.Encrypt(lenPrefixPack(nonce, plaintext))
+}
 
-		if valid {
-			return msg, nil
-		}
+// DecryptWithNonce decrypts 'ciphertext' and splits the nonce back out of the plaintext
+func (kc *keyCrypter) DecryptWithNonce(ciphertext string) ([]uint8, []byte, error) {
+
+	packed, err := kc.Decrypt(ciphertext)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return nil, ErrInvalidSignature
+	return unpackNonce(packed)
 }
 
-// Return a signature for 'msg' and the nonce
-// All the heavy lifting is done by the key
-func (ks *keySigner) AttachedSign(msg []byte, nonce []byte) (string, error) {
+// split the nonce and plaintext packed by EncryptWithNonce
+func unpackNonce(packed []byte) ([]byte, []byte, error) {
+
+	arrays, err := lenPrefixUnpackN(packed, 2)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	key := ks.kz.getPrimaryKey()
+	nonce, plaintext := arrays[0], arrays[1]
 
-	signingKey := key.(signVerifyKey)
+	if len(nonce) < minNonceLength || len(nonce) > maxNonceLength {
+		return nil, nil, ErrInvalidNonce
+	}
 
-	signedbytes := buildAttachedSignedBytes(msg, nonce)
+	return plaintext, nonce, nil
+}
 
-	signature, err := signingKey.Sign(signedbytes)
+// A CrypterDeriver is a Crypter that can derive per-label Crypters from its keys.
+// The Crypters from NewCrypter implement it.
+type CrypterDeriver interface {
+	Crypter
+	// DeriveCrypter returns a Crypter whose keys are derived from these ones and label, keeping data for different labels apart
+	DeriveCrypter(label []byte) (Crypter, error)
+}
+
+// DeriveCrypter returns a Crypter for AES keysets whose keys are derived from this one's and 'label', for
+// keeping many tenants' data apart under one keyset.  Each version's AES and HMAC keys are replaced with
+// HKDF-SHA256 output from the originals, so ciphertexts made under one label don't decrypt under another,
+// or under the original keys.  The derived keys, and so their KeyIDs, are the same every time for the same
+// label.  The new Crypter starts with this one's settings and reloads from the same reader.
+func (kc *keyCrypter) DeriveCrypter(label []byte) (Crypter, error) {
+
+	kz := kc.keys()
+	if kz.keymeta.Type != T_AES {
+		return nil, kz.named(ErrUnsupportedType)
+	}
+
+	label = append([]byte(nil), label...)
+
+	d := new(keyCrypter)
+	d.encodingController = kc.encodingController
+	d.compressionController = kc.compressionController
+	d.authenticationController = kc.authenticationController
+	d.limitController = kc.limitController
+	d.plaintextController = kc.plaintextController
+	d.minSize = kc.minSize
+	d.nameErrors = kc.nameErrors
+
+	d.load = func(ctx context.Context) (*keyczar, error) {
+		kz, err := kc.load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return kz.derive(label)
+	}
 
+	if err := d.Reload(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Reencrypt moves 'ciphertext' onto the current primary key, for migrating stored data after a rotation
+func (kc *keyCrypter) Reencrypt(ciphertext string) (string, error) {
+
+	plaintext, err := kc.Decrypt(ciphertext)
 	if err != nil {
 		return "", err
 	}
 
-	h := makeHeader(key)
+	return kc.Encrypt(plaintext)
+}
 
-	signedMsg := make([]byte, kzHeaderLength+4+len(msg)+len(signature))
-	offs := 0
-	copy(signedMsg[offs:], h)
-	offs += kzHeaderLength
-	binary.BigEndian.PutUint32(signedMsg[offs:], uint32(len(msg)))
-	offs += 4
-	copy(signedMsg[offs:], msg)
-	offs += len(msg)
-	copy(signedMsg[offs:], signature)
+// Decode and decrypt ciphertext and return plaintext as []byte
+// All the heavy lifting is done by the key
+func (kc *keyCrypter) Decrypt(ciphertext string) ([]uint8, error) {
+	plaintext, _, err := kc.decrypt(kc.keys(), ciphertext, nil)
+	return plaintext, err
+}
 
-	s := ks.encode(signedMsg)
+// DecryptResult is the plaintext of a ciphertext along with what its header says about the key that made it
+type DecryptResult struct {
+	Plaintext     []uint8
+	Footer        []byte // the footer, for ciphertexts made by EncryptWithFooter
+	Version       byte   // the format version from the header
+	KeyID         []byte // the 4-byte KeyID from the header
+	KeyVersion    int    // the version number of the key that decrypted it
+	Authenticated bool   // whether the header and plaintext were covered by a MAC or AEAD tag
+}
 
-	return s, nil
+// A DetailedDecrypter is a Crypter that can report what a ciphertext's header says along with its plaintext.
+// The Crypters from NewCrypter implement it.
+type DetailedDecrypter interface {
+	Crypter
+	// DecryptDetailed is Decrypt, also returning the header, any footer and the version of the key that decrypted it
+	DecryptDetailed(ciphertext string) (*DecryptResult, error)
 }
 
-const timestampSize = 8
+// DecryptDetailed is Decrypt, also returning the header fields and the key version that decrypted the
+// ciphertext.  Ciphertexts from EncryptWithFooter are recognised by their header and their footer
+// is returned as well.
+//
+// The header is only authenticated along with the ciphertext for AES keys, which is what Authenticated
+// reports.  An RSA ciphertext can be made by anyone holding the public key, and its header only says
+// which key decrypted it.
+//
+// A nonce from EncryptWithNonce is packed inside the plaintext, and nothing in the ciphertext marks it
+// as being there, so DecryptDetailed can't split it off: use DecryptWithNonce for those ciphertexts.
+func (kc *keyCrypter) DecryptDetailed(ciphertext string) (*DecryptResult, error) {
 
-func buildTimeoutSignedBytes(msg []byte, expiration int64) []byte {
+	kz := kc.keys()
 
-	signedBytesLen := timestampSize + len(msg) + 1
+	if err := kc.checkSize(kc.encodingController, ciphertext); err != nil {
+		return nil, kz.named(err)
+	}
 
-	signedbytes := make([]byte, signedBytesLen)
-	offs := 0
+	b, err := decodeCryptotext(kc.encodingController, ciphertext)
+	if err != nil {
+		return nil, kz.named(err)
+	}
 
-	binary.BigEndian.PutUint64(signedbytes[offs:], uint64(expiration))
-	offs += timestampSize
+	r := &DecryptResult{Version: kzVersion}
 
-	copy(signedbytes[offs:], msg)
-	offs += len(msg)
+	var k keydata
 
-	signedbytes[offs] = kzVersion
+	if len(b) > 0 && b[0] == kzFooterVersion {
+		r.Version = kzFooterVersion
+		r.Plaintext, r.Footer, k, err = kc.decryptFooterBytes(kz, b)
+	} else {
+		r.Plaintext, k, err = kc.decryptBytes(kz, b, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	return signedbytes
+	r.KeyID = append([]byte(nil), k.KeyID()...)
+	r.Authenticated = isAuthenticatedKey(k)
+
+	for version, vk := range kz.keys {
+		if vk == k {
+			r.KeyVersion = version
+		}
+	}
+
+	return r, nil
 }
 
-// construct and return a timeout signature
-func (ks *keySigner) TimeoutSign(msg []byte, expiration int64) (string, error) {
+// DecryptString decrypts a ciphertext with 'c' and returns the plaintext as a string, as the Java and
+// Python Keyczar decrypt does
+func DecryptString(c Crypter, ciphertext string) (string, error) {
 
-	key := ks.kz.getPrimaryKey()
+	plaintext, err := c.Decrypt(ciphertext)
+	if err != nil {
+		return "", err
+	}
 
-	signingKey := key.(signVerifyKey)
+	return string(plaintext), nil
+}
 
-	h := makeHeader(key)
+// EncryptJSON marshals 'v' with encoding/json and encrypts the result with 'e', compressed if compression
+// is on.  The ciphertext is encoded as by Encrypt, and the marshalled plaintext is zeroed once it's encrypted.
+func EncryptJSON(e Encrypter, v interface{}) ([]byte, error) {
 
-	signedbytes := buildTimeoutSignedBytes(msg, expiration)
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(plaintext)
 
-	signature, err := signingKey.Sign(signedbytes)
+	s, err := e.Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(s), nil
+}
 
+// DecryptJSON decrypts 'blob' with 'c' and unmarshals the plaintext into 'v' with encoding/json.
+// The plaintext is zeroed once it has been unmarshalled.
+func DecryptJSON(c Crypter, blob []byte, v interface{}) error {
+
+	plaintext, err := c.Decrypt(string(blob))
 	if err != nil {
-		return "", err
+		return err
 	}
+	defer zeroBytes(plaintext)
 
-	signedMsg := make([]byte, kzHeaderLength+timestampSize+len(signature))
-	offs := 0
+	return json.Unmarshal(plaintext, v)
+}
 
-	copy(signedMsg[offs:], h)
-	offs += kzHeaderLength
+// Decrypt each of the ciphertexts, reusing the cipher and hmac for each aes key encountered
+func (kc *keyCrypter) DecryptBatch(ciphertexts []string) ([][]uint8, error) {
 
-	binary.BigEndian.PutUint64(signedMsg[offs:], uint64(expiration))
-	offs += timestampSize
+	sessions := make(map[*aesKey]*aesSession)
 
-	copy(signedMsg[offs:], signature)
+	plaintexts := make([][]uint8, len(ciphertexts))
 
-	s := ks.encode(signedMsg)
+	for i, ciphertext := range ciphertexts {
+		plaintext, _, err := kc.decrypt(kc.keys(), ciphertext, sessions)
+		if err != nil {
+			return nil, err
+		}
+		plaintexts[i] = plaintext
+	}
 
-	return s, nil
+	return plaintexts, nil
 }
 
-// validate a timeout signature.  must be both cryptographically valid and not yet expired.
-func (ks *keySigner) TimeoutVerify(message []byte, signature string) (bool, error) {
+// decrypt a single ciphertext with the keys in 'kz', and return the plaintext and the key that decrypted it.
+// If 'sessions' is non-nil, it is used to cache the aes state between calls
+func (kc *keyCrypter) decrypt(kz *keyczar, ciphertext string, sessions map[*aesKey]*aesSession) ([]uint8, keydata, error) {
 
-	sig, kl, err := splitHeader(ks.encodingController, ks.kz, signature, ErrShortSignature)
+	// refuse oversized input before we allocate anything for it
+	if err := kc.checkSize(kc.encodingController, ciphertext); err != nil {
+		return nil, nil, kz.named(err)
+	}
 
+	b, err := decodeCryptotext(kc.encodingController, ciphertext)
 	if err != nil {
-		return false, err
+		return nil, nil, kz.named(err)
 	}
 
-	offs := kzHeaderLength
+	return kc.decryptBytes(kz, b, sessions)
+}
 
-	if len(sig[offs:]) < timestampSize {
-		return false, ErrShortSignature
-	}
+// decrypt the decoded ciphertext 'b' like decrypt
+func (kc *keyCrypter) decryptBytes(kz *keyczar, b []byte, sessions map[*aesKey]*aesSession) ([]uint8, keydata, error) {
 
-	expiration := int64(binary.BigEndian.Uint64(sig[offs:]))
-	offs += timestampSize
+	b, kl, err := splitHeaderBytes(kc.encodingController, kz, b, ErrShortCiphertext)
 
-	sig = sig[offs:]
+	if err != nil {
+		return nil, nil, kz.named(err)
+	}
 
-	signedbytes := buildTimeoutSignedBytes(message, expiration)
-	currentMillis := ks.currentTime()
+	// only call the ciphertext malformed if it is for every key it might belong to
+	malformed := true
 
 	for _, k := range kl {
-		verifyKey := k.(verifyKey)
-		valid, _ := verifyKey.Verify(signedbytes, sig)
-		if valid {
-			return currentMillis < expiration, nil
+		if err := kc.checkAuthenticated(k); err != nil {
+			return nil, nil, kz.named(err)
+		}
+		dk, ok := k.(decryptEncryptKey)
+		if !ok {
+			return nil, nil, kz.named(ErrNoPrivateKey)
+		}
+		decrypt := dk.Decrypt
+		if ak, ok := k.(*aesKey); ok && sessions != nil {
+			session, ok := sessions[ak]
+			if !ok {
+				session, err = ak.newSession()
+				if err != nil {
+					return nil, nil, kz.named(err)
+				}
+				sessions[ak] = session
+			}
+			decrypt = session.Decrypt
+		}
+		compressedPlaintext, err := decrypt(b)
+		if err == nil {
+			plaintext, err := kc.decompress(compressedPlaintext)
+			return plaintext, k, err
 		}
+		malformed = malformed && err == ErrMalformedCiphertext
 	}
 
-	return false, nil
+	if malformed {
+		return nil, nil, kz.named(ErrMalformedCiphertext)
+	}
+
+	return nil, nil, kz.named(ErrInvalidSignature)
 }
 
-// NewCrypter returns an object capable of encrypting and decrypting using the key provded by the reader
-func NewCrypter(r KeyReader) (Crypter, error) {
-	k := new(keyCrypter)
-	var err error
-	k.kz, err = newKeyczar(r)
+// A HeaderlessEncrypter is an Encrypter that can leave the Keyczar header off its ciphertexts.
+// The Encrypters and Crypters from NewEncrypter and NewCrypter implement it.
+type HeaderlessEncrypter interface {
+	Encrypter
+	// EncryptHeaderless encrypts with the primary key but leaves the Keyczar header off the ciphertext, returning
+	// the version of the key used.  The ciphertext is NOT compatible with other Keyczar implementations.
+	EncryptHeaderless(plaintext []uint8) (string, int, error)
+}
 
-	if err != nil {
-		return nil, err
-	}
+// A HeaderlessDecrypter is a Crypter that can decrypt the ciphertexts of a HeaderlessEncrypter.
+// The Crypters from NewCrypter implement it.
+type HeaderlessDecrypter interface {
+	Crypter
+	// DecryptHeaderless decrypts a ciphertext from EncryptHeaderless with the given key version
+	DecryptHeaderless(ciphertext string, version int) ([]uint8, error)
+}
 
-	if !k.kz.isAcceptablePurpose(P_DECRYPT_AND_ENCRYPT) {
-		return nil, ErrUnacceptablePurpose
+// EncryptHeaderless encrypts 'plaintext' like Encrypt, then drops the 5-byte header, for storage where every
+// byte counts and the key version is recorded separately.  This breaks compatibility with other Keyczar
+// implementations, which can't read the result.  The header is still covered by the HMAC of AES ciphertexts:
+// DecryptHeaderless rebuilds it from the key version, so a ciphertext only decrypts with the key that made it.
+func (kc *keyCrypter) EncryptHeaderless(plaintext []uint8) (string, int, error) {
+
+	if err := kc.checkPlaintext(plaintext); err != nil {
+		return "", 0, err
 	}
 
-	err = k.kz.loadPrimaryKey()
+	kz := kc.keys()
+
+	ciphertext, err := kz.getPrimaryKey().(encryptKey).Encrypt(kc.compress(plaintext))
 	if err != nil {
-		return nil, err
+		return "", 0, err
 	}
 
-	return k, err
+	return kc.encode(ciphertext[kzHeaderLength:]), kz.primary, nil
 }
 
-func NewSignedEncrypter(r KeyReader, signer Signer, nonce []byte) (SignedEncrypter, error) {
-	k := new(keySignedEncypter)
-	var err error
-	k.kz, err = newKeyczar(r)
-	k.nonce = nonce
-	k.signer = signer
+// DecryptHeaderless decrypts a ciphertext made by EncryptHeaderless with key 'version'
+func (kc *keyCrypter) DecryptHeaderless(ciphertext string, version int) ([]uint8, error) {
 
-	if err != nil {
-		return nil, err
-	}
+	kz := kc.keys()
 
-	if !k.kz.isAcceptablePurpose(P_DECRYPT_AND_ENCRYPT) {
-		return nil, ErrUnacceptablePurpose
+	if err := kc.checkSize(kc.encodingController, ciphertext); err != nil {
+		return nil, kz.named(err)
 	}
 
-	err = k.kz.loadPrimaryKey()
-	if err != nil {
-		return nil, err
+	key, ok := kz.keys[version]
+	if !ok {
+		return nil, kz.named(withVersion(ErrNoSuchKeyVersion, version))
 	}
 
-	return k, err
-}
+	if err := kc.checkAuthenticated(key); err != nil {
+		return nil, kz.named(err)
+	}
 
-func NewSignedDecrypter(r KeyReader, verifier Verifier, nonce []byte) (SignedDecrypter, error) {
-	k := new(keySignedDecrypter)
-	var err error
-	k.kz, err = newKeyczar(r)
-	k.nonce = nonce
-	k.verifier = verifier
+	dk, ok := key.(decryptEncryptKey)
+	if !ok {
+		return nil, kz.named(ErrNoPrivateKey)
+	}
 
-	if err != nil {
+	b, err := kc.decode(ciphertext)
+	if err == ErrBadMagic {
 		return nil, err
 	}
-
-	if !k.kz.isAcceptablePurpose(P_DECRYPT_AND_ENCRYPT) {
-		return nil, ErrUnacceptablePurpose
+	if err != nil {
+		return nil, ErrBase64Decoding
 	}
 
-	err = k.kz.loadPrimaryKey()
+	compressedPlaintext, err := dk.Decrypt(append(makeHeader(key), b...))
 	if err != nil {
-		return nil, err
+		return nil, kz.named(withVersion(ErrInvalidSignature, version))
 	}
 
-	return k, err
+	return kc.decompress(compressedPlaintext)
 }
 
-// NewEncrypter returns an object capable of encrypting using the key provded by the reader
-func NewEncrypter(r KeyReader) (Encrypter, error) {
-	k := new(keyCrypter)
-	var err error
-	k.kz, err = newKeyczar(r)
+// DecryptWithVersion decrypts 'ciphertext' with key 'version', overwriting its header with the one for that key
+// instead of looking the key up by KeyID.  This is for recovering ciphertexts whose header is damaged but
+// whose key version is known; it is not needed in normal use.  The ciphertext is still authenticated, and
+// because the signature covers the header, it only succeeds if 'version' is the key that made it.
+func (kc *keyCrypter) DecryptWithVersion(ciphertext string, version int) ([]uint8, error) {
+
+	kz := kc.keys()
+
+	if err := kc.checkSize(kc.encodingController, ciphertext); err != nil {
+		return nil, kz.named(err)
+	}
+
+	key, ok := kz.keys[version]
+	if !ok {
+		return nil, kz.named(withVersion(ErrNoSuchKeyVersion, version))
+	}
+
+	if err := kc.checkAuthenticated(key); err != nil {
+		return nil, kz.named(err)
+	}
+
+	dk, ok := key.(decryptEncryptKey)
+	if !ok {
+		return nil, kz.named(ErrNoPrivateKey)
+	}
+
+	b, err := kc.decode(ciphertext)
+	if err == ErrBadMagic {
+		return nil, err
+	}
+	if err != nil {
+		return nil, ErrBase64Decoding
+	}
+
+	if len(b) < kzHeaderLength {
+		return nil, kz.named(ErrShortCiphertext)
+	}
+
+	copy(b, makeHeader(key))
+
+	compressedPlaintext, err := dk.Decrypt(b)
+	if err != nil {
+		return nil, kz.named(withVersion(ErrInvalidSignature, version))
+	}
+
+	return kc.decompress(compressedPlaintext)
+}
+
+// Decode and decrypt ciphertext and return plaintext as []byte
+// All the heavy lifting is done by the key
+func (kc *keySignedDecrypter) Decrypt(signedCiphertext string) ([]uint8, error) {
+
+	ciphertext, err := kc.verifier.AttachedVerify(signedCiphertext, kc.nonce)
+
+	if err != nil {
+		return nil, err
+	}
+
+	b, kl, err := splitHeaderBytes(kc.encodingController, kc.kz, ciphertext, ErrShortCiphertext)
+
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range kl {
+		decryptKey, ok := k.(decryptEncryptKey)
+		if !ok {
+			return nil, ErrNoPrivateKey
+		}
+		compressedPlaintext, err := decryptKey.Decrypt(b)
+		if err == nil {
+			return kc.decompress(compressedPlaintext)
+		}
+	}
+
+	return nil, ErrInvalidSignature
+
+}
+
+type currentTime func() int64
+
+// the default currentTime: milliseconds since 1/1/1970 GMT
+func currentMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+type keySigner struct {
+	keyset
+	currentTime
+	encodingController
+	issuer []byte // if set, Sign makes issuer signatures
+
+	maxVerifyAttempts int           // if set, the most keys tried for one signature
+	acceptHashes      []crypto.Hash // RSA PKCS#1 v1.5 digests accepted after SHA-1, for AcceptRSAHashes
+	acceptP1363       bool          // DSA signatures may be raw r||s, for P1363Signatures
+	verifyCacheSize   int           // if set, the most valid signatures Verify remembers
+}
+
+// A SignerOption changes how a Signer made by NewSigner, or a Verifier made by NewVerifier, works
+type SignerOption func(ks *keySigner) error
+
+// WithIssuer makes Sign embed 'issuer', a name for the signer that stays the same across key rotations,
+// in each signature, covered by the signature itself.  Verifiers from this package return it from
+// VerifyIssuer.  The issuer may be at most 255 bytes.
+//
+// Issuer signatures are specific to this package:
+//
+//	|version|keyID|issuerLen|issuer|signature|
+//
+// where version is kzIssuerVersion rather than the standard kzVersion, issuerLen is a single byte,
+// and signature is over the message followed by the issuer, issuerLen and version bytes.  Other
+// Keyczar implementations reject them as having a bad version.  Only Sign and SignBoth are affected.
+// NewVerifier refuses this option with ErrSignerOnlyOption.
+func WithIssuer(issuer string) SignerOption {
+	return func(ks *keySigner) error {
+		if len(issuer) > 255 {
+			return ErrIssuerTooLong
+		}
+		ks.issuer = []byte(issuer)
+		return nil
+	}
+}
+
+// SignerNamedErrors makes every error from the Signer or Verifier a KeyczarError naming the keyset, as in the
+// metadata "name", for telling keysets apart when several are loaded.  Without it only errors that already
+// carry other details are named, and the rest can still be compared to the errors in errors.go with ==.
+func SignerNamedErrors() SignerOption {
+	return func(ks *keySigner) error {
+		ks.nameErrors = true
+		return nil
+	}
+}
+
+// SignerMinKeySize makes NewSigner and Reload refuse a keyset with any key smaller than 'p' allows,
+// returning ErrKeyTooWeak.
+func SignerMinKeySize(p KeySizePolicy) SignerOption {
+	return func(ks *keySigner) error {
+		ks.minSize = p
+		return nil
+	}
+}
+
+// MaxVerifyAttempts makes verifying give up with ErrTooManyCandidates once 'n' keys have failed to verify a
+// signature, bounding the public-key operations a forged signature can cost.  The candidates are the keys
+// whose KeyID matches the signature header, or every key for UnversionedVerify; KeyIDs are only 4 bytes,
+// so in a big keyset a few keys may share one.  A signature from the first 'n' candidates verifies as usual.
+// UnversionedVerify tries the primary key first, then the active and inactive keys, newest first.
+// 0 means no limit.
+func MaxVerifyAttempts(n int) SignerOption {
+	return func(ks *keySigner) error {
+		ks.maxVerifyAttempts = n
+		return nil
+	}
+}
+
+// AcceptRSAHashes makes RSA PKCS#1 v1.5 signatures over a digest from one of 'hashes' verify as well as
+// the usual SHA-1 ones, for checking signatures made by other tools.  Only crypto.SHA256, crypto.SHA384
+// and crypto.SHA512 are allowed; others return ErrUnsupportedHash.  Keys using PSS are unaffected, as is
+// VerifyReader, which only checks SHA-1.
+func AcceptRSAHashes(hashes ...crypto.Hash) SignerOption {
+	return func(ks *keySigner) error {
+		for _, h := range hashes {
+			if h != crypto.SHA256 && h != crypto.SHA384 && h != crypto.SHA512 {
+				return ErrUnsupportedHash
+			}
+		}
+		ks.acceptHashes = append([]crypto.Hash(nil), hashes...)
+		return nil
+	}
+}
+
+// P1363Signatures makes DSA signatures in IEEE P1363 format (raw r||s, see DSASignatureToP1363) verify
+// as well as the usual ASN.1 DER ones.
+func P1363Signatures() SignerOption {
+	return func(ks *keySigner) error {
+		ks.acceptP1363 = true
+		return nil
+	}
+}
+
+// WithTimeProvider makes the timeout signature methods take the current time, in milliseconds since
+// 1/1/1970 GMT, from 't' rather than the system clock.
+func WithTimeProvider(t currentTime) SignerOption {
+	return func(ks *keySigner) error {
+		ks.currentTime = t
+		return nil
+	}
+}
+
+// WithVerifyCache makes Verify remember up to 'size' signatures it has verified, so verifying the same
+// message and signature again, as when a request is retried, skips the public-key math.
+// Only signatures that really verified are cached: invalid ones and errors are checked afresh each time, so
+// forged signatures can't be added to the cache.  The least recently used entry is dropped when it is full,
+// and the whole cache is cleared on Reload, in case a key was removed.  Only Verify is cached.
+func WithVerifyCache(size int) SignerOption {
+	return func(ks *keySigner) error {
+		ks.verifyCacheSize = size
+		return nil
+	}
+}
+
+// set up freshly loaded keys for the verify options
+func (ks *keySigner) prepare(kz *keyczar) {
+
+	if ks.verifyCacheSize > 0 {
+		kz.verified = newVerifyCache(ks.verifyCacheSize)
+	}
+
+	for _, key := range kz.keys {
+		switch k := key.(type) {
+		case *rsaPublicKey:
+			k.acceptHashes = ks.acceptHashes
+		case *rsaKey:
+			k.publicKey.acceptHashes = ks.acceptHashes
+		case *dsaPublicKey:
+			k.acceptP1363 = ks.acceptP1363
+		case *dsaKey:
+			k.publicKey.acceptP1363 = ks.acceptP1363
+		}
+	}
+}
+
+// trim 'kl' to the keys a verify may try.  If any were dropped, the error is ErrTooManyCandidates,
+// to be returned if none of those left verify.
+func (ks *keySigner) candidates(kl []keydata) ([]keydata, error) {
+	if ks.maxVerifyAttempts > 0 && len(kl) > ks.maxVerifyAttempts {
+		return kl[:ks.maxVerifyAttempts], ErrTooManyCandidates
+	}
+	return kl, nil
+}
+
+// the header version byte of issuer signatures.  The high bit keeps it clear of any future Keyczar versions.
+const kzIssuerVersion = uint8(0x80)
+
+// the bytes signed for an issuer signature of 'msg'
+func buildIssuerSignedBytes(msg []byte, issuer []byte) []byte {
+	signedbytes := make([]byte, 0, len(msg)+len(issuer)+2)
+	signedbytes = append(signedbytes, msg...)
+	return appendIssuerTrailer(signedbytes, issuer)
+}
+
+// append what follows the message in the bytes signed for an issuer signature
+func appendIssuerTrailer(b []byte, issuer []byte) []byte {
+	b = append(b, issuer...)
+	return append(b, byte(len(issuer)), kzIssuerVersion)
+}
+
+// the header of an issuer signature made with 'key'
+func makeIssuerHeader(key keydata, issuer []byte) []byte {
+	h := makeHeader(key)
+	h[0] = kzIssuerVersion
+	h = append(h, byte(len(issuer)))
+	return append(h, issuer...)
+}
+
+func (ks *keySigner) UnversionedSign(message []byte) (string, error) {
+
+	key := ks.keys().getPrimaryKey()
+
+	signingKey, ok := key.(signVerifyKey)
+	if !ok {
+		return "", ErrUnacceptablePurpose
+	}
+
+	signature, err := signingKey.Sign(message)
+
+	if err != nil {
+		return "", err
+	}
+
+	s := ks.encode(signature)
+
+	return s, nil
+}
+
+func (ks *keySigner) UnversionedVerify(message []byte, signature string) (bool, error) {
+
+	b, err := ks.decode(signature)
+
+	if err != nil {
+		return false, err
+	}
+
+	kz := ks.keys()
+
+	// without a key id, we have to check all the keys
+	kl, tooMany := ks.candidates(kz.verifyOrder())
+
+	for _, k := range kl {
+		verifyKey := k.(verifyKey)
+		// errors ignored here
+		valid, _ := verifyKey.Verify(message, b)
+		if valid {
+			return true, nil
+		}
+	}
+
+	if tooMany != nil {
+		return false, kz.named(tooMany)
+	}
+
+	return false, nil
+}
+
+// Verify the signature on 'msg'
+// All the heavy lifting is done by the key
+func (ks *keySigner) Verify(msg []byte, signature string) (bool, error) {
+
+	kz := ks.keys()
+	if kz.verified == nil {
+		_, valid, err := ks.VerifyIssuer(msg, signature)
+		return valid, err
+	}
+
+	key := verifyCacheKey(ks.Encoding(), msg, signature)
+	if kz.verified.contains(key) {
+		return true, nil
+	}
+
+	_, valid, err := ks.VerifyIssuer(msg, signature)
+	if valid && err == nil {
+		kz.verified.add(key)
+	}
+
+	return valid, err
+}
+
+// VerifyIssuer checks a signature like Verify, and if it was made by a Signer using WithIssuer,
+// also returns the issuer it carries.  The issuer is "" for standard signatures.
+func (ks *keySigner) VerifyIssuer(msg []byte, signature string) (string, bool, error) {
+
+	kz := ks.keys()
+
+	b, err := ks.decode(signature)
+	if err != nil {
+		return "", false, kz.named(ErrBase64Decoding)
+	}
+
+	if len(b) > 0 && b[0] == kzIssuerVersion {
+		return ks.verifyIssuer(kz, msg, b)
+	}
+
+	valid, err := ks.verify(kz, msg, b)
+	return "", valid, err
+}
+
+// A KeyIDVerifier is a Verifier that can require a signature to be from one particular key.
+// The Signers and Verifiers from NewSigner and NewVerifier implement it.
+type KeyIDVerifier interface {
+	Verifier
+	// VerifyFromKeyID is Verify for an unencoded signature, which must also be from the key with KeyID expectedKeyID
+	VerifyFromKeyID(message []byte, signature []byte, expectedKeyID []byte) (bool, error)
+}
+
+// VerifyFromKeyID checks an unencoded signature, as returned by SignBoth, like Verify, but first requires the
+// KeyID in its header to be 'expectedKeyID', returning ErrUnexpectedSigner if it isn't.  This pins the signature
+// to one key version, so that a valid signature from another key in the keyset isn't accepted, as while
+// moving trust from one key to the next.  Issuer signatures are accepted too.
+func (ks *keySigner) VerifyFromKeyID(msg []byte, signature []byte, expectedKeyID []byte) (bool, error) {
+
+	kz := ks.keys()
+
+	_, keyID, _, err := ParseHeader(signature)
+	if err != nil {
+		return false, kz.named(ErrShortSignature)
+	}
+
+	if subtle.ConstantTimeCompare(keyID, expectedKeyID) != 1 {
+		return false, kz.named(ErrUnexpectedSigner)
+	}
+
+	if signature[0] == kzIssuerVersion {
+		_, valid, err := ks.verifyIssuer(kz, msg, signature)
+		return valid, err
+	}
+
+	return ks.verify(kz, msg, signature)
+}
+
+// check an issuer signature, returning the issuer if it is valid
+func (ks *keySigner) verifyIssuer(kz *keyczar, msg []byte, b []byte) (string, bool, error) {
+
+	_, keyID, rest, err := ParseHeader(b)
+	if err != nil || len(rest) < 1 || len(rest)-1 < int(rest[0]) {
+		return "", false, kz.named(ErrShortSignature)
+	}
+
+	kl, err := kz.getKeyForID(keyID)
+	if err != nil {
+		return "", false, kz.named(err)
+	}
+
+	issuer := rest[1 : 1+rest[0]]
+	sig := rest[1+len(issuer):]
+
+	signedbytes := buildIssuerSignedBytes(msg, issuer)
+
+	kl, tooMany := ks.candidates(kl)
+
+	for _, k := range kl {
+		if valid, _ := k.(verifyKey).Verify(signedbytes, sig); valid {
+			return string(issuer), true, nil
+		}
+	}
+
+	if tooMany != nil {
+		return "", false, kz.named(tooMany)
+	}
+
+	return "", false, nil
+}
+
+// check a standard signature, already decoded
+func (ks *keySigner) verify(kz *keyczar, msg []byte, signature []byte) (bool, error) {
+
+	b, kl, err := splitHeaderBytes(ks.encodingController, kz, signature, ErrShortSignature)
+
+	if err != nil {
+		return false, kz.named(err)
+	}
+
+	signedbytes := make([]byte, len(msg)+1)
+	copy(signedbytes, msg)
+	signedbytes[len(msg)] = kzVersion
+
+	kl, tooMany := ks.candidates(kl)
+
+	for _, k := range kl {
+		sig := b[kzHeaderLength:]
+		verifyKey := k.(verifyKey)
+		valid, _ := verifyKey.Verify(signedbytes, sig)
+		if valid {
+			return true, nil
+		}
+	}
+
+	if tooMany != nil {
+		return false, kz.named(tooMany)
+	}
+
+	return false, nil
+}
+
+// VerifyReader is Verify for a message read from 'src'.
+// The message is hashed as it is read, once for each key that matches the signature header.
+// Ed25519 can't hash a message in pieces, so for Ed25519 keys the whole message is held in memory.
+func (ks *keySigner) VerifyReader(src io.Reader, signature string) (bool, error) {
+
+	kz := ks.keys()
+
+	b, kl, err := splitHeader(ks.encodingController, kz, signature, ErrShortSignature)
+
+	if err != nil {
+		return false, kz.named(err)
+	}
+
+	kl, tooMany := ks.candidates(kl)
+
+	keys := make([]digestVerifyKey, len(kl))
+	hashes := make([]hash.Hash, len(kl))
+	writers := make([]io.Writer, len(kl))
+
+	for i, k := range kl {
+		keys[i] = k.(digestVerifyKey)
+		hashes[i] = keys[i].newHash()
+		writers[i] = hashes[i]
+	}
+
+	if _, err := io.Copy(io.MultiWriter(writers...), src); err != nil {
+		return false, err
+	}
+
+	sig := b[kzHeaderLength:]
+
+	for i, k := range keys {
+		hashes[i].Write([]byte{kzVersion})
+		valid, _ := k.verifyDigest(hashes[i].Sum(nil), sig)
+		if valid {
+			return true, nil
+		}
+	}
+
+	if tooMany != nil {
+		return false, kz.named(tooMany)
+	}
+
+	return false, nil
+}
+
+// Return a signature for 'msg'
+// All the heavy lifting is done by the key
+func (ks *keySigner) Sign(msg []byte) (string, error) {
+
+	signature, err := ks.sign(msg)
+	if err != nil {
+		return "", err
+	}
+
+	s := ks.encode(signature)
+
+	return s, nil
+}
+
+// A RawSigner is a Signer that can return its signature unencoded as well, without signing twice.
+// The Signers from NewSigner implement it.
+type RawSigner interface {
+	Signer
+	// SignBoth signs once and returns the signature both as raw bytes and encoded with web-safe base64
+	SignBoth(message []byte) ([]byte, string, error)
+}
+
+// SignBoth returns the signature for 'msg' unencoded and as web-safe base64, regardless of the encoding setting
+func (ks *keySigner) SignBoth(msg []byte) ([]byte, string, error) {
+
+	signature, err := ks.sign(msg)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return signature, encodeWeb64String(signature), nil
+}
+
+// return the raw header and signature for 'msg' made with the primary key
+func (ks *keySigner) sign(msg []byte) ([]byte, error) {
+
+	key := ks.keys().getPrimaryKey()
+
+	signingKey, ok := key.(signVerifyKey)
+	if !ok {
+		return nil, ErrUnacceptablePurpose
+	}
+
+	if ks.issuer != nil {
+		signature, err := signingKey.Sign(buildIssuerSignedBytes(msg, ks.issuer))
+		if err != nil {
+			return nil, err
+		}
+
+		return append(makeIssuerHeader(key, ks.issuer), signature...), nil
+	}
+
+	signedbytes := make([]byte, len(msg)+1)
+	copy(signedbytes, msg)
+	signedbytes[len(msg)] = kzVersion
+
+	signature, err := signingKey.Sign(signedbytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	h := makeHeader(key)
+
+	return append(h, signature...), nil
+}
+
+func buildAttachedSignedBytes(msg []byte, nonce []byte) []byte {
+
+	signedBytesLen := len(msg) + 1
+	if nonce != nil {
+		signedBytesLen += 4 + len(nonce)
+	} else {
+		signedBytesLen += 4
+	}
+
+	signedbytes := make([]byte, signedBytesLen)
+	offs := 0
+	copy(signedbytes[offs:], msg)
+	offs += len(msg)
+	if nonce != nil {
+		binary.BigEndian.PutUint32(signedbytes[offs:], uint32(len(nonce)))
+		offs += 4
+		copy(signedbytes[offs:], nonce)
+		offs += len(nonce)
+	} else {
+		binary.BigEndian.PutUint32(signedbytes[offs:], uint32(0))
+		offs += 4
+	}
+	signedbytes[offs] = kzVersion
+
+	return signedbytes
+}
+
+// Verify the attached signature on 'msg', and return the signed data if valid
+// All the heavy lifting is done by the key
+func (ks *keySigner) AttachedVerify(signedMsg string, nonce []byte) ([]byte, error) {
+
+	kz := ks.keys()
+
+	b, kl, err := splitHeader(ks.encodingController, kz, signedMsg, ErrShortSignature)
+
+	if err != nil {
+		return nil, kz.named(err)
+	}
+
+	offs := kzHeaderLength
+
+	if len(b[offs:]) < 4 {
+		return nil, kz.named(ErrShortSignature)
+	}
+
+	msglen := int(binary.BigEndian.Uint32(b[offs:]))
+
+	offs += 4
+
+	if msglen > len(b[offs:]) {
+		return nil, kz.named(ErrShortSignature)
+	}
+
+	msg := b[offs : offs+msglen]
+	offs += msglen
+	sig := b[offs:]
+
+	signedbytes := buildAttachedSignedBytes(msg, nonce)
+
+	kl, tooMany := ks.candidates(kl)
+
+	for _, k := range kl {
+		verifyKey := k.(verifyKey)
+		valid, _ := verifyKey.Verify(signedbytes, sig)
+
+		if valid {
+			return msg, nil
+		}
+	}
+
+	if tooMany != nil {
+		return nil, kz.named(tooMany)
+	}
+
+	return nil, kz.named(ErrInvalidSignature)
+}
+
+// Return a signature for 'msg' and the nonce
+// All the heavy lifting is done by the key
+func (ks *keySigner) AttachedSign(msg []byte, nonce []byte) (string, error) {
+
+	key := ks.keys().getPrimaryKey()
+
+	signingKey, ok := key.(signVerifyKey)
+	if !ok {
+		return "", ErrUnacceptablePurpose
+	}
+
+	signedbytes := buildAttachedSignedBytes(msg, nonce)
+
+	signature, err := signingKey.Sign(signedbytes)
+
+	if err != nil {
+		return "", err
+	}
+
+	h := makeHeader(key)
+
+	signedMsg := make([]byte, kzHeaderLength+4+len(msg)+len(signature))
+	offs := 0
+	copy(signedMsg[offs:], h)
+	offs += kzHeaderLength
+	binary.BigEndian.PutUint32(signedMsg[offs:], uint32(len(msg)))
+	offs += 4
+	copy(signedMsg[offs:], msg)
+	offs += len(msg)
+	copy(signedMsg[offs:], signature)
+
+	s := ks.encode(signedMsg)
+
+	return s, nil
+}
+
+// TranslateSigned moves an attached signature from one trust domain to another: it checks 'blob' with
+// in.AttachedVerify and returns the message it carries attached-signed by 'out'.  Nothing is signed unless
+// the inbound signature is valid.  Both signatures use an empty nonce, and each side uses its own encoding.
+func TranslateSigned(blob string, in Verifier, out Signer) (string, error) {
+
+	msg, err := in.AttachedVerify(blob, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return out.AttachedSign(msg, nil)
+}
+
+const timestampSize = 8
+
+func buildTimeoutSignedBytes(msg []byte, expiration int64) []byte {
+
+	signedBytesLen := timestampSize + len(msg) + 1
+
+	signedbytes := make([]byte, signedBytesLen)
+	offs := 0
+
+	binary.BigEndian.PutUint64(signedbytes[offs:], uint64(expiration))
+	offs += timestampSize
+
+	copy(signedbytes[offs:], msg)
+	offs += len(msg)
+
+	signedbytes[offs] = kzVersion
+
+	return signedbytes
+}
+
+// construct and return a timeout signature
+func (ks *keySigner) TimeoutSign(msg []byte, expiration int64) (string, error) {
+
+	key := ks.keys().getPrimaryKey()
+
+	signingKey, ok := key.(signVerifyKey)
+	if !ok {
+		return "", ErrUnacceptablePurpose
+	}
+
+	h := makeHeader(key)
+
+	signedbytes := buildTimeoutSignedBytes(msg, expiration)
+
+	signature, err := signingKey.Sign(signedbytes)
+
+	if err != nil {
+		return "", err
+	}
+
+	signedMsg := make([]byte, kzHeaderLength+timestampSize+len(signature))
+	offs := 0
+
+	copy(signedMsg[offs:], h)
+	offs += kzHeaderLength
+
+	binary.BigEndian.PutUint64(signedMsg[offs:], uint64(expiration))
+	offs += timestampSize
+
+	copy(signedMsg[offs:], signature)
+
+	s := ks.encode(signedMsg)
+
+	return s, nil
+}
+
+// validate a timeout signature.  must be both cryptographically valid and not yet expired.
+func (ks *keySigner) TimeoutVerify(message []byte, signature string) (bool, error) {
+
+	_, valid, err := ks.VerifyTimeoutDetailed(message, signature)
+	if errors.Is(err, ErrSignatureExpired) {
+		return false, nil
+	}
+
+	return valid, err
+}
+
+// VerifyTimeoutDetailed checks a timeout signature like TimeoutVerify, and also returns the expiration it
+// carries, in milliseconds since 1/1/1970 GMT, once the signature has been found to be valid.
+// If it has expired, the expiration is returned with valid false and ErrSignatureExpired, so that callers
+// can log how long ago it ran out.  For an invalid signature the expiration isn't trusted and is 0.
+func (ks *keySigner) VerifyTimeoutDetailed(message []byte, signature string) (int64, bool, error) {
+
+	kz := ks.keys()
+
+	sig, kl, err := splitHeader(ks.encodingController, kz, signature, ErrShortSignature)
+
+	if err != nil {
+		return 0, false, kz.named(err)
+	}
+
+	offs := kzHeaderLength
+
+	if len(sig[offs:]) < timestampSize {
+		return 0, false, kz.named(ErrShortSignature)
+	}
+
+	expiration := int64(binary.BigEndian.Uint64(sig[offs:]))
+	offs += timestampSize
+
+	sig = sig[offs:]
+
+	signedbytes := buildTimeoutSignedBytes(message, expiration)
+	currentMillis := ks.currentTime()
+
+	kl, tooMany := ks.candidates(kl)
+
+	for _, k := range kl {
+		verifyKey := k.(verifyKey)
+		valid, _ := verifyKey.Verify(signedbytes, sig)
+		if valid {
+			if currentMillis >= expiration {
+				return expiration, false, kz.named(ErrSignatureExpired)
+			}
+			return expiration, true, nil
+		}
+	}
+
+	if tooMany != nil {
+		return 0, false, kz.named(tooMany)
+	}
+
+	return 0, false, nil
+}
+
+// A CrypterOption configures a Crypter made by NewCrypter
+type CrypterOption func(kc *keyCrypter) error
+
+// CrypterNamedErrors makes every error from the Crypter a KeyczarError naming the keyset, as in the metadata
+// "name", for telling keysets apart when several are loaded.  Without it only errors that already carry
+// other details are named, and the rest can still be compared to the errors in errors.go with ==.
+func CrypterNamedErrors() CrypterOption {
+	return func(kc *keyCrypter) error {
+		kc.nameErrors = true
+		return nil
+	}
+}
+
+// CrypterMinKeySize makes NewCrypter and Reload refuse a keyset with any key smaller than 'p' allows,
+// returning ErrKeyTooWeak.
+func CrypterMinKeySize(p KeySizePolicy) CrypterOption {
+	return func(kc *keyCrypter) error {
+		kc.minSize = p
+		return nil
+	}
+}
+
+// CrypterMagic makes the Crypter write 'magic', such as "DKZ1:", in front of every ciphertext from Encrypt and
+// WriteEncrypted, so that storage holding other data too can pick out dkeyczar blobs.  The magic goes before
+// the encoded ciphertext, outside the Keyczar header, and is not authenticated.  Decrypt then requires and strips
+// it, returning ErrBadMagic if it's missing, so only use it where every consumer is configured the same way:
+// other Keyczar implementations won't expect it.  EncryptBoth ignores it.
+func CrypterMagic(magic string) CrypterOption {
+	return func(kc *keyCrypter) error {
+		kc.magic = magic
+		return nil
+	}
+}
+
+// NewCrypter returns an object capable of encrypting and decrypting using the key provded by the reader
+func NewCrypter(r KeyReader, opts ...CrypterOption) (Crypter, error) {
+	return NewCrypterContext(context.Background(), r, opts...)
+}
+
+// NewCrypterContext is NewCrypter, giving up on loading the keys when ctx is done if r is a ContextKeyReader
+func NewCrypterContext(ctx context.Context, r KeyReader, opts ...CrypterOption) (Crypter, error) {
+	k := new(keyCrypter)
+
+	for _, opt := range opts {
+		if err := opt(k); err != nil {
+			return nil, err
+		}
+	}
+
+	k.load = func(ctx context.Context) (*keyczar, error) {
+		kz, err := loadKeyczar(withContext(ctx, r), P_DECRYPT_AND_ENCRYPT, true)
+		if err != nil {
+			return nil, err
+		}
+		k.ivs.watch(kz)
+		return kz, nil
+	}
+
+	err := k.ReloadContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// NewCrypterWithMAC is like NewCrypter, but authenticates the ciphertexts with the MACs returned by newMAC
+// instead of HMAC-SHA1.  The resulting ciphertexts can only be decrypted by a crypter using the same MAC.
+func NewCrypterWithMAC(r KeyReader, newMAC MACFactory) (Crypter, error) {
+	k := new(keyCrypter)
+	k.load = func(ctx context.Context) (*keyczar, error) {
+		kz, err := loadKeyczar(withContext(ctx, r), P_DECRYPT_AND_ENCRYPT, true)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range kz.keys {
+			if ak, ok := key.(*aesKey); ok {
+				ak.newMAC = newMAC
+			}
+		}
+
+		return kz, nil
+	}
+
+	err := k.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+func NewSignedEncrypter(r KeyReader, signer Signer, nonce []byte) (SignedEncrypter, error) {
+	k := new(keySignedEncypter)
+	var err error
+	k.kz, err = newKeyczar(r)
+	k.nonce = nonce
+	k.signer = signer
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !k.kz.isAcceptablePurpose(P_DECRYPT_AND_ENCRYPT) {
+		return nil, ErrUnacceptablePurpose
+	}
+
+	err = k.kz.loadPrimaryKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return k, err
+}
+
+func NewSignedDecrypter(r KeyReader, verifier Verifier, nonce []byte) (SignedDecrypter, error) {
+	k := new(keySignedDecrypter)
+	var err error
+	k.kz, err = newKeyczar(r)
+	k.nonce = nonce
+	k.verifier = verifier
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !k.kz.isAcceptablePurpose(P_DECRYPT_AND_ENCRYPT) {
+		return nil, ErrUnacceptablePurpose
+	}
+
+	err = k.kz.loadPrimaryKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return k, err
+}
+
+// keyEncrypter is the Encrypter returned by NewEncrypter.  Embedding only the interface hides the keyCrypter's
+// decrypting methods, so it can't be type-asserted to a Crypter.
+type keyEncrypter struct {
+	Encrypter
+}
+
+// NewEncrypter returns an object capable of encrypting using the key provded by the reader.
+// The reader may provide a public keyset, such as one exported with PubKeys, which is all encrypting needs.
+// If it provides a private one, only the public keys are kept, and the result can't decrypt in either case.
+func NewEncrypter(r KeyReader) (Encrypter, error) {
+	k := new(keyCrypter)
+	k.load = func(ctx context.Context) (*keyczar, error) {
+		kz, err := loadKeyczar(withContext(ctx, r), P_ENCRYPT, true)
+		if err != nil {
+			return nil, err
+		}
+
+		kz.dropPrivateKeys()
+
+		return kz, nil
+	}
+
+	err := k.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return &keyEncrypter{k}, nil
+}
+
+// NewVerifier returns an object capable of verifying signatures using the key provded by the reader
+// If the reader provides a private keyset, only the public keys are kept.
+// As in other Keyczar implementations, every version in the keyset verifies, including INACTIVE ones, so
+// signatures from a demoted key keep verifying until the version is removed from the keyset (revoked).
+func NewVerifier(r KeyReader, opts ...SignerOption) (Verifier, error) {
+	return NewVerifierContext(context.Background(), r, opts...)
+}
+
+// NewVerifierContext is NewVerifier, giving up on loading the keys when ctx is done if r is a ContextKeyReader
+func NewVerifierContext(ctx context.Context, r KeyReader, opts ...SignerOption) (Verifier, error) {
+	k := new(keySigner)
+	k.currentTime = currentMillis
+
+	for _, opt := range opts {
+		if err := opt(k); err != nil {
+			return nil, err
+		}
+	}
+
+	// a Verifier never signs, so an option that only changes signing would silently do nothing
+	if k.issuer != nil {
+		return nil, ErrSignerOnlyOption
+	}
+
+	k.load = func(ctx context.Context) (*keyczar, error) {
+		kz, err := loadVerifyKeyczar(withContext(ctx, r))
+		if err != nil {
+			return nil, err
+		}
+		k.prepare(kz)
+		return kz, nil
+	}
+
+	err := k.ReloadContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// NewVerifierFromRSAPublicKey returns an object capable of verifying Keyczar signatures made with the private half of 'pub'
+func NewVerifierFromRSAPublicKey(pub *rsa.PublicKey) (Verifier, error) {
+	return NewVerifier(newImportedRSAPublicKeyReader(pub, P_VERIFY))
+}
+
+// NewVerifierFromDSAPublicKey returns an object capable of verifying Keyczar signatures made with the private half of 'pub'
+func NewVerifierFromDSAPublicKey(pub *dsa.PublicKey) (Verifier, error) {
+	return NewVerifier(newImportedDSAPublicKeyReader(pub))
+}
+
+// NewVerifierFromPEM returns an object capable of verifying Keyczar signatures using the RSA or DSA public key in the PEM-encoded 'data'.
+// The key may be a PKIX "PUBLIC KEY" block, or a PKCS#1 "RSA PUBLIC KEY" block; other blocks return ErrUnsupportedType.
+func NewVerifierFromPEM(data []byte) (Verifier, error) {
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrUnsupportedType
+	}
+
+	var pub interface{}
+	var err error
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, ErrUnsupportedType
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return NewVerifierFromRSAPublicKey(pub)
+	case *dsa.PublicKey:
+		return NewVerifierFromDSAPublicKey(pub)
+	}
+
+	return nil, ErrUnsupportedType
+}
+
+// NewVerifierTimeProvider returns an object verifying signatures valid for a certain period
+func NewVerifierTimeProvider(r KeyReader, t currentTime) (Verifier, error) {
+	return NewVerifier(r, WithTimeProvider(t))
+}
+
+// NewSigner returns an object capable of creating and verifying signatures using the key provded by the reader
+func NewSigner(r KeyReader, opts ...SignerOption) (Signer, error) {
+	k := new(keySigner)
+	k.currentTime = currentMillis
+
+	for _, opt := range opts {
+		if err := opt(k); err != nil {
+			return nil, err
+		}
+	}
+
+	k.load = func(ctx context.Context) (*keyczar, error) {
+		kz, err := loadKeyczar(withContext(ctx, r), P_SIGN_AND_VERIFY, true)
+		if err != nil {
+			return nil, err
+		}
+		k.prepare(kz)
+		return kz, nil
+	}
+
+	err := k.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// NewSessionEncrypter returns an Encrypter that has been initailized with a random session key.  This key material is encrypted with crypter and returned.
+func NewSessionEncrypter(encrypter Encrypter) (Crypter, string, error) {
+
+	aeskey, err := generateAESKey(0)
+	if err != nil {
+		return nil, "", err
+	}
+	r := newImportedAESKeyReader(aeskey)
+
+	keys, err := encrypter.Encrypt(aeskey.packedKeys())
+	if err != nil {
+		return nil, "", err
+	}
+	sessionCrypter, err := NewCrypter(r)
+
+	return sessionCrypter, keys, err
+}
+
+// EncryptSessions encrypts many payloads for the same recipient under a single session key, so the
+// (possibly expensive) encryption of the session key with encrypter is done once for the whole batch.
+// It returns the encrypted session key and the ciphertexts, which NewSessionDecrypter and DecryptBatch
+// will decrypt.
+//
+// Each payload gets its own IV and HMAC, but they all share the one key: anyone who recovers the
+// session key for one payload can decrypt every payload in the batch, and the payloads can be
+// swapped for one another without detection.  Only batch payloads that are always handled together.
+func EncryptSessions(encrypter Encrypter, payloads [][]byte) (string, []string, error) {
+
+	sessionCrypter, keys, err := NewSessionEncrypter(encrypter)
+	if err != nil {
+		return "", nil, err
+	}
+
+	ciphertexts, err := sessionCrypter.(BatchEncrypter).EncryptBatch(payloads)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return keys, ciphertexts, nil
+}
+
+// NewSessionDecrypter decrypts the sessionKeys string and returns a new Crypter using these keys.
+func NewSessionDecrypter(crypter Crypter, sessionKeys string) (Crypter, error) {
+
+	packedKeys, err := crypter.Decrypt(sessionKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	aeskey, err := newAESFromPackedKeys(packedKeys)
+	if err != nil {
+		return nil, err
+	}
+	r := newImportedAESKeyReader(aeskey)
+
+	return NewCrypter(r)
+}
+
+// NewSignedSessionEncrypter returns an Encrypter that has been initailized with a random session key.  This key material is encrypted with crypter and returned.
+func NewSignedSessionEncrypter(encrypter Encrypter, signer Signer) (SignedEncrypter, string, error) {
+
+	aeskey, err := generateAESKey(0)
+	if err != nil {
+		return nil, "", err
+	}
+	r := newImportedAESKeyReader(aeskey)
+
+	nonce := make([]byte, 16)
+	if err := randBytes(nonce); err != nil {
+		return nil, "", err
+	}
+
+	sm := new(sessionMaterial)
+	sm.key = *aeskey
+	sm.nonce = nonce
+
+	keys, err := encrypter.Encrypt(sm.ToSessionMaterialJSON())
+	if err != nil {
+		return nil, "", err
+	}
+
+	sessionCrypter, err := NewSignedEncrypter(r, signer, nonce)
+
+	return sessionCrypter, keys, err
+}
+
+// NewSignedSessionDecrypter decrypts the sessionKeys string and returns a new Crypter using these keys.
+func NewSignedSessionDecrypter(crypter Crypter, verifier Verifier, sessionKeys string) (SignedDecrypter, error) {
+
+	smJSON, err := crypter.Decrypt(sessionKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	sm, err := newSessionMaterialFromJSON(smJSON)
+	if err != nil {
+		return nil, err
+	}
+	r := newImportedAESKeyReader(&sm.key)
+
+	return NewSignedDecrypter(r, verifier, sm.nonce)
+}
+
+// NewSignedKeysSessionEncrypter is NewSessionEncrypter with sender authentication: the session
+// key material, encrypted with encrypter, is also signed with signer, so a recipient can tell who
+// chose the session key before using it.  Unlike NewSignedSessionEncrypter, the ciphertexts
+// themselves are not signed; they are still authenticated by the session key's HMAC.
+//
+// The returned session string is an attached signature (see AttachedSign) with no nonce whose
+// message is the raw ciphertext of the session material:
+//
+//	|header|len|ciphertext|signature|
+//
+// where header is the signing key's, len is the big-endian uint32 length of ciphertext, and the
+// whole is encoded with signer's encoding.
+func NewSignedKeysSessionEncrypter(encrypter Encrypter, signer Signer) (Crypter, string, error) {
+
+	aeskey, err := generateAESKey(0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	keys, err := encryptRaw(encrypter, aeskey.packedKeys())
+	if err != nil {
+		return nil, "", err
+	}
+
+	signedKeys, err := signer.AttachedSign(keys, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sessionCrypter, err := NewCrypter(newImportedAESKeyReader(aeskey))
+
+	return sessionCrypter, signedKeys, err
+}
+
+// return the unencoded ciphertext of 'plaintext', from EncryptBoth if 'e' is a RawEncrypter
+func encryptRaw(e Encrypter, plaintext []byte) ([]byte, error) {
+
+	if re, ok := e.(RawEncrypter); ok {
+		ciphertext, _, err := re.EncryptBoth(plaintext)
+		return ciphertext, err
+	}
+
+	s, err := e.Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	ec := encodingController{encoding: e.Encoding()}
+
+	return ec.decode(s)
+}
+
+// NewSignedKeysSessionDecrypter checks the signature on a session string from
+// NewSignedKeysSessionEncrypter with verifier, and only then decrypts the session key material
+// with crypter and returns a new Crypter using it.
+func NewSignedKeysSessionDecrypter(crypter Crypter, verifier Verifier, signedKeys string) (Crypter, error) {
+
+	keys, err := verifier.AttachedVerify(signedKeys, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// crypter expects its own encoding
+	ec := encodingController{encoding: crypter.Encoding()}
+
+	return NewSessionDecrypter(crypter, ec.encode(keys))
+}
+
+func (kz *keyczar) loadPrimaryKey() error {
+
+	// search for the primary key
+	kz.primary = -1
+	for _, v := range kz.keymeta.Versions {
+		if v.Status == S_PRIMARY {
+			if kz.primary == -1 {
+				kz.primary = v.VersionNumber
+			} else {
+				return ErrNoPrimaryKey // technically, ErrMultiplePrimaryKey
+			}
+		}
+	}
+
+	// not found :(
+	if kz.primary == -1 {
+		return ErrNoPrimaryKey
+	}
+
+	return nil
+
+}
+
+func (kz *keyczar) getPrimaryKey() keydata {
+	if kz.primary == -1 {
+		return nil
+	}
+	return kz.keys[kz.primary]
+}
+
+// return every key in the order UnversionedVerify tries them: the primary, then the active and then the
+// inactive keys, newest first.  The order is fixed so that MaxVerifyAttempts always keeps the same keys.
+func (kz *keyczar) verifyOrder() []keydata {
+
+	status := make(map[int]keyStatus, len(kz.keymeta.Versions))
+	for _, v := range kz.keymeta.Versions {
+		status[v.VersionNumber] = v.Status
+	}
+
+	versions := kz.versions()
+	sort.Slice(versions, func(i, j int) bool {
+		if si, sj := status[versions[i]], status[versions[j]]; si != sj {
+			return si < sj
+		}
+		return versions[i] > versions[j]
+	})
+
+	kl := make([]keydata, 0, len(versions))
+	for _, version := range versions {
+		kl = append(kl, kz.keys[version])
+	}
+
+	return kl
+}
+
+// add the name of this keyset to 'err', if it has one.  Bare errors are left alone, so they can still
+// be compared with ==, unless the keyset was loaded with CrypterNamedErrors or SignerNamedErrors.
+func (kz *keyczar) named(err error) error {
+	var kerr *KeyczarError
+	if !kz.nameErrors && !errors.As(err, &kerr) {
+		return err
+	}
+	return withKeyset(err, kz.keymeta.Name)
+}
+
+// return the key version numbers in ascending order
+func (kz *keyczar) versions() []int {
+
+	versions := make([]int, 0, len(kz.keys))
+	for version := range kz.keys {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+
+	return versions
+}
+
+// replace any private keys with their public halves, so the private material is no longer reachable
+func (kz *keyczar) dropPrivateKeys() {
+
+	switch kz.keymeta.Type {
+	case T_DSA_PRIV:
+		kz.keymeta.Type = T_DSA_PUB
+	case T_RSA_PRIV:
+		kz.keymeta.Type = T_RSA_PUB
+	case T_ED25519_PRIV:
+		kz.keymeta.Type = T_ED25519_PUB
+	default:
+		return
+	}
+
+	kz.keymeta.Purpose = kz.keymeta.Purpose.publicPurpose()
+
+	for version, k := range kz.keys {
+		switch k := k.(type) {
+		case *dsaKey:
+			kz.keys[version] = &k.publicKey
+		case *rsaKey:
+			kz.keys[version] = &k.publicKey
+		case *ed25519Key:
+			kz.keys[version] = &k.publicKey
+		}
+	}
+
+	kz.idkeys = kz.idkeys[:0]
+	for _, version := range kz.versions() {
+		kz.idkeys = append(kz.idkeys, kz.keys[version])
+	}
+}
+
+func (kz *keyczar) isAcceptablePurpose(purpose keyPurpose) bool {
+	return kz.keymeta.Purpose.isAcceptablePurpose(purpose)
+}
+
+type lookupKeyIDer interface {
+	getKeyForID(id []byte) ([]keydata, error)
+}
+
+// return the keys whose KeyID is 'id'.
+// Every key's id is compared in constant time, so the time taken doesn't reveal which key matched.
+func (kz *keyczar) getKeyForID(id []byte) ([]keydata, error) {
+
+	var kl []keydata
+
+	for _, k := range kz.idkeys {
+		if subtle.ConstantTimeCompare(k.KeyID(), id) == 1 {
+			kl = append(kl, k)
+		}
+	}
+
+	if len(kl) == 0 {
+		return nil, ErrKeyNotFound
+	}
+
+	return kl, nil
+}
+
+func newKeysFromReader(r KeyReader, kz *keyczar, keyFromJSON func([]byte) (keydata, error)) (map[int]keydata, []keydata, error) {
+
+	keys := make(map[int]keydata)
+	var idkeys []keydata
+	for _, kv := range kz.keymeta.Versions {
+		if kv.Status == S_PRIMARY {
+			kz.primary = kv.VersionNumber
+		}
+		s, err := r.GetKey(kv.VersionNumber)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// encrypted key material can only be parsed if a reader on the way in decrypted it,
+		// and ciphertext is never valid JSON
+		if kz.keymeta.Encrypted && !json.Valid([]byte(s)) {
+			return nil, nil, ErrKeysetEncrypted
+		}
 
-	if err != nil {
-		return nil, err
-	}
+		k, err := keyFromJSON([]byte(s))
+		if err != nil {
+			return nil, nil, withVersion(err, kv.VersionNumber)
+		}
 
-	if !k.kz.isAcceptablePurpose(P_ENCRYPT) {
-		return nil, ErrUnacceptablePurpose
+		keys[kv.VersionNumber] = k
+		idkeys = append(idkeys, k)
 	}
 
-	err = k.kz.loadPrimaryKey()
-	if err != nil {
-		return nil, err
+	if err := resolveSharedHMACKeys(keys); err != nil {
+		return nil, nil, err
 	}
 
-	return k, err
+	return keys, idkeys, nil
 }
 
-// NewVerifier returns an object capable of verifying signatures using the key provded by the reader
-func NewVerifier(r KeyReader) (Verifier, error) {
-	k := new(keySigner)
-	k.currentTime = func() int64 {
-		return time.Now().UnixNano() / int64(time.Millisecond)
-	}
-	var err error
-	k.kz, err = newKeyczar(r)
+// give the AES keys that refer to another version's HMAC key a copy of it.  Only keys that
+// embed their HMAC key can be referred to, so references don't chain.
+func resolveSharedHMACKeys(keys map[int]keydata) error {
 
-	if err != nil {
-		return nil, err
+	var shared []int
+
+	for version, k := range keys {
+		ak, ok := k.(*aesKey)
+		if !ok || ak.hmacKeyVersion == 0 {
+			continue
+		}
+		if hk, ok := keys[ak.hmacKeyVersion].(*aesKey); !ok || hk.hmacKeyVersion != 0 {
+			return withVersion(newFieldError(ErrNoSuchKeyVersion, "hmacKeyVersion"), version)
+		}
+		shared = append(shared, version)
 	}
 
-	if !k.kz.isAcceptablePurpose(P_VERIFY) {
-		return nil, ErrUnacceptablePurpose
+	for _, version := range shared {
+		ak := keys[version].(*aesKey)
+		ak.hmacKey = keys[ak.hmacKeyVersion].(*aesKey).hmacKey
+		ak.hmacKeyVersion = 0
 	}
 
-	return k, err
+	return nil
 }
 
-// NewVerifierTimeProvider returns an object verifying signatures valid for a certain period
-func NewVerifierTimeProvider(r KeyReader, t currentTime) (Verifier, error) {
-	k := new(keySigner)
-	k.currentTime = t
-	var err error
-	k.kz, err = newKeyczar(r)
+// ValidateKeyset loads the keyset from the reader and checks each of its keys for the keyset's purpose:
+// keys of a DECRYPT_AND_ENCRYPT keyset are used to encrypt and decrypt a test message, and keys of a
+// SIGN_AND_VERIFY keyset to sign and verify one.  Public keys can't be tried out that way, so for ENCRYPT
+// and VERIFY keysets their parameters are checked instead, and ENCRYPT keys encrypt a test message.
+// A keyset meant for encrypting or signing must also have a primary key.
+// A key that fails is reported with its version.
+func ValidateKeyset(r KeyReader) error {
 
+	kz, err := newKeyczar(r)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if !k.kz.isAcceptablePurpose(P_VERIFY) {
-		return nil, ErrUnacceptablePurpose
+	switch kz.keymeta.Purpose {
+	case P_DECRYPT_AND_ENCRYPT, P_ENCRYPT, P_SIGN_AND_VERIFY:
+		if err := kz.loadPrimaryKey(); err != nil {
+			return kz.named(err)
+		}
 	}
 
-	return k, err
+	for _, version := range kz.versions() {
+		if err := validateKey(kz.keymeta.Purpose, kz.keys[version]); err != nil {
+			return kz.named(withVersion(err, version))
+		}
+	}
+
+	return nil
 }
 
-// NewSigner returns an object capable of creating and verifying signatures using the key provded by the reader
-func NewSigner(r KeyReader) (Signer, error) {
-	k := new(keySigner)
-	var err error
-	k.kz, err = newKeyczar(r)
+// check that 'k' works for 'purpose'.  The purpose decides what is tried, since
+// some keys, like RSA ones, can both decrypt and sign.
+func validateKey(purpose keyPurpose, k keydata) error {
 
-	if err != nil {
-		return nil, err
-	}
+	msg := []byte("keyczar keyset validation")
 
-	if !k.kz.isAcceptablePurpose(P_SIGN_AND_VERIFY) {
-		return nil, ErrUnacceptablePurpose
-	}
+	switch purpose {
+	case P_DECRYPT_AND_ENCRYPT:
+		dk, ok := k.(decryptEncryptKey)
+		if !ok {
+			return ErrNoPrivateKey
+		}
+		c, err := dk.Encrypt(msg)
+		if err != nil {
+			return err
+		}
+		p, err := dk.Decrypt(c)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(p, msg) {
+			return ErrKeyCheckFailed
+		}
 
-	err = k.kz.loadPrimaryKey()
-	if err != nil {
-		return nil, err
-	}
+	case P_SIGN_AND_VERIFY:
+		sk, ok := k.(signVerifyKey)
+		if !ok {
+			return ErrNoPrivateKey
+		}
+		sig, err := sk.Sign(msg)
+		if err != nil {
+			return err
+		}
+		ok, err = sk.Verify(msg, sig)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrKeyCheckFailed
+		}
 
-	return k, err
-}
+	case P_ENCRYPT:
+		if err := checkPublicKey(k); err != nil {
+			return err
+		}
+		ek, ok := k.(encryptKey)
+		if !ok {
+			return ErrUnacceptablePurpose
+		}
+		if _, err := ek.Encrypt(msg); err != nil {
+			return err
+		}
 
-// NewSessionEncrypter returns an Encrypter that has been initailized with a random session key.  This key material is encrypted with crypter and returned.
-func NewSessionEncrypter(encrypter Encrypter) (Crypter, string, error) {
+	case P_VERIFY:
+		return checkPublicKey(k)
 
-	aeskey, _ := generateAESKey(0) // shouldn't fail
-	r := newImportedAESKeyReader(aeskey)
+	default:
+		return ErrUnacceptablePurpose
+	}
 
-	keys, err := encrypter.Encrypt(aeskey.packedKeys())
-	if err != nil {
-		return nil, "", err
+	return nil
+}
+
+// check the parameters of the public key 'k', or the public half of a private key
+func checkPublicKey(k keydata) error {
+
+	switch k := k.(type) {
+	case *rsaKey:
+		return checkPublicKey(&k.publicKey)
+	case *dsaKey:
+		return checkPublicKey(&k.publicKey)
+	case *rsaPublicKey:
+		// the exponent must be odd to be invertible, and so must the product of two odd primes
+		if k.key.E < 3 || k.key.E%2 == 0 {
+			return newFieldError(ErrKeyCheckFailed, "publicExponent")
+		}
+		if k.key.N.Bit(0) == 0 {
+			return newFieldError(ErrKeyCheckFailed, "modulus")
+		}
+	case *dsaPublicKey:
+		return checkDSAParameters(&k.key, "")
+	case *ed25519Key, *ed25519PublicKey:
+		// only the length can be checked, and that was done when it was loaded
+	default:
+		return ErrUnacceptablePurpose
 	}
-	sessionCrypter, err := NewCrypter(r)
 
-	return sessionCrypter, keys, err
+	return nil
 }
 
-// NewSessionDecrypter decrypts the sessionKeys string and returns a new Crypter using these keys.
-func NewSessionDecrypter(crypter Crypter, sessionKeys string) (Crypter, error) {
+// GenerateChecksum returns a digest of the keyset that operators can store apart from it and
+// later pass to VerifyChecksum, to detect key files or metadata that were swapped or edited.
+// It covers the metadata and, for each version, its number, KeyID and key material.
+// It is an integrity manifest only: anyone who can read the keyset can compute it.
+func GenerateChecksum(r KeyReader) (string, error) {
 
-	packedKeys, err := crypter.Decrypt(sessionKeys)
+	kz, err := newKeyczar(r)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	aeskey, err := newAESFromPackedKeys(packedKeys)
+	sum, err := kz.checksum()
 	if err != nil {
-		return nil, err
+		return "", kz.named(err)
 	}
-	r := newImportedAESKeyReader(aeskey)
 
-	return NewCrypter(r)
+	return encodeWeb64String(sum), nil
 }
 
-// NewSignedSessionEncrypter returns an Encrypter that has been initailized with a random session key.  This key material is encrypted with crypter and returned.
-func NewSignedSessionEncrypter(encrypter Encrypter, signer Signer) (SignedEncrypter, string, error) {
-
-	aeskey, _ := generateAESKey(0) // shouldn't fail
-	r := newImportedAESKeyReader(aeskey)
+// VerifyChecksum reports whether the keyset still matches a checksum from GenerateChecksum
+func VerifyChecksum(r KeyReader, checksum string) (bool, error) {
 
-	nonce := make([]byte, 16)
-	io.ReadFull(rand.Reader, nonce)
-
-	sm := new(sessionMaterial)
-	sm.key = *aeskey
-	sm.nonce = nonce
+	want, err := decodeWeb64String(checksum)
+	if err != nil {
+		return false, ErrBase64Decoding
+	}
 
-	keys, err := encrypter.Encrypt(sm.ToSessionMaterialJSON())
+	kz, err := newKeyczar(r)
 	if err != nil {
-		return nil, "", err
+		return false, err
 	}
 
-	sessionCrypter, err := NewSignedEncrypter(r, signer, nonce)
+	sum, err := kz.checksum()
+	if err != nil {
+		return false, kz.named(err)
+	}
 
-	return sessionCrypter, keys, err
+	return subtle.ConstantTimeCompare(sum, want) == 1, nil
 }
 
-// NewSignedSessionDecrypter decrypts the sessionKeys string and returns a new Crypter using these keys.
-func NewSignedSessionDecrypter(crypter Crypter, verifier Verifier, sessionKeys string) (SignedDecrypter, error) {
+// KeysetContains reports whether 'superset' can verify everything 'subset' can: every key in 'subset'
+// must have a key in 'superset' with the same KeyID and the same public parameters.
+// Private keys are compared by their public halves, so a private keyset contains its exported public one.
+// Version numbers and status are ignored.
+func KeysetContains(superset, subset KeyReader) (bool, error) {
 
-	smJSON, err := crypter.Decrypt(sessionKeys)
+	sup, err := newKeyczar(superset)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	sm, err := newSessionMaterialFromJSON(smJSON)
+	sub, err := newKeyczar(subset)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	r := newImportedAESKeyReader(&sm.key)
 
-	return NewSignedDecrypter(r, verifier, sm.nonce)
-}
+	sup.dropPrivateKeys()
+	sub.dropPrivateKeys()
 
-func (kz *keyczar) loadPrimaryKey() error {
+	for _, k := range sub.idkeys {
+		kl, err := sup.getKeyForID(k.KeyID())
+		if err == ErrKeyNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, sup.named(err)
+		}
 
-	// search for the primary key
-	kz.primary = -1
-	for _, v := range kz.keymeta.Versions {
-		if v.Status == S_PRIMARY {
-			if kz.primary == -1 {
-				kz.primary = v.VersionNumber
-			} else {
-				return ErrNoPrimaryKey // technically, ErrMultiplePrimaryKey
+		found := false
+		for _, sk := range kl {
+			if bytes.Equal(sk.ToKeyJSON(), k.ToKeyJSON()) {
+				found = true
+				break
 			}
 		}
+		if !found {
+			return false, nil
+		}
 	}
 
-	// not found :(
-	if kz.primary == -1 {
-		return ErrNoPrimaryKey
+	return true, nil
+}
+
+// return a copy of the AES keyset 'kz' with every key derived from 'label'
+func (kz *keyczar) derive(label []byte) (*keyczar, error) {
+
+	d := &keyczar{keymeta: kz.keymeta, keys: make(map[int]keydata, len(kz.keys)), primary: kz.primary}
+
+	derived := make(map[keydata]keydata, len(kz.keys))
+	for version, k := range kz.keys {
+		dk, err := k.(*aesKey).derive(label)
+		if err != nil {
+			return nil, kz.named(err)
+		}
+		d.keys[version] = dk
+		derived[k] = dk
 	}
 
-	return nil
+	for _, k := range kz.idkeys {
+		d.idkeys = append(d.idkeys, derived[k])
+	}
 
+	return d, nil
 }
 
-func (kz *keyczar) getPrimaryKey() keydata {
-	if kz.primary == -1 {
-		return nil
+// hash the metadata, then each version's number, KeyID and key material in version order.
+// KeyIDs are only 4 bytes, so the key material is hashed in full to make swapped keys hard to disguise.
+func (kz *keyczar) checksum() ([]byte, error) {
+
+	meta, err := json.Marshal(kz.keymeta)
+	if err != nil {
+		return nil, err
 	}
-	return kz.keys[kz.primary]
-}
 
-func (kz *keyczar) isAcceptablePurpose(purpose keyPurpose) bool {
-	return kz.keymeta.Purpose.isAcceptablePurpose(purpose)
-}
+	h := sha256.New()
+	h.Write(lenPrefixPack(meta))
 
-type lookupKeyIDer interface {
-	getKeyForID(id []byte) ([]keydata, error)
-}
+	for _, version := range kz.versions() {
+		k := kz.keys[version]
 
-func (kz *keyczar) getKeyForID(id []byte) ([]keydata, error) {
+		v := make([]byte, 4)
+		binary.BigEndian.PutUint32(v, uint32(version))
 
-	kl, ok := kz.idkeys[binary.BigEndian.Uint32(id)]
+		material := sha256.Sum256(k.ToKeyJSON())
 
-	if !ok || len(kl) == 0 {
-		return kl, ErrKeyNotFound
+		h.Write(lenPrefixPack(v, k.KeyID(), material[:]))
 	}
 
-	return kl, nil
+	return h.Sum(nil), nil
 }
 
-func newKeysFromReader(r KeyReader, kz *keyczar, keyFromJSON func([]byte) (keydata, error)) (map[int]keydata, map[uint32][]keydata, error) {
+// construct a keyczar object from a reader and check it can be used for 'purpose'
+func loadKeyczar(r KeyReader, purpose keyPurpose, needPrimary bool) (*keyczar, error) {
 
-	keys := make(map[int]keydata)
-	idkeys := make(map[uint32][]keydata)
-	for _, kv := range kz.keymeta.Versions {
-		if kv.Status == S_PRIMARY {
-			kz.primary = kv.VersionNumber
-		}
-		s, err := r.GetKey(kv.VersionNumber)
-		if err != nil {
-			return nil, nil, err
+	kz, err := newKeyczar(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !kz.isAcceptablePurpose(purpose) {
+		// the public half of a keyset is fine for the right job, but can't decrypt or sign
+		if purpose.publicPurpose() == kz.keymeta.Purpose {
+			return nil, ErrNoPrivateKey
 		}
+		return nil, ErrUnacceptablePurpose
+	}
 
-		k, err := keyFromJSON([]byte(s))
+	if needPrimary {
+		err = kz.loadPrimaryKey()
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
+	}
 
-		keys[kv.VersionNumber] = k
-		//initialize fast lookup for keys
-		hash := binary.BigEndian.Uint32(k.KeyID())
-		kl := idkeys[hash]
-		kl = append(kl, k)
-		idkeys[hash] = kl
+	return kz, nil
+}
+
+// construct a keyczar object for verification only, keeping just the public keys of a private keyset
+func loadVerifyKeyczar(r KeyReader) (*keyczar, error) {
+
+	kz, err := loadKeyczar(r, P_VERIFY, false)
+	if err != nil {
+		return nil, err
 	}
 
-	return keys, idkeys, nil
+	kz.dropPrivateKeys()
+
+	return kz, nil
 }
 
 // construct a keyczar object from a reader for a given purpose
@@ -948,9 +2967,30 @@ func newKeyczar(r KeyReader) (*keyczar, error) {
 		return nil, err
 	}
 
+	// a public keyset can't be used for decrypting or signing, whatever its metadata claims
+	if !kz.keymeta.Type.isPrivate() {
+		switch kz.keymeta.Purpose {
+		case P_DECRYPT_AND_ENCRYPT, P_SIGN_AND_VERIFY:
+			return nil, ErrNoPrivateKey
+		}
+	}
+
+	f := keyParser(kz.keymeta.Type)
+	if f == nil {
+		return nil, ErrUnsupportedType
+	}
+
+	kz.keys, kz.idkeys, err = newKeysFromReader(r, kz, f)
+
+	return kz, err
+}
+
+// return the function that parses the key JSON for keys of type 't', or nil if the type isn't supported
+func keyParser(t keyType) func(s []byte) (keydata, error) {
+
 	var f func(s []byte) (keydata, error)
 
-	switch kz.keymeta.Type {
+	switch t {
 	case T_AES:
 		f = func(s []byte) (keydata, error) { return newAESKeyFromJSON(s) }
 	case T_HMAC_SHA1:
@@ -963,13 +3003,21 @@ func newKeyczar(r KeyReader) (*keyczar, error) {
 		f = func(s []byte) (keydata, error) { return newRSAKeyFromJSON(s) }
 	case T_RSA_PUB:
 		f = func(s []byte) (keydata, error) { return newRSAPublicKeyFromJSON(s) }
+	case T_ED25519_PRIV:
+		f = func(s []byte) (keydata, error) { return newEd25519KeyFromJSON(s) }
+	case T_ED25519_PUB:
+		f = func(s []byte) (keydata, error) { return newEd25519PublicKeyFromJSON(s) }
 	default:
-		return nil, ErrUnsupportedType
+		return nil
 	}
 
-	kz.keys, kz.idkeys, err = newKeysFromReader(r, kz, f)
-
-	return kz, err
+	// make sure the key material is the type the metadata says it is before parsing it
+	return func(s []byte) (keydata, error) {
+		if err := t.checkKeyJSON(s); err != nil {
+			return nil, err
+		}
+		return f(s)
+	}
 }
 
 const kzVersion = uint8(0)
@@ -980,6 +3028,15 @@ type kHeader struct {
 	keyid   [4]uint8
 }
 
+// report whether ciphertexts made with 'k' carry an integrity check.  The header version is the same for
+// every format, so it's the key that tells.  RSA-OAEP has none: anyone with the public key can encrypt.
+func isAuthenticatedKey(k keydata) bool {
+
+	// AES ciphertexts always carry a MAC
+	_, ok := k.(*aesKey)
+	return ok
+}
+
 // make and return a header for the given key
 func makeHeader(key keydata) []byte {
 	b := make([]byte, kzHeaderLength)
@@ -989,46 +3046,132 @@ func makeHeader(key keydata) []byte {
 	return b
 }
 
-func splitHeaderBytes(ec encodingController, lookup lookupKeyIDer, cryptotext []byte, errTooShort error) ([]byte, []keydata, error) {
-
-	b := cryptotext
+// ParseHeader splits a raw (already decoded) ciphertext or signature into the version byte and KeyID
+// of its header and the bytes that follow.  It returns ErrShortHeader if b is too short to hold a header.
+// The version isn't checked, and keyID and rest share b's storage.
+func ParseHeader(b []byte) (version byte, keyID []byte, rest []byte, err error) {
 
 	if len(b) < kzHeaderLength {
+		return 0, nil, nil, ErrShortHeader
+	}
+
+	return b[0], b[1:kzHeaderLength], b[kzHeaderLength:], nil
+}
+
+// HeaderInfo returns the version byte and KeyID from the header of a raw (already decoded) ciphertext or
+// signature, for routing messages by key without loading any keys.  It returns ErrShortHeader if blob is
+// too short to hold a header, and ErrBadVersion, along with the header, if the version isn't one this package
+// produces.  Nothing after the header is looked at.
+func HeaderInfo(blob []byte) (version byte, keyID [4]byte, err error) {
+
+	version, id, _, err := ParseHeader(blob)
+	if err != nil {
+		return 0, keyID, err
+	}
+
+	copy(keyID[:], id)
+
+	if version != kzVersion && version != kzIssuerVersion && version != kzFooterVersion {
+		return version, keyID, ErrBadVersion
+	}
+
+	return version, keyID, nil
+}
+
+// check the header of 'cryptotext' and return the keys that might have produced it
+func splitHeaderBytes(ec encodingController, lookup lookupKeyIDer, cryptotext []byte, errTooShort error) ([]byte, []keydata, error) {
+
+	version, keyID, _, err := ParseHeader(cryptotext)
+	if err != nil {
 		return nil, nil, errTooShort
 	}
 
-	if b[0] != kzVersion {
+	if version != kzVersion {
 		return nil, nil, ErrBadVersion
 	}
 
-	k, err := lookup.getKeyForID(b[1:5])
+	k, err := lookup.getKeyForID(keyID)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	return b, k, nil
+	return cryptotext, k, nil
 }
 
+// decode 'cryptotext', then check its header and return the keys that might have produced it
 func splitHeader(ec encodingController, lookup lookupKeyIDer, cryptotext string, errTooShort error) ([]byte, []keydata, error) {
 
+	b, err := decodeCryptotext(ec, cryptotext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return splitHeaderBytes(ec, lookup, b, errTooShort)
+}
+
+// decode 'cryptotext', reporting any failure other than a missing magic as ErrBase64Decoding
+func decodeCryptotext(ec encodingController, cryptotext string) ([]byte, error) {
+
 	b, err := ec.decode(cryptotext)
 
+	if err == ErrBadMagic {
+		return nil, err
+	}
 	if err != nil {
-		return nil, nil, ErrBase64Decoding
+		return nil, ErrBase64Decoding
 	}
 
-	if len(b) < kzHeaderLength {
-		return nil, nil, errTooShort
+	return b, nil
+}
+
+// SignatureInfo describes the structure of a signature, as reported by InspectSignature
+type SignatureInfo struct {
+	Version        uint8    // version byte from the header
+	KeyID          []byte   // key id from the header
+	Algorithm      string   // best guess at the signing algorithm: "HMAC_SHA1", "HMAC_SHA256", "DSA", "ED25519", "RSA", or "" if unrecognized
+	Length         int      // length of the signature following the header
+	ExpectedLength int      // expected signature length for Algorithm, or 0 if it can vary
+	R, S           *big.Int // the signature values, for DSA only
+}
+
+// InspectSignature parses a raw (already decoded) signature as returned by Sign and reports what it contains.
+// No key is needed and no verification is done, so the result must not be trusted:
+// it is meant for telling a signature from the wrong key apart from a corrupted one.
+func InspectSignature(blob []byte) (*SignatureInfo, error) {
+
+	version, keyID, sig, err := ParseHeader(blob)
+	if err != nil {
+		return nil, ErrShortSignature
 	}
 
-	if b[0] != kzVersion {
-		return nil, nil, ErrBadVersion
+	info := &SignatureInfo{
+		Version: version,
+		KeyID:   append([]byte(nil), keyID...),
 	}
 
-	k, err := lookup.getKeyForID(b[1:5])
-	if err != nil {
-		return nil, nil, err
+	info.Length = len(sig)
+
+	var rs dsaSignature
+	rest, err := asn1.Unmarshal(sig, &rs)
+
+	switch {
+	case len(sig) == hmacSigLength:
+		info.Algorithm = "HMAC_SHA1"
+		info.ExpectedLength = hmacSigLength
+	case len(sig) == sha256.Size:
+		info.Algorithm = "HMAC_SHA256"
+		info.ExpectedLength = sha256.Size
+	case err == nil && len(rest) == 0 && rs.R.Sign() > 0 && rs.S.Sign() > 0:
+		info.Algorithm = "DSA"
+		info.R, info.S = rs.R, rs.S
+	case len(sig) == ed25519.SignatureSize:
+		info.Algorithm = "ED25519"
+		info.ExpectedLength = ed25519.SignatureSize
+	case len(sig) == 128 || len(sig) == 256 || len(sig) == 512:
+		// rsa signatures are the size of the modulus
+		info.Algorithm = "RSA"
+		info.ExpectedLength = len(sig)
 	}
 
-	return b, k, nil
+	return info, nil
 }
@@ -41,7 +41,7 @@ func main() {
 		Location   string `short:"l" long:"location" description:"The location of the key set."`
 		Purpose    string `short:"o" long:"purpose"  description:"The purpose of the key set (sign|crypt)."`
 		Name       string `short:"n" long:"name" description:"The key set name."`
-		Asymmetric string `short:"a" long:"asymmetric" description:"Use asymmetric algorithm (dsa|rsa)."`
+		Asymmetric string `short:"a" long:"asymmetric" description:"Use asymmetric algorithm (dsa|rsa|ed25519)."`
 	}
 	var addKeyOpts struct {
 		Location string `short:"l" long:"location" description:"The location of the key set."`
@@ -113,7 +113,7 @@ func main() {
 			return
 		}
 
-		if createOpts.Asymmetric != "" && createOpts.Asymmetric != "dsa" && createOpts.Asymmetric != "rsa" {
+		if createOpts.Asymmetric != "" && createOpts.Asymmetric != "dsa" && createOpts.Asymmetric != "rsa" && createOpts.Asymmetric != "ed25519" {
 			fmt.Println("unknown asymmetric key type:", createOpts.Asymmetric)
 			return
 		}
@@ -131,6 +131,8 @@ func main() {
 			keytype = dkeyczar.T_RSA_PRIV
 		case keypurpose == dkeyczar.P_SIGN_AND_VERIFY && createOpts.Asymmetric == "dsa":
 			keytype = dkeyczar.T_DSA_PRIV
+		case keypurpose == dkeyczar.P_SIGN_AND_VERIFY && createOpts.Asymmetric == "ed25519":
+			keytype = dkeyczar.T_ED25519_PRIV
 		default:
 			fmt.Println("unknown or invalid purpose/asymmetric combination:", createOpts.Purpose, "/", createOpts.Asymmetric)
 			return
@@ -10,6 +10,7 @@ store just the key material.  There are routines for converting back and forth
 between these two types.
 
 There are types for AES+HMAC, HMAC, RSA and RSA Public, DSA and DSA Public.
+Ed25519 and Ed25519 Public are in ed25519.go.
 */
 
 import (
@@ -17,14 +18,18 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/dsa"
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
+	_ "crypto/sha512" // for AcceptRSAHashes
 	"crypto/subtle"
 	"encoding/asn1"
 	"encoding/binary"
 	"encoding/json"
+	"hash"
 	"io"
 	"math/big"
 )
@@ -37,6 +42,8 @@ type keydata interface {
 type encryptKey interface {
 	keydata
 	Encrypt(b []byte) ([]byte, error)
+	// the length of the raw ciphertext Encrypt returns for a plaintext of 'n' bytes
+	ciphertextLen(n int) int
 }
 
 type decryptEncryptKey interface {
@@ -54,6 +61,23 @@ type signVerifyKey interface {
 	Sign(message []byte) ([]byte, error)
 }
 
+// a verifyKey that can check a signature against a message hashed elsewhere
+type digestVerifyKey interface {
+	verifyKey
+	// return a hash to write the message into
+	newHash() hash.Hash
+	// check 'signature' against the sum of a hash returned by newHash
+	verifyDigest(digest []byte, signature []byte) (bool, error)
+}
+
+// a signVerifyKey that can sign a message hashed elsewhere
+type digestSignKey interface {
+	signVerifyKey
+	digestVerifyKey
+	// sign the sum of a hash returned by newHash
+	signDigest(digest []byte) ([]byte, error)
+}
+
 func generateKey(ktype keyType, size uint) (keydata, error) {
 
 	switch ktype {
@@ -65,6 +89,33 @@ func generateKey(ktype keyType, size uint) (keydata, error) {
 		return generateDSAKey(size)
 	case T_RSA_PRIV:
 		return generateRSAKey(size)
+	case T_ED25519_PRIV:
+		return generateEd25519Key(size)
+	}
+
+	panic("not reached")
+}
+
+// return the size of 'k' in bits, as recorded in its JSON: the AES key for AES keys, and the modulus for public-key types
+func keyBits(k keydata) uint {
+
+	switch k := k.(type) {
+	case *aesKey:
+		return uint(len(k.key)) * 8
+	case *hmacKey:
+		return uint(len(k.key)) * 8
+	case *dsaKey:
+		return uint(k.key.P.BitLen())
+	case *dsaPublicKey:
+		return uint(k.key.P.BitLen())
+	case *rsaKey:
+		return uint(k.key.N.BitLen())
+	case *rsaPublicKey:
+		return uint(k.key.N.BitLen())
+	case *ed25519Key:
+		return uint(len(k.publicKey.key)) * 8
+	case *ed25519PublicKey:
+		return uint(len(k.key)) * 8
 	}
 
 	panic("not reached")
@@ -73,21 +124,30 @@ func generateKey(ktype keyType, size uint) (keydata, error) {
 // we only support one hmac size for the moment
 const hmacSigLength = 20
 
+// the shortest truncated tag we'll accept for AES ciphertexts
+const minHMACTagLength = 10
+
 type hmacKeyJSON struct {
-	HMACKeyString string `json:"hmacKeyString"`
-	Size          uint   `json:"size"`
+	HMACKeyString string     `json:"hmacKeyString"`
+	Size          uint       `json:"size"`
+	TagLength     int        `json:"tagLength,omitempty"`
+	Digest        hmacDigest `json:"digest,omitempty"`
 }
 
 type hmacKey struct {
-	key []byte
-	id  []byte
+	key       []byte
+	id        []byte
+	tagLength int        // AES only: tag bytes kept after truncation, 0 for the full MAC
+	digest    hmacDigest // HMAC_SHA1 keysets only: the hash for signing
 }
 
 func generateHMACKey() (*hmacKey, error) {
 	hk := new(hmacKey)
 
 	hk.key = make([]byte, T_HMAC_SHA1.defaultSize()/8)
-	io.ReadFull(rand.Reader, hk.key)
+	if err := randBytes(hk.key); err != nil {
+		return nil, err
+	}
 
 	return hk, nil
 }
@@ -119,26 +179,26 @@ func newSessionMaterialFromJSON(s []byte) (*sessionMaterial, error) {
 	}
 
 	if !T_AES.isAcceptableSize(smjson.Key.Size) {
-		return nil, ErrInvalidKeySize
+		return nil, newFieldError(ErrInvalidKeySize, "key.size")
 	}
 
 	sm.key.key, err = decodeWeb64String(smjson.Key.AESKeyString)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "key.aesKeyString")
 	}
 
 	if !T_HMAC_SHA1.isAcceptableSize(smjson.Key.HMACKey.Size) {
-		return nil, ErrInvalidKeySize
+		return nil, newFieldError(ErrInvalidKeySize, "key.hmacKey.size")
 	}
 
 	sm.key.hmacKey.key, err = decodeWeb64String(smjson.Key.HMACKey.HMACKeyString)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "key.hmacKey.hmacKeyString")
 	}
 
 	sm.nonce, err = decodeWeb64String(smjson.Nonce)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "nonce")
 	}
 
 	return sm, nil
@@ -159,17 +219,94 @@ func newSessionMaterialJSON(sm *sessionMaterial) *sessionMaterialJSON {
 	return smjson
 }
 
+// AES keys normally embed their own HMAC key.  Some legacy keysets share one HMAC key across
+// versions instead: those versions leave out "hmacKey" and give the version that holds it,
+//
+//	{"aesKeyString": <web64>, "size": 128, "hmacKeyVersion": 1, "mode": "CBC"}
+//
+// The referenced version must be an AES key in the same keyset with an embedded HMAC key.
+// The reference is resolved when the keyset is loaded, and written out embedded again.
 type aesKeyJSON struct {
-	AESKeyString string      `json:"aesKeyString"`
-	Size         uint        `json:"size"`
-	HMACKey      hmacKeyJSON `json:"hmacKey"`
-	Mode         cipherMode  `json:"mode"`
+	AESKeyString   string      `json:"aesKeyString"`
+	Size           uint        `json:"size"`
+	HMACKey        hmacKeyJSON `json:"hmacKey"`
+	HMACKeyVersion int         `json:"hmacKeyVersion,omitempty"`
+	Mode           cipherMode  `json:"mode"`
 }
 
 type aesKey struct {
-	key     []byte
-	hmacKey hmacKey
-	id      []byte
+	key            []byte
+	hmacKey        hmacKey
+	hmacKeyVersion int // if set, hmacKey is still to be copied from this version
+	id             []byte
+	newMAC         MACFactory // nil for the standard HMAC-SHA1
+	mode           cipherMode // CBC or CTR with an HMAC, GCM, or SIV
+	ivs            *ivSet     // if set, the ivs used so far, for StrictIVs
+}
+
+// A MAC computes and checks the integrity tag appended to AES ciphertexts.
+// It is only used from one goroutine at a time.
+type MAC interface {
+	// Sign returns the tag for msg
+	Sign(msg []byte) ([]byte, error)
+	// Verify reports whether tag is valid for msg
+	Verify(msg []byte, tag []byte) (bool, error)
+	// Size returns the length in bytes of the tags returned by Sign
+	Size() int
+}
+
+// A MACFactory returns a MAC keyed with the key material stored in the keyset's hmacKey field
+type MACFactory func(key []byte) MAC
+
+// the default MAC: HMAC-SHA1, as required for interoperability with other Keyczar implementations.
+// The hash state is reused from one message to the next.
+type hmacSHA1MAC struct {
+	h hash.Hash
+}
+
+func newHMACSHA1MAC(key []byte) MAC {
+	return &hmacSHA1MAC{h: hmac.New(sha1.New, key)}
+}
+
+func (m *hmacSHA1MAC) Sign(msg []byte) ([]byte, error) {
+	m.h.Reset()
+	m.h.Write(msg)
+	return m.h.Sum(nil), nil
+}
+
+func (m *hmacSHA1MAC) Verify(msg []byte, tag []byte) (bool, error) {
+	sig, _ := m.Sign(msg)
+	return subtle.ConstantTimeCompare(sig, tag) == 1, nil
+}
+
+func (m *hmacSHA1MAC) Size() int {
+	return hmacSigLength
+}
+
+// a MAC whose tags are cut down to the first 'length' bytes
+type truncatedMAC struct {
+	mac    MAC
+	length int
+}
+
+func (m *truncatedMAC) Sign(msg []byte) ([]byte, error) {
+	sig, err := m.mac.Sign(msg)
+	if err != nil {
+		return nil, err
+	}
+	return sig[:m.length], nil
+}
+
+func (m *truncatedMAC) Verify(msg []byte, tag []byte) (bool, error) {
+	sig, err := m.Sign(msg)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(sig, tag) == 1, nil
+}
+
+func (m *truncatedMAC) Size() int {
+	return m.length
 }
 
 func generateAESKey(size uint) (*aesKey, error) {
@@ -185,9 +322,14 @@ func generateAESKey(size uint) (*aesKey, error) {
 
 	ak.key = make([]byte, size/8)
 
-	io.ReadFull(rand.Reader, ak.key)
+	if err := randBytes(ak.key); err != nil {
+		return nil, err
+	}
 
-	hmackey, _ := generateHMACKey()
+	hmackey, err := generateHMACKey()
+	if err != nil {
+		return nil, err
+	}
 
 	ak.hmacKey = *hmackey
 
@@ -204,21 +346,42 @@ func (ak *aesKey) packedKeys() []byte {
 // unpack the b array and return a new aes+hmac struct
 func newAESFromPackedKeys(b []byte) (*aesKey, error) {
 
-	keys := lenPrefixUnpack(b)
+	keys, err := lenPrefixUnpackN(b, 2)
+	if err != nil {
+		return nil, err
+	}
 
-	if len(keys) != 2 || !T_AES.isAcceptableSize(uint(len(keys[0]))*8) || !T_HMAC_SHA1.isAcceptableSize(uint(len(keys[1]))*8) {
+	if !T_AES.isAcceptableSize(uint(len(keys[0]))*8) || !T_HMAC_SHA1.isAcceptableSize(uint(len(keys[1]))*8) {
 		return nil, ErrInvalidKeySize
 	}
 
 	ak := new(aesKey)
 
-	// FIXME: make+copy? I think we're safe if lPU gives us 'fresh' data
-	ak.key = keys[0]
-	ak.hmacKey.key = keys[1]
+	// the unpacked keys point into 'b', which the caller may reuse
+	ak.key = append([]byte(nil), keys[0]...)
+	ak.hmacKey.key = append([]byte(nil), keys[1]...)
 
 	return ak, nil
 }
 
+// the HKDF info prefix for keys made by derive
+var aesDeriveInfo = []byte("dkeyczar DeriveCrypter")
+
+// return a new key of the same sizes and mode, with key material derived from this key's and 'label'
+func (ak *aesKey) derive(label []byte) (*aesKey, error) {
+
+	okm, err := hkdfSHA256(append(append([]byte(nil), ak.key...), ak.hmacKey.key...), nil, lenPrefixPack(aesDeriveInfo, label), len(ak.key)+len(ak.hmacKey.key))
+	if err != nil {
+		return nil, err
+	}
+
+	d := &aesKey{key: okm[:len(ak.key)], newMAC: ak.newMAC, mode: ak.mode, ivs: ak.ivs}
+	d.hmacKey.key = okm[len(ak.key):]
+	d.hmacKey.tagLength = ak.hmacKey.tagLength
+
+	return d, nil
+}
+
 func (ak *aesKey) KeyID() []byte {
 
 	if len(ak.id) != 0 {
@@ -248,21 +411,56 @@ func newAESKeyFromJSON(s []byte) (*aesKey, error) {
 	}
 
 	if !T_AES.isAcceptableSize(aesjson.Size) {
-		return nil, ErrInvalidKeySize
+		return nil, newFieldError(ErrInvalidKeySize, "size")
 	}
 
 	aeskey.key, err = decodeWeb64String(aesjson.AESKeyString)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "aesKeyString")
 	}
 
-	if !T_HMAC_SHA1.isAcceptableSize(aesjson.HMACKey.Size) {
-		return nil, ErrInvalidKeySize
+	// sizes can differ between versions, so each key must be the size its own JSON says
+	if uint(len(aeskey.key))*8 != aesjson.Size {
+		return nil, newFieldError(ErrKeySizeMismatch, "aesKeyString")
 	}
 
-	aeskey.hmacKey.key, err = decodeWeb64String(aesjson.HMACKey.HMACKeyString)
-	if err != nil {
-		return nil, ErrBase64Decoding
+	if aesjson.HMACKeyVersion != 0 {
+		// a shared HMAC key, filled in by resolveSharedHMACKeys
+		if aesjson.HMACKeyVersion < 0 || aesjson.HMACKey.HMACKeyString != "" {
+			return nil, newFieldError(ErrMalformedKeyset, "hmacKeyVersion")
+		}
+		aeskey.hmacKeyVersion = aesjson.HMACKeyVersion
+	} else {
+		if !T_HMAC_SHA1.isAcceptableSize(aesjson.HMACKey.Size) {
+			return nil, newFieldError(ErrInvalidKeySize, "hmacKey.size")
+		}
+
+		aeskey.hmacKey.key, err = decodeWeb64String(aesjson.HMACKey.HMACKeyString)
+		if err != nil {
+			return nil, newFieldError(ErrBase64Decoding, "hmacKey.hmacKeyString")
+		}
+	}
+
+	switch aesjson.Mode {
+	case cmCBC, cmCTR, cmGCM:
+		aeskey.mode = aesjson.Mode
+	case cmSIV:
+		if len(aeskey.key) != sivKeySize {
+			return nil, newFieldError(ErrInvalidKeySize, "size")
+		}
+		aeskey.mode = aesjson.Mode
+	default:
+		return nil, newFieldError(ErrUnsupportedCipherMode, "mode")
+	}
+
+	if n := aesjson.HMACKey.TagLength; n != 0 && n < minHMACTagLength {
+		return nil, newFieldError(ErrInvalidKeySize, "hmacKey.tagLength")
+	}
+	aeskey.hmacKey.tagLength = aesjson.HMACKey.TagLength
+
+	// the MAC on AES ciphertexts is always HMAC-SHA1
+	if aesjson.HMACKey.Digest != HD_SHA1 {
+		return nil, newFieldError(ErrUnsupportedHash, "hmacKey.digest")
 	}
 
 	return aeskey, nil
@@ -277,7 +475,8 @@ func newAESJSONFromKey(key *aesKey) *aesKeyJSON {
 	aesjson.Size = uint(len(key.key)) * 8
 	aesjson.HMACKey.HMACKeyString = encodeWeb64String(key.hmacKey.key)
 	aesjson.HMACKey.Size = uint(len(key.hmacKey.key)) * 8
-	aesjson.Mode = cmCBC
+	aesjson.HMACKey.TagLength = key.hmacKey.tagLength
+	aesjson.Mode = key.mode
 
 	return aesjson
 }
@@ -288,35 +487,108 @@ func (ak *aesKey) ToKeyJSON() []byte {
 	return s
 }
 
-func (ak *aesKey) Encrypt(data []byte) ([]byte, error) {
+// the AES cipher and MAC state for a key, set up once and reused across messages
+type aesSession struct {
+	key   *aesKey
+	block cipher.Block
+	mac   MAC          // CBC and CTR only
+	aead  cipher.AEAD  // GCM only
+	s2v   cipher.Block // SIV only, keyed with the first half of the key; block has the second half
+}
 
-	data = pkcs5pad(data, aes.BlockSize)
+func (ak *aesKey) newSession() (*aesSession, error) {
 
-	iv := make([]byte, aes.BlockSize)
-	io.ReadFull(rand.Reader, iv)
+	if ak.mode == cmSIV {
+		return ak.newSIVSession()
+	}
 
 	aesCipher, err := aes.NewCipher(ak.key)
 	if err != nil {
 		return nil, err
 	}
 
-	// aes only ever created with CBC as a mode
-	crypter := cipher.NewCBCEncrypter(aesCipher, iv)
+	if ak.mode == cmGCM {
+		aead, err := cipher.NewGCM(aesCipher)
+		if err != nil {
+			return nil, err
+		}
+		return &aesSession{key: ak, block: aesCipher, aead: aead}, nil
+	}
+
+	newMAC := ak.newMAC
+	if newMAC == nil {
+		newMAC = newHMACSHA1MAC
+	}
 
-	cipherBytes := make([]byte, len(data))
+	mac := newMAC(ak.hmacKey.key)
+
+	if n := ak.hmacKey.tagLength; n != 0 {
+		if n > mac.Size() {
+			return nil, newFieldError(ErrInvalidKeySize, "hmacKey.tagLength")
+		}
+		if n < mac.Size() {
+			mac = &truncatedMAC{mac: mac, length: n}
+		}
+	}
+
+	return &aesSession{key: ak, block: aesCipher, mac: mac}, nil
+}
+
+func (ak *aesKey) Encrypt(data []byte) ([]byte, error) {
+
+	s, err := ak.newSession()
+	if err != nil {
+		return nil, err
+	}
 
-	crypter.CryptBlocks(cipherBytes, data)
+	return s.Encrypt(data)
+}
 
-	h := makeHeader(ak)
+func (s *aesSession) Encrypt(data []byte) ([]byte, error) {
 
-	msg := make([]byte, 0, kzHeaderLength+aes.BlockSize+len(cipherBytes)+hmacSigLength)
+	if s.aead != nil {
+		return s.encryptGCM(data)
+	}
+
+	if s.s2v != nil {
+		return s.encryptSIV(data), nil
+	}
+
+	return s.encryptHMAC(makeHeader(s.key), data, nil)
+}
+
+// encrypt in CBC or CTR mode behind header 'h', appending 'trailer' after the ciphertext, and sign the lot
+func (s *aesSession) encryptHMAC(h []byte, data []byte, trailer []byte) ([]byte, error) {
+
+	blockSize := s.block.BlockSize()
+
+	if s.key.mode == cmCBC {
+		data = pkcs5pad(data, blockSize)
+	}
+
+	iv := make([]byte, blockSize)
+	if err := s.key.randIV(iv); err != nil {
+		return nil, err
+	}
+
+	cipherBytes := make([]byte, len(data))
+
+	if s.key.mode == cmCTR {
+		cipher.NewCTR(s.block, iv).XORKeyStream(cipherBytes, data)
+	} else {
+		crypter := cipher.NewCBCEncrypter(s.block, iv)
+		crypter.CryptBlocks(cipherBytes, data)
+	}
+
+	msg := make([]byte, 0, kzHeaderLength+blockSize+len(cipherBytes)+len(trailer)+s.mac.Size())
 
 	msg = append(msg, h...)
 	msg = append(msg, iv...)
 	msg = append(msg, cipherBytes...)
+	msg = append(msg, trailer...)
 
 	// we sign the header, iv, and ciphertext
-	sig, err := ak.hmacKey.Sign(msg)
+	sig, err := s.mac.Sign(msg)
 	if err != nil {
 		return nil, err
 	}
@@ -326,6 +598,88 @@ func (ak *aesKey) Encrypt(data []byte) ([]byte, error) {
 
 }
 
+// the amount of ciphertext writeEncrypted produces between writes
+const writeChunkSize = 4 * 1024
+
+// writeEncrypted writes the same bytes as Encrypt to 'w', encrypting and signing a chunk at a time
+func (s *aesSession) writeEncrypted(w io.Writer, m *hmacSHA1MAC, data []byte) error {
+
+	blockSize := s.block.BlockSize()
+
+	iv := make([]byte, blockSize)
+	if err := s.key.randIV(iv); err != nil {
+		return err
+	}
+
+	m.h.Reset()
+
+	// we sign the header, iv, and ciphertext
+	write := func(b []byte) error {
+		m.h.Write(b)
+		_, err := w.Write(b)
+		return err
+	}
+
+	if err := write(makeHeader(s.key)); err != nil {
+		return err
+	}
+	if err := write(iv); err != nil {
+		return err
+	}
+
+	crypter := cipher.NewCBCEncrypter(s.block, iv)
+
+	// everything but the last partial block goes through unpadded
+	full := len(data) - len(data)%blockSize
+	chunk := make([]byte, writeChunkSize)
+
+	for off := 0; off < full; off += writeChunkSize {
+		n := full - off
+		if n > writeChunkSize {
+			n = writeChunkSize
+		}
+		crypter.CryptBlocks(chunk[:n], data[off:off+n])
+		if err := write(chunk[:n]); err != nil {
+			return err
+		}
+	}
+
+	last := pkcs5pad(append([]byte(nil), data[full:]...), blockSize)
+	crypter.CryptBlocks(last, last)
+	if err := write(last); err != nil {
+		return err
+	}
+
+	_, err := w.Write(m.h.Sum(nil))
+	return err
+}
+
+func (ak *aesKey) ciphertextLen(n int) int {
+
+	if ak.mode == cmGCM {
+		return kzHeaderLength + gcmNonceSize + n + gcmTagSize
+	}
+
+	if ak.mode == cmSIV {
+		return kzHeaderLength + aes.BlockSize + n
+	}
+
+	// the mac size depends on the MAC in use and any tag truncation
+	s, err := ak.newSession()
+	if err != nil {
+		return -1
+	}
+
+	blockSize := s.block.BlockSize()
+
+	if ak.mode == cmCBC {
+		// PKCS#5 always adds padding, a whole block of it if n is already a multiple of the block size
+		n = (n/blockSize + 1) * blockSize
+	}
+
+	return kzHeaderLength + blockSize + n + s.mac.Size()
+}
+
 /*
 We do a bunch of array splicing below.
 
@@ -335,7 +689,16 @@ The data array should contain the following fields:
 
 with lengths
 
-|kzHeaderLength|aes.BlockSize|<unknown>|hmacSigLength|
+|kzHeaderLength|blockSize|<unknown>|macLength|
+
+where blockSize is the cipher's block size (aes.BlockSize for AES), and
+macLength is hmacSigLength unless a custom MAC or a truncated tag is in use.
+
+Keys in CTR mode use the same layout, with the iv as the initial counter block
+and a ciphertext exactly as long as the plaintext, since CTR needs no padding.
+The iv is always random: there is no deterministic CTR mode, and callers must
+never construct CTR ciphertexts with a chosen or repeated iv, as reusing a
+counter block under the same key reveals the XOR of the plaintexts.
 
 The expressions could probably be simplified.
 
@@ -343,37 +706,184 @@ The expressions could probably be simplified.
 
 func (ak *aesKey) Decrypt(data []byte) ([]byte, error) {
 
-	if len(data) < kzHeaderLength+aes.BlockSize+hmacSigLength {
+	s, err := ak.newSession()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Decrypt(data)
+}
+
+func (s *aesSession) Decrypt(data []byte) ([]byte, error) {
+
+	if s.aead != nil {
+		return s.decryptGCM(data)
+	}
+
+	if s.s2v != nil {
+		return s.decryptSIV(data)
+	}
+
+	macLength := s.mac.Size()
+	blockSize := s.block.BlockSize()
+
+	if len(data) < kzHeaderLength+blockSize+macLength {
 		return nil, ErrShortCiphertext
 	}
 
-	msg := data[:len(data)-hmacSigLength]
-	sig := data[len(data)-hmacSigLength:]
+	// a CBC ciphertext is a whole number of blocks, so anything else was cut short or damaged, and
+	// can be reported as such without computing the MAC.  The length isn't secret, so this leaks nothing.
+	if n := len(data) - kzHeaderLength - blockSize - macLength; s.key.mode == cmCBC && (n == 0 || n%blockSize != 0) {
+		return nil, ErrMalformedCiphertext
+	}
+
+	if m, ok := s.mac.(*hmacSHA1MAC); ok && s.key.mode == cmCBC && len(data) >= singlePassMinLength {
+		return s.decryptSinglePass(m, data)
+	}
+
+	return s.decryptTwoPass(data)
+}
+
+// verify the whole message, then decrypt the ciphertext from it into a new buffer
+func (s *aesSession) decryptTwoPass(data []byte) ([]byte, error) {
+
+	macLength := s.mac.Size()
+	blockSize := s.block.BlockSize()
+
+	msg := data[:len(data)-macLength]
+	sig := data[len(data)-macLength:]
 
 	// before doing anything else, first check the signature
-	if ok, err := ak.hmacKey.Verify(msg, sig); !ok || err != nil {
+	if ok, err := s.mac.Verify(msg, sig); !ok || err != nil {
 		if err == nil {
 			err = ErrInvalidSignature
 		}
 		return nil, err
 	}
 
-	iv := data[kzHeaderLength : kzHeaderLength+aes.BlockSize]
+	iv := data[kzHeaderLength : kzHeaderLength+blockSize]
+	cipherBytes := data[kzHeaderLength+blockSize : len(data)-macLength]
 
-	aesCipher, err := aes.NewCipher(ak.key)
-	if err != nil {
+	return s.decryptBody(iv, cipherBytes)
+}
+
+// decrypt the ciphertext from a message whose signature has already been checked
+func (s *aesSession) decryptBody(iv []byte, cipherBytes []byte) ([]byte, error) {
+
+	blockSize := s.block.BlockSize()
+
+	if s.key.mode == cmCTR {
+		plainBytes := make([]byte, len(cipherBytes))
+		cipher.NewCTR(s.block, iv).XORKeyStream(plainBytes, cipherBytes)
+		return plainBytes, nil
+	}
+
+	if len(cipherBytes) == 0 || len(cipherBytes)%blockSize != 0 {
+		return nil, ErrBadPadding
+	}
+
+	crypter := cipher.NewCBCDecrypter(s.block, iv)
+
+	plainBytes := make([]byte, len(cipherBytes))
+
+	crypter.CryptBlocks(plainBytes, cipherBytes)
+
+	return pkcs5unpad(plainBytes, blockSize)
+}
+
+// ciphertexts at least this long are decrypted with decryptSinglePass, in chunks of singlePassChunkSize
+const (
+	singlePassMinLength = 64 * 1024
+	singlePassChunkSize = 4 * 1024
+)
+
+// decryptSinglePass is Decrypt for large ciphertexts under the default HMAC: rather than hashing the
+// whole message and then reading the ciphertext again to decrypt it, each chunk of ciphertext is copied
+// into the output buffer and hashed from there while it is still in cache.  The signature is still
+// checked before anything is decrypted, which then happens in place.
+func (s *aesSession) decryptSinglePass(m *hmacSHA1MAC, data []byte) ([]byte, error) {
+
+	blockSize := s.block.BlockSize()
+
+	msgLen := len(data) - hmacSigLength
+	sig := data[msgLen:]
+
+	iv := data[kzHeaderLength : kzHeaderLength+blockSize]
+
+	m.h.Reset()
+	m.h.Write(data[:kzHeaderLength+blockSize])
+
+	buf := make([]byte, msgLen-kzHeaderLength-blockSize)
+	src := data[kzHeaderLength+blockSize : msgLen]
+
+	for off := 0; off < len(buf); off += singlePassChunkSize {
+		end := off + singlePassChunkSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+		copy(buf[off:end], src[off:end])
+		m.h.Write(buf[off:end])
+	}
+
+	if subtle.ConstantTimeCompare(m.h.Sum(nil), sig) != 1 {
+		return nil, ErrInvalidSignature
+	}
+
+	crypter := cipher.NewCBCDecrypter(s.block, iv)
+	crypter.CryptBlocks(buf, buf)
+
+	return pkcs5unpad(buf, blockSize)
+}
+
+/*
+Keys in GCM mode produce
+
+|header|nonce|ciphertext|tag|
+
+with lengths
+
+|kzHeaderLength|gcmNonceSize|len(plaintext)|gcmTagSize|
+
+The header is the usual version byte (kzVersion) and KeyID, and is passed to GCM
+as additional data so it is authenticated along with the ciphertext.  There is
+no padding and no HMAC key is used.  The mode isn't signalled in the header: it
+is a property of the key, so a key only ever decrypts in the mode it encrypts in.
+*/
+
+const (
+	gcmNonceSize = 12
+	gcmTagSize   = 16
+)
+
+func (s *aesSession) encryptGCM(data []byte) ([]byte, error) {
+
+	msg := make([]byte, kzHeaderLength+gcmNonceSize, kzHeaderLength+gcmNonceSize+len(data)+gcmTagSize)
+
+	copy(msg, makeHeader(s.key))
+
+	nonce := msg[kzHeaderLength:]
+	if err := s.key.randIV(nonce); err != nil {
 		return nil, err
 	}
 
-	crypter := cipher.NewCBCDecrypter(aesCipher, iv)
+	return s.aead.Seal(msg, nonce, data, msg[:kzHeaderLength]), nil
+}
+
+func (s *aesSession) decryptGCM(data []byte) ([]byte, error) {
 
-	plainBytes := make([]byte, len(data)-kzHeaderLength-hmacSigLength-aes.BlockSize)
+	if len(data) < kzHeaderLength+gcmNonceSize+gcmTagSize {
+		return nil, ErrShortCiphertext
+	}
 
-	crypter.CryptBlocks(plainBytes, data[kzHeaderLength+aes.BlockSize:len(data)-hmacSigLength])
+	h := data[:kzHeaderLength]
+	nonce := data[kzHeaderLength : kzHeaderLength+gcmNonceSize]
 
-	plainBytes = pkcs5unpad(plainBytes)
+	plaintext, err := s.aead.Open(nil, nonce, data[kzHeaderLength+gcmNonceSize:], h)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
 
-	return plainBytes, nil
+	return plaintext, nil
 }
 
 func newHMACKeyFromJSON(s []byte) (*hmacKey, error) {
@@ -388,14 +898,20 @@ func newHMACKeyFromJSON(s []byte) (*hmacKey, error) {
 	}
 
 	if !T_HMAC_SHA1.isAcceptableSize(hmacjson.Size) {
-		return nil, ErrInvalidKeySize
+		return nil, newFieldError(ErrInvalidKeySize, "size")
 	}
 
 	hmackey.key, err = decodeWeb64String(hmacjson.HMACKeyString)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "hmacKeyString")
 	}
 
+	if hmacjson.Digest == hdUnknown {
+		return nil, newFieldError(ErrUnsupportedHash, "digest")
+	}
+
+	hmackey.digest = hmacjson.Digest
+
 	return hmackey, nil
 
 }
@@ -405,6 +921,7 @@ func newHMACJSONFromKey(hm *hmacKey) *hmacKeyJSON {
 
 	hmacjson.HMACKeyString = encodeWeb64String(hm.key)
 	hmacjson.Size = uint(len(hm.key)) * 8
+	hmacjson.Digest = hm.digest
 
 	return hmacjson
 
@@ -416,6 +933,8 @@ func (hm *hmacKey) ToKeyJSON() []byte {
 	return s
 }
 
+// the id of an HMAC-SHA1 key is the Keyczar one, a hash of the key.  Other digests add their name after
+// the key, so the same key material can't have the same id under two digests.
 func (hm *hmacKey) KeyID() []byte {
 
 	if len(hm.id) != 0 {
@@ -424,6 +943,9 @@ func (hm *hmacKey) KeyID() []byte {
 
 	h := sha1.New()
 	h.Write(hm.key)
+	if hm.digest != HD_SHA1 {
+		h.Write([]byte(hm.digest.String()))
+	}
 
 	hm.id = h.Sum(nil)[:4]
 
@@ -432,19 +954,41 @@ func (hm *hmacKey) KeyID() []byte {
 
 func (hm *hmacKey) Sign(msg []byte) ([]byte, error) {
 
-	sha1hmac := hmac.New(sha1.New, hm.key)
-	sha1hmac.Write(msg)
-	sig := sha1hmac.Sum(nil)
+	mac := hm.newHash()
+	mac.Write(msg)
+	sig := mac.Sum(nil)
 	return sig, nil
 }
 
 func (hm *hmacKey) Verify(msg []byte, signature []byte) (bool, error) {
 
-	sha1hmac := hmac.New(sha1.New, hm.key)
+	sha1hmac := hm.newHash()
 	sha1hmac.Write(msg)
-	sig := sha1hmac.Sum(nil)
 
-	return subtle.ConstantTimeCompare(sig, signature) == 1, nil
+	return hm.verifyDigest(sha1hmac.Sum(nil), signature)
+}
+
+func (hm *hmacKey) newHash() hash.Hash {
+	if hm.digest == HD_SHA256 {
+		return hmac.New(sha256.New, hm.key)
+	}
+	return hmac.New(sha1.New, hm.key)
+}
+
+// for an hmac the digest is the signature
+func (hm *hmacKey) signDigest(digest []byte) ([]byte, error) {
+	return digest, nil
+}
+
+func (hm *hmacKey) verifyDigest(digest []byte, signature []byte) (bool, error) {
+	return subtle.ConstantTimeCompare(digest, signature) == 1, nil
+}
+
+// report whether the modulus 'n' is the bit length declared in the key's size field.
+// The top byte is allowed some slack, but a key can't be more than a byte shorter than it claims.
+func isDeclaredSize(n *big.Int, size uint) bool {
+	bits := uint(n.BitLen())
+	return bits <= size && bits+8 > size
 }
 
 type dsaPublicKeyJSON struct {
@@ -456,8 +1000,9 @@ type dsaPublicKeyJSON struct {
 }
 
 type dsaPublicKey struct {
-	key dsa.PublicKey
-	id  []byte
+	key         dsa.PublicKey
+	id          []byte
+	acceptP1363 bool // also accept raw r||s signatures
 }
 
 type dsaKeyJSON struct {
@@ -516,36 +1061,86 @@ func newDSAPublicKeyFromJSON(s []byte) (*dsaPublicKey, error) {
 	}
 
 	if !T_DSA_PUB.isAcceptableSize(dsajson.Size) {
-		return nil, ErrInvalidKeySize
+		return nil, newFieldError(ErrInvalidKeySize, "size")
 	}
 
 	b, err := decodeWeb64String(dsajson.Y)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "y")
 	}
 	dsakey.key.Y = big.NewInt(0).SetBytes(b)
 
 	b, err = decodeWeb64String(dsajson.G)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "g")
 	}
 	dsakey.key.G = big.NewInt(0).SetBytes(b)
 
 	b, err = decodeWeb64String(dsajson.P)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "p")
 	}
 	dsakey.key.P = big.NewInt(0).SetBytes(b)
+	if !isDeclaredSize(dsakey.key.P, dsajson.Size) {
+		return nil, newFieldError(ErrKeySizeMismatch, "p")
+	}
 
 	b, err = decodeWeb64String(dsajson.Q)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "q")
 	}
 	dsakey.key.Q = big.NewInt(0).SetBytes(b)
 
+	if err := checkDSAParameters(&dsakey.key, ""); err != nil {
+		return nil, err
+	}
+
 	return dsakey, nil
 }
 
+// the bit lengths of Q allowed for each length of P, from FIPS 186-3
+var dsaQBits = map[int][]int{
+	1024: {160},
+	2048: {224, 256},
+	3072: {256},
+}
+
+// check that 'pub' describes a proper DSA group, so that a malformed or deliberately weakened
+// keyset doesn't load: P and Q are primes of matching standard sizes, Q divides P-1, and G and Y
+// are elements of the order Q subgroup.
+func checkDSAParameters(pub *dsa.PublicKey, prefix string) error {
+
+	one := big.NewInt(1)
+	p, q, g, y := pub.P, pub.Q, pub.G, pub.Y
+
+	okQ := false
+	for _, n := range dsaQBits[p.BitLen()] {
+		okQ = okQ || q.BitLen() == n
+	}
+	if !okQ {
+		return newFieldError(ErrInvalidDSAParameters, prefix+"q")
+	}
+
+	if !p.ProbablyPrime(20) {
+		return newFieldError(ErrInvalidDSAParameters, prefix+"p")
+	}
+
+	pm1 := new(big.Int).Sub(p, one)
+	if !q.ProbablyPrime(20) || new(big.Int).Mod(pm1, q).Sign() != 0 {
+		return newFieldError(ErrInvalidDSAParameters, prefix+"q")
+	}
+
+	if g.Cmp(one) <= 0 || g.Cmp(pm1) >= 0 || new(big.Int).Exp(g, q, p).Cmp(one) != 0 {
+		return newFieldError(ErrInvalidDSAParameters, prefix+"g")
+	}
+
+	if y.Cmp(one) <= 0 || y.Cmp(pm1) >= 0 || new(big.Int).Exp(y, q, p).Cmp(one) != 0 {
+		return newFieldError(ErrInvalidDSAParameters, prefix+"y")
+	}
+
+	return nil
+}
+
 func newDSAJSONFromKey(key *dsa.PrivateKey) *dsaKeyJSON {
 
 	dsajson := new(dsaKeyJSON)
@@ -597,44 +1192,59 @@ func newDSAKeyFromJSON(s []byte) (*dsaKey, error) {
 		return nil, err
 	}
 
-	if !T_DSA_PRIV.isAcceptableSize(dsajson.Size) || !T_DSA_PUB.isAcceptableSize(dsajson.PublicKey.Size) {
-		return nil, ErrInvalidKeySize
+	if !T_DSA_PRIV.isAcceptableSize(dsajson.Size) {
+		return nil, newFieldError(ErrInvalidKeySize, "size")
+	}
+
+	if !T_DSA_PUB.isAcceptableSize(dsajson.PublicKey.Size) {
+		return nil, newFieldError(ErrInvalidKeySize, "publicKey.size")
 	}
 
 	b, err := decodeWeb64String(dsajson.X)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "x")
 	}
 	dsakey.key.X = big.NewInt(0).SetBytes(b)
 
 	b, err = decodeWeb64String(dsajson.PublicKey.Y)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "publicKey.y")
 	}
 	dsakey.key.Y = big.NewInt(0).SetBytes(b)
 	dsakey.publicKey.key.Y = dsakey.key.Y
 
 	b, err = decodeWeb64String(dsajson.PublicKey.G)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "publicKey.g")
 	}
 	dsakey.key.G = big.NewInt(0).SetBytes(b)
 	dsakey.publicKey.key.G = dsakey.key.G
 
 	b, err = decodeWeb64String(dsajson.PublicKey.P)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "publicKey.p")
 	}
 	dsakey.key.P = big.NewInt(0).SetBytes(b)
+	if !isDeclaredSize(dsakey.key.P, dsajson.Size) || !isDeclaredSize(dsakey.key.P, dsajson.PublicKey.Size) {
+		return nil, newFieldError(ErrKeySizeMismatch, "publicKey.p")
+	}
 	dsakey.publicKey.key.P = dsakey.key.P
 
 	b, err = decodeWeb64String(dsajson.PublicKey.Q)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "publicKey.q")
 	}
 	dsakey.key.Q = big.NewInt(0).SetBytes(b)
 	dsakey.publicKey.key.Q = dsakey.key.Q
 
+	if err := checkDSAParameters(&dsakey.key.PublicKey, "publicKey."); err != nil {
+		return nil, err
+	}
+
+	if dsakey.key.X.Sign() <= 0 || dsakey.key.X.Cmp(dsakey.key.Q) >= 0 {
+		return nil, newFieldError(ErrInvalidDSAParameters, "x")
+	}
+
 	return dsakey, nil
 }
 
@@ -668,10 +1278,15 @@ type dsaSignature struct {
 
 func (dk *dsaKey) Sign(msg []byte) ([]byte, error) {
 
-	h := sha1.New()
+	h := dk.newHash()
 	h.Write(msg)
 
-	r, s, err := dsa.Sign(rand.Reader, &dk.key, h.Sum(nil))
+	return dk.signDigest(h.Sum(nil))
+}
+
+func (dk *dsaKey) signDigest(digest []byte) ([]byte, error) {
+
+	r, s, err := dsa.Sign(rand.Reader, &dk.key, digest)
 	if err != nil {
 		return nil, err
 	}
@@ -690,29 +1305,162 @@ func (dk *dsaKey) Verify(msg []byte, signature []byte) (bool, error) {
 	return dk.publicKey.Verify(msg, signature)
 }
 
+func (dk *dsaKey) newHash() hash.Hash {
+	return dk.publicKey.newHash()
+}
+
+func (dk *dsaKey) verifyDigest(digest []byte, signature []byte) (bool, error) {
+	return dk.publicKey.verifyDigest(digest, signature)
+}
+
 func (dk *dsaPublicKey) Verify(msg []byte, signature []byte) (bool, error) {
 
-	h := sha1.New()
+	h := dk.newHash()
 	h.Write(msg)
 
+	return dk.verifyDigest(h.Sum(nil), signature)
+}
+
+func (dk *dsaPublicKey) newHash() hash.Hash {
+	return sha1.New()
+}
+
+func (dk *dsaPublicKey) verifyDigest(digest []byte, signature []byte) (bool, error) {
+
 	var rs dsaSignature
 	_, err := asn1.Unmarshal(signature, &rs)
+	if err == nil && dsa.Verify(&dk.key, digest, rs.R, rs.S) {
+		return true, nil
+	}
+
+	// a short DER signature can be the same length as a raw one, so try both
+	if dk.acceptP1363 && len(signature) == 2*dsaQLength(&dk.key) {
+		r, s := splitP1363(signature)
+		return dsa.Verify(&dk.key, digest, r, s), nil
+	}
+
 	if err != nil {
 		return false, err
 	}
 
-	return dsa.Verify(&dk.key, h.Sum(nil), rs.R, rs.S), nil
+	return false, nil
+}
+
+// the length in bytes of each of r and s in an IEEE P1363 signature for 'pub'
+func dsaQLength(pub *dsa.PublicKey) int {
+	return (pub.Q.BitLen() + 7) / 8
+}
+
+func splitP1363(sig []byte) (*big.Int, *big.Int) {
+	n := len(sig) / 2
+	return new(big.Int).SetBytes(sig[:n]), new(big.Int).SetBytes(sig[n:])
+}
+
+// DSASignatureToP1363 converts an ASN.1 DER DSA signature, as made by a Signer, to the IEEE P1363
+// format used by JOSE and some mobile platforms: r and s as fixed-width big-endian integers, each
+// as long as the key's Q.
+func DSASignatureToP1363(pub *dsa.PublicKey, sig []byte) ([]byte, error) {
+
+	var rs dsaSignature
+	if _, err := asn1.Unmarshal(sig, &rs); err != nil {
+		return nil, err
+	}
+
+	n := dsaQLength(pub)
+	if rs.R.Sign() < 0 || rs.S.Sign() < 0 || len(rs.R.Bytes()) > n || len(rs.S.Bytes()) > n {
+		return nil, ErrMalformedSignature
+	}
+
+	p1363 := make([]byte, 2*n)
+	rs.R.FillBytes(p1363[:n])
+	rs.S.FillBytes(p1363[n:])
+
+	return p1363, nil
+}
+
+// DSASignatureFromP1363 converts an IEEE P1363 DSA signature for 'pub' to the ASN.1 DER format Verifiers expect
+func DSASignatureFromP1363(pub *dsa.PublicKey, sig []byte) ([]byte, error) {
+
+	if len(sig) != 2*dsaQLength(pub) {
+		return nil, ErrShortSignature
+	}
+
+	r, s := splitP1363(sig)
+
+	return asn1.Marshal(dsaSignature{r, s})
+}
+
+// GuessSignatureScheme guesses from its shape alone which kind of key made a raw (already decoded) signature,
+// for inspection tools that have no keyset to hand.  A Keyczar header, if present, is skipped.
+// It returns "DSA" for an ASN.1 SEQUENCE of two INTEGERs, "HMAC_SHA1" or "HMAC_SHA256" for a 20 or 32-byte
+// tag, "ED25519" for a 64-byte signature, "RSA" for a block the size of an RSA modulus, and "unknown"
+// otherwise.  The guess is purely heuristic: nothing is verified.
+func GuessSignatureScheme(sig []byte) string {
+
+	body := sig
+	switch {
+	case len(sig) > kzHeaderLength && sig[0] == kzVersion:
+		body = sig[kzHeaderLength:]
+	case len(sig) > kzHeaderLength+1 && sig[0] == kzIssuerVersion:
+		if offs := kzHeaderLength + 1 + int(sig[kzHeaderLength]); offs < len(sig) {
+			body = sig[offs:]
+		}
+	}
+
+	// a headerless RSA signature can start with a version byte by chance, so fall back to the whole input
+	if guess := guessSignatureBody(body); guess != "unknown" || len(body) == len(sig) {
+		return guess
+	}
+
+	return guessSignatureBody(sig)
+}
+
+// guess the scheme of a signature with no header
+func guessSignatureBody(body []byte) string {
+
+	var rs dsaSignature
+	if rest, err := asn1.Unmarshal(body, &rs); err == nil && len(rest) == 0 {
+		return "DSA"
+	}
+
+	switch len(body) {
+	case hmacSigLength:
+		return "HMAC_SHA1"
+	case sha256.Size:
+		return "HMAC_SHA256"
+	}
+
+	if len(body) == ed25519.SignatureSize {
+		return "ED25519"
+	}
+
+	// RSA signatures are exactly the size of the modulus, which is at least 1024 bits and a whole number of bytes
+	if len(body) >= 128 && len(body)%8 == 0 {
+		return "RSA"
+	}
+
+	return "unknown"
 }
 
 type rsaPublicKeyJSON struct {
-	Modulus        string `json:"modulus"`
-	PublicExponent string `json:"publicExponent"`
-	Size           uint   `json:"size"`
+	Modulus        string          `json:"modulus"`
+	PublicExponent string          `json:"publicExponent"`
+	Size           uint            `json:"size"`
+	SigningScheme  signatureScheme `json:"signingScheme,omitempty"`
+	PSSSaltLength  int             `json:"pssSaltLength,omitempty"`
+	OAEPHash       oaepHash        `json:"oaepHash,omitempty"`
+	OAEPLabel      string          `json:"oaepLabel,omitempty"`
 }
 
 type rsaPublicKey struct {
-	key rsa.PublicKey
-	id  []byte
+	key        rsa.PublicKey
+	id         []byte
+	scheme     signatureScheme // PKCS1v15 unless PSS was requested
+	saltLength int             // PSS only; 0 means rsa.PSSSaltLengthAuto
+	oaepHash   oaepHash        // SHA-1 unless SHA-256 was requested
+	oaepLabel  []byte          // OAEP label, which must match on decryption
+
+	acceptHashes []crypto.Hash // PKCS1v15 only: digests to try after SHA-1, for signatures made elsewhere
 }
 
 type rsaKeyJSON struct {
@@ -794,21 +1542,35 @@ func newRSAPublicKeyFromJSON(s []byte) (*rsaPublicKey, error) {
 	}
 
 	if !T_RSA_PUB.isAcceptableSize(rsajson.Size) {
-		return nil, ErrInvalidKeySize
+		return nil, newFieldError(ErrInvalidKeySize, "size")
 	}
 
 	b, err := decodeWeb64String(rsajson.Modulus)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "modulus")
 	}
 	rsakey.key.N = big.NewInt(0).SetBytes(b)
+	if !isDeclaredSize(rsakey.key.N, rsajson.Size) {
+		return nil, newFieldError(ErrKeySizeMismatch, "modulus")
+	}
 
 	b, err = decodeWeb64String(rsajson.PublicExponent)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "publicExponent")
 	}
 	rsakey.key.E = int(big.NewInt(0).SetBytes(b).Int64())
 
+	rsakey.scheme = rsajson.SigningScheme
+	rsakey.saltLength = rsajson.PSSSaltLength
+
+	rsakey.oaepHash = rsajson.OAEPHash
+	if rsajson.OAEPLabel != "" {
+		rsakey.oaepLabel, err = decodeWeb64String(rsajson.OAEPLabel)
+		if err != nil {
+			return nil, newFieldError(ErrBase64Decoding, "oaepLabel")
+		}
+	}
+
 	return rsakey, nil
 }
 
@@ -829,6 +1591,7 @@ func newRSAPublicJSONFromKey(key *rsa.PublicKey) *rsaPublicKeyJSON {
 
 func (rk *rsaPublicKey) ToKeyJSON() []byte {
 	j := newRSAPublicJSONFromKey(&rk.key)
+	rk.setOptionsJSON(j)
 	s, _ := json.Marshal(j)
 	return s
 }
@@ -844,37 +1607,41 @@ func newRSAKeyFromJSON(s []byte) (*rsaKey, error) {
 		return nil, err
 	}
 
-	if !T_RSA_PRIV.isAcceptableSize(rsajson.Size) || !T_RSA_PUB.isAcceptableSize(rsajson.PublicKey.Size) {
-		return nil, ErrInvalidKeySize
+	if !T_RSA_PRIV.isAcceptableSize(rsajson.Size) {
+		return nil, newFieldError(ErrInvalidKeySize, "size")
+	}
+
+	if !T_RSA_PUB.isAcceptableSize(rsajson.PublicKey.Size) {
+		return nil, newFieldError(ErrInvalidKeySize, "publicKey.size")
 	}
 
 	b, err := decodeWeb64String(rsajson.CrtCoefficient)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "crtCoefficient")
 	}
 	rsakey.key.Precomputed.Qinv = big.NewInt(0).SetBytes(b)
 
 	b, err = decodeWeb64String(rsajson.PrimeExponentP)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "primeExponentP")
 	}
 	rsakey.key.Precomputed.Dp = big.NewInt(0).SetBytes(b)
 
 	b, err = decodeWeb64String(rsajson.PrimeExponentQ)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "primeExponentQ")
 	}
 	rsakey.key.Precomputed.Dq = big.NewInt(0).SetBytes(b)
 
 	b, err = decodeWeb64String(rsajson.PrimeP)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "primeP")
 	}
 	p := big.NewInt(0).SetBytes(b)
 
 	b, err = decodeWeb64String(rsajson.PrimeQ)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "primeQ")
 	}
 	q := big.NewInt(0).SetBytes(b)
 
@@ -882,33 +1649,58 @@ func newRSAKeyFromJSON(s []byte) (*rsaKey, error) {
 
 	b, err = decodeWeb64String(rsajson.PrivateExponent)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "privateExponent")
 	}
 	rsakey.key.D = big.NewInt(0).SetBytes(b)
 
 	b, err = decodeWeb64String(rsajson.PublicKey.Modulus)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "publicKey.modulus")
 	}
 	rsakey.key.PublicKey.N = big.NewInt(0).SetBytes(b)
+	if !isDeclaredSize(rsakey.key.PublicKey.N, rsajson.Size) || !isDeclaredSize(rsakey.key.PublicKey.N, rsajson.PublicKey.Size) {
+		return nil, newFieldError(ErrKeySizeMismatch, "publicKey.modulus")
+	}
 	rsakey.publicKey.key.N = rsakey.key.PublicKey.N
 
 	b, err = decodeWeb64String(rsajson.PublicKey.PublicExponent)
 	if err != nil {
-		return nil, ErrBase64Decoding
+		return nil, newFieldError(ErrBase64Decoding, "publicKey.publicExponent")
 	}
 	rsakey.key.PublicKey.E = int(big.NewInt(0).SetBytes(b).Int64())
 	rsakey.publicKey.key.E = rsakey.key.PublicKey.E
 
+	rsakey.publicKey.scheme = rsajson.PublicKey.SigningScheme
+	rsakey.publicKey.saltLength = rsajson.PublicKey.PSSSaltLength
+
+	rsakey.publicKey.oaepHash = rsajson.PublicKey.OAEPHash
+	if rsajson.PublicKey.OAEPLabel != "" {
+		rsakey.publicKey.oaepLabel, err = decodeWeb64String(rsajson.PublicKey.OAEPLabel)
+		if err != nil {
+			return nil, newFieldError(ErrBase64Decoding, "publicKey.oaepLabel")
+		}
+	}
+
 	return rsakey, nil
 }
 
 func (rk *rsaKey) ToKeyJSON() []byte {
 	j := newRSAJSONFromKey(&rk.key)
+	rk.publicKey.setOptionsJSON(&j.PublicKey)
 	s, _ := json.Marshal(j)
 	return s
 }
 
+// copy the signing and encryption options of the key into its JSON representation
+func (rk *rsaPublicKey) setOptionsJSON(j *rsaPublicKeyJSON) {
+	j.SigningScheme = rk.scheme
+	j.PSSSaltLength = rk.saltLength
+	j.OAEPHash = rk.oaepHash
+	if rk.oaepLabel != nil {
+		j.OAEPLabel = encodeWeb64String(rk.oaepLabel)
+	}
+}
+
 func newRSAJSONFromKey(key *rsa.PrivateKey) *rsaKeyJSON {
 
 	rsajson := new(rsaKeyJSON)
@@ -933,25 +1725,81 @@ func newRSAJSONFromKey(key *rsa.PrivateKey) *rsaKeyJSON {
 
 func (rk *rsaKey) Sign(msg []byte) ([]byte, error) {
 
-	h := sha1.New()
+	h := rk.newHash()
 	h.Write(msg)
 
-	s, err := rsa.SignPKCS1v15(rand.Reader, &rk.key, crypto.SHA1, h.Sum(nil))
+	return rk.signDigest(h.Sum(nil))
+}
+
+func (rk *rsaKey) signDigest(digest []byte) ([]byte, error) {
 
-	return s, err
+	if rk.publicKey.scheme == SS_PSS {
+		return rsa.SignPSS(rand.Reader, &rk.key, crypto.SHA256, digest, rk.publicKey.pssOptions())
+	}
 
+	return rsa.SignPKCS1v15(rand.Reader, &rk.key, crypto.SHA1, digest)
 }
 
 func (rk *rsaKey) Verify(msg []byte, signature []byte) (bool, error) {
 	return rk.publicKey.Verify(msg, signature)
 }
 
+func (rk *rsaKey) newHash() hash.Hash {
+	return rk.publicKey.newHash()
+}
+
+func (rk *rsaKey) verifyDigest(digest []byte, signature []byte) (bool, error) {
+	return rk.publicKey.verifyDigest(digest, signature)
+}
+
+// PSS signatures always use SHA-256; only the salt length is configurable
+func (rk *rsaPublicKey) pssOptions() *rsa.PSSOptions {
+	return &rsa.PSSOptions{SaltLength: rk.saltLength, Hash: crypto.SHA256}
+}
+
 func (rk *rsaPublicKey) Verify(msg []byte, signature []byte) (bool, error) {
 
-	h := sha1.New()
+	h := rk.newHash()
 	h.Write(msg)
 
-	return rsa.VerifyPKCS1v15(&rk.key, crypto.SHA1, h.Sum(nil), signature) == nil, nil
+	if ok, err := rk.verifyDigest(h.Sum(nil), signature); ok || err != nil || rk.scheme == SS_PSS {
+		return ok, err
+	}
+
+	for _, ch := range rk.acceptHashes {
+		h := ch.New()
+		h.Write(msg)
+		if rsa.VerifyPKCS1v15(&rk.key, ch, h.Sum(nil), signature) == nil {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// PSS signatures are over SHA-256, PKCS1v15 signatures over SHA-1
+func (rk *rsaPublicKey) newHash() hash.Hash {
+	if rk.scheme == SS_PSS {
+		return sha256.New()
+	}
+	return sha1.New()
+}
+
+func (rk *rsaPublicKey) verifyDigest(digest []byte, signature []byte) (bool, error) {
+
+	if rk.scheme == SS_PSS {
+		return rsa.VerifyPSS(&rk.key, crypto.SHA256, digest, signature, rk.pssOptions()) == nil, nil
+	}
+
+	return rsa.VerifyPKCS1v15(&rk.key, crypto.SHA1, digest, signature) == nil, nil
+}
+
+// the hash used for OAEP padding with this key
+func (rk *rsaPublicKey) newOAEPHash() hash.Hash {
+	if rk.oaepHash == OH_SHA256 {
+		return sha256.New()
+	}
+	return sha1.New()
 }
 
 func (rk *rsaPublicKey) Encrypt(msg []byte) ([]byte, error) {
@@ -959,12 +1807,13 @@ func (rk *rsaPublicKey) Encrypt(msg []byte) ([]byte, error) {
 	// FIXME: If msg is too long for keysize, EncryptOAEP returns an error
 	// Do we want to return a Keyczar error here, either by checking
 	// ourselves for this case or by wrapping the returned error?
-	s, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, &rk.key, msg, nil)
+	s, err := rsa.EncryptOAEP(rk.newOAEPHash(), rand.Reader, &rk.key, msg, rk.oaepLabel)
 	if err != nil {
 		return nil, err
 	}
 
-	h := append(makeHeader(rk), s...)
+	// the ciphertext is always exactly the modulus size, for formats with fixed-width fields
+	h := append(makeHeader(rk), leftPad(s, rk.key.Size())...)
 
 	return h, nil
 
@@ -974,9 +1823,26 @@ func (rk *rsaKey) Encrypt(msg []byte) ([]byte, error) {
 	return rk.publicKey.Encrypt(msg)
 }
 
+// RSA ciphertexts are always the size of the modulus, whatever the plaintext length
+func (rk *rsaPublicKey) ciphertextLen(n int) int {
+	return kzHeaderLength + rk.key.Size()
+}
+
+func (rk *rsaKey) ciphertextLen(n int) int {
+	return rk.publicKey.ciphertextLen(n)
+}
+
 func (rk *rsaKey) Decrypt(msg []byte) ([]byte, error) {
 
-	s, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, &rk.key, msg[kzHeaderLength:], nil)
+	_, _, body, err := ParseHeader(msg)
+	if err != nil {
+		return nil, ErrShortCiphertext
+	}
+
+	// accept ciphertexts whose leading zero bytes were stripped by another implementation
+	body = leftPad(body, rk.key.Size())
+
+	s, err := rsa.DecryptOAEP(rk.publicKey.newOAEPHash(), rand.Reader, &rk.key, body, rk.publicKey.oaepLabel)
 
 	if err != nil {
 		return nil, err
@@ -984,3 +1850,27 @@ func (rk *rsaKey) Decrypt(msg []byte) ([]byte, error) {
 
 	return s, nil
 }
+
+// ComputeAESKeyID returns the 4-byte key id an AES key with the given AES and HMAC key material will have
+func ComputeAESKeyID(aesKeyBytes []byte, hmacKeyBytes []byte) []byte {
+	ak := &aesKey{key: aesKeyBytes, hmacKey: hmacKey{key: hmacKeyBytes}}
+	return ak.KeyID()
+}
+
+// ComputeHMACKeyID returns the 4-byte key id an HMAC key with the given key material will have
+func ComputeHMACKeyID(key []byte) []byte {
+	hk := &hmacKey{key: key}
+	return hk.KeyID()
+}
+
+// ComputeRSAKeyID returns the 4-byte key id of an RSA key.  Public and private keys share the same id.
+func ComputeRSAKeyID(pub *rsa.PublicKey) []byte {
+	rk := &rsaPublicKey{key: *pub}
+	return rk.KeyID()
+}
+
+// ComputeDSAKeyID returns the 4-byte key id of a DSA key.  Public and private keys share the same id.
+func ComputeDSAKeyID(pub *dsa.PublicKey) []byte {
+	dk := &dsaPublicKey{key: *pub}
+	return dk.KeyID()
+}
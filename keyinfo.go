@@ -1,5 +1,11 @@
 package dkeyczar
 
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
 type keyType int
 
 const (
@@ -9,6 +15,8 @@ const (
 	T_DSA_PUB
 	T_RSA_PRIV
 	T_RSA_PUB
+	T_ED25519_PRIV
+	T_ED25519_PUB
 )
 
 // This struct copies the Java layout, but suffers from YAGNI
@@ -20,12 +28,14 @@ var keyTypeInfo = map[keyType]struct {
 	output  uint
 	outputs []uint
 }{
-	T_AES:       {"AES", []byte("\"AES\""), []uint{128, 192, 256}, 128, nil},
-	T_HMAC_SHA1: {"HMAC_SHA1", []byte("\"HMAC_SHA1\""), []uint{256}, 160, nil},
-	T_DSA_PRIV:  {"DSA_PRIV", []byte("\"DSA_PRIV\""), []uint{1024}, 384, nil},
-	T_DSA_PUB:   {"DSA_PUB", []byte("\"DSA_PUB\""), []uint{1024}, 384, nil},
-	T_RSA_PRIV:  {"RSA_PRIV", []byte("\"RSA_PRIV\""), []uint{4096, 2048, 1024}, 0, []uint{512, 256, 128}},
-	T_RSA_PUB:   {"RSA_PUB", []byte("\"RSA_PUB\""), []uint{4096, 2048, 1024}, 0, []uint{512, 256, 128}},
+	T_AES:          {"AES", []byte("\"AES\""), []uint{128, 192, 256}, 128, nil},
+	T_HMAC_SHA1:    {"HMAC_SHA1", []byte("\"HMAC_SHA1\""), []uint{256}, 160, nil},
+	T_DSA_PRIV:     {"DSA_PRIV", []byte("\"DSA_PRIV\""), []uint{1024}, 384, nil},
+	T_DSA_PUB:      {"DSA_PUB", []byte("\"DSA_PUB\""), []uint{1024}, 384, nil},
+	T_RSA_PRIV:     {"RSA_PRIV", []byte("\"RSA_PRIV\""), []uint{4096, 3072, 2048, 1024}, 0, []uint{512, 384, 256, 128}},
+	T_RSA_PUB:      {"RSA_PUB", []byte("\"RSA_PUB\""), []uint{4096, 3072, 2048, 1024}, 0, []uint{512, 384, 256, 128}},
+	T_ED25519_PRIV: {"ED25519_PRIV", []byte("\"ED25519_PRIV\""), []uint{256}, 512, nil},
+	T_ED25519_PUB:  {"ED25519_PUB", []byte("\"ED25519_PUB\""), []uint{256}, 512, nil},
 }
 
 func (k keyType) String() string {
@@ -39,12 +49,14 @@ func (k keyType) String() string {
 }
 
 var keyTypeLookup = map[string]keyType{
-	"AES":       T_AES,
-	"HMAC_SHA1": T_HMAC_SHA1,
-	"DSA_PRIV":  T_DSA_PRIV,
-	"DSA_PUB":   T_DSA_PUB,
-	"RSA_PRIV":  T_RSA_PRIV,
-	"RSA_PUB":   T_RSA_PUB,
+	"AES":          T_AES,
+	"HMAC_SHA1":    T_HMAC_SHA1,
+	"DSA_PRIV":     T_DSA_PRIV,
+	"DSA_PUB":      T_DSA_PUB,
+	"RSA_PRIV":     T_RSA_PRIV,
+	"RSA_PUB":      T_RSA_PUB,
+	"ED25519_PRIV": T_ED25519_PRIV,
+	"ED25519_PUB":  T_ED25519_PUB,
 }
 
 func (k *keyType) UnmarshalJSON(b []byte) error {
@@ -98,6 +110,88 @@ func (k keyType) isAcceptableSize(size uint) bool {
 	return false
 }
 
+// the purposes a keyset of each type can be created with
+var keyTypePurposes = map[keyType][]keyPurpose{
+	T_AES:          {P_DECRYPT_AND_ENCRYPT},
+	T_HMAC_SHA1:    {P_SIGN_AND_VERIFY},
+	T_DSA_PRIV:     {P_SIGN_AND_VERIFY},
+	T_DSA_PUB:      {P_VERIFY},
+	T_RSA_PRIV:     {P_DECRYPT_AND_ENCRYPT, P_SIGN_AND_VERIFY},
+	T_RSA_PUB:      {P_ENCRYPT, P_VERIFY},
+	T_ED25519_PRIV: {P_SIGN_AND_VERIFY},
+	T_ED25519_PUB:  {P_VERIFY},
+}
+
+// SupportedKeyType describes a key type and the sizes and purposes a keyset of that type can have
+type SupportedKeyType struct {
+	Type        keyType      // the type, for KeyManager.Create
+	Name        string       // the type's name in keyset metadata, e.g. "RSA_PRIV"
+	Sizes       []uint       // the acceptable key sizes in bits, for KeyManager.AddKey
+	DefaultSize uint         // the size AddKey uses when given 0
+	Purposes    []keyPurpose // the purposes a keyset of this type can have
+}
+
+// SupportedKeyTypes returns every key type, in the order of the T_ constants, for tools that
+// offer the user a choice when creating a keyset
+func SupportedKeyTypes() []SupportedKeyType {
+
+	var types []SupportedKeyType
+
+	for k := T_AES; k <= T_ED25519_PUB; k++ {
+		ktinfo := keyTypeInfo[k]
+
+		types = append(types, SupportedKeyType{
+			Type:        k,
+			Name:        ktinfo.str,
+			Sizes:       append([]uint(nil), ktinfo.sizes...),
+			DefaultSize: k.defaultSize(),
+			Purposes:    append([]keyPurpose(nil), keyTypePurposes[k]...),
+		})
+	}
+
+	return types
+}
+
+// report whether keys of this type hold secret material, and so can decrypt or sign
+func (k keyType) isPrivate() bool {
+	return k != T_DSA_PUB && k != T_RSA_PUB && k != T_ED25519_PUB
+}
+
+// the JSON fields that every key of a given type must have, and that tell the types apart
+var keyTypeFields = map[keyType][]string{
+	T_AES:          {"aesKeyString", "hmacKey"},
+	T_HMAC_SHA1:    {"hmacKeyString"},
+	T_DSA_PRIV:     {"x", "publicKey"},
+	T_DSA_PUB:      {"p", "q", "g", "y"},
+	T_RSA_PRIV:     {"privateExponent", "publicKey"},
+	T_RSA_PUB:      {"modulus", "publicExponent"},
+	T_ED25519_PRIV: {"seed", "publicKey"},
+	T_ED25519_PUB:  {"publicKeyString"},
+}
+
+// fields that may stand in for a required one: an AES key may refer to a shared HMAC key rather than embed one
+var keyFieldAlternatives = map[string]string{
+	"hmacKey": "hmacKeyVersion",
+}
+
+// return ErrKeyTypeMismatch if the key JSON 's' lacks any of the fields keys of this type must have,
+// or the unmarshalling error if it isn't a JSON object at all
+func (k keyType) checkKeyJSON(s []byte) error {
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(s, &fields); err != nil {
+		return err
+	}
+
+	for _, f := range keyTypeFields[k] {
+		if _, ok := fields[f]; !ok && fields[keyFieldAlternatives[f]] == nil {
+			return &KeyczarError{Err: ErrKeyTypeMismatch, Field: f, Msg: "expected " + k.String() + " key"}
+		}
+	}
+
+	return nil
+}
+
 type keyStatus int
 
 const (
@@ -198,6 +292,17 @@ func (k keyPurpose) isAcceptablePurpose(want keyPurpose) bool {
 	panic("unknown purpose: " + string(want))
 }
 
+// return the purpose of the public half of a keyset with this purpose
+func (k keyPurpose) publicPurpose() keyPurpose {
+	switch k {
+	case P_DECRYPT_AND_ENCRYPT:
+		return P_ENCRYPT
+	case P_SIGN_AND_VERIFY:
+		return P_VERIFY
+	}
+	return k
+}
+
 func (k *keyPurpose) UnmarshalJSON(b []byte) error {
 	kp, ok := keyPurposeLookup[string(b[1:len(b)-1])]
 	if ok {
@@ -237,14 +342,47 @@ type keyVersion struct {
 	Exportable    bool      `json:"exportable"`
 }
 
+// String describes the keyset for logging, e.g. `"name" AES DECRYPT_AND_ENCRYPT [1:PRIMARY 2:ACTIVE]`
+func (m keyMeta) String() string {
+
+	s := strconv.Quote(m.Name) + " " + m.Type.String() + " " + m.Purpose.String()
+
+	if m.Encrypted {
+		s += " encrypted"
+	}
+
+	versions := make([]string, len(m.Versions))
+	for i, kv := range m.Versions {
+		versions[i] = strconv.Itoa(kv.VersionNumber) + ":" + kv.Status.String()
+	}
+
+	return s + " [" + strings.Join(versions, " ") + "]"
+}
+
+// MarshalJSON writes only the metadata fields listed here, so nothing else the struct
+// might come to hold can end up in a meta file or a log
+func (m keyMeta) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Name      string       `json:"name"`
+		Type      keyType      `json:"type"`
+		Purpose   keyPurpose   `json:"purpose"`
+		Encrypted bool         `json:"encrypted"`
+		Versions  []keyVersion `json:"versions"`
+	}{m.Name, m.Type, m.Purpose, m.Encrypted, m.Versions})
+}
+
 type cipherMode int
 
 // FIXME: need rest of info for cipher modes
 const (
-	cmCBC     cipherMode = iota
-	cmCTR                // unsupported
-	cmECB                // unsupported
-	cmDET_CBC            // unsupported
+	cmCBC cipherMode = iota
+	cmCTR
+	cmECB     // unsupported
+	cmDET_CBC // unsupported
+	cmGCM
+	cmSIV
+
+	cmUnknown cipherMode = -1 // a mode name we don't recognize
 )
 
 func (c cipherMode) String() string {
@@ -257,6 +395,10 @@ func (c cipherMode) String() string {
 		return "ECB"
 	case cmDET_CBC:
 		return "DET_CBC"
+	case cmGCM:
+		return "GCM"
+	case cmSIV:
+		return "SIV"
 	}
 
 	return "(unknown CipherMode)"
@@ -267,12 +409,18 @@ var cipherModeLookup = map[string]cipherMode{
 	"CTR":     cmCTR,
 	"ECB":     cmECB,
 	"DET_CBC": cmDET_CBC,
+	"GCM":     cmGCM,
+	"SIV":     cmSIV,
 }
 
+// unlike the other enums, an unrecognized mode isn't left as the default:
+// treating a key in some other mode as CBC would misread every ciphertext
 func (c *cipherMode) UnmarshalJSON(b []byte) error {
 	cm, ok := cipherModeLookup[string(b[1:len(b)-1])]
 	if ok {
 		*c = cm
+	} else {
+		*c = cmUnknown
 	}
 	return nil
 }
@@ -287,7 +435,143 @@ func (c cipherMode) MarshalJSON() ([]byte, error) {
 		return []byte("\"ECB\""), nil
 	case cmDET_CBC:
 		return []byte("\"DET_CBC\""), nil
+	case cmGCM:
+		return []byte("\"GCM\""), nil
+	case cmSIV:
+		return []byte("\"SIV\""), nil
 	}
 
 	return []byte("\"(unknown CipherMode)\""), nil
 }
+
+type signatureScheme int
+
+const (
+	SS_PKCS1_V15 signatureScheme = iota // RSASSA-PKCS1-v1_5 with SHA-1 [default]
+	SS_PSS                              // RSASSA-PSS with SHA-256
+)
+
+func (s signatureScheme) String() string {
+	switch s {
+	case SS_PKCS1_V15:
+		return "PKCS1_V15"
+	case SS_PSS:
+		return "PSS"
+	}
+
+	return "(unknown SignatureScheme)"
+}
+
+var signatureSchemeLookup = map[string]signatureScheme{
+	"PKCS1_V15": SS_PKCS1_V15,
+	"PSS":       SS_PSS,
+}
+
+func (s *signatureScheme) UnmarshalJSON(b []byte) error {
+	ss, ok := signatureSchemeLookup[string(b[1:len(b)-1])]
+	if ok {
+		*s = ss
+	}
+	return nil
+}
+
+func (s signatureScheme) MarshalJSON() ([]byte, error) {
+	switch s {
+	case SS_PKCS1_V15:
+		return []byte("\"PKCS1_V15\""), nil
+	case SS_PSS:
+		return []byte("\"PSS\""), nil
+	}
+
+	return []byte("\"(unknown SignatureScheme)\""), nil
+}
+
+type hmacDigest int
+
+const (
+	HD_SHA1   hmacDigest = iota // HMAC-SHA1 [default]
+	HD_SHA256                   // HMAC-SHA256, not readable by other Keyczar implementations
+
+	hdUnknown hmacDigest = -1 // a digest name we don't recognize
+)
+
+func (d hmacDigest) String() string {
+	switch d {
+	case HD_SHA1:
+		return "SHA1"
+	case HD_SHA256:
+		return "SHA256"
+	}
+
+	return "(unknown HMACDigest)"
+}
+
+var hmacDigestLookup = map[string]hmacDigest{
+	"SHA1":   HD_SHA1,
+	"SHA256": HD_SHA256,
+}
+
+// like cipherMode, an unrecognized digest isn't left as the default:
+// checking signatures from some other hash as HMAC-SHA1 would fail every one
+func (d *hmacDigest) UnmarshalJSON(b []byte) error {
+	hd, ok := hmacDigestLookup[string(b[1:len(b)-1])]
+	if ok {
+		*d = hd
+	} else {
+		*d = hdUnknown
+	}
+	return nil
+}
+
+func (d hmacDigest) MarshalJSON() ([]byte, error) {
+	switch d {
+	case HD_SHA1:
+		return []byte("\"SHA1\""), nil
+	case HD_SHA256:
+		return []byte("\"SHA256\""), nil
+	}
+
+	return []byte("\"(unknown HMACDigest)\""), nil
+}
+
+type oaepHash int
+
+const (
+	OH_SHA1   oaepHash = iota // RSAES-OAEP with SHA-1 [default]
+	OH_SHA256                 // RSAES-OAEP with SHA-256
+)
+
+func (o oaepHash) String() string {
+	switch o {
+	case OH_SHA1:
+		return "SHA1"
+	case OH_SHA256:
+		return "SHA256"
+	}
+
+	return "(unknown OAEPHash)"
+}
+
+var oaepHashLookup = map[string]oaepHash{
+	"SHA1":   OH_SHA1,
+	"SHA256": OH_SHA256,
+}
+
+func (o *oaepHash) UnmarshalJSON(b []byte) error {
+	oh, ok := oaepHashLookup[string(b[1:len(b)-1])]
+	if ok {
+		*o = oh
+	}
+	return nil
+}
+
+func (o oaepHash) MarshalJSON() ([]byte, error) {
+	switch o {
+	case OH_SHA1:
+		return []byte("\"SHA1\""), nil
+	case OH_SHA256:
+		return []byte("\"SHA256\""), nil
+	}
+
+	return []byte("\"(unknown OAEPHash)\""), nil
+}
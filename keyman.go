@@ -6,19 +6,37 @@ import (
 
 // KeyManager handles all aspects of dealing with keyczar key files
 type KeyManager interface {
-	Create(name string, purpose keyPurpose, ktype keyType) error
+	Create(name string, purpose keyPurpose, ktype keyType, initialStatus ...keyStatus) error
 	Load(reader KeyReader) error
 	AddKey(size uint, status keyStatus) error
+	RotateHMACKey(version int, status keyStatus) error
+	RotateAESKey(version int, status keyStatus) error
 	Promote(version int)
 	Demote(version int)
+	SetSignatureScheme(version int, scheme signatureScheme, saltLength int) error
+	SetOAEPOptions(version int, hash oaepHash, label []byte) error
+	SetHMACTagLength(version int, length int) error
+	SetCipherMode(version int, mode cipherMode) error
+	SetHMACDigest(version int, digest hmacDigest) error
+	SetDeprecationPolicy(policy DeprecationPolicy)
 	// Revoke
 	PubKeys() KeyManager
 	// Write
 	ToJSONs(encrypter Encrypter) []string
+	Export(writer KeyWriter) error
 }
 
 type keyManager struct {
-	kz *keyczar
+	kz         *keyczar
+	deprecated DeprecationPolicy
+}
+
+// A DeprecationPolicy lists the algorithms a KeyManager may no longer generate keys for.
+// It only affects new keys: keysets that already use these algorithms still load, decrypt and verify.
+type DeprecationPolicy struct {
+	// SHA1Signatures refuses to add HMAC_SHA1 or DSA keys, and makes new RSA signing keys use PSS
+	// with SHA-256 instead of PKCS#1 v1.5 with SHA-1.  AES keys still use HMAC-SHA1 for integrity.
+	SHA1Signatures bool
 }
 
 // NewKeyManager returns a new KeyManager
@@ -32,18 +50,30 @@ func (m *keyManager) Load(reader KeyReader) error {
 	return err
 }
 
-func (m *keyManager) Create(name string, purpose keyPurpose, ktype keyType) error {
+// Create starts a new, empty keyset.  For each status in 'initialStatus' a key of the default size is then
+// added as with AddKey, so Create(name, purpose, ktype, S_PRIMARY) gives a keyset that is ready to encrypt
+// or sign.  Public key types can't generate keys, and return ErrUnsupportedType if any are asked for.
+func (m *keyManager) Create(name string, purpose keyPurpose, ktype keyType, initialStatus ...keyStatus) error {
 
 	m.kz = &keyczar{
 		keymeta: keyMeta{name, ktype, purpose, false, nil},
 		keys:    make(map[int]keydata),
-		idkeys:  make(map[uint32][]keydata),
 		primary: -1}
 
 	// check purpose vs ktype
 	// complain if location/meta exists
 	// write serialized km to location/meta
 
+	if len(initialStatus) > 0 && !ktype.isPrivate() {
+		return ErrUnsupportedType
+	}
+
+	for _, status := range initialStatus {
+		if err := m.AddKey(0, status); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -56,9 +86,7 @@ func (m *keyManager) ToJSONs(encrypter Encrypter) []string {
 		return s
 	}
 
-	if encrypter != nil {
-		m.kz.keymeta.Encrypted = true
-	}
+	m.kz.keymeta.Encrypted = encrypter != nil
 
 	b, _ := json.Marshal(m.kz.keymeta)
 	s[0] = string(b)
@@ -84,8 +112,123 @@ func (m *keyManager) ToJSONs(encrypter Encrypter) []string {
 
 }
 
+// Export writes the unencrypted keyset to 'writer' in the standard Keyczar format: the metadata, then the
+// key JSON of each version.  To write encrypted key material, use ToJSONs with an Encrypter.
+func (m *keyManager) Export(writer KeyWriter) error {
+
+	// the copy is what's exported; the keyset we're managing keeps its own metadata
+	meta := m.kz.keymeta
+	meta.Encrypted = false
+
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	if err := writer.PutMetadata(string(b)); err != nil {
+		return err
+	}
+
+	for _, version := range m.kz.versions() {
+		if err := writer.PutKey(version, string(m.kz.keys[version].ToKeyJSON())); err != nil {
+			return withVersion(err, version)
+		}
+	}
+
+	return nil
+}
+
+// SetDeprecationPolicy sets the algorithms that AddKey, SetSignatureScheme and SetHMACDigest refuse with ErrDeprecatedAlgorithm
+func (m *keyManager) SetDeprecationPolicy(policy DeprecationPolicy) {
+	m.deprecated = policy
+}
+
 func (m *keyManager) AddKey(size uint, status keyStatus) error {
 
+	if m.deprecated.SHA1Signatures && (m.kz.keymeta.Type == T_HMAC_SHA1 || m.kz.keymeta.Type == T_DSA_PRIV) {
+		return ErrDeprecatedAlgorithm
+	}
+
+	k, err := generateKey(m.kz.keymeta.Type, size)
+	if err != nil {
+		return err
+	}
+
+	if rk, ok := k.(*rsaKey); ok && m.deprecated.SHA1Signatures && m.kz.keymeta.Purpose == P_SIGN_AND_VERIFY {
+		rk.publicKey.scheme = SS_PSS
+	}
+
+	m.addVersion(k, status)
+
+	return nil
+}
+
+// RotateHMACKey adds a new AES key version that reuses the AES key from 'version' with a freshly generated HMAC key.
+//
+// This is an advanced operation meant for incident response.  The new version
+// shares key material with the old one, so it only helps if the HMAC key alone
+// was exposed: data encrypted under either version is still readable by anyone
+// holding the AES key.  When in doubt, use AddKey to generate a completely new key.
+func (m *keyManager) RotateHMACKey(version int, status keyStatus) error {
+
+	ak, err := m.getAESKey(version)
+	if err != nil {
+		return err
+	}
+
+	hk, err := generateHMACKey()
+	if err != nil {
+		return err
+	}
+
+	m.addVersion(&aesKey{key: ak.key, hmacKey: *hk}, status)
+
+	return nil
+}
+
+// RotateAESKey adds a new AES key version that reuses the HMAC key from 'version' with a freshly generated AES key.
+//
+// This carries the same caveats as RotateHMACKey: the shared HMAC key still
+// authenticates messages under both versions, so an attacker who learned it can
+// forge ciphertexts for whichever AES key they also hold.
+func (m *keyManager) RotateAESKey(version int, status keyStatus) error {
+
+	ak, err := m.getAESKey(version)
+	if err != nil {
+		return err
+	}
+
+	nk, err := generateAESKey(uint(len(ak.key)) * 8)
+	if err != nil {
+		return err
+	}
+
+	nk.hmacKey = hmacKey{key: ak.hmacKey.key}
+
+	m.addVersion(nk, status)
+
+	return nil
+}
+
+// return the aes key for 'version', or an error if the version doesn't exist or isn't an aes key
+func (m *keyManager) getAESKey(version int) (*aesKey, error) {
+
+	k, ok := m.kz.keys[version]
+	if !ok {
+		return nil, ErrNoSuchKeyVersion
+	}
+
+	ak, ok := k.(*aesKey)
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+
+	return ak, nil
+}
+
+// add 'k' to the keyset as the next version number with the given status
+func (m *keyManager) addVersion(k keydata, status keyStatus) {
+
 	exportable := false
 
 	// if we're adding a primary key, and we already have a primary key, then move the existing key to 'active'
@@ -112,13 +255,11 @@ func (m *keyManager) AddKey(size uint, status keyStatus) error {
 		m.kz.keymeta.Versions = append(m.kz.keymeta.Versions, kv)
 	}
 
-	k, err := generateKey(m.kz.keymeta.Type, size)
-	if err != nil {
-		return err
+	if status == S_PRIMARY {
+		m.kz.primary = maxVersion
 	}
 
 	m.kz.keys[maxVersion] = k
-	return nil
 }
 
 func (m *keyManager) Promote(version int) {
@@ -173,11 +314,13 @@ func (m *keyManager) PubKeys() KeyManager {
 		kt, kp = T_RSA_PUB, P_VERIFY
 	case m.kz.keymeta.Type == T_RSA_PRIV && m.kz.keymeta.Purpose == P_DECRYPT_AND_ENCRYPT:
 		kt, kp = T_RSA_PUB, P_ENCRYPT
+	case m.kz.keymeta.Type == T_ED25519_PRIV && m.kz.keymeta.Purpose == P_SIGN_AND_VERIFY:
+		kt, kp = T_ED25519_PUB, P_VERIFY
 	default:
 		return nil // unknown types
 	}
 
-	km.kz = &keyczar{keyMeta{m.kz.keymeta.Name, kt, kp, false, nil}, nil, nil, -1}
+	km.kz = &keyczar{keyMeta{m.kz.keymeta.Name, kt, kp, false, nil}, nil, nil, -1, false, nil}
 
 	km.kz.keymeta.Versions = make([]keyVersion, len(m.kz.keymeta.Versions))
 
@@ -195,9 +338,145 @@ func (m *keyManager) PubKeys() KeyManager {
 			km.kz.keys[version] = &k.publicKey
 		case *rsaKey:
 			km.kz.keys[version] = &k.publicKey
-
+		case *ed25519Key:
+			km.kz.keys[version] = &k.publicKey
 		}
 	}
 
 	return km
 }
+
+// SetSignatureScheme selects PKCS1v15 or PSS signing for an RSA key version.
+// saltLength is only used for PSS; 0 lets the verifier detect it.
+// PKCS1v15 signs with SHA-1, so it is refused with ErrDeprecatedAlgorithm if the DeprecationPolicy says so.
+func (m *keyManager) SetSignatureScheme(version int, scheme signatureScheme, saltLength int) error {
+
+	pub, err := m.getRSAPublicKey(version)
+	if err != nil {
+		return err
+	}
+
+	if scheme == SS_PKCS1_V15 && m.deprecated.SHA1Signatures && m.kz.keymeta.Purpose == P_SIGN_AND_VERIFY {
+		return ErrDeprecatedAlgorithm
+	}
+
+	pub.scheme = scheme
+	pub.saltLength = saltLength
+
+	return nil
+}
+
+// SetOAEPOptions selects the OAEP hash and label used to encrypt with an RSA key version.
+// Ciphertexts only decrypt with the same hash and label.
+func (m *keyManager) SetOAEPOptions(version int, hash oaepHash, label []byte) error {
+
+	pub, err := m.getRSAPublicKey(version)
+	if err != nil {
+		return err
+	}
+
+	pub.oaepHash = hash
+	pub.oaepLabel = label
+
+	return nil
+}
+
+// SetHMACTagLength truncates the integrity tag on ciphertexts from an AES key version to 'length' bytes,
+// for interoperating with producers that shorten their tags.  0 restores the full tag.
+func (m *keyManager) SetHMACTagLength(version int, length int) error {
+
+	ak, err := m.getAESKey(version)
+	if err != nil {
+		return err
+	}
+
+	if length != 0 && length < minHMACTagLength {
+		return ErrInvalidKeySize
+	}
+
+	ak.hmacKey.tagLength = length
+
+	return nil
+}
+
+// SetCipherMode switches an AES key version between CBC or CTR with an HMAC, GCM, and SIV.
+// SIV needs a 256-bit key.  Ciphertexts only decrypt in the mode they were made in, so only change
+// the mode of a new key.
+func (m *keyManager) SetCipherMode(version int, mode cipherMode) error {
+
+	ak, err := m.getAESKey(version)
+	if err != nil {
+		return err
+	}
+
+	if mode != cmCBC && mode != cmCTR && mode != cmGCM && mode != cmSIV {
+		return ErrUnsupportedCipherMode
+	}
+
+	if mode == cmSIV && len(ak.key) != sivKeySize {
+		return ErrInvalidKeySize
+	}
+
+	ak.mode = mode
+
+	return nil
+}
+
+// SetHMACDigest selects the hash for a version of an HMAC_SHA1 keyset, for moving a keyset from HMAC-SHA1 to
+// HMAC-SHA256 without downtime.  The KeyID depends on the digest, so signatures from either kind of key find
+// their own key.  The rollout is:
+//
+//  1. AddKey(0, S_ACTIVE) and SetHMACDigest(version, HD_SHA256), then publish the keyset to every verifier.
+//     They now accept both digests, while signers still use the SHA-1 primary.
+//  2. Promote the new version to primary and publish to the signers, which now sign with HMAC-SHA256.
+//  3. Once no SHA-1 signatures are still in use, demote and remove the old versions.
+//
+// New keys always start out as HMAC-SHA1: SHA-256 is only ever chosen here.  A DeprecationPolicy with
+// SHA1Signatures makes AddKey refuse HMAC_SHA1 keysets, so step 1 has to happen before the policy is set.
+// Once it is, HD_SHA1 is refused here with ErrDeprecatedAlgorithm.
+//
+// Other Keyczar implementations only know HMAC-SHA1, and can't use the SHA-256 versions.
+// Changing the digest of a key that has already signed anything invalidates those signatures.
+func (m *keyManager) SetHMACDigest(version int, digest hmacDigest) error {
+
+	k, ok := m.kz.keys[version]
+	if !ok {
+		return ErrNoSuchKeyVersion
+	}
+
+	hk, ok := k.(*hmacKey)
+	if !ok {
+		return ErrUnsupportedType
+	}
+
+	if digest != HD_SHA1 && digest != HD_SHA256 {
+		return ErrUnsupportedHash
+	}
+
+	if digest == HD_SHA1 && m.deprecated.SHA1Signatures {
+		return ErrDeprecatedAlgorithm
+	}
+
+	hk.digest = digest
+	hk.id = nil
+
+	return nil
+}
+
+// return the public half of the RSA key with the given version
+func (m *keyManager) getRSAPublicKey(version int) (*rsaPublicKey, error) {
+
+	k, ok := m.kz.keys[version]
+	if !ok {
+		return nil, ErrNoSuchKeyVersion
+	}
+
+	switch k := k.(type) {
+	case *rsaKey:
+		return &k.publicKey, nil
+	case *rsaPublicKey:
+		return k, nil
+	}
+
+	return nil, ErrUnsupportedType
+}
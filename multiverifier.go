@@ -0,0 +1,136 @@
+package dkeyczar
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync/atomic"
+)
+
+// A MultiVerifier verifies signatures from several issuers, each with its own keyset
+type MultiVerifier interface {
+	KeyczarEncodingController
+	// Verify checks the signature with the keyset of the issuer whose KeyID is in the signature header,
+	// and returns the name of the issuer that verified it
+	Verify(message []byte, signature string) (issuer string, valid bool, err error)
+	// Reload reloads every issuer's keyset and picks up their new KeyIDs
+	Reload() error
+	// ReloadContext is Reload, passing ctx on to each issuer's Verifier
+	ReloadContext(ctx context.Context) error
+}
+
+type multiVerifier struct {
+	encodingController
+	verifiers map[string]Verifier // issuer name to verifier
+	index     atomic.Value        // map[uint32][]string: KeyID to the issuers with a key with that id
+	unlisted  []string            // issuers whose Verifier isn't a KeyIDLister, tried for every KeyID
+}
+
+// NewMultiVerifier returns a MultiVerifier for the issuers in 'verifiers', which maps issuer names to their Verifiers.
+// Signatures are decoded with the MultiVerifier's encoding, which should match that of each Verifier.
+// Each issuer's Verifier applies its own MaxVerifyAttempts, if any.  A Verifier that isn't a KeyIDLister can't
+// be indexed, so it is tried, after the issuers that own the KeyID, for every signature.
+func NewMultiVerifier(verifiers map[string]Verifier) MultiVerifier {
+
+	mv := new(multiVerifier)
+
+	mv.verifiers = make(map[string]Verifier, len(verifiers))
+	for issuer, v := range verifiers {
+		mv.verifiers[issuer] = v
+		if _, ok := v.(KeyIDLister); !ok {
+			mv.unlisted = append(mv.unlisted, issuer)
+		}
+	}
+	sort.Strings(mv.unlisted)
+
+	mv.buildIndex()
+
+	return mv
+}
+
+// map every KeyID to the issuers that own it
+func (mv *multiVerifier) buildIndex() {
+
+	index := make(map[uint32][]string)
+
+	for issuer, v := range mv.verifiers {
+		kl, ok := v.(KeyIDLister)
+		if !ok {
+			continue
+		}
+		for _, id := range kl.KeyIDs() {
+			h := binary.BigEndian.Uint32(id)
+			index[h] = append(index[h], issuer)
+		}
+	}
+
+	mv.index.Store(index)
+}
+
+// Reload reloads each issuer's keys, then rebuilds the KeyID index.
+// If any keyset fails to load, the index is left as it was.
+func (mv *multiVerifier) Reload() error {
+	return mv.ReloadContext(context.Background())
+}
+
+// ReloadContext is Reload, with 'ctx' passed on to each issuer's Verifier
+func (mv *multiVerifier) ReloadContext(ctx context.Context) error {
+
+	for issuer, v := range mv.verifiers {
+		if err := v.ReloadContext(ctx); err != nil {
+			return withKeyset(err, issuer)
+		}
+	}
+
+	mv.buildIndex()
+
+	return nil
+}
+
+// Verify routes the signature to the issuers that own the KeyID in its header.
+// It returns ErrUnknownIssuer if no issuer has a key with that id.
+func (mv *multiVerifier) Verify(msg []byte, signature string) (string, bool, error) {
+
+	b, err := mv.decode(signature)
+	if err != nil {
+		return "", false, ErrBase64Decoding
+	}
+
+	version, keyID, _, err := ParseHeader(b)
+	if err != nil {
+		return "", false, ErrShortSignature
+	}
+
+	if version != kzVersion {
+		return "", false, ErrBadVersion
+	}
+
+	index := mv.index.Load().(map[uint32][]string)
+
+	issuers := index[binary.BigEndian.Uint32(keyID)]
+	issuers = append(issuers[:len(issuers):len(issuers)], mv.unlisted...)
+
+	// KeyIDs are short enough that two issuers could share one
+	known := false
+	for _, issuer := range issuers {
+		valid, err := mv.verifiers[issuer].Verify(msg, signature)
+		if errors.Is(err, ErrKeyNotFound) {
+			// an unlisted issuer that doesn't have the key
+			continue
+		}
+		if err != nil {
+			return "", false, withKeyset(err, issuer)
+		}
+		known = true
+		if valid {
+			return issuer, true, nil
+		}
+	}
+
+	if !known {
+		return "", false, ErrUnknownIssuer
+	}
+
+	return "", false, nil
+}
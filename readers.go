@@ -1,19 +1,26 @@
 package dkeyczar
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/dsa"
-	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"strconv"
+	"strings"
 
 	"golang.org/x/crypto/pbkdf2"
 )
@@ -26,40 +33,357 @@ type KeyReader interface {
 	GetKey(version int) (string, error)
 }
 
+// KeyWriter stores a keyset, in the same form a KeyReader returns it
+type KeyWriter interface {
+	// PutMetadata stores the meta information for this key
+	PutMetadata(meta string) error
+	// PutKey stores the key material for a particular version of this key
+	PutKey(version int, key string) error
+}
+
 type fileReader struct {
 	location string // directory path of keyfiles
+	metadata string // name of the metadata file, or "" for "meta"
+	keyName  string // fmt template for the name of each key file, or "" for the version number alone
 }
 
 // NewFileReader returns a KeyReader that reads a keyczar key from a directory on the file system.
 func NewFileReader(location string) KeyReader {
 	r := new(fileReader)
 
-	// make sure 'location' ends with our path separator
+	r.location = withPathSeparator(location)
+
+	return r
+}
+
+// make sure 'location' ends with our path separator
+func withPathSeparator(location string) string {
 	if location[len(location)-1] == os.PathSeparator {
-		r.location = location
-	} else {
-		r.location = location + string(os.PathSeparator)
+		return location
 	}
+	return location + string(os.PathSeparator)
+}
 
-	return r
+type fileWriter struct {
+	location string // directory path of keyfiles
+}
+
+// NewFileWriter returns a KeyWriter that writes a keyczar key to an existing directory on the file system,
+// in the layout NewFileReader reads.  Files are created readable only by their owner.
+func NewFileWriter(location string) KeyWriter {
+	return &fileWriter{location: withPathSeparator(location)}
+}
+
+func (w *fileWriter) PutMetadata(meta string) error {
+	return ioutil.WriteFile(w.location+"meta", []byte(meta), 0600)
+}
+
+func (w *fileWriter) PutKey(version int, key string) error {
+	return ioutil.WriteFile(w.location+strconv.Itoa(version), []byte(key), 0600)
+}
+
+// NewFileReaderWithLayout is NewFileReader for a directory whose files aren't named in the standard way.
+// The metadata is read from the file 'metadata', and each version from the file named by 'template',
+// which must contain a single %d for the version number, as in "key_%d.json".
+// It returns ErrBadLayout if 'template' doesn't.
+func NewFileReaderWithLayout(location, metadata, template string) (KeyReader, error) {
+
+	if strings.Count(template, "%") != 1 || !strings.Contains(template, "%d") {
+		return nil, ErrBadLayout
+	}
+
+	r := NewFileReader(location).(*fileReader)
+
+	r.metadata = metadata
+	r.keyName = template
+
+	return r, nil
 }
 
 // return the entire contents of a file as a string
 func slurp(path string) (string, error) {
 	b, err := ioutil.ReadFile(path)
-	return string(b), err
+	return trimKeyFile(b), err
+}
+
+// return the contents of a key or metadata file without a leading UTF-8 byte order mark or surrounding
+// whitespace, which editors on Windows like to add and which json.Unmarshal (or base64, for an encrypted
+// key) would otherwise reject
+func trimKeyFile(b []byte) string {
+	b = bytes.TrimPrefix(b, []byte("\ufeff"))
+	return string(bytes.TrimSpace(b))
 }
 
 // slurp and return the meta file
 func (r *fileReader) GetMetadata() (string, error) {
+	if r.metadata != "" {
+		return slurp(r.location + r.metadata)
+	}
 	return slurp(r.location + "meta")
 }
 
 // slurp and return the requested key version
 func (r *fileReader) GetKey(version int) (string, error) {
+	if r.keyName != "" {
+		return slurp(r.location + fmt.Sprintf(r.keyName, version))
+	}
 	return slurp(r.location + strconv.Itoa(version))
 }
 
+type tarReader struct {
+	files map[string]string // file contents by base name: "meta", "1", "2", ...
+}
+
+// NewTarReader returns a KeyReader for a keyset stored as a tar archive, laid out as the directory
+// read by NewFileReader.  The files may be at the top level of the archive or inside a single directory.
+// The whole archive is read before NewTarReader returns.
+func NewTarReader(r io.Reader) (KeyReader, error) {
+	tr := &tarReader{files: make(map[string]string)}
+
+	t := tar.NewReader(r)
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		b, err := ioutil.ReadAll(t)
+		if err != nil {
+			return nil, err
+		}
+
+		tr.files[path.Base(hdr.Name)] = trimKeyFile(b)
+	}
+
+	return tr, nil
+}
+
+// return the contents of the named file from the archive, or an error like a missing file on disk
+func (r *tarReader) get(name string) (string, error) {
+	s, ok := r.files[name]
+	if !ok {
+		return "", &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return s, nil
+}
+
+// return the meta file from the archive
+func (r *tarReader) GetMetadata() (string, error) {
+	return r.get("meta")
+}
+
+// return the requested key version from the archive
+func (r *tarReader) GetKey(version int) (string, error) {
+	return r.get(strconv.Itoa(version))
+}
+
+// a keyset already read into memory, by NewNDJSONReader or NewWrappedJSONReader
+type ndjsonReader struct {
+	meta string
+	keys map[int]string
+}
+
+// one key line of a newline-delimited keyset
+type ndjsonKeyLine struct {
+	Version *int            `json:"version"`
+	Key     json.RawMessage `json:"key"`
+}
+
+// the longest line NewNDJSONReader accepts
+const ndjsonMaxLine = 1024 * 1024
+
+// NewNDJSONReader returns a KeyReader for a keyset stored as newline-delimited JSON: the metadata on the
+// first line, then a line of the form {"version":n,"key":...} for each key.  The key may be the key JSON
+// object itself, or a string holding it (such as an encrypted key).  Blank lines are ignored.
+// The whole stream is read before NewNDJSONReader returns; a missing metadata line, a malformed key line
+// or a repeated version returns ErrMalformedKeyset.
+func NewNDJSONReader(r io.Reader) (KeyReader, error) {
+	nr := &ndjsonReader{keys: make(map[int]string)}
+
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, ndjsonMaxLine)
+
+	for line := 1; s.Scan(); line++ {
+		b := bytes.TrimSpace(s.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+
+		if nr.meta == "" {
+			if !json.Valid(b) || b[0] != '{' {
+				return nil, &KeyczarError{Err: ErrMalformedKeyset, Msg: "line " + strconv.Itoa(line) + ": bad metadata"}
+			}
+			nr.meta = string(b)
+			continue
+		}
+
+		var kl ndjsonKeyLine
+		if err := json.Unmarshal(b, &kl); err != nil || kl.Version == nil || len(kl.Key) == 0 {
+			return nil, &KeyczarError{Err: ErrMalformedKeyset, Msg: "line " + strconv.Itoa(line) + ": bad key line"}
+		}
+
+		version := *kl.Version
+		if _, ok := nr.keys[version]; ok {
+			return nil, &KeyczarError{Err: ErrMalformedKeyset, Version: version, Msg: "line " + strconv.Itoa(line) + ": duplicate version"}
+		}
+
+		key := string(kl.Key)
+		if kl.Key[0] == '"' {
+			if err := json.Unmarshal(kl.Key, &key); err != nil {
+				return nil, &KeyczarError{Err: ErrMalformedKeyset, Version: version, Msg: "line " + strconv.Itoa(line) + ": bad key"}
+			}
+		}
+		nr.keys[version] = key
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if nr.meta == "" {
+		return nil, &KeyczarError{Err: ErrMalformedKeyset, Msg: "no metadata"}
+	}
+
+	return nr, nil
+}
+
+// a keyset wrapped in a single JSON object
+type wrappedJSON struct {
+	Meta json.RawMessage            `json:"meta"`
+	Data map[string]json.RawMessage `json:"data"`
+}
+
+// NewWrappedJSONReader returns a KeyReader for a whole keyset held in one JSON document of the form
+//
+//	{"meta": {...}, "data": {"1": {...}, "2": {...}}}
+//
+// where "data" maps each version number, as a string, to its key.  The metadata and keys may be the
+// JSON objects themselves, or strings holding them (such as encrypted keys).  This is the single-object
+// export; use NewNDJSONReader for one JSON value per line, and NewFileReader for a directory with a
+// "meta" file and a file per version.  A missing "meta", a version that isn't a positive number, or a
+// malformed key returns ErrMalformedKeyset.
+func NewWrappedJSONReader(doc string) (KeyReader, error) {
+
+	var w wrappedJSON
+	if err := json.Unmarshal([]byte(doc), &w); err != nil {
+		return nil, &KeyczarError{Err: ErrMalformedKeyset, Msg: err.Error()}
+	}
+
+	meta, ok := unwrapJSONString(w.Meta)
+	if !ok {
+		return nil, &KeyczarError{Err: ErrMalformedKeyset, Field: "meta", Msg: "bad metadata"}
+	}
+
+	wr := &ndjsonReader{meta: meta, keys: make(map[int]string)}
+
+	for v, k := range w.Data {
+		version, err := strconv.Atoi(v)
+		if err != nil || version <= 0 || strconv.Itoa(version) != v {
+			return nil, &KeyczarError{Err: ErrMalformedKeyset, Field: "data", Msg: "bad version " + strconv.Quote(v)}
+		}
+
+		key, ok := unwrapJSONString(k)
+		if !ok {
+			return nil, &KeyczarError{Err: ErrMalformedKeyset, Version: version, Msg: "bad key"}
+		}
+		wr.keys[version] = key
+	}
+
+	return wr, nil
+}
+
+// return the JSON object in 'b', or the contents of the JSON string in 'b'
+func unwrapJSONString(b json.RawMessage) (string, bool) {
+
+	b = bytes.TrimSpace(b)
+
+	switch {
+	case len(b) == 0:
+		return "", false
+	case b[0] == '{':
+		return string(b), true
+	case b[0] == '"':
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil || s == "" {
+			return "", false
+		}
+		return s, true
+	}
+
+	return "", false
+}
+
+func (r *ndjsonReader) GetMetadata() (string, error) {
+	return r.meta, nil
+}
+
+func (r *ndjsonReader) GetKey(version int) (string, error) {
+	s, ok := r.keys[version]
+	if !ok {
+		return "", ErrNoSuchKeyVersion
+	}
+	return s, nil
+}
+
+// A ContextKeyReader is a KeyReader that can give up on a slow read, such as one from a key server,
+// when a context is done.  Readers that read from the network should implement it; local readers
+// need not, and are only checked for a done context before each read.
+type ContextKeyReader interface {
+	KeyReader
+	// GetMetadataContext is GetMetadata, returning early with ctx.Err() if ctx is done
+	GetMetadataContext(ctx context.Context) (string, error)
+	// GetKeyContext is GetKey, returning early with ctx.Err() if ctx is done
+	GetKeyContext(ctx context.Context, version int) (string, error)
+}
+
+// read the metadata from 'r', passing it 'ctx' if it can use it
+func getMetadataContext(ctx context.Context, r KeyReader) (string, error) {
+	if cr, ok := r.(ContextKeyReader); ok {
+		return cr.GetMetadataContext(ctx)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return r.GetMetadata()
+}
+
+// read key 'version' from 'r', passing it 'ctx' if it can use it
+func getKeyContext(ctx context.Context, r KeyReader, version int) (string, error) {
+	if cr, ok := r.(ContextKeyReader); ok {
+		return cr.GetKeyContext(ctx, version)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return r.GetKey(version)
+}
+
+// a KeyReader that reads from its wrapped reader with a fixed context
+type contextReader struct {
+	ctx    context.Context
+	reader KeyReader
+}
+
+// bind 'ctx' to the reads from 'r' while keys are loaded
+func withContext(ctx context.Context, r KeyReader) KeyReader {
+	return &contextReader{ctx: ctx, reader: r}
+}
+
+func (r *contextReader) GetMetadata() (string, error) {
+	return getMetadataContext(r.ctx, r.reader)
+}
+
+func (r *contextReader) GetKey(version int) (string, error) {
+	return getKeyContext(r.ctx, r.reader, version)
+}
+
 type encryptedReader struct {
 	reader  KeyReader // our wrapped reader
 	crypter Crypter   // the crypter we use to decrypt what we've read
@@ -77,12 +401,20 @@ func NewEncryptedReader(reader KeyReader, crypter Crypter) KeyReader {
 
 // return the meta information from the wrapper reader.  Meta information is not encrypted.
 func (r *encryptedReader) GetMetadata() (string, error) {
-	return r.reader.GetMetadata()
+	return r.GetMetadataContext(context.Background())
+}
+
+func (r *encryptedReader) GetMetadataContext(ctx context.Context) (string, error) {
+	return getMetadataContext(ctx, r.reader)
 }
 
 // decrypt and return an encrypted key
 func (r *encryptedReader) GetKey(version int) (string, error) {
-	s, err := r.reader.GetKey(version)
+	return r.GetKeyContext(context.Background(), version)
+}
+
+func (r *encryptedReader) GetKeyContext(ctx context.Context, version int) (string, error) {
+	s, err := getKeyContext(ctx, r.reader, version)
 
 	if err != nil {
 		return "", err
@@ -97,6 +429,252 @@ func (r *encryptedReader) GetKey(version int) (string, error) {
 	return string(b), nil
 }
 
+// RewrapKeyset re-encrypts the key material of the encrypted keyset in 'base' from 'oldCrypter' to 'newCrypter',
+// for rotating the key that protects a keyset.  The metadata is written to 'writer' unchanged, then each version.
+// Every key is decrypted and checked before anything is written, so a wrong 'oldCrypter' or damaged key
+// leaves 'writer' untouched.
+func RewrapKeyset(base KeyReader, oldCrypter Crypter, newCrypter Encrypter, writer KeyWriter) error {
+
+	meta, err := base.GetMetadata()
+	if err != nil {
+		return err
+	}
+
+	r := NewEncryptedReader(base, oldCrypter)
+
+	kz, err := newKeyczar(r)
+	if err != nil {
+		return err
+	}
+
+	if !kz.keymeta.Encrypted {
+		return kz.named(ErrUnsupportedType)
+	}
+
+	keys := make(map[int]string, len(kz.keys))
+	for _, version := range kz.versions() {
+		s, err := r.GetKey(version)
+		if err != nil {
+			return kz.named(withVersion(err, version))
+		}
+
+		keys[version], err = newCrypter.Encrypt([]byte(s))
+		if err != nil {
+			return kz.named(withVersion(err, version))
+		}
+	}
+
+	if err := writer.PutMetadata(meta); err != nil {
+		return err
+	}
+
+	for _, version := range kz.versions() {
+		if err := writer.PutKey(version, keys[version]); err != nil {
+			return kz.named(withVersion(err, version))
+		}
+	}
+
+	return nil
+}
+
+type gzipReader struct {
+	reader   KeyReader // our wrapped reader
+	metadata bool      // whether the metadata is compressed too
+}
+
+// NewGzipReader returns a KeyReader which gunzips the keys returned by the wrapped 'reader'.
+// The metadata is returned as is.  Key data that isn't valid gzip, including truncated data,
+// returns ErrDecompression.
+func NewGzipReader(reader KeyReader) KeyReader {
+	return &gzipReader{reader: reader}
+}
+
+// NewGzipMetadataReader is NewGzipReader for keysets whose metadata is also gzipped
+func NewGzipMetadataReader(reader KeyReader) KeyReader {
+	return &gzipReader{reader: reader, metadata: true}
+}
+
+func (r *gzipReader) GetMetadata() (string, error) {
+	return r.GetMetadataContext(context.Background())
+}
+
+func (r *gzipReader) GetMetadataContext(ctx context.Context) (string, error) {
+	s, err := getMetadataContext(ctx, r.reader)
+	if err != nil || !r.metadata {
+		return s, err
+	}
+
+	return gunzip(s)
+}
+
+func (r *gzipReader) GetKey(version int) (string, error) {
+	return r.GetKeyContext(context.Background(), version)
+}
+
+func (r *gzipReader) GetKeyContext(ctx context.Context, version int) (string, error) {
+	s, err := getKeyContext(ctx, r.reader, version)
+	if err != nil {
+		return "", err
+	}
+
+	s, err = gunzip(s)
+	if err != nil {
+		return "", withVersion(err, version)
+	}
+
+	return s, nil
+}
+
+func gunzip(s string) (string, error) {
+
+	zr, err := gzip.NewReader(strings.NewReader(s))
+	if err != nil {
+		return "", ErrDecompression
+	}
+
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return "", ErrDecompression
+	}
+
+	return string(b), nil
+}
+
+type pinnedReader struct {
+	reader KeyReader // our wrapped reader
+	keyIDs [][]byte  // the KeyIDs we accept
+}
+
+// NewPinnedReader returns a KeyReader which only returns keys whose KeyID is one of 'keyIDs', so a keyset
+// that was swapped or had versions added is caught when it is loaded.  Other keys return ErrUnexpectedKey.
+// The keyset must also hold every pinned key: reading the metadata reads and checks every version it lists,
+// and returns ErrUnexpectedKey if a pinned KeyID is missing, so removing a key is caught as well.
+// The wrapped reader must return plain key JSON: wrap any encrypted or compressed reader, not the reverse.
+func NewPinnedReader(reader KeyReader, keyIDs [][]byte) KeyReader {
+	return &pinnedReader{reader: reader, keyIDs: keyIDs}
+}
+
+func (r *pinnedReader) GetMetadata() (string, error) {
+	return r.GetMetadataContext(context.Background())
+}
+
+// GetMetadataContext checks every version in the metadata against the pinned KeyIDs, and that none are missing,
+// before returning it.  Everything is read afresh each time, so concurrent loads don't share any state.
+func (r *pinnedReader) GetMetadataContext(ctx context.Context) (string, error) {
+
+	s, meta, err := r.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	seen := make([]bool, len(r.keyIDs))
+
+	for _, v := range meta.Versions {
+		_, id, err := r.key(ctx, meta, v.VersionNumber)
+		if err != nil {
+			return "", err
+		}
+
+		pinned := false
+		for i, pin := range r.keyIDs {
+			if bytes.Equal(id, pin) {
+				seen[i] = true
+				pinned = true
+			}
+		}
+
+		if !pinned {
+			return "", withVersion(ErrUnexpectedKey, v.VersionNumber)
+		}
+	}
+
+	for _, ok := range seen {
+		if !ok {
+			return "", &KeyczarError{Err: ErrUnexpectedKey, Msg: "pinned keys missing from the keyset"}
+		}
+	}
+
+	return s, nil
+}
+
+func (r *pinnedReader) GetKey(version int) (string, error) {
+	return r.GetKeyContext(context.Background(), version)
+}
+
+// GetKeyContext checks the key against the pinned KeyIDs again, in case the keyset changed since its metadata was read
+func (r *pinnedReader) GetKeyContext(ctx context.Context, version int) (string, error) {
+
+	_, meta, err := r.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	s, id, err := r.key(ctx, meta, version)
+	if err != nil {
+		return "", err
+	}
+
+	for _, pin := range r.keyIDs {
+		if bytes.Equal(id, pin) {
+			return s, nil
+		}
+	}
+
+	return "", withVersion(ErrUnexpectedKey, version)
+}
+
+// read and parse the wrapped reader's metadata, for the key type and versions
+func (r *pinnedReader) metadata(ctx context.Context) (string, *keyMeta, error) {
+
+	s, err := getMetadataContext(ctx, r.reader)
+	if err != nil {
+		return "", nil, err
+	}
+
+	meta := new(keyMeta)
+	if err := json.Unmarshal([]byte(s), meta); err != nil {
+		return "", nil, err
+	}
+
+	return s, meta, nil
+}
+
+// read the key with the given version, and parse it as the metadata's key type to find its KeyID
+func (r *pinnedReader) key(ctx context.Context, meta *keyMeta, version int) (string, []byte, error) {
+
+	keyFromJSON := keyParser(meta.Type)
+	if keyFromJSON == nil {
+		return "", nil, ErrUnsupportedType
+	}
+
+	s, err := getKeyContext(ctx, r.reader, version)
+	if err != nil {
+		return "", nil, err
+	}
+
+	k, err := keyFromJSON([]byte(s))
+	if err != nil {
+		return "", nil, withVersion(err, version)
+	}
+
+	// a shared HMAC key is part of the KeyID, so it has to be read too
+	if ak, ok := k.(*aesKey); ok && ak.hmacKeyVersion != 0 {
+		hs, err := getKeyContext(ctx, r.reader, ak.hmacKeyVersion)
+		if err != nil {
+			return "", nil, err
+		}
+		hk, err := keyFromJSON([]byte(hs))
+		if err != nil {
+			return "", nil, withVersion(err, ak.hmacKeyVersion)
+		}
+		if err := resolveSharedHMACKeys(map[int]keydata{version: k, ak.hmacKeyVersion: hk}); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return s, k.KeyID(), nil
+}
+
 // NewPBEReader returns a KeyReader which decrypts keys encrypted with password-based encryption
 func NewPBEReader(reader KeyReader, password []byte) KeyReader {
 
@@ -127,12 +705,26 @@ func NewPBEEncrypter(password []byte) Encrypter {
 type pbeCrypter struct {
 	KeyczarCompressionController
 	KeyczarEncodingController
+	authenticationController
+	limitController
+	plaintextController
 	password []byte // the password to use for the PBE
 }
 
+// Decrypt decrypts a pbe-json key.  The format has no MAC, whatever its "hmac" field says,
+// so with RequireAuthentication set it returns ErrUnauthenticatedCiphertext.
 func (c *pbeCrypter) Decrypt(message string) ([]byte, error) {
 	var pbejson pbeKeyJSON
 
+	if c.requireAuthentication {
+		return nil, ErrUnauthenticatedCiphertext
+	}
+
+	// the JSON isn't encoded, so its length is what's limited
+	if c.maxCiphertextBytes > 0 && len(message) > c.maxCiphertextBytes {
+		return nil, ErrCiphertextTooLarge
+	}
+
 	err := json.Unmarshal([]byte(message), &pbejson)
 	if err != nil {
 		return nil, err
@@ -175,17 +767,25 @@ func (c *pbeCrypter) Decrypt(message string) ([]byte, error) {
 
 func (c *pbeCrypter) Encrypt(plaintext []byte) (string, error) {
 
+	if err := c.checkPlaintext(plaintext); err != nil {
+		return "", err
+	}
+
 	var pbejson pbeKeyJSON
 	pbejson.Cipher = "AES128"
 	pbejson.HMAC = "HMAC_SHA1"
 	pbejson.IterationCount = 4096
 
 	salt := make([]byte, 16)
-	io.ReadFull(rand.Reader, salt)
+	if err := randBytes(salt); err != nil {
+		return "", err
+	}
 	pbejson.Salt = encodeWeb64String(salt)
 
 	iv := make([]byte, 16)
-	io.ReadFull(rand.Reader, iv)
+	if err := randBytes(iv); err != nil {
+		return "", err
+	}
 	pbejson.Iv = encodeWeb64String(iv)
 
 	keybytes := pbkdf2.Key(c.password, salt, pbejson.IterationCount, 128/8, sha1.New)
@@ -217,6 +817,81 @@ func (c *pbeCrypter) Encrypt(plaintext []byte) (string, error) {
 	return string(j), nil
 }
 
+// the JSON ciphertext has no fixed size
+func (c *pbeCrypter) CiphertextLen(plaintextLen int) int {
+	return -1
+}
+
+func (c *pbeCrypter) WriteEncrypted(w io.Writer, plaintext []byte) error {
+
+	s, err := c.Encrypt(plaintext)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, s)
+	return err
+}
+
+func (c *pbeCrypter) DecryptWithVersion(message string, version int) ([]byte, error) {
+	return nil, ErrUnsupportedType
+}
+
+func (c *pbeCrypter) EncryptWithNonce(plaintext []byte, nonce []byte) (string, error) {
+
+	if len(nonce) < minNonceLength || len(nonce) > maxNonceLength {
+		return "", ErrInvalidNonce
+	}
+
+	if err := c.checkPlaintext(plaintext); err != nil {
+		return "", err
+	}
+
+	return c.Encrypt(lenPrefixPack(nonce, plaintext))
+}
+
+func (c *pbeCrypter) DecryptWithNonce(message string) ([]byte, []byte, error) {
+
+	packed, err := c.Decrypt(message)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return unpackNonce(packed)
+}
+
+// Reencrypt decrypts the message and encrypts it again with a fresh salt and iv
+func (c *pbeCrypter) Reencrypt(message string) (string, error) {
+
+	plaintext, err := c.Decrypt(message)
+	if err != nil {
+		return "", err
+	}
+
+	return c.Encrypt(plaintext)
+}
+
+// there are no keys to reload for password-based encryption
+func (c *pbeCrypter) Reload() error {
+	return nil
+}
+
+func (c *pbeCrypter) ReloadContext(ctx context.Context) error {
+	return nil
+}
+
+func (c *pbeCrypter) KeyInfo() KeyInfo {
+	return KeyInfo{Name: "PBE", Type: "AES", Purpose: P_DECRYPT_AND_ENCRYPT.String(), Primary: -1}
+}
+
+func (c *pbeCrypter) PrimaryVersion() (int, error) {
+	return -1, ErrNoPrimaryKey
+}
+
+func (c *pbeCrypter) ActiveVersions() []int {
+	return nil
+}
+
 // a fake reader for an RSA private key
 type importedRSAPrivateKeyReader struct {
 	km      keyMeta    // our fake meta info
@@ -441,6 +1116,28 @@ func newImportedAESKeyReader(key *aesKey) KeyReader {
 	return r
 }
 
+// ImportAESKey returns a KeyReader for the raw AES key material, paired with a newly generated HMAC key.
+// The resulting key can be used for encryption and decryption.
+func ImportAESKey(raw []byte) (KeyReader, error) {
+
+	if !T_AES.isAcceptableSize(uint(len(raw)) * 8) {
+		return nil, ErrInvalidKeySize
+	}
+
+	hmackey, err := generateHMACKey()
+	if err != nil {
+		return nil, err
+	}
+
+	ak := new(aesKey)
+	ak.key = append([]byte(nil), raw...)
+	ak.hmacKey = *hmackey
+
+	r := newImportedAESKeyReader(ak)
+
+	return r, nil
+}
+
 func (r *importedAESKeyReader) GetMetadata() (string, error) {
 	b, err := json.Marshal(r.km)
 	return string(b), err
@@ -483,3 +1180,33 @@ func (r *importedDSAPrivateKeyReader) GetKey(version int) (string, error) {
 	b, err := json.Marshal(r.dsajson)
 	return string(b), err
 }
+
+// a fake reader for a DSA public key
+type importedDSAPublicKeyReader struct {
+	km      keyMeta          // our fake meta info
+	dsajson dsaPublicKeyJSON // the dsa key we're importing
+}
+
+// construct a fake keyreader for the provided dsa public key
+func newImportedDSAPublicKeyReader(key *dsa.PublicKey) KeyReader {
+	r := new(importedDSAPublicKeyReader)
+	kv := keyVersion{0, S_PRIMARY, false}
+	r.km = keyMeta{"Imported DSA Public Key", T_DSA_PUB, P_VERIFY, false, []keyVersion{kv}}
+
+	r.dsajson = *newDSAPublicJSONFromKey(key)
+
+	return r
+}
+
+func (r *importedDSAPublicKeyReader) GetMetadata() (string, error) {
+	b, err := json.Marshal(r.km)
+	return string(b), err
+}
+
+func (r *importedDSAPublicKeyReader) GetKey(version int) (string, error) {
+	if version != 0 {
+		return "", ErrNoSuchKeyVersion
+	}
+	b, err := json.Marshal(r.dsajson)
+	return string(b), err
+}
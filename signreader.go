@@ -0,0 +1,93 @@
+package dkeyczar
+
+import (
+	"hash"
+	"io"
+)
+
+// A SigningReader passes on the data read from its source unchanged, signing it as it goes
+type SigningReader interface {
+	io.Reader
+	// Signature returns the signature over everything read, the same as Sign would return for it.
+	// It returns ErrIncompleteRead until the source has returned io.EOF.
+	Signature() (string, error)
+}
+
+// A ReaderSigner is a Signer that can sign data as it is read.  The Signers from NewSigner implement it.
+type ReaderSigner interface {
+	Signer
+	// SignReader returns a reader that passes on what it reads from src and then gives its signature
+	SignReader(src io.Reader) (SigningReader, error)
+}
+
+type keySigningReader struct {
+	ks  *keySigner
+	src io.Reader
+
+	key    digestSignKey
+	h      hash.Hash
+	issuer []byte
+
+	eof bool
+	sig string
+	err error
+}
+
+// SignReader returns a SigningReader that reads from 'src', for signing data that is being forwarded
+// without holding it all in memory.  The primary key is fixed when SignReader is called, so a Reload
+// while reading doesn't change which key signs.  Ed25519 can't sign a message in pieces, so for Ed25519
+// keys the data is held in memory until it is signed.
+func (ks *keySigner) SignReader(src io.Reader) (SigningReader, error) {
+
+	key, ok := ks.keys().getPrimaryKey().(digestSignKey)
+	if !ok {
+		return nil, ErrUnacceptablePurpose
+	}
+
+	return &keySigningReader{ks: ks, src: src, key: key, h: key.newHash(), issuer: ks.issuer}, nil
+}
+
+// Read reads from the source and adds what it read to the signature
+func (sr *keySigningReader) Read(p []byte) (int, error) {
+
+	n, err := sr.src.Read(p)
+	sr.h.Write(p[:n])
+
+	if err == io.EOF {
+		sr.eof = true
+	}
+
+	return n, err
+}
+
+// Signature returns the encoded signature once the source is exhausted.  It is only computed once.
+func (sr *keySigningReader) Signature() (string, error) {
+
+	if !sr.eof {
+		return "", ErrIncompleteRead
+	}
+
+	if sr.sig != "" || sr.err != nil {
+		return sr.sig, sr.err
+	}
+
+	var h []byte
+
+	if sr.issuer != nil {
+		sr.h.Write(appendIssuerTrailer(nil, sr.issuer))
+		h = makeIssuerHeader(sr.key, sr.issuer)
+	} else {
+		sr.h.Write([]byte{kzVersion})
+		h = makeHeader(sr.key)
+	}
+
+	signature, err := sr.key.signDigest(sr.h.Sum(nil))
+	if err != nil {
+		sr.err = err
+		return "", err
+	}
+
+	sr.sig = sr.ks.encode(append(h, signature...))
+
+	return sr.sig, nil
+}
@@ -0,0 +1,190 @@
+package dkeyczar
+
+/*
+Deterministic encryption with AES-SIV (RFC 5297).
+
+Keys in SIV mode produce
+
+|header|siv|ciphertext|
+
+with lengths
+
+|kzHeaderLength|aes.BlockSize|len(plaintext)|
+
+The synthetic iv is computed with S2V over the header and the plaintext, using
+AES-CMAC keyed with the first half of the AES key, then used as the counter
+block for AES-CTR keyed with the second half.  Decrypt runs CTR and recomputes
+the siv, so the header and ciphertext are authenticated without an HMAC.
+
+There is no random iv: the same plaintext under the same key always gives the
+same ciphertext.  That is the point of the mode, for values that must be found
+by their encryption, like database keys, but it does reveal which ciphertexts
+hold equal plaintexts.  The key must be 256 bits, giving AES-SIV-CMAC-256 with
+two AES-128 keys; the HMAC key is not used.
+*/
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+)
+
+// the AES key size for SIV mode, in bytes: two AES-128 keys
+const sivKeySize = 32
+
+func (ak *aesKey) newSIVSession() (*aesSession, error) {
+
+	if len(ak.key) != sivKeySize {
+		return nil, ErrInvalidKeySize
+	}
+
+	s2v, err := aes.NewCipher(ak.key[:sivKeySize/2])
+	if err != nil {
+		return nil, err
+	}
+
+	ctr, err := aes.NewCipher(ak.key[sivKeySize/2:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &aesSession{key: ak, block: ctr, s2v: s2v}, nil
+}
+
+func (s *aesSession) encryptSIV(data []byte) []byte {
+
+	msg := make([]byte, kzHeaderLength+aes.BlockSize+len(data))
+
+	copy(msg, makeHeader(s.key))
+
+	v := sivS2V(s.s2v, msg[:kzHeaderLength], data)
+	copy(msg[kzHeaderLength:], v)
+
+	sivCTR(s.block, v).XORKeyStream(msg[kzHeaderLength+aes.BlockSize:], data)
+
+	return msg
+}
+
+func (s *aesSession) decryptSIV(data []byte) ([]byte, error) {
+
+	if len(data) < kzHeaderLength+aes.BlockSize {
+		return nil, ErrShortCiphertext
+	}
+
+	h := data[:kzHeaderLength]
+	v := data[kzHeaderLength : kzHeaderLength+aes.BlockSize]
+
+	plaintext := make([]byte, len(data)-kzHeaderLength-aes.BlockSize)
+	sivCTR(s.block, v).XORKeyStream(plaintext, data[kzHeaderLength+aes.BlockSize:])
+
+	if subtle.ConstantTimeCompare(sivS2V(s.s2v, h, plaintext), v) != 1 {
+		return nil, ErrInvalidSignature
+	}
+
+	return plaintext, nil
+}
+
+// CiphertextEqual reports whether two raw (already decoded) ciphertexts are the same, for deduplicating values
+// encrypted with an SIV-mode key, where equal plaintexts under one key always give equal ciphertexts.  The
+// headers must have the same version and KeyID, so ciphertexts from different keys, and so different modes,
+// are never equal; the rest is then compared in constant time.  Other modes use a random iv, so two
+// encryptions of the same plaintext never compare equal.  Nothing is decrypted or authenticated.
+func CiphertextEqual(a, b []byte) bool {
+
+	va, ida, ra, err := ParseHeader(a)
+	if err != nil || va != kzVersion {
+		return false
+	}
+
+	vb, idb, rb, err := ParseHeader(b)
+	if err != nil || vb != kzVersion {
+		return false
+	}
+
+	// the KeyIDs are public, but compare them the same way as the rest
+	if subtle.ConstantTimeCompare(ida, idb) != 1 {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(ra, rb) == 1
+}
+
+// return the CTR stream for synthetic iv 'v', with the two bits RFC 5297 clears so implementations
+// using 64- or 32-bit counter arithmetic agree
+func sivCTR(block cipher.Block, v []byte) cipher.Stream {
+
+	q := append([]byte(nil), v...)
+	q[8] &= 0x7f
+	q[12] &= 0x7f
+
+	return cipher.NewCTR(block, q)
+}
+
+// the S2V function of RFC 5297 over the associated data 'ad' and the plaintext
+func sivS2V(block cipher.Block, ad []byte, plaintext []byte) []byte {
+
+	d := cmac(block, make([]byte, aes.BlockSize))
+
+	sivDouble(d)
+	subtle.XORBytes(d, d, cmac(block, ad))
+
+	var t []byte
+	if len(plaintext) >= aes.BlockSize {
+		// xor d into the end of the plaintext
+		t = append([]byte(nil), plaintext...)
+		end := t[len(t)-aes.BlockSize:]
+		subtle.XORBytes(end, end, d)
+	} else {
+		sivDouble(d)
+		t = make([]byte, aes.BlockSize)
+		copy(t, plaintext)
+		t[len(plaintext)] = 0x80
+		subtle.XORBytes(t, t, d)
+	}
+
+	return cmac(block, t)
+}
+
+// multiply 'b' by x in GF(2^128), in place
+func sivDouble(b []byte) {
+
+	carry := b[0] >> 7
+	for i := 0; i < len(b)-1; i++ {
+		b[i] = b[i]<<1 | b[i+1]>>7
+	}
+	b[len(b)-1] = b[len(b)-1]<<1 ^ 0x87*carry
+}
+
+// AES-CMAC (NIST SP 800-38B) of 'msg'
+func cmac(block cipher.Block, msg []byte) []byte {
+
+	// the subkeys: k1 for a message ending in a whole block, k2 for one that needs padding
+	k := make([]byte, aes.BlockSize)
+	block.Encrypt(k, k)
+	sivDouble(k)
+
+	last := make([]byte, aes.BlockSize)
+
+	n := len(msg)
+	if n > 0 && n%aes.BlockSize == 0 {
+		n -= aes.BlockSize
+		copy(last, msg[n:])
+	} else {
+		sivDouble(k)
+		n -= n % aes.BlockSize
+		copy(last, msg[n:])
+		last[len(msg)-n] = 0x80
+	}
+	subtle.XORBytes(last, last, k)
+
+	x := make([]byte, aes.BlockSize)
+	for i := 0; i < n; i += aes.BlockSize {
+		subtle.XORBytes(x, x, msg[i:i+aes.BlockSize])
+		block.Encrypt(x, x)
+	}
+
+	subtle.XORBytes(x, x, last)
+	block.Encrypt(x, x)
+
+	return x
+}
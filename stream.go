@@ -0,0 +1,297 @@
+package dkeyczar
+
+/*
+Streaming encryption with AES+HMAC.
+
+A stream is a standard Keyczar header followed by a sequence of frames:
+
+|header|frame|frame|...|frame|
+
+Each frame is encrypted and authenticated on its own:
+
+|sequence|flags|length|iv|ciphertext|signature|
+
+with lengths
+
+|4|1|4|aes.BlockSize|length|macLength|
+
+where macLength is hmacSigLength unless a custom MAC or a truncated tag is in use.
+
+The sequence number is a big-endian uint32 starting at 0, and length is the
+big-endian uint32 length of the ciphertext.  The last frame of the stream has
+streamFinalFrame set in its flags.  The signature covers the stream header, the
+frame header, the iv and the ciphertext, so frames can't be reordered, dropped,
+or moved between streams, and a stream cut off at a frame boundary is detected
+by the missing final frame.
+
+Because every frame is checked before its plaintext is written out,
+DecryptStream never releases unauthenticated data.  If it returns an error,
+everything written so far came from valid frames, but the stream as a whole
+should not be trusted.
+*/
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+)
+
+// A StreamCrypter encrypts and decrypts streams as a series of individually authenticated frames
+type StreamCrypter interface {
+	// EncryptStream reads plaintext from src until EOF and writes the encrypted stream to dst
+	EncryptStream(dst io.Writer, src io.Reader) error
+	// DecryptStream reads an encrypted stream from src and writes the plaintext to dst, one verified frame at a time
+	DecryptStream(dst io.Writer, src io.Reader) error
+}
+
+const (
+	streamFrameSize        = 64 * 1024 // maximum plaintext bytes per frame
+	streamFrameHeaderSize  = 4 + 1 + 4
+	streamFinalFrame       = 0x01
+	streamMaxCiphertextLen = streamFrameSize + aes.BlockSize // a full frame plus a block of padding
+)
+
+type keyStreamCrypter struct {
+	kz *keyczar
+}
+
+// NewStreamCrypter returns an object capable of encrypting and decrypting streams using the AES key provided by the reader
+func NewStreamCrypter(r KeyReader) (StreamCrypter, error) {
+	k := new(keyStreamCrypter)
+	var err error
+	k.kz, err = newKeyczar(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !k.kz.isAcceptablePurpose(P_DECRYPT_AND_ENCRYPT) {
+		return nil, ErrUnacceptablePurpose
+	}
+
+	if k.kz.keymeta.Type != T_AES {
+		return nil, ErrUnsupportedType
+	}
+
+	err = k.kz.loadPrimaryKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// EncryptStream encrypts everything read from src with the primary key
+func (sc *keyStreamCrypter) EncryptStream(dst io.Writer, src io.Reader) error {
+
+	ak := sc.kz.getPrimaryKey().(*aesKey)
+
+	session, err := ak.newSession()
+	if err != nil {
+		return err
+	}
+
+	// frames are CBC with an HMAC; keys in other modes have no stream format
+	if ak.mode != cmCBC {
+		return ErrUnsupportedType
+	}
+
+	h := makeHeader(ak)
+
+	if _, err := dst.Write(h); err != nil {
+		return err
+	}
+
+	buf := make([]byte, streamFrameSize)
+
+	for seq := uint32(0); ; seq++ {
+		n, err := io.ReadFull(src, buf)
+
+		final := false
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			final = true
+		default:
+			return err
+		}
+
+		frame, err := session.encryptFrame(h, seq, final, buf[:n])
+		if err != nil {
+			return err
+		}
+
+		if _, err := dst.Write(frame); err != nil {
+			return err
+		}
+
+		if final {
+			return nil
+		}
+	}
+}
+
+// encrypt and sign a single frame of the stream with header 'h'
+func (s *aesSession) encryptFrame(h []byte, seq uint32, final bool, plaintext []byte) ([]byte, error) {
+
+	data := pkcs5pad(append([]byte(nil), plaintext...), aes.BlockSize)
+
+	// the stream header is included in the signature, but not written out with every frame
+	signed := make([]byte, kzHeaderLength+streamFrameHeaderSize+aes.BlockSize+len(data), kzHeaderLength+streamFrameHeaderSize+aes.BlockSize+len(data)+s.mac.Size())
+	copy(signed, h)
+	frame := signed[kzHeaderLength:]
+
+	binary.BigEndian.PutUint32(frame[0:], seq)
+	if final {
+		frame[4] = streamFinalFrame
+	}
+	binary.BigEndian.PutUint32(frame[5:], uint32(len(data)))
+
+	iv := frame[streamFrameHeaderSize : streamFrameHeaderSize+aes.BlockSize]
+	if err := s.key.randIV(iv); err != nil {
+		return nil, err
+	}
+
+	crypter := cipher.NewCBCEncrypter(s.block, iv)
+	crypter.CryptBlocks(frame[streamFrameHeaderSize+aes.BlockSize:], data)
+
+	sig, err := s.mac.Sign(signed)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(frame, sig...), nil
+}
+
+// DecryptStream decrypts a stream produced by EncryptStream
+func (sc *keyStreamCrypter) DecryptStream(dst io.Writer, src io.Reader) error {
+
+	h := make([]byte, kzHeaderLength)
+	if _, err := io.ReadFull(src, h); err != nil {
+		return ErrShortCiphertext
+	}
+
+	_, kl, err := splitHeaderBytes(encodingController{}, sc.kz, h, ErrShortCiphertext)
+	if err != nil {
+		return err
+	}
+
+	var session *aesSession
+
+	for seq := uint32(0); ; seq++ {
+
+		fh := make([]byte, streamFrameHeaderSize)
+		if _, err := io.ReadFull(src, fh); err != nil {
+			// ran out of frames before seeing the last one
+			return ErrShortCiphertext
+		}
+
+		if binary.BigEndian.Uint32(fh[0:]) != seq {
+			return ErrInvalidSignature
+		}
+
+		final := fh[4]&streamFinalFrame != 0
+
+		length := binary.BigEndian.Uint32(fh[5:])
+		if length == 0 || length > streamMaxCiphertextLen || length%aes.BlockSize != 0 {
+			return ErrInvalidSignature
+		}
+
+		// the first frame tells us which of the keys with this id encrypted the stream
+		candidates := []*aesSession{session}
+		if session == nil {
+			candidates = candidates[:0]
+			for _, k := range kl {
+				s, err := k.(*aesKey).newSession()
+				if err != nil {
+					return err
+				}
+				if s.key.mode != cmCBC {
+					continue
+				}
+				// all the candidate keys must agree on the tag size, or we can't tell where the frame ends
+				if len(candidates) > 0 && s.mac.Size() != candidates[0].mac.Size() {
+					return ErrInvalidSignature
+				}
+				candidates = append(candidates, s)
+			}
+			if len(candidates) == 0 {
+				return ErrUnsupportedType
+			}
+		}
+
+		signed, sig, err := readFrame(src, h, fh, length, candidates[0].mac.Size())
+		if err != nil {
+			return err
+		}
+
+		session = nil
+		for _, s := range candidates {
+			if s.verifyFrame(signed, sig) {
+				session = s
+				break
+			}
+		}
+		if session == nil {
+			return ErrInvalidSignature
+		}
+
+		plaintext, err := session.decryptFrame(signed)
+		if err != nil {
+			return err
+		}
+
+		// nothing may follow the last frame
+		if final {
+			if _, err := io.ReadFull(src, make([]byte, 1)); err == nil {
+				return ErrInvalidSignature
+			} else if err != io.EOF {
+				return err
+			}
+		}
+
+		if _, err := dst.Write(plaintext); err != nil {
+			return err
+		}
+
+		if final {
+			return nil
+		}
+	}
+}
+
+// read the rest of a frame, returning the signed bytes (stream header, frame header, iv and ciphertext) and the signature
+func readFrame(src io.Reader, h []byte, fh []byte, length uint32, macLength int) ([]byte, []byte, error) {
+
+	signed := make([]byte, kzHeaderLength+streamFrameHeaderSize+aes.BlockSize+int(length)+macLength)
+	copy(signed, h)
+	copy(signed[kzHeaderLength:], fh)
+
+	if _, err := io.ReadFull(src, signed[kzHeaderLength+streamFrameHeaderSize:]); err != nil {
+		return nil, nil, ErrShortCiphertext
+	}
+
+	return signed[:len(signed)-macLength], signed[len(signed)-macLength:], nil
+}
+
+// decrypt the body of a frame whose signature has already been checked
+func (s *aesSession) decryptFrame(signed []byte) ([]byte, error) {
+
+	body := signed[kzHeaderLength+streamFrameHeaderSize:]
+	blockSize := s.block.BlockSize()
+
+	iv := body[:blockSize]
+	ciphertext := body[blockSize:]
+
+	crypter := cipher.NewCBCDecrypter(s.block, iv)
+	crypter.CryptBlocks(ciphertext, ciphertext)
+
+	return pkcs5unpad(ciphertext, blockSize)
+}
+
+// check the signature on a frame
+func (s *aesSession) verifyFrame(signed []byte, sig []byte) bool {
+	ok, err := s.mac.Verify(signed, sig)
+	return ok && err == nil
+}
@@ -2,11 +2,25 @@ package dkeyczar
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
+	"io"
 	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
 )
 
+// fill 'b' from the system random source, failing rather than leaving any of it unset
+func randBytes(b []byte) error {
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return ErrRandomSource
+	}
+	return nil
+}
+
 func bigIntBytes(value *big.Int) []byte {
 	absbytes := value.Bytes()
 	if absbytes[0]&0x80 != 0x00 {
@@ -16,6 +30,16 @@ func bigIntBytes(value *big.Int) []byte {
 	return absbytes
 }
 
+// left-pad 'b' with zeros to 'n' bytes; longer inputs are returned unchanged
+func leftPad(b []byte, n int) []byte {
+	if len(b) >= n {
+		return b
+	}
+	padded := make([]byte, n)
+	copy(padded[n-len(b):], b)
+	return padded
+}
+
 // A Web64 string is a base64 encoded string with a web-safe character set and no trailing equal signs.
 func decodeWeb64String(key string) ([]byte, error) {
 
@@ -46,6 +70,29 @@ func encodeWeb64String(b []byte) string {
 	return s[0 : i+1]
 }
 
+// EncodeWeb64 returns 'b' as a web64 string: base64 with the URL-safe alphabet and no padding, as used for all Keyczar output
+func EncodeWeb64(b []byte) string {
+	return encodeWeb64String(b)
+}
+
+// DecodeWeb64 decodes a web64 string.  Input with trailing padding is also accepted.
+func DecodeWeb64(s string) ([]byte, error) {
+	b, err := decodeWeb64String(s)
+	if err != nil {
+		return nil, ErrBase64Decoding
+	}
+	return b, nil
+}
+
+// web64 uses '-' and '_' in place of '+' and '/'
+var web64Replacer = strings.NewReplacer("+", "-", "/", "_")
+
+// NormalizeBase64 converts standard base64 (with '+', '/' and '=' padding) to the web64 form expected by this package.
+// Input that is already web64 is returned unchanged.
+func NormalizeBase64(s string) string {
+	return strings.TrimRight(web64Replacer.Replace(s), "=")
+}
+
 // Encode a list of arrays as a single byte-stream:
 //    <number_of_arrays> <len1> <array1> <len2> <array2> ...
 // The number of arrays and lengths are big-endian uint32.
@@ -73,28 +120,67 @@ func lenPrefixPack(arrays ...[]byte) []byte {
 	return buf.Bytes()
 }
 
-// Unpack a list of arrays packed with lenPrefixPack
-func lenPrefixUnpack(packed []byte) [][]byte {
+// HKDF (RFC 5869) with SHA-256: extract a key from 'secret' and 'salt', then expand it to 'n' bytes for 'info'
+func hkdfSHA256(secret, salt, info []byte, n int) ([]byte, error) {
 
-	var numArrays uint32
+	okm := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, info), okm); err != nil {
+		return nil, err
+	}
 
-	buf := bytes.NewBuffer(packed)
+	return okm, nil
+}
 
-	binary.Read(buf, binary.BigEndian, &numArrays)
+// Unpack a list of arrays packed with lenPrefixPack.  Truncated data, lengths that run past the end,
+// and trailing bytes return ErrBadPacking.  The arrays share storage with 'packed'.
+func lenPrefixUnpack(packed []byte) ([][]byte, error) {
 
-	arrays := make([][]byte, numArrays)
+	if len(packed) < 4 {
+		return nil, ErrBadPacking
+	}
 
-	for i := uint32(0); i < numArrays; i++ {
-		var size uint32
-		binary.Read(buf, binary.BigEndian, &size)
+	return lenPrefixUnpackN(packed, int(binary.BigEndian.Uint32(packed)))
+}
 
-		arrays[i] = make([]byte, size)
-		buf.Read(arrays[i])
+// Unpack exactly 'n' arrays packed with lenPrefixPack, checking every length against the data available
+func lenPrefixUnpackN(packed []byte, n int) ([][]byte, error) {
+
+	if len(packed) < 4 || binary.BigEndian.Uint32(packed) != uint32(n) {
+		return nil, ErrBadPacking
+	}
+	packed = packed[4:]
+
+	// every array needs at least its length, so don't allocate for more than could be there
+	if n < 0 || n > len(packed)/4 {
+		return nil, ErrBadPacking
+	}
+
+	arrays := make([][]byte, n)
+
+	for i := range arrays {
+		if len(packed) < 4 {
+			return nil, ErrBadPacking
+		}
+		size := binary.BigEndian.Uint32(packed)
+		packed = packed[4:]
+
+		if uint64(size) > uint64(len(packed)) {
+			return nil, ErrBadPacking
+		}
+		arrays[i] = packed[:size]
+		packed = packed[size:]
+	}
+
+	if len(packed) != 0 {
+		return nil, ErrBadPacking
 	}
 
-	return arrays
+	return arrays, nil
 }
 
+// PKCS#5/#7 padding: append 'pad' bytes of value 'pad' to fill out the last block.
+// Data that is already a multiple of the block size gets a whole extra block of
+// padding, so the padded length is always (len(data)/blocksize + 1) * blocksize.
 // only needed by AES?
 func pkcs5pad(data []byte, blocksize int) []byte {
 	pad := blocksize - len(data)%blocksize
@@ -105,8 +191,29 @@ func pkcs5pad(data []byte, blocksize int) []byte {
 	return append(data, b...)
 }
 
-func pkcs5unpad(data []byte) []byte {
+// remove the padding added by pkcs5pad for 'blocksize', checking that it is well-formed
+func pkcs5unpad(data []byte, blocksize int) ([]byte, error) {
+	if len(data) == 0 || len(data)%blocksize != 0 {
+		return nil, ErrBadPadding
+	}
+
 	pad := int(data[len(data)-1])
-	// FIXME: check that the padding bytes are all what we expect
-	return data[0 : len(data)-pad]
+	if pad == 0 || pad > blocksize {
+		return nil, ErrBadPadding
+	}
+
+	for _, b := range data[len(data)-pad:] {
+		if int(b) != pad {
+			return nil, ErrBadPadding
+		}
+	}
+
+	return data[0 : len(data)-pad], nil
+}
+
+// overwrite 'b' with zeros, so plaintext doesn't linger in memory longer than needed
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
 }
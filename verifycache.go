@@ -0,0 +1,61 @@
+package dkeyczar
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"strconv"
+	"sync"
+)
+
+// verifyCache remembers the (message, signature) pairs a Verifier has found valid, for WithVerifyCache.
+// Each load of the keys gets a new one, so Reload clears it.
+type verifyCache struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	lru     list.List // of [sha256.Size]byte, most recently used first
+}
+
+func newVerifyCache(size int) *verifyCache {
+	return &verifyCache{
+		size:    size,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+// the cache key for a message and its signature.  The encoding is included because it
+// changes which signature bytes the same string stands for.
+func verifyCacheKey(encoding KeyczarEncoding, msg []byte, signature string) [sha256.Size]byte {
+	return sha256.Sum256(lenPrefixPack([]byte(strconv.Itoa(int(encoding))), msg, []byte(signature)))
+}
+
+// report whether 'key' has been verified before, marking it as recently used
+func (vc *verifyCache) contains(key [sha256.Size]byte) bool {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	e, ok := vc.entries[key]
+	if ok {
+		vc.lru.MoveToFront(e)
+	}
+	return ok
+}
+
+// remember that 'key' verified, dropping the least recently used entry if the cache is full
+func (vc *verifyCache) add(key [sha256.Size]byte) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	if _, ok := vc.entries[key]; ok {
+		return
+	}
+
+	vc.entries[key] = vc.lru.PushFront(key)
+
+	for vc.lru.Len() > vc.size {
+		oldest := vc.lru.Back()
+		delete(vc.entries, oldest.Value.([sha256.Size]byte))
+		vc.lru.Remove(oldest)
+	}
+}